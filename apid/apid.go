@@ -0,0 +1,8 @@
+package apid
+
+import "context"
+
+// APId is the interface for usra to provide the management API daemon.
+type APId interface {
+	Serve(ctx context.Context, addr string) error
+}
@@ -0,0 +1,89 @@
+package goapid
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lovi-cloud/ursa/datastore"
+)
+
+const (
+	defaultAuditLimit = 500
+	maxAuditLimit     = 5000
+)
+
+// apiActor returns the actor of the changes made by the request with the
+// token of the name.
+func apiActor(name string) string {
+	return "api:" + name
+}
+
+// auditHandler serves the latest audit entries selected by the host and
+// the time range [since, until), oldest first.
+func (g *GoAPId) auditHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		filter := datastore.AuditFilter{Limit: defaultAuditLimit}
+		if name := q.Get("host"); name != "" {
+			h, err := g.ds.GetHostByName(r.Context(), name)
+			if err != nil {
+				g.writeError(w, statusCode(err), err)
+				return
+			}
+			filter.HostID = h.ID
+		}
+		// The entries of a deleted host are selected by its id.
+		if id := q.Get("host_id"); id != "" {
+			hostID, err := strconv.Atoi(id)
+			if err != nil || hostID <= 0 {
+				g.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid host_id %s", id))
+				return
+			}
+			filter.HostID = hostID
+		}
+		for _, p := range []struct {
+			name string
+			dest *time.Time
+		}{
+			{"since", &filter.Since},
+			{"until", &filter.Until},
+		} {
+			v := q.Get(p.name)
+			if v == "" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				g.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s %s", p.name, v))
+				return
+			}
+			*p.dest = t
+		}
+		if l := q.Get("limit"); l != "" {
+			limit, err := strconv.Atoi(l)
+			if err != nil || limit <= 0 {
+				g.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %s", l))
+				return
+			}
+			if limit > maxAuditLimit {
+				limit = maxAuditLimit
+			}
+			filter.Limit = limit
+		}
+		entries, err := g.ds.ListAuditEntry(r.Context(), filter)
+		if err != nil {
+			g.writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if entries == nil {
+			entries = []datastore.AuditEntry{}
+		}
+		g.writeJSON(w, http.StatusOK, entries)
+	})
+}
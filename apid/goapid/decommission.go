@@ -0,0 +1,127 @@
+package goapid
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lovi-cloud/ursa/event"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// decommission moves the host to decommissioning so that it boots the wipe
+// image. If the host has a BMC credential, the host is power cycled into
+// PXE.
+func (g *GoAPId) decommission(w http.ResponseWriter, r *http.Request, h httpd.Host) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.State != httpd.HostStateDecommissioning {
+		_, err := g.ds.UpdateHostState(r.Context(), h.ID, httpd.HostStateDecommissioning)
+		if err != nil {
+			g.writeError(w, statusCode(err), err)
+			return
+		}
+		g.publishHostStateChanged(h, httpd.HostStateDecommissioning)
+	}
+
+	if _, err := g.ds.GetBMCCredentialByHostID(r.Context(), h.ID); err != nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	driver, err := g.getPowerDriver(r, h)
+	if err != nil {
+		g.writeError(w, statusCode(err), err)
+		return
+	}
+	err = driver.SetNextBootPXE(r.Context())
+	if err != nil {
+		g.writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	err = driver.PowerCycle(r.Context())
+	if err != nil {
+		g.writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// listWipeReport returns the wipe reports posted by the host.
+func (g *GoAPId) listWipeReport(w http.ResponseWriter, r *http.Request, h httpd.Host) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	reports, err := g.ds.ListWipeReport(r.Context(), h.ID)
+	if err != nil {
+		g.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	g.writeJSON(w, http.StatusOK, reports)
+}
+
+// deleteHost deletes the host. Only a wiped host or a host that has not
+// been provisioned can be deleted.
+func (g *GoAPId) deleteHost(w http.ResponseWriter, r *http.Request, h httpd.Host) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if h.State != httpd.HostStateWiped && h.State != httpd.HostStateDiscovered {
+		g.writeError(w, http.StatusConflict, fmt.Errorf("host %s is %s, decommission it first", h.Name, h.State))
+		return
+	}
+	err := g.ds.DeleteHost(r.Context(), h.ID)
+	if err != nil {
+		g.writeError(w, statusCode(err), err)
+		return
+	}
+	g.bus.Publish(event.TypeHostDeleted, h.Name, map[string]string{"uuid": h.UUID.String()})
+	for _, id := range []int{h.ServiceLeaseID, h.ManagementLeaseID} {
+		if id != 0 {
+			g.bus.Publish(event.TypeLeaseReleased, h.Name, map[string]string{"id": strconv.Itoa(id)})
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// leasesHandler serves /api/v1/leases and /api/v1/leases/{id}.
+func (g *GoAPId) leasesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		param := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/leases"), "/")
+		if param == "" {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			leases, err := g.ds.ListLease(r.Context())
+			if err != nil {
+				g.writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			g.writeJSON(w, http.StatusOK, leases)
+			return
+		}
+
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.Atoi(param)
+		if err != nil {
+			g.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid lease id %s", param))
+			return
+		}
+		err = g.ds.DeleteLease(r.Context(), id)
+		if err != nil {
+			g.writeError(w, statusCode(err), err)
+			return
+		}
+		g.bus.Publish(event.TypeLeaseReleased, "", map[string]string{"id": strconv.Itoa(id)})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,77 @@
+package goapid
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/lovi-cloud/ursa/event"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+func TestDecommission(t *testing.T) {
+	ctx := context.Background()
+	g := newGoAPId(t)
+	h := registerHost(t, g.ds, 1)
+	setHostState(t, g.ds, h, httpd.HostStateProvisioning, httpd.HostStateProvisioned, httpd.HostStateInService)
+	path := "/api/v1/hosts/" + h.Name
+
+	if resp := serve(g, http.MethodDelete, path, ""); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("status of deleting the host in service = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+	if resp := serve(g, http.MethodGet, path+"/decommission", ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("status of GET = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+	events, cancel := g.bus.Subscribe(4)
+	defer cancel()
+	// Decommissioning is accepted again while the host is decommissioning.
+	for i := 0; i < 2; i++ {
+		if resp := serve(g, http.MethodPost, path+"/decommission", ""); resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("status of decommission = %d, want %d", resp.StatusCode, http.StatusAccepted)
+		}
+	}
+	got, err := g.ds.GetHostByName(ctx, h.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != httpd.HostStateDecommissioning {
+		t.Fatalf("state = %s, want %s", got.State, httpd.HostStateDecommissioning)
+	}
+	if e := <-events; e.Type != event.TypeHostStateChanged || e.Data["to"] != httpd.HostStateDecommissioning {
+		t.Errorf("event = %+v, want the state changed to decommissioning", e)
+	}
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %+v", e)
+	default:
+	}
+
+	// ursa-wipe reports the disks, and the host is wiped.
+	_, err = g.ds.CreateWipeReport(ctx, h.ID, httpd.WipeReport{Disks: []httpd.DiskWipeResult{{Name: "sda", Method: "blkdiscard", Success: true}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.ds.DecommissionHost(ctx, h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := serve(g, http.MethodGet, path+"/wipe-reports", "")
+	var reports []httpd.HostWipeReport
+	if err := json.NewDecoder(resp.Body).Decode(&reports); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || len(reports) != 1 || !reports[0].Report.Succeeded() {
+		t.Fatalf("wipe reports = %d %+v, want the report", resp.StatusCode, reports)
+	}
+	// A wiped host is not decommissioned again, but can be deleted.
+	if resp := serve(g, http.MethodPost, path+"/decommission", ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("status of decommissioning the wiped host = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+	if resp := serve(g, http.MethodDelete, path, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("status of deleting the wiped host = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if resp := serve(g, http.MethodGet, path+"/wipe-reports", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status after the deletion = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,182 @@
+package goapid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lovi-cloud/ursa/event"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+const (
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 120 * time.Second
+	heartbeatInterval  = 30 * time.Second
+	streamBuffer       = 256
+)
+
+func (g *GoAPId) publishHostStateChanged(h httpd.Host, to string) {
+	g.bus.Publish(event.TypeHostStateChanged, h.Name, map[string]string{
+		"from": h.State,
+		"to":   to,
+	})
+}
+
+// eventFilter selects the events by type and host. An empty field matches
+// all events.
+type eventFilter struct {
+	types map[string]bool
+	host  string
+}
+
+func newEventFilter(r *http.Request) eventFilter {
+	f := eventFilter{host: r.URL.Query().Get("host")}
+	if t := r.URL.Query().Get("type"); t != "" {
+		f.types = map[string]bool{}
+		for _, typ := range strings.Split(t, ",") {
+			f.types[typ] = true
+		}
+	}
+	return f
+}
+
+func (f eventFilter) match(e event.Event) bool {
+	if f.types != nil && !f.types[e.Type] {
+		return false
+	}
+	return f.host == "" || f.host == e.Host
+}
+
+func (f eventFilter) filter(events []event.Event) []event.Event {
+	matched := []event.Event{}
+	for _, e := range events {
+		if f.match(e) {
+			matched = append(matched, e)
+		}
+	}
+	return matched
+}
+
+// eventsHandler serves the events as server-sent events if the client
+// accepts text/event-stream, or as a long poll otherwise. The client
+// resumes from the event after the since parameter (or Last-Event-ID).
+func (g *GoAPId) eventsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		since := r.URL.Query().Get("since")
+		if id := r.Header.Get("Last-Event-ID"); id != "" {
+			since = id
+		}
+		var id uint64
+		if since != "" {
+			var err error
+			id, err = strconv.ParseUint(since, 10, 64)
+			if err != nil {
+				g.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid event id %s", since))
+				return
+			}
+		}
+		filter := newEventFilter(r)
+
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			g.streamEvents(w, r, id, filter)
+			return
+		}
+		g.pollEvents(w, r, id, filter)
+	})
+}
+
+// pollEvents returns the events after id. If there is no event, it waits
+// for an event until the timeout parameter (seconds) and returns an empty
+// list on timeout.
+func (g *GoAPId) pollEvents(w http.ResponseWriter, r *http.Request, id uint64, filter eventFilter) {
+	timeout := defaultPollTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		sec, err := strconv.Atoi(t)
+		if err != nil || sec < 0 {
+			g.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout %s", t))
+			return
+		}
+		timeout = time.Duration(sec) * time.Second
+		if timeout > maxPollTimeout {
+			timeout = maxPollTimeout
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	for {
+		events := g.bus.Wait(ctx, id)
+		if len(events) == 0 {
+			g.writeJSON(w, http.StatusOK, []event.Event{})
+			return
+		}
+		if matched := filter.filter(events); len(matched) != 0 {
+			g.writeJSON(w, http.StatusOK, matched)
+			return
+		}
+		id = events[len(events)-1].ID
+	}
+}
+
+func (g *GoAPId) streamEvents(w http.ResponseWriter, r *http.Request, id uint64, filter eventFilter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		g.writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	events, cancel := g.bus.Subscribe(streamBuffer)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(e event.Event) error {
+		if e.ID <= id {
+			return nil
+		}
+		id = e.ID
+		if !filter.match(e) {
+			return nil
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b)
+		return err
+	}
+	for _, e := range g.bus.Since(id) {
+		if err := write(e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e := <-events:
+			if err := write(e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
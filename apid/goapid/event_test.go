@@ -0,0 +1,127 @@
+package goapid
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lovi-cloud/ursa/event"
+)
+
+func TestPollEvents(t *testing.T) {
+	g := newGoAPId(t)
+	g.bus.Publish(event.TypeHostRegistered, "cn0001", nil)
+	g.bus.Publish(event.TypeLeaseCreated, "", map[string]string{"subnet": "management"})
+
+	resp := serve(g, http.MethodGet, "/api/v1/events?since=0&type=lease.created", "")
+	var events []event.Event
+	err := json.NewDecoder(resp.Body).Decode(&events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].ID != 2 || events[0].Data["subnet"] != "management" {
+		t.Fatalf("events = %+v, want the lease.created event", events)
+	}
+
+	// The poll waits for the next event of the host.
+	got := make(chan []event.Event)
+	go func() {
+		resp := serve(g, http.MethodGet, "/api/v1/events?since=2&host=cn0002&timeout=5", "")
+		var events []event.Event
+		json.NewDecoder(resp.Body).Decode(&events)
+		got <- events
+	}()
+	time.Sleep(50 * time.Millisecond)
+	g.bus.Publish(event.TypeHostRegistered, "cn0001", nil)
+	g.bus.Publish(event.TypeHostRegistered, "cn0002", nil)
+	select {
+	case events := <-got:
+		if len(events) != 1 || events[0].Host != "cn0002" {
+			t.Fatalf("events = %+v, want the event of cn0002", events)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the poll")
+	}
+
+	resp = serve(g, http.MethodGet, "/api/v1/events?since=4&timeout=0", "")
+	events = nil
+	err = json.NewDecoder(resp.Body).Decode(&events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || len(events) != 0 {
+		t.Fatalf("want no event on timeout, but got %d %+v", resp.StatusCode, events)
+	}
+	if resp := serve(g, http.MethodGet, "/api/v1/events?since=x", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status of invalid since = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	g := newGoAPId(t)
+	srv := httptest.NewServer(g.handler())
+	defer srv.Close()
+	g.bus.Publish(event.TypeHostRegistered, "cn0001", nil)
+	g.bus.Publish(event.TypeHostRenamed, "cn0002", map[string]string{"from": "cn0001"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/v1/events?type=host.renamed", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type = %s, want text/event-stream", ct)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	// readEvent reads the next event of the stream.
+	readEvent := func() (string, event.Event) {
+		t.Helper()
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				break
+			}
+			lines = append(lines, line)
+		}
+		var e event.Event
+		err := json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(lines[:2], "\n"), e
+	}
+
+	// The recent event is replayed.
+	header, e := readEvent()
+	if header != "id: 2\nevent: host.renamed" || e.Host != "cn0002" || e.Data["from"] != "cn0001" {
+		t.Fatalf("event = %q %+v, want the renamed event", header, e)
+	}
+
+	// The published event is streamed.
+	g.bus.Publish(event.TypeHostRegistered, "cn0003", nil)
+	g.bus.Publish(event.TypeHostRenamed, "cn0004", map[string]string{"from": "cn0003"})
+	header, e = readEvent()
+	if header != "id: 4\nevent: host.renamed" || e.Host != "cn0004" {
+		t.Fatalf("event = %q %+v, want the renamed event", header, e)
+	}
+}
@@ -0,0 +1,451 @@
+package goapid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lovi-cloud/ursa/apid"
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/dhcpd"
+	"github.com/lovi-cloud/ursa/event"
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/httpd/gohttpd"
+	"github.com/lovi-cloud/ursa/metrics"
+	"github.com/lovi-cloud/ursa/pki"
+)
+
+// GoAPId is
+type GoAPId struct {
+	ds      datastore.Datastore
+	logger  *zap.Logger
+	signer  *pki.CodeSigner
+	bus     *event.Bus
+	metrics *metrics.Metrics
+	tokens  Tokens
+}
+
+// New is. If signer is not nil, the artifacts of a registered boot profile
+// are signed. The API requests must have one of tokens as the bearer token.
+func New(ds datastore.Datastore, logger *zap.Logger, signer *pki.CodeSigner, bus *event.Bus, m *metrics.Metrics, tokens Tokens) (apid.APId, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("no API token")
+	}
+	return &GoAPId{
+		ds:      ds,
+		logger:  logger,
+		signer:  signer,
+		bus:     bus,
+		metrics: m,
+		tokens:  tokens,
+	}, nil
+}
+
+// Serve is
+func (g *GoAPId) Serve(ctx context.Context, addr string) error {
+	return http.ListenAndServe(addr, g.handler())
+}
+
+func (g *GoAPId) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", http.NotFoundHandler())
+	mux.Handle("/metrics", g.metrics.Registry)
+	handle := func(pattern string, handler http.Handler) {
+		mux.Handle(pattern, g.loggingHandler(pattern, handler))
+	}
+	handle("/api/v1/userdata-templates", g.userdataTemplatesHandler())
+	handle("/api/v1/userdata-templates/assignments", g.userdataTemplateAssignmentsHandler())
+	handle("/api/v1/hosts/", g.hostsHandler())
+	handle("/api/v1/groups", g.groupsHandler())
+	handle("/api/v1/groups/", g.groupsHandler())
+	handle("/api/v1/users", g.usersHandler())
+	handle("/api/v1/users/", g.usersHandler())
+	handle("/api/v1/boot-profiles", g.bootProfilesHandler())
+	handle("/api/v1/boot-profiles/assignments", g.bootProfileAssignmentsHandler())
+	handle("/api/v1/network-profiles", g.networkProfilesHandler())
+	handle("/api/v1/network-profiles/assignments", g.networkProfileAssignmentsHandler())
+	handle("/api/v1/bmcs", g.bmcsHandler())
+	handle("/api/v1/leases", g.leasesHandler())
+	handle("/api/v1/leases/", g.leasesHandler())
+	handle("/api/v1/events", g.eventsHandler())
+	handle("/api/v1/audit", g.auditHandler())
+	return mux
+}
+
+// loggingHandler logs the request and records the metrics of the handler
+// registered as route. A request without a valid bearer token is
+// rejected, and the changes made by the request are audited as made by
+// the name of its token.
+func (g *GoAPId) loggingHandler(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.logger.Info("api request log", zap.String("method", r.Method), zap.String("url", r.URL.String()), zap.String("remote", r.RemoteAddr))
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		name, ok := g.authenticate(r)
+		if ok {
+			r = r.WithContext(datastore.WithActor(r.Context(), apiActor(name)))
+			handler.ServeHTTP(sw, r)
+		} else {
+			g.logger.Warn("rejected api request", zap.String("url", r.URL.String()), zap.String("remote", r.RemoteAddr))
+			sw.Header().Set("WWW-Authenticate", `Bearer realm="ursa"`)
+			g.writeError(sw, http.StatusUnauthorized, errors.New("invalid bearer token"))
+		}
+		g.metrics.HTTPRequests.Inc("apid", route, strconv.Itoa(sw.code))
+		g.metrics.HTTPDuration.Observe(time.Since(start).Seconds(), "apid", route)
+	})
+}
+
+// authenticate returns the name of the bearer token of the request.
+func (g *GoAPId) authenticate(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	return g.tokens.lookup(strings.TrimPrefix(auth, "Bearer "))
+}
+
+// statusWriter records the status code. It implements http.Flusher for the
+// event stream.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *GoAPId) userdataTemplatesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			ts, err := g.ds.ListUserdataTemplate(r.Context())
+			if err != nil {
+				g.writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			g.writeJSON(w, http.StatusOK, ts)
+		case http.MethodPost:
+			var req httpd.UserdataTemplate
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				g.writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			if req.Name == "" {
+				g.writeError(w, http.StatusBadRequest, errors.New("name is required"))
+				return
+			}
+			_, err = gohttpd.ParseUserdataTemplate(req.Template)
+			if err != nil {
+				g.writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			t, err := g.ds.CreateUserdataTemplate(r.Context(), req)
+			if err != nil {
+				g.writeError(w, statusCode(err), err)
+				return
+			}
+			g.writeJSON(w, http.StatusCreated, t)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func (g *GoAPId) bootProfilesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			profiles, err := g.ds.ListBootProfile(r.Context())
+			if err != nil {
+				g.writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			g.writeJSON(w, http.StatusOK, profiles)
+		case http.MethodPost:
+			var req httpd.BootProfile
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				g.writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			if req.Name == "" || req.Kind == "" {
+				g.writeError(w, http.StatusBadRequest, errors.New("name and kind are required"))
+				return
+			}
+			err = validateInstaller(req)
+			if err != nil {
+				g.writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			if req.Diskless && (req.Kind == httpd.BootProfileKindInstaller || req.Kind == httpd.BootProfileKindLocal) {
+				g.writeError(w, http.StatusBadRequest, fmt.Errorf("%s kind can not be diskless", req.Kind))
+				return
+			}
+			if g.signer != nil {
+				err = gohttpd.SignBootProfile(g.signer, req)
+				if err != nil {
+					g.writeError(w, http.StatusBadRequest, err)
+					return
+				}
+			}
+			profile, err := g.ds.CreateBootProfile(r.Context(), req)
+			if err != nil {
+				g.writeError(w, statusCode(err), err)
+				return
+			}
+			g.writeJSON(w, http.StatusCreated, profile)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func (g *GoAPId) bootProfileAssignmentsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req assignmentRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			g.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		profile, err := g.ds.GetBootProfileByName(r.Context(), req.Name)
+		if err != nil {
+			g.writeError(w, statusCode(err), err)
+			return
+		}
+		err = g.ds.AssignBootProfile(r.Context(), req.Scope, req.Value, profile.ID)
+		if err != nil {
+			g.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func validateInstaller(profile httpd.BootProfile) error {
+	if profile.Installer == "" {
+		return nil
+	}
+	if profile.Kind != httpd.BootProfileKindInstaller {
+		return fmt.Errorf("installer is only for %s kind", httpd.BootProfileKindInstaller)
+	}
+	switch profile.Installer {
+	case httpd.InstallerPreseed, httpd.InstallerAutoinstall, httpd.InstallerKickstart:
+	default:
+		return fmt.Errorf("invalid installer %s", profile.Installer)
+	}
+	switch profile.Layout {
+	case "", httpd.InstallLayoutLVM, httpd.InstallLayoutDirect:
+	default:
+		return fmt.Errorf("invalid layout %s", profile.Layout)
+	}
+	return nil
+}
+
+type assignmentRequest struct {
+	Scope string `json:"scope"`
+	Value string `json:"value"`
+	Name  string `json:"name"`
+}
+
+func (g *GoAPId) userdataTemplateAssignmentsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req assignmentRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			g.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		t, err := g.ds.GetUserdataTemplateByName(r.Context(), req.Name)
+		if err != nil {
+			g.writeError(w, statusCode(err), err)
+			return
+		}
+		err = g.ds.AssignUserdataTemplate(r.Context(), req.Scope, req.Value, t.ID)
+		if err != nil {
+			g.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// hostsHandler serves /api/v1/hosts/{name}/{resource}.
+func (g *GoAPId) hostsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		words := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/hosts/"), "/")
+		if len(words) > 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		h, err := g.ds.GetHostByName(r.Context(), words[0])
+		if err != nil {
+			g.writeError(w, statusCode(err), err)
+			return
+		}
+		if len(words) == 1 {
+			g.deleteHost(w, r, *h)
+			return
+		}
+
+		switch words[1] {
+		case "user-data":
+			g.renderUserdata(w, r, *h)
+		case "inventory":
+			g.getInventory(w, r, *h)
+		case "inventories":
+			g.listInventory(w, r, *h)
+		case "bmc":
+			g.bmc(w, r, *h)
+		case "power":
+			g.power(w, r, *h)
+		case "reprovision":
+			g.reprovision(w, r, *h)
+		case "state":
+			g.hostState(w, r, *h)
+		case "decommission":
+			g.decommission(w, r, *h)
+		case "wipe-reports":
+			g.listWipeReport(w, r, *h)
+		case "timeline":
+			g.timeline(w, r, *h)
+		case "rename":
+			g.rename(w, r, *h)
+		case "labels":
+			g.hostLabels(w, r, *h)
+		case "groups":
+			g.listHostGroupByHost(w, r, *h)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
+
+// renderUserdata is a dry-run of user-data for the host. GET renders the
+// assigned template and POST renders the template in the request body.
+func (g *GoAPId) renderUserdata(w http.ResponseWriter, r *http.Request, h httpd.Host) {
+	var text string
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			g.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		text = string(body)
+		if text == "" {
+			g.writeError(w, http.StatusBadRequest, errors.New("template is required"))
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	server := r.URL.Query().Get("server")
+	if server == "" {
+		server = r.Host
+	}
+	base := "http://" + server
+	out, err := gohttpd.RenderUserdata(r.Context(), g.ds, h, base, base+"/init/dry-run/", text)
+	if err != nil {
+		g.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/yaml")
+	w.Write(out)
+}
+
+// getInventory returns the latest inventory of the host, or the version
+// given by the version query.
+func (g *GoAPId) getInventory(w http.ResponseWriter, r *http.Request, h httpd.Host) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var hi *httpd.HostInventory
+	var err error
+	if v := r.URL.Query().Get("version"); v != "" {
+		var version int
+		version, err = strconv.Atoi(v)
+		if err != nil {
+			g.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		hi, err = g.ds.GetHostInventory(r.Context(), h.ID, version)
+	} else {
+		hi, err = g.ds.GetLatestHostInventory(r.Context(), h.ID)
+	}
+	if err != nil {
+		g.writeError(w, statusCode(err), err)
+		return
+	}
+	g.writeJSON(w, http.StatusOK, hi)
+}
+
+func (g *GoAPId) listInventory(w http.ResponseWriter, r *http.Request, h httpd.Host) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	his, err := g.ds.ListHostInventory(r.Context(), h.ID)
+	if err != nil {
+		g.writeError(w, statusCode(err), err)
+		return
+	}
+	g.writeJSON(w, http.StatusOK, his)
+}
+
+func (g *GoAPId) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		g.logger.Error("failed to encode response", zap.Error(err))
+	}
+}
+
+func (g *GoAPId) writeError(w http.ResponseWriter, code int, err error) {
+	g.logger.Error("api error", zap.Int("code", code), zap.Error(err))
+	g.writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func statusCode(err error) int {
+	if errors.Is(err, datastore.ErrNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, datastore.ErrInvalidHostname) || errors.Is(err, datastore.ErrInvalidLabel) || errors.Is(err, datastore.ErrInvalidSelector) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, datastore.ErrConflict) || errors.Is(err, httpd.ErrInvalidHostStateTransition) || errors.Is(err, dhcpd.ErrLeaseInUse) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+var _ apid.APId = &GoAPId{}
@@ -0,0 +1,309 @@
+package goapid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"go.uber.org/zap"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/datastore/memory"
+	"github.com/lovi-cloud/ursa/event"
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/metrics"
+	"github.com/lovi-cloud/ursa/types"
+)
+
+func mustParseIP(t *testing.T, s string) types.IP {
+	t.Helper()
+	ip, err := types.ParseIP(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *ip
+}
+
+func mustParseCIDR(t *testing.T, s string) types.IPNet {
+	t.Helper()
+	n, err := types.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *n
+}
+
+const testToken = "secret"
+
+// newGoAPId returns a GoAPId with a datastore that has the subnets.
+func newGoAPId(t *testing.T) *GoAPId {
+	t.Helper()
+	ctx := context.Background()
+	naming, err := datastore.NewNaming("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := memory.New(naming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.CreateManagementSubnet(ctx, mustParseCIDR(t, "10.0.0.0/24"), mustParseIP(t, "10.0.0.1"), mustParseIP(t, "10.0.0.99"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.CreateServiceSubnet(ctx, mustParseCIDR(t, "192.168.0.0/24"), mustParseIP(t, "192.168.0.1"), mustParseIP(t, "192.168.0.99"), mustParseIP(t, "192.168.0.254"), mustParseIP(t, "8.8.8.8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &GoAPId{
+		ds:      ds,
+		logger:  zap.NewNop(),
+		bus:     event.NewBus(16),
+		metrics: metrics.New(),
+		tokens:  Tokens{"test": testToken},
+	}
+}
+
+// registerHost registers the i-th host with its leases.
+func registerHost(t *testing.T, ds datastore.Datastore, i int) *httpd.Host {
+	t.Helper()
+	ctx := context.Background()
+	mac := types.HardwareAddr(net.HardwareAddr{0x52, 0x54, 0x00, 0x00, 0x00, byte(i)})
+	ml, err := ds.CreateLeaseFromManagementSubnet(ctx, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := ds.CreateLeaseFromServiceSubnet(ctx, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.NewV5(uuid.NamespaceOID, fmt.Sprintf("host-%d", i))
+	h, err := ds.RegisterHost(ctx, id, fmt.Sprintf("SN%d", i), "product", "manufacturer", sl.ID, ml.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// setHostState moves the host through the states.
+func setHostState(t *testing.T, ds datastore.Datastore, h *httpd.Host, states ...string) {
+	t.Helper()
+	for _, s := range states {
+		_, err := ds.UpdateHostState(context.Background(), h.ID, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// serve serves the request by the handler of g and returns the response.
+func serve(g *GoAPId, method, path, body string) *http.Response {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, r)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	w := httptest.NewRecorder()
+	g.handler().ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestHostState(t *testing.T) {
+	ctx := context.Background()
+	g := newGoAPId(t)
+	h := registerHost(t, g.ds, 1)
+	path := "/api/v1/hosts/" + h.Name
+
+	// A discovered host is not in service.
+	resp := serve(g, http.MethodPost, path+"/state", `{"state": "in-service"}`)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("status of discovered host = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+	resp = serve(g, http.MethodPost, path+"/state", `{"state": "wiped"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status of wiped = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	setHostState(t, g.ds, h, httpd.HostStateProvisioning, httpd.HostStateProvisioned)
+	events, cancel := g.bus.Subscribe(1)
+	defer cancel()
+	resp = serve(g, http.MethodPost, path+"/state", `{"state": "in-service"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	var got httpd.Host
+	err := json.NewDecoder(resp.Body).Decode(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != httpd.HostStateInService {
+		t.Errorf("state = %s, want %s", got.State, httpd.HostStateInService)
+	}
+	e := <-events
+	if e.Type != event.TypeHostStateChanged || e.Data["from"] != httpd.HostStateProvisioned || e.Data["to"] != httpd.HostStateInService {
+		t.Errorf("event = %+v, want %s to %s", e, httpd.HostStateProvisioned, httpd.HostStateInService)
+	}
+
+	// An in-service host without a BMC is decommissioned by the next boot.
+	resp = serve(g, http.MethodPost, path+"/decommission", "")
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status of decommission = %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+	updated, err := g.ds.GetHostByName(ctx, h.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.State != httpd.HostStateDecommissioning {
+		t.Errorf("state = %s, want %s", updated.State, httpd.HostStateDecommissioning)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	ctx := context.Background()
+	g := newGoAPId(t)
+	g.tokens["ops"] = "ops-token"
+	h := registerHost(t, g.ds, 1)
+
+	for _, auth := range []string{"", "Bearer", "Bearer ", "Bearer wrong", "Basic " + testToken, testToken} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/hosts/"+h.Name+"/rename", strings.NewReader(`{"name": "renamed"}`))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		g.handler().ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("status with %q = %d, want %d", auth, w.Code, http.StatusUnauthorized)
+		}
+	}
+	if _, err := g.ds.GetHostByName(ctx, h.Name); err != nil {
+		t.Fatalf("want the host not renamed, but got %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/hosts/"+h.Name+"/rename", strings.NewReader(`{"name": "renamed"}`))
+	req.Header.Set("Authorization", "Bearer ops-token")
+	w := httptest.NewRecorder()
+	g.handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	entries, err := g.ds.ListAuditEntry(ctx, datastore.AuditFilter{HostID: h.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := entries[len(entries)-1]
+	if last.Action != datastore.AuditHostRename || last.Actor != "api:ops" {
+		t.Fatalf("audit entry = %+v, want %s by api:ops", last, datastore.AuditHostRename)
+	}
+}
+
+func TestLoadOrCreateTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ursa-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "api-tokens")
+
+	created, err := LoadOrCreateTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created[defaultTokenName]) != 64 {
+		t.Fatalf("want a token named %s, but got %v", defaultTokenName, created)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", fi.Mode().Perm())
+	}
+	loaded, err := LoadOrCreateTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, created) {
+		t.Errorf("loaded %v, want %v", loaded, created)
+	}
+
+	for content, ok := range map[string]bool{
+		"# operators\nalice a-token\n\nci ci-token\n": true,
+		"alice\n":                        false,
+		"alice a-token\nalice b-token\n": false,
+		"# no token\n":                   false,
+	} {
+		err = ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = LoadOrCreateTokens(path)
+		if (err == nil) != ok {
+			t.Errorf("error for %q = %v, want ok %t", content, err, ok)
+		}
+	}
+}
+
+func TestInventories(t *testing.T) {
+	ctx := context.Background()
+	g := newGoAPId(t)
+	h := registerHost(t, g.ds, 1)
+	path := "/api/v1/hosts/" + h.Name
+
+	if resp := serve(g, http.MethodGet, path+"/inventory", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status without inventory = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	for _, memory := range []uint64{1024, 2048} {
+		_, err := g.ds.CreateHostInventory(ctx, h.ID, httpd.Inventory{Serial: "SN1", Memory: memory})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp := serve(g, http.MethodGet, path+"/inventories", "")
+	var his []httpd.HostInventory
+	if err := json.NewDecoder(resp.Body).Decode(&his); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || len(his) != 2 || his[0].Version != 2 || his[1].Version != 1 {
+		t.Fatalf("inventories = %d %+v, want 2 versions, newest first", resp.StatusCode, his)
+	}
+
+	for _, test := range []struct {
+		query   string
+		code    int
+		version int
+	}{
+		{query: "", code: http.StatusOK, version: 2},
+		{query: "?version=1", code: http.StatusOK, version: 1},
+		{query: "?version=3", code: http.StatusNotFound},
+		{query: "?version=latest", code: http.StatusBadRequest},
+	} {
+		resp := serve(g, http.MethodGet, path+"/inventory"+test.query, "")
+		if resp.StatusCode != test.code {
+			t.Errorf("status of %q = %d, want %d", test.query, resp.StatusCode, test.code)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		var hi httpd.HostInventory
+		if err := json.NewDecoder(resp.Body).Decode(&hi); err != nil {
+			t.Fatal(err)
+		}
+		if hi.Version != test.version || hi.Inventory.Memory != uint64(test.version)*1024 {
+			t.Errorf("inventory of %q = %+v, want version %d", test.query, hi, test.version)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package goapid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// hostLabels gets or replaces the labels of the host.
+func (g *GoAPId) hostLabels(w http.ResponseWriter, r *http.Request, h httpd.Host) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var labels map[string]string
+		err := json.NewDecoder(r.Body).Decode(&labels)
+		if err != nil {
+			g.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = g.ds.SetHostLabels(r.Context(), h.ID, labels)
+		if err != nil {
+			g.writeError(w, statusCode(err), err)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	labels, err := g.ds.GetHostLabels(r.Context(), h.ID)
+	if err != nil {
+		g.writeError(w, statusCode(err), err)
+		return
+	}
+	g.writeJSON(w, http.StatusOK, labels)
+}
+
+// listHostGroupByHost returns the groups of the host.
+func (g *GoAPId) listHostGroupByHost(w http.ResponseWriter, r *http.Request, h httpd.Host) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	groups, err := g.ds.ListHostGroupByHost(r.Context(), h.ID)
+	if err != nil {
+		g.writeError(w, statusCode(err), err)
+		return
+	}
+	g.writeJSON(w, http.StatusOK, groups)
+}
+
+type hostGroupRequest struct {
+	Name string `json:"name"`
+}
+
+// groupsHandler serves /api/v1/groups, /api/v1/groups/{name} and
+// /api/v1/groups/{name}/hosts/{host}.
+func (g *GoAPId) groupsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		param := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/groups"), "/")
+		if param == "" {
+			g.hostGroups(w, r)
+			return
+		}
+
+		words := strings.Split(param, "/")
+		if len(words) != 1 && (len(words) != 3 || words[1] != "hosts") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		group, err := g.ds.GetHostGroupByName(r.Context(), words[0])
+		if err != nil {
+			g.writeError(w, statusCode(err), err)
+			return
+		}
+		if len(words) == 1 {
+			g.hostGroup(w, r, *group)
+			return
+		}
+		g.hostGroupMember(w, r, *group, words[2])
+	})
+}
+
+func (g *GoAPId) hostGroups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		groups, err := g.ds.ListHostGroup(r.Context())
+		if err != nil {
+			g.writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		g.writeJSON(w, http.StatusOK, groups)
+	case http.MethodPost:
+		var req hostGroupRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			g.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		group, err := g.ds.CreateHostGroup(r.Context(), req.Name)
+		if err != nil {
+			g.writeError(w, statusCode(err), err)
+			return
+		}
+		g.writeJSON(w, http.StatusCreated, group)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// hostGroup returns the hosts in the group, or deletes the group.
+func (g *GoAPId) hostGroup(w http.ResponseWriter, r *http.Request, group httpd.HostGroup) {
+	switch r.Method {
+	case http.MethodGet:
+		hosts, err := g.ds.ListHostByGroup(r.Context(), group.ID)
+		if err != nil {
+			g.writeError(w, statusCode(err), err)
+			return
+		}
+		g.writeJSON(w, http.StatusOK, hosts)
+	case http.MethodDelete:
+		err := g.ds.DeleteHostGroup(r.Context(), group.ID)
+		if err != nil {
+			g.writeError(w, statusCode(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// hostGroupMember adds the host to the group by PUT, or removes it by
+// DELETE.
+func (g *GoAPId) hostGroupMember(w http.ResponseWriter, r *http.Request, group httpd.HostGroup, name string) {
+	h, err := g.ds.GetHostByName(r.Context(), name)
+	if err != nil {
+		g.writeError(w, statusCode(err), err)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		err = g.ds.AddHostGroupMember(r.Context(), group.ID, h.ID)
+	case http.MethodDelete:
+		err = g.ds.RemoveHostGroupMember(r.Context(), group.ID, h.ID)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		g.writeError(w, statusCode(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type userAccessRequest struct {
+	Scope string `json:"scope"`
+	Value string `json:"value"`
+}
+
+// usersHandler serves /api/v1/users and /api/v1/users/{name}/access.
+func (g *GoAPId) usersHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		param := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/users"), "/")
+		users, err := g.ds.ListUser(r.Context())
+		if err != nil {
+			g.writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if param == "" {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			g.writeJSON(w, http.StatusOK, users)
+			return
+		}
+
+		words := strings.Split(param, "/")
+		if len(words) != 2 || words[1] != "access" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var user *httpd.User
+		for i := range users {
+			if users[i].Name == words[0] {
+				user = &users[i]
+			}
+		}
+		if user == nil {
+			g.writeError(w, http.StatusNotFound, fmt.Errorf("user %s: %w", words[0], datastore.ErrNotFound))
+			return
+		}
+		g.userAccess(w, r, *user)
+	})
+}
+
+// userAccess lists, grants or revokes the access of the user to the hosts.
+// A user without any access granted has the access to every host.
+func (g *GoAPId) userAccess(w http.ResponseWriter, r *http.Request, user httpd.User) {
+	switch r.Method {
+	case http.MethodGet, http.MethodPost, http.MethodDelete:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method == http.MethodGet {
+		access, err := g.ds.ListUserAccess(r.Context(), user.ID)
+		if err != nil {
+			g.writeError(w, statusCode(err), err)
+			return
+		}
+		g.writeJSON(w, http.StatusOK, access)
+		return
+	}
+
+	var req userAccessRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		g.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if r.Method == http.MethodPost {
+		err = g.ds.GrantUserAccess(r.Context(), user.ID, req.Scope, req.Value)
+	} else {
+		err = g.ds.RevokeUserAccess(r.Context(), user.ID, req.Scope, req.Value)
+	}
+	if errors.Is(err, datastore.ErrNotFound) {
+		g.writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		g.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
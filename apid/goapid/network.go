@@ -0,0 +1,73 @@
+package goapid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+func (g *GoAPId) networkProfilesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			profiles, err := g.ds.ListNetworkProfile(r.Context())
+			if err != nil {
+				g.writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			g.writeJSON(w, http.StatusOK, profiles)
+		case http.MethodPost:
+			var req httpd.NetworkProfile
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				g.writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			if req.Name == "" {
+				g.writeError(w, http.StatusBadRequest, errors.New("name is required"))
+				return
+			}
+			if req.ServiceVLAN < 0 || req.ServiceVLAN > 4094 {
+				g.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid service_vlan %d", req.ServiceVLAN))
+				return
+			}
+			profile, err := g.ds.CreateNetworkProfile(r.Context(), req)
+			if err != nil {
+				g.writeError(w, statusCode(err), err)
+				return
+			}
+			g.writeJSON(w, http.StatusCreated, profile)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func (g *GoAPId) networkProfileAssignmentsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req assignmentRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			g.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		profile, err := g.ds.GetNetworkProfileByName(r.Context(), req.Name)
+		if err != nil {
+			g.writeError(w, statusCode(err), err)
+			return
+		}
+		err = g.ds.AssignNetworkProfile(r.Context(), req.Scope, req.Value, profile.ID)
+		if err != nil {
+			g.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
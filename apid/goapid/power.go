@@ -0,0 +1,202 @@
+package goapid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/power"
+	"github.com/lovi-cloud/ursa/power/ipmi"
+	"github.com/lovi-cloud/ursa/power/redfish"
+)
+
+// Power actions
+const (
+	powerActionOn    = "on"
+	powerActionOff   = "off"
+	powerActionCycle = "cycle"
+	powerActionPXE   = "pxe"
+)
+
+type bmcRequest struct {
+	Driver   string `json:"driver"`
+	Address  string `json:"address"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Insecure bool   `json:"insecure"`
+}
+
+type powerRequest struct {
+	Action string `json:"action"`
+}
+
+type powerResponse struct {
+	State string `json:"state"`
+}
+
+func newPowerDriver(cred httpd.BMCCredential) (power.Driver, error) {
+	switch cred.Driver {
+	case httpd.BMCDriverIPMI:
+		return ipmi.New(cred.Address, cred.Username, cred.Password)
+	case httpd.BMCDriverRedfish:
+		return redfish.New(cred.Address, cred.Username, cred.Password, cred.Insecure)
+	}
+	return nil, fmt.Errorf("invalid BMC driver %s", cred.Driver)
+}
+
+// getPowerDriver returns the power driver of the host. If the credential
+// has no address, the address of the BMC linked with the host is used.
+func (g *GoAPId) getPowerDriver(r *http.Request, h httpd.Host) (power.Driver, error) {
+	cred, err := g.ds.GetBMCCredentialByHostID(r.Context(), h.ID)
+	if err != nil {
+		return nil, err
+	}
+	if cred.Address == "" {
+		bmc, err := g.ds.GetBMCByHostID(r.Context(), h.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get BMC linked with %s: %w", h.Name, err)
+		}
+		cred.Address = bmc.IPAddress.String()
+	}
+	return newPowerDriver(*cred)
+}
+
+// bmc gets or sets the BMC credential of the host. The password is never
+// returned.
+func (g *GoAPId) bmc(w http.ResponseWriter, r *http.Request, h httpd.Host) {
+	switch r.Method {
+	case http.MethodGet:
+		cred, err := g.ds.GetBMCCredentialByHostID(r.Context(), h.ID)
+		if err != nil {
+			g.writeError(w, statusCode(err), err)
+			return
+		}
+		g.writeJSON(w, http.StatusOK, cred)
+	case http.MethodPut:
+		var req bmcRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			g.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Username == "" {
+			g.writeError(w, http.StatusBadRequest, errors.New("username is required"))
+			return
+		}
+		cred, err := g.ds.SetBMCCredential(r.Context(), httpd.BMCCredential{
+			HostID:   h.ID,
+			Driver:   req.Driver,
+			Address:  req.Address,
+			Username: req.Username,
+			Password: req.Password,
+			Insecure: req.Insecure,
+		})
+		if err != nil {
+			g.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		g.writeJSON(w, http.StatusOK, cred)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// power returns the power state of the host on GET, and runs the action
+// in the request body on POST.
+func (g *GoAPId) power(w http.ResponseWriter, r *http.Request, h httpd.Host) {
+	driver, err := g.getPowerDriver(r, h)
+	if err != nil {
+		g.writeError(w, statusCode(err), err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req powerRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			g.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		switch req.Action {
+		case powerActionOn:
+			err = driver.PowerOn(r.Context())
+		case powerActionOff:
+			err = driver.PowerOff(r.Context())
+		case powerActionCycle:
+			err = driver.PowerCycle(r.Context())
+		case powerActionPXE:
+			err = driver.SetNextBootPXE(r.Context())
+		default:
+			g.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid power action %s", req.Action))
+			return
+		}
+		if err != nil {
+			g.writeError(w, http.StatusBadGateway, err)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	state, err := driver.PowerState(r.Context())
+	if err != nil {
+		g.writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	g.writeJSON(w, http.StatusOK, powerResponse{State: state})
+}
+
+// reprovision moves the host to provisioning, sets the next boot device to
+// PXE and power cycles the host.
+func (g *GoAPId) reprovision(w http.ResponseWriter, r *http.Request, h httpd.Host) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	driver, err := g.getPowerDriver(r, h)
+	if err != nil {
+		g.writeError(w, statusCode(err), err)
+		return
+	}
+
+	if h.State != httpd.HostStateProvisioning {
+		_, err = g.ds.UpdateHostState(r.Context(), h.ID, httpd.HostStateProvisioning)
+		if err != nil {
+			g.writeError(w, statusCode(err), err)
+			return
+		}
+		g.publishHostStateChanged(h, httpd.HostStateProvisioning)
+	}
+	err = driver.SetNextBootPXE(r.Context())
+	if err != nil {
+		g.writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	err = driver.PowerCycle(r.Context())
+	if err != nil {
+		g.writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// bmcsHandler lists the BMCs discovered by DHCP.
+func (g *GoAPId) bmcsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		bmcs, err := g.ds.ListBMC(r.Context())
+		if err != nil {
+			g.writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		g.writeJSON(w, http.StatusOK, bmcs)
+	})
+}
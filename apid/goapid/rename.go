@@ -0,0 +1,37 @@
+package goapid
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/lovi-cloud/ursa/event"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+type renameRequest struct {
+	Name string `json:"name"`
+}
+
+// rename renames the host. An empty name regenerates the hostname by the
+// naming template with the latest inventory of the host.
+func (g *GoAPId) rename(w http.ResponseWriter, r *http.Request, h httpd.Host) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req renameRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		g.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	renamed, err := g.ds.RenameHost(r.Context(), h.ID, req.Name)
+	if err != nil {
+		g.writeError(w, statusCode(err), err)
+		return
+	}
+	if renamed.Name != h.Name {
+		g.bus.Publish(event.TypeHostRenamed, renamed.Name, map[string]string{"from": h.Name})
+	}
+	g.writeJSON(w, http.StatusOK, renamed)
+}
@@ -0,0 +1,40 @@
+package goapid
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+type stateRequest struct {
+	State string `json:"state"`
+}
+
+// hostState moves the host to the state given by the operator. Only
+// in-service is set by the operator; the other states are set by
+// provisioning, reprovision and decommission.
+func (g *GoAPId) hostState(w http.ResponseWriter, r *http.Request, h httpd.Host) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req stateRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		g.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.State != httpd.HostStateInService {
+		g.writeError(w, http.StatusBadRequest, fmt.Errorf("state must be %s", httpd.HostStateInService))
+		return
+	}
+	updated, err := g.ds.UpdateHostState(r.Context(), h.ID, req.State)
+	if err != nil {
+		g.writeError(w, statusCode(err), err)
+		return
+	}
+	g.publishHostStateChanged(h, req.State)
+	g.writeJSON(w, http.StatusOK, updated)
+}
@@ -0,0 +1,64 @@
+package goapid
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+const (
+	defaultTimelineLimit = 500
+	maxTimelineLimit     = 5000
+	// bootSessionGap splits the boot events into sessions.
+	bootSessionGap = 10 * time.Minute
+)
+
+// timeline returns the latest boot events and state transitions of the
+// host grouped into boot sessions, oldest first.
+func (g *GoAPId) timeline(w http.ResponseWriter, r *http.Request, h httpd.Host) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	limit := defaultTimelineLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			g.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %s", l))
+			return
+		}
+		if limit > maxTimelineLimit {
+			limit = maxTimelineLimit
+		}
+	}
+	events, err := g.ds.ListBootEventByHost(r.Context(), h.ID, limit)
+	if err != nil {
+		g.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	transitions, err := g.ds.ListHostStateTransition(r.Context(), h.ID)
+	if err != nil {
+		g.writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(events) == limit {
+		// The transitions before the oldest event are beyond the limit.
+		var latest []httpd.HostStateTransition
+		for _, tr := range transitions {
+			if !tr.CreatedAt.Before(events[0].CreatedAt) {
+				latest = append(latest, tr)
+			}
+		}
+		transitions = latest
+	}
+	events = httpd.MergeStateTransitions(events, transitions)
+	sessions := httpd.SplitBootSessions(events, bootSessionGap)
+	if sessions == nil {
+		sessions = []httpd.BootSession{}
+	}
+	g.writeJSON(w, http.StatusOK, sessions)
+}
@@ -0,0 +1,85 @@
+package goapid
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+func TestTimeline(t *testing.T) {
+	ctx := context.Background()
+	g := newGoAPId(t)
+	h := registerHost(t, g.ds, 1)
+	transitions, err := g.ds.ListHostStateTransition(ctx, h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := transitions[0].CreatedAt
+	record := func(protocol, name string, at time.Time) {
+		t.Helper()
+		e := httpd.BootEvent{Protocol: protocol, Name: name, Outcome: httpd.BootEventOutcomeOK, CreatedAt: at}
+		if protocol == httpd.BootEventProtocolDHCP {
+			e.MACAddress = "52:54:00:00:00:01"
+		} else {
+			e.IPAddress = "10.0.0.1"
+		}
+		if err := g.ds.RecordBootEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record(httpd.BootEventProtocolDHCP, "discover", registered.Add(-2*time.Second))
+	record(httpd.BootEventProtocolTFTP, "ipxe.efi", registered.Add(-time.Second))
+	record(httpd.BootEventProtocolHTTP, "GET /ipxe", registered)
+	setHostState(t, g.ds, h, httpd.HostStateProvisioning)
+	record(httpd.BootEventProtocolHTTP, "GET /init/-/user-data", time.Now().UTC().Add(time.Millisecond))
+	// The events of another host are not in the timeline.
+	if err := g.ds.RecordBootEvent(ctx, httpd.BootEvent{Protocol: httpd.BootEventProtocolDHCP, Name: "discover", MACAddress: "52:54:00:00:00:02", CreatedAt: registered}); err != nil {
+		t.Fatal(err)
+	}
+
+	timeline := func(query string) []string {
+		t.Helper()
+		resp := serve(g, http.MethodGet, "/api/v1/hosts/"+h.Name+"/timeline"+query, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+		var sessions []httpd.BootSession
+		if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) != 1 {
+			t.Fatalf("sessions = %+v, want 1", sessions)
+		}
+		var got []string
+		for _, e := range sessions[0].Events {
+			got = append(got, e.Protocol+" "+e.Name)
+		}
+		return got
+	}
+	want := []string{
+		"dhcp discover",
+		"tftp ipxe.efi",
+		"http GET /ipxe",
+		"state discovered",
+		"state provisioning",
+		"http GET /init/-/user-data",
+	}
+	if got := timeline(""); !reflect.DeepEqual(got, want) {
+		t.Errorf("timeline = %v, want %v", got, want)
+	}
+	// The transitions older than the events within the limit are dropped.
+	if got := timeline("?limit=2"); !reflect.DeepEqual(got, want[2:]) {
+		t.Errorf("timeline of 2 events = %v, want %v", got, want[2:])
+	}
+	if got := timeline("?limit=1"); !reflect.DeepEqual(got, want[5:]) {
+		t.Errorf("timeline of 1 event = %v, want %v", got, want[5:])
+	}
+	if resp := serve(g, http.MethodGet, "/api/v1/hosts/"+h.Name+"/timeline?limit=0", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status of limit 0 = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
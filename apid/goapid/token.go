@@ -0,0 +1,86 @@
+package goapid
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// defaultTokenName is the name of the token generated in a new token file.
+const defaultTokenName = "admin"
+
+// Tokens is the API bearer tokens by their names.
+type Tokens map[string]string
+
+// LoadOrCreateTokens loads the API tokens from path. Each line of the file
+// is a name and a token separated by spaces, and empty lines and lines
+// starting with # are ignored. If path does not exist, it is created with
+// a random token named admin.
+func LoadOrCreateTokens(path string) (Tokens, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createTokens(path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	tokens := Tokens{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid token at %s:%d", path, n)
+		}
+		if _, ok := tokens[fields[0]]; ok {
+			return nil, fmt.Errorf("duplicate token name %s at %s:%d", fields[0], path, n)
+		}
+		tokens[fields[0]] = fields[1]
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no token in %s", path)
+	}
+	return tokens, nil
+}
+
+func createTokens(path string) (Tokens, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := hex.EncodeToString(b)
+	err = ioutil.WriteFile(path, []byte(fmt.Sprintf("%s %s\n", defaultTokenName, token)), 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return Tokens{defaultTokenName: token}, nil
+}
+
+// lookup returns the name of the token. Every token is compared in
+// constant time.
+func (t Tokens) lookup(token string) (string, bool) {
+	got := sha256.Sum256([]byte(token))
+	var name string
+	for n, v := range t {
+		want := sha256.Sum256([]byte(v))
+		if subtle.ConstantTimeCompare(got[:], want[:]) == 1 {
+			name = n
+		}
+	}
+	return name, name != ""
+}
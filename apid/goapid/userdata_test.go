@@ -0,0 +1,145 @@
+package goapid
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// userdata requests the user-data of the host and returns the body.
+func userdata(t *testing.T, g *GoAPId, method, name, query, body string) (int, string) {
+	t.Helper()
+	resp := serve(g, method, "/api/v1/hosts/"+name+"/user-data"+query, body)
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+// phoneHomeURL returns the phone_home url of the cloud-config.
+func phoneHomeURL(t *testing.T, out string) string {
+	t.Helper()
+	if !strings.HasPrefix(out, "#cloud-config\n") {
+		t.Fatalf("user-data = %q, want cloud-config", out)
+	}
+	var config struct {
+		PhoneHome struct {
+			URL  string   `yaml:"url"`
+			Post []string `yaml:"post"`
+		} `yaml:"phone_home"`
+	}
+	if err := yaml.Unmarshal([]byte(out), &config); err != nil {
+		t.Fatal(err)
+	}
+	return config.PhoneHome.URL
+}
+
+func TestUserdataTemplate(t *testing.T) {
+	ctx := context.Background()
+	g := newGoAPId(t)
+	h1 := registerHost(t, g.ds, 1)
+	h2 := registerHost(t, g.ds, 2)
+	group, err := g.ds.CreateHostGroup(ctx, "gpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.ds.AddHostGroupMember(ctx, group.ID, h2.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const seed = "http://example.com/init/dry-run/"
+
+	// The built-in cloud-config is rendered without a template.
+	code, out := userdata(t, g, http.MethodGet, h1.Name, "", "")
+	if code != http.StatusOK || !strings.Contains(out, "ursa-inventory") || phoneHomeURL(t, out) != seed+"phone-home" {
+		t.Fatalf("built-in user-data = %d %s", code, out)
+	}
+
+	templates := map[string]string{
+		"base":   "#cloud-config\nhostname: {{ .Host.Name }}\n",
+		"gpu":    "#cloud-config\n# gpu nodes report to the custom URL\nhostname: gpu-{{ .Host.Name }}\nphone_home:\n  url: {{ .Seed }}custom\n",
+		"script": "#!/bin/sh\necho {{ .Host.Name }}\n",
+	}
+	for name, text := range templates {
+		b, _ := json.Marshal(httpd.UserdataTemplate{Name: name, Template: text})
+		if resp := serve(g, http.MethodPost, "/api/v1/userdata-templates", string(b)); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("create %s status = %d, want %d", name, resp.StatusCode, http.StatusCreated)
+		}
+	}
+	if resp := serve(g, http.MethodPost, "/api/v1/userdata-templates", `{"name": "broken", "template": "{{ .Host"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("create broken status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	for _, a := range []assignmentRequest{
+		{Scope: httpd.ScopeDefault, Name: "base"},
+		{Scope: httpd.ScopeGroup, Value: "gpu", Name: "gpu"},
+	} {
+		b, _ := json.Marshal(a)
+		if resp := serve(g, http.MethodPost, "/api/v1/userdata-templates/assignments", string(b)); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("assign %s status = %d, want %d", a.Name, resp.StatusCode, http.StatusNoContent)
+		}
+	}
+
+	// The default template without phone_home is given the phone_home of
+	// ursa.
+	code, out = userdata(t, g, http.MethodGet, h1.Name, "", "")
+	if code != http.StatusOK || !strings.Contains(out, "hostname: "+h1.Name+"\n") || phoneHomeURL(t, out) != seed+"phone-home" {
+		t.Errorf("user-data of %s = %d %s, want base with phone_home", h1.Name, code, out)
+	}
+	// The group template has its own phone_home, so it is kept as it is.
+	code, out = userdata(t, g, http.MethodGet, h2.Name, "", "")
+	want := "#cloud-config\n# gpu nodes report to the custom URL\nhostname: gpu-" + h2.Name + "\nphone_home:\n  url: " + seed + "custom\n"
+	if code != http.StatusOK || out != want {
+		t.Errorf("user-data of %s = %d %q, want %q", h2.Name, code, out, want)
+	}
+	// The host scope takes precedence, and a script is not changed.
+	b, _ := json.Marshal(assignmentRequest{Scope: httpd.ScopeHost, Value: h2.UUID.String(), Name: "script"})
+	if resp := serve(g, http.MethodPost, "/api/v1/userdata-templates/assignments", string(b)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("assign script status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	code, out = userdata(t, g, http.MethodGet, h2.Name, "", "")
+	if code != http.StatusOK || out != "#!/bin/sh\necho "+h2.Name+"\n" {
+		t.Errorf("user-data of %s = %d %q, want the script", h2.Name, code, out)
+	}
+}
+
+func TestUserdataDryRun(t *testing.T) {
+	g := newGoAPId(t)
+	h := registerHost(t, g.ds, 1)
+
+	code, out := userdata(t, g, http.MethodPost, h.Name, "?server=10.0.0.254", "#cloud-config\nfqdn: {{ .Host.Name }}.example.com\n")
+	if code != http.StatusOK || !strings.Contains(out, "fqdn: "+h.Name+".example.com\n") {
+		t.Fatalf("dry-run = %d %s", code, out)
+	}
+	if url := phoneHomeURL(t, out); url != "http://10.0.0.254/init/dry-run/phone-home" {
+		t.Errorf("phone_home url = %s, want of the server", url)
+	}
+
+	for _, test := range []struct {
+		name   string
+		method string
+		body   string
+		want   int
+	}{
+		{name: "empty", method: http.MethodPost, body: "", want: http.StatusBadRequest},
+		{name: "parse error", method: http.MethodPost, body: "{{ .Host", want: http.StatusBadRequest},
+		{name: "execute error", method: http.MethodPost, body: "{{ .Unknown }}", want: http.StatusBadRequest},
+		{name: "not a mapping", method: http.MethodPost, body: "#cloud-config\n- {{ .Host.Name }}\n", want: http.StatusBadRequest},
+		{name: "flow style", method: http.MethodPost, body: "#cloud-config\n{hostname: {{ .Host.Name }}}\n", want: http.StatusBadRequest},
+		{name: "method", method: http.MethodPut, body: "#cloud-config\n", want: http.StatusMethodNotAllowed},
+	} {
+		if code, out := userdata(t, g, test.method, h.Name, "", test.body); code != test.want {
+			t.Errorf("%s: status = %d %s, want %d", test.name, code, out, test.want)
+		}
+	}
+	if code, _ := userdata(t, g, http.MethodGet, "unknown", "", ""); code != http.StatusNotFound {
+		t.Errorf("status of unknown host = %d, want %d", code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,240 @@
+package ursa
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/lovi-cloud/ursa/datastore"
+)
+
+// Export writes the full state of the datastore as JSON or YAML.
+func Export(ctx context.Context, args []string) error {
+	var datastoreKind, dsn, format, output string
+	flags := flag.NewFlagSet(fmt.Sprintf("ursa export (v%s rev:%s)", version, revision), flag.ContinueOnError)
+	flags.StringVar(&datastoreKind, "datastore", "sqlite", "datastore backend (sqlite, postgres)")
+	flags.StringVar(&dsn, "dsn", "file:ursa.db", "datastore dsn")
+	flags.StringVar(&format, "format", "", "json or yaml (by the extension of -o if empty, json for stdout)")
+	flags.StringVar(&output, "o", "-", "output path (- for stdout)")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if format == "" {
+		format = dumpFormat(output)
+	}
+
+	ds, err := newDatastore(ctx, datastoreKind, dsn, nil)
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	dump, err := ds.Export(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := encodeDump(*dump, format)
+	if err != nil {
+		return err
+	}
+
+	if output == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	// The dump has the BMC passwords and the hashes of the metadata tokens.
+	err = ioutil.WriteFile(output, b, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write dump: %w", err)
+	}
+	return nil
+}
+
+// Import replaces the full state of the datastore with the dump written by
+// Export.
+func Import(ctx context.Context, args []string) error {
+	var datastoreKind, dsn, format string
+	flags := flag.NewFlagSet(fmt.Sprintf("ursa import (v%s rev:%s)", version, revision), flag.ContinueOnError)
+	flags.StringVar(&datastoreKind, "datastore", "sqlite", "datastore backend (sqlite, postgres)")
+	flags.StringVar(&dsn, "dsn", "file:ursa.db", "datastore dsn")
+	flags.StringVar(&format, "format", "", "json or yaml (by the extension of the input if empty, json for stdin)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: ursa import [options] <path|->\n")
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("path of the dump is required")
+	}
+	input := flags.Arg(0)
+	if format == "" {
+		format = dumpFormat(input)
+	}
+
+	var b []byte
+	if input == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(input)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read dump: %w", err)
+	}
+	dump, err := decodeDump(b, format)
+	if err != nil {
+		return err
+	}
+	if dump.Version < 1 || dump.Version > datastore.DumpVersion {
+		return fmt.Errorf("unsupported dump version %d (supported: 1-%d)", dump.Version, datastore.DumpVersion)
+	}
+
+	ds, err := newDatastore(ctx, datastoreKind, dsn, nil)
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	err = ds.Import(datastore.WithActor(ctx, "cli:import"), *dump)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d hosts and %d leases\n", len(dump.Hosts), len(dump.Leases))
+	return nil
+}
+
+func dumpFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "json"
+}
+
+// encodeDump encodes the dump. JSON is the canonical encoding, and YAML is
+// converted from it to keep the same keys and values.
+func encodeDump(dump datastore.Dump, format string) ([]byte, error) {
+	b, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode dump: %w", err)
+	}
+	switch format {
+	case "json":
+		return append(b, '\n'), nil
+	case "yaml":
+		var v interface{}
+		err = yaml.Unmarshal(b, &v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert dump to YAML: %w", err)
+		}
+		return yaml.Marshal(v)
+	}
+	return nil, fmt.Errorf("invalid format %s", format)
+}
+
+func decodeDump(b []byte, format string) (*datastore.Dump, error) {
+	switch format {
+	case "json":
+	case "yaml":
+		var v interface{}
+		err := yaml.Unmarshal(b, &v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode dump: %w", err)
+		}
+		b, err = json.Marshal(jsonValue(v))
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert dump to JSON: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid format %s", format)
+	}
+	var dump datastore.Dump
+	err := json.Unmarshal(b, &dump)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode dump: %w", err)
+	}
+	return &dump, nil
+}
+
+// jsonValue converts the maps decoded from YAML, which can not be encoded
+// to JSON, to map[string]interface{}.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+		return v
+	}
+	return v
+}
+
+// backupDatastore writes a backup to dir every interval and keeps the
+// latest keep backups.
+func backupDatastore(ctx context.Context, b datastore.Backuper, logger *zap.Logger, dir string, interval time.Duration, keep int) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		path := filepath.Join(dir, fmt.Sprintf("ursa-%s.db", time.Now().UTC().Format("20060102T150405Z")))
+		err := b.Backup(ctx, path)
+		if err != nil {
+			logger.Warn("failed to back up datastore", zap.Error(err))
+		} else {
+			logger.Info("backed up datastore", zap.String("path", path))
+			err = pruneBackups(dir, keep)
+			if err != nil {
+				logger.Warn("failed to prune backups", zap.Error(err))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneBackups deletes the backups except the latest keep. All backups are
+// kept if keep is not positive.
+func pruneBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "ursa-*.db"))
+	if err != nil {
+		return err
+	}
+	// The names have the UTC timestamp, so the order of names is the
+	// order of time.
+	sort.Strings(paths)
+	for len(paths) > keep {
+		err = os.Remove(paths[0])
+		if err != nil {
+			return err
+		}
+		paths = paths[1:]
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package ursa
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"go.uber.org/zap"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/types"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ursa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// newSQLite returns the sqlite datastore of path with a host that has a BMC
+// credential.
+func newSQLite(t *testing.T, path string) datastore.Datastore {
+	t.Helper()
+	ctx := context.Background()
+	ds, err := newDatastore(ctx, "sqlite", "file:"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidr := func(s string) types.IPNet {
+		n, err := types.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *n
+	}
+	ip := func(s string) types.IP {
+		i, err := types.ParseIP(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *i
+	}
+	_, err = ds.CreateManagementSubnet(ctx, cidr("10.0.0.0/24"), ip("10.0.0.1"), ip("10.0.0.99"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.CreateServiceSubnet(ctx, cidr("192.168.0.0/24"), ip("192.168.0.1"), ip("192.168.0.99"), ip("192.168.0.254"), ip("8.8.8.8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := types.HardwareAddr(net.HardwareAddr{0x52, 0x54, 0x00, 0x00, 0x00, 0x01})
+	ml, err := ds.CreateLeaseFromManagementSubnet(ctx, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := ds.CreateLeaseFromServiceSubnet(ctx, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ds.RegisterHost(ctx, uuid.NewV5(uuid.NamespaceOID, "host-1"), "SN1", "product", "manufacturer", sl.ID, ml.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.SetBMCCredential(ctx, httpd.BMCCredential{HostID: h.ID, Driver: httpd.BMCDriverIPMI, Address: "10.0.0.200", Username: "admin", Password: "p@ss'word"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.CreateBootProfile(ctx, httpd.BootProfile{Name: "local", Kind: httpd.BootProfileKindLocal})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+// dumpValue returns the JSON value of dump, so dumps compare regardless of
+// the key order of the audited objects.
+func dumpValue(t *testing.T, dump datastore.Dump) interface{} {
+	t.Helper()
+	b, err := encodeDump(dump, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	dir, done := tempDir(t)
+	defer done()
+	src := newSQLite(t, filepath.Join(dir, "src.db"))
+	defer src.Close()
+	want, err := src.Export(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"dump.json", "dump.yaml"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			err := Export(ctx, []string{"-dsn", "file:" + filepath.Join(dir, "src.db"), "-o", path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0600 {
+				t.Errorf("mode = %o, want 0600", fi.Mode().Perm())
+			}
+
+			// Import into a fresh datastore.
+			dst := filepath.Join(dir, "dst-"+name+".db")
+			err = Import(ctx, []string{"-dsn", "file:" + dst, path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ds, err := newDatastore(ctx, "sqlite", "file:"+dst, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ds.Close()
+			got, err := ds.Export(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got.BMCCredentials) != 1 || got.BMCCredentials[0].Password != "p@ss'word" {
+				t.Errorf("BMC credentials = %+v, want the password", got.BMCCredentials)
+			}
+			// The import is audited in addition to the imported log.
+			n := len(got.AuditLog)
+			if n != len(want.AuditLog)+1 || got.AuditLog[n-1].Action != datastore.AuditImport || got.AuditLog[n-1].Actor != "cli:import" {
+				t.Errorf("audit log = %+v, want the import appended", got.AuditLog)
+			} else {
+				got.AuditLog = got.AuditLog[:n-1]
+			}
+			if g, w := dumpValue(t, *got), dumpValue(t, *want); !reflect.DeepEqual(g, w) {
+				t.Errorf("imported dump = %v, want %v", g, w)
+			}
+		})
+	}
+
+	if err := Import(ctx, []string{"-dsn", "file:" + filepath.Join(dir, "other.db"), filepath.Join(dir, "missing.json")}); err == nil {
+		t.Error("want an error for the missing dump")
+	}
+}
+
+func TestDumpYAML(t *testing.T) {
+	ctx := context.Background()
+	dir, done := tempDir(t)
+	defer done()
+	ds := newSQLite(t, filepath.Join(dir, "ursa.db"))
+	defer ds.Close()
+	dump, err := ds.Export(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := encodeDump(*dump, "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeDump(b, "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, w := dumpValue(t, *got), dumpValue(t, *dump); !reflect.DeepEqual(g, w) {
+		t.Errorf("YAML round trip = %v, want %v", g, w)
+	}
+	if got.BMCCredentials[0].Password != "p@ss'word" {
+		t.Errorf("BMC password = %q, want %q", got.BMCCredentials[0].Password, "p@ss'word")
+	}
+	if _, err := encodeDump(*dump, "xml"); err == nil {
+		t.Error("want an error for the invalid format")
+	}
+	for path, want := range map[string]string{"a.yaml": "yaml", "a.YML": "yaml", "a.json": "json", "-": "json"} {
+		if got := dumpFormat(path); got != want {
+			t.Errorf("format of %s = %s, want %s", path, got, want)
+		}
+	}
+}
+
+func listBackups(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "ursa-*.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range paths {
+		names = append(names, filepath.Base(p))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// cancelBackuper cancels the context after the backup.
+type cancelBackuper struct {
+	datastore.Backuper
+	cancel func()
+	count  int
+}
+
+func (b *cancelBackuper) Backup(ctx context.Context, path string) error {
+	defer b.cancel()
+	b.count++
+	return b.Backuper.Backup(ctx, path)
+}
+
+func TestBackupDatastore(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+	ds := newSQLite(t, filepath.Join(dir, "ursa.db"))
+	defer ds.Close()
+	backups := filepath.Join(dir, "backups")
+	if err := os.MkdirAll(backups, 0700); err != nil {
+		t.Fatal(err)
+	}
+	var old []string
+	for i := 1; i <= 3; i++ {
+		name := fmt.Sprintf("ursa-2020010%dT000000Z.db", i)
+		if err := ioutil.WriteFile(filepath.Join(backups, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		old = append(old, name)
+	}
+
+	// The backup is written before the interval elapses.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := &cancelBackuper{Backuper: ds.(datastore.Backuper), cancel: cancel}
+	err := backupDatastore(ctx, b, zap.NewNop(), backups, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := listBackups(t, backups)
+	if len(names) != 2 || names[0] != old[2] {
+		t.Fatalf("backups = %v, want the latest of the old and the new", names)
+	}
+	if b.count != 1 {
+		t.Errorf("backups taken = %d, want 1", b.count)
+	}
+	restored, err := newDatastore(context.Background(), "sqlite", "file:"+filepath.Join(backups, names[1]), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	dump, err := restored.Export(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dump.Hosts) != 1 {
+		t.Errorf("hosts in the backup = %+v, want 1", dump.Hosts)
+	}
+
+	// Not positive keep keeps every backup.
+	if err := pruneBackups(backups, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := pruneBackups(backups, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := listBackups(t, backups); len(got) != 1 || got[0] != names[1] {
+		t.Errorf("backups = %v, want %s", got, names[1])
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+var (
+	url    string
+	dryRun bool
+)
+
+func main() {
+	log.SetFlags(0)
+	if err := run(context.Background(), os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, argv []string, outStream, errStream io.Writer) error {
+	log.SetOutput(errStream)
+	log.SetPrefix("[ursa-inventory] ")
+
+	fs := flag.NewFlagSet(fmt.Sprintf("ursa-inventory (v%s rev:%s)", version, revision), flag.ContinueOnError)
+	fs.SetOutput(errStream)
+	fs.StringVar(&url, "url", "", "ursa inventory endpoint (http://<ursa>/init/<token>/inventory)")
+	fs.BoolVar(&dryRun, "dry-run", false, "print inventory instead of posting")
+	fs.Parse(argv)
+
+	inventory, err := collect(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(inventory)
+	if err != nil {
+		return fmt.Errorf("failed to marshal inventory: %w", err)
+	}
+	if dryRun {
+		_, err = outStream.Write(append(body, '\n'))
+		return err
+	}
+	if url == "" {
+		return fmt.Errorf("-url is required")
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post inventory: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to post inventory: status=%d", resp.StatusCode)
+	}
+	return nil
+}
+
+func collect(ctx context.Context) (*httpd.Inventory, error) {
+	cpu, err := getCPU()
+	if err != nil {
+		return nil, err
+	}
+	memory, err := getMemory()
+	if err != nil {
+		return nil, err
+	}
+	disks, err := getDisks()
+	if err != nil {
+		return nil, err
+	}
+	nics, err := getNICs()
+	if err != nil {
+		return nil, err
+	}
+
+	neighbors, err := getLLDPNeighbors(ctx)
+	if err != nil {
+		log.Printf("failed to get lldp neighbors: %+v", err)
+	}
+	for i := range nics {
+		if n, ok := neighbors[nics[i].Name]; ok {
+			nics[i].LLDPNeighbor = &n
+		}
+	}
+
+	bmc, err := getBMC(ctx)
+	if err != nil {
+		log.Printf("failed to get bmc: %+v", err)
+	}
+
+	return &httpd.Inventory{
+		Serial: readSysfs("/sys/class/dmi/id/product_serial"),
+		CPU:    *cpu,
+		Memory: memory,
+		Disks:  disks,
+		NICs:   nics,
+		BIOS: httpd.BIOS{
+			Vendor:  readSysfs("/sys/class/dmi/id/bios_vendor"),
+			Version: readSysfs("/sys/class/dmi/id/bios_version"),
+			Date:    readSysfs("/sys/class/dmi/id/bios_date"),
+		},
+		BMC: bmc,
+	}, nil
+}
+
+func getCPU() (*httpd.CPU, error) {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /proc/cpuinfo: %w", err)
+	}
+	defer f.Close()
+
+	var cpu httpd.CPU
+	sockets := map[string]int{}
+	var physicalID string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		words := strings.SplitN(scanner.Text(), ":", 2)
+		if len(words) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(words[0])
+		value := strings.TrimSpace(words[1])
+		switch key {
+		case "processor":
+			cpu.Threads++
+		case "model name":
+			cpu.Model = value
+		case "physical id":
+			physicalID = value
+		case "cpu cores":
+			cores, err := strconv.Atoi(value)
+			if err == nil {
+				sockets[physicalID] = cores
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read /proc/cpuinfo: %w", err)
+	}
+	cpu.Sockets = len(sockets)
+	for _, cores := range sockets {
+		cpu.Cores += cores
+	}
+	return &cpu, nil
+}
+
+func getMemory() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, fmt.Errorf("failed to open /proc/meminfo: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("failed to parse MemTotal: %w", err)
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("failed to find MemTotal in /proc/meminfo")
+}
+
+func getDisks() ([]httpd.Disk, error) {
+	paths, err := filepath.Glob("/sys/block/*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list block devices: %w", err)
+	}
+	var disks []httpd.Disk
+	for _, p := range paths {
+		name := filepath.Base(p)
+		// skip virtual block devices (loop, ram, dm-*, ...)
+		if _, err := os.Stat(filepath.Join(p, "device")); err != nil {
+			continue
+		}
+		sectors, err := strconv.ParseUint(readSysfs(filepath.Join(p, "size")), 10, 64)
+		if err != nil {
+			log.Printf("failed to get size disk=%s: %+v", name, err)
+			continue
+		}
+		serial := readSysfs(filepath.Join(p, "device", "serial"))
+		if serial == "" {
+			serial = readSysfs(filepath.Join(p, "device", "wwid"))
+		}
+		disks = append(disks, httpd.Disk{
+			Name:       name,
+			Model:      readSysfs(filepath.Join(p, "device", "model")),
+			Serial:     serial,
+			Size:       sectors * 512,
+			Rotational: readSysfs(filepath.Join(p, "queue", "rotational")) == "1",
+		})
+	}
+	return disks, nil
+}
+
+func getNICs() ([]httpd.NIC, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interface list: %w", err)
+	}
+	var nics []httpd.NIC
+	for _, iface := range ifaces {
+		p := filepath.Join("/sys/class/net", iface.Name)
+		// skip virtual interfaces (lo, bond, vlan, ...)
+		if _, err := os.Stat(filepath.Join(p, "device")); err != nil {
+			continue
+		}
+		driver, err := os.Readlink(filepath.Join(p, "device", "driver"))
+		if err != nil {
+			log.Printf("failed to get driver name interface=%s: %+v", iface.Name, err)
+		}
+		speed, _ := strconv.Atoi(readSysfs(filepath.Join(p, "speed")))
+		if speed < 0 {
+			speed = 0
+		}
+		nics = append(nics, httpd.NIC{
+			Name:       iface.Name,
+			MACAddress: iface.HardwareAddr.String(),
+			Driver:     filepath.Base(driver),
+			Speed:      speed,
+		})
+	}
+	return nics, nil
+}
+
+// lldpctl -f json0 output
+type lldpValue struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type lldpOutput struct {
+	LLDP []struct {
+		Interface []struct {
+			Name    string `json:"name"`
+			Chassis []struct {
+				ID   []lldpValue `json:"id"`
+				Name []lldpValue `json:"name"`
+			} `json:"chassis"`
+			Port []struct {
+				ID    []lldpValue `json:"id"`
+				Descr []lldpValue `json:"descr"`
+			} `json:"port"`
+		} `json:"interface"`
+	} `json:"lldp"`
+}
+
+func getLLDPNeighbors(ctx context.Context) (map[string]httpd.LLDPNeighbor, error) {
+	out, err := runCmd(ctx, "lldpctl", "-f", "json0")
+	if err != nil {
+		return nil, err
+	}
+	var lldp lldpOutput
+	err = json.Unmarshal([]byte(out), &lldp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse lldpctl output: %w", err)
+	}
+
+	neighbors := map[string]httpd.LLDPNeighbor{}
+	for _, l := range lldp.LLDP {
+		for _, iface := range l.Interface {
+			var n httpd.LLDPNeighbor
+			for _, c := range iface.Chassis {
+				n.ChassisID = first(c.ID)
+				n.SystemName = first(c.Name)
+			}
+			for _, p := range iface.Port {
+				n.PortID = first(p.ID)
+				n.PortDescription = first(p.Descr)
+			}
+			neighbors[iface.Name] = n
+		}
+	}
+	return neighbors, nil
+}
+
+func first(values []lldpValue) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0].Value
+}
+
+func getBMC(ctx context.Context) (*httpd.BMC, error) {
+	mc, err := runCmd(ctx, "ipmitool", "mc", "info")
+	if err != nil {
+		return nil, err
+	}
+	lan, err := runCmd(ctx, "ipmitool", "lan", "print")
+	if err != nil {
+		return nil, err
+	}
+	return &httpd.BMC{
+		Version:    getField(mc, "Firmware Revision"),
+		IPAddress:  getField(lan, "IP Address"),
+		MACAddress: getField(lan, "MAC Address"),
+	}, nil
+}
+
+// getField returns the value of "key : value" line in ipmitool output.
+func getField(out, key string) string {
+	for _, line := range strings.Split(out, "\n") {
+		words := strings.SplitN(line, ":", 2)
+		if len(words) == 2 && strings.TrimSpace(words[0]) == key {
+			return strings.TrimSpace(words[1])
+		}
+	}
+	return ""
+}
+
+func readSysfs(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func runCmd(ctx context.Context, cmd string, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, cmd, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to exec [%s %s] msg=%s: %w", cmd, strings.Join(args, " "), string(out), err)
+	}
+	return string(out), nil
+}
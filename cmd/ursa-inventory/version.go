@@ -0,0 +1,5 @@
+package main
+
+const version = "0.0.1"
+
+var revision = "HEAD"
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// ataPassword is the temporary user password to enable ATA security. It is
+// cleared by the secure erase.
+const ataPassword = "ursa"
+
+var (
+	url    string
+	dryRun bool
+)
+
+func main() {
+	log.SetFlags(0)
+	if err := run(context.Background(), os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, argv []string, outStream, errStream io.Writer) error {
+	log.SetOutput(errStream)
+	log.SetPrefix("[ursa-wipe] ")
+
+	fs := flag.NewFlagSet(fmt.Sprintf("ursa-wipe (v%s rev:%s)", version, revision), flag.ContinueOnError)
+	fs.SetOutput(errStream)
+	fs.StringVar(&url, "url", "", "ursa wipe report endpoint (http://<ursa>/init/<token>/wipe-report)")
+	fs.BoolVar(&dryRun, "dry-run", false, "print the wipe method of disks instead of wiping and posting")
+	fs.Parse(argv)
+
+	if url == "" && !dryRun {
+		return fmt.Errorf("-url is required")
+	}
+
+	disks, err := getDisks()
+	if err != nil {
+		return err
+	}
+	report := httpd.WipeReport{Disks: make([]httpd.DiskWipeResult, len(disks))}
+	var wg sync.WaitGroup
+	for i, d := range disks {
+		wg.Add(1)
+		go func(i int, d disk) {
+			defer wg.Done()
+			report.Disks[i] = wipe(ctx, d)
+		}(i, d)
+	}
+	wg.Wait()
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal wipe report: %w", err)
+	}
+	if dryRun {
+		_, err = outStream.Write(append(body, '\n'))
+		return err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post wipe report: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to post wipe report: status=%d", resp.StatusCode)
+	}
+	if !report.Succeeded() {
+		return fmt.Errorf("failed to wipe disks")
+	}
+	return nil
+}
+
+type disk struct {
+	name   string
+	serial string
+	size   uint64
+}
+
+func (d disk) path() string {
+	return filepath.Join("/dev", d.name)
+}
+
+func getDisks() ([]disk, error) {
+	paths, err := filepath.Glob("/sys/block/*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list block devices: %w", err)
+	}
+	var disks []disk
+	for _, p := range paths {
+		name := filepath.Base(p)
+		// skip virtual block devices (loop, ram, dm-*, ...)
+		if _, err := os.Stat(filepath.Join(p, "device")); err != nil {
+			continue
+		}
+		if strings.HasPrefix(name, "sr") || readSysfs(filepath.Join(p, "removable")) == "1" {
+			continue
+		}
+		sectors, err := strconv.ParseUint(readSysfs(filepath.Join(p, "size")), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get size disk=%s: %w", name, err)
+		}
+		serial := readSysfs(filepath.Join(p, "device", "serial"))
+		if serial == "" {
+			serial = readSysfs(filepath.Join(p, "device", "wwid"))
+		}
+		disks = append(disks, disk{
+			name:   name,
+			serial: serial,
+			size:   sectors * 512,
+		})
+	}
+	return disks, nil
+}
+
+// wipe erases the disk by the strongest method the disk supports. It falls
+// back to the next method if a method fails.
+func wipe(ctx context.Context, d disk) httpd.DiskWipeResult {
+	result := httpd.DiskWipeResult{
+		Name:   d.name,
+		Serial: d.serial,
+	}
+	var messages []string
+	for _, method := range methods(ctx, d) {
+		result.Method = method
+		if dryRun {
+			result.Message = "dry-run"
+			return result
+		}
+		log.Printf("wiping disk=%s method=%s", d.name, method)
+		err := wipeBy(ctx, d, method)
+		if err == nil {
+			result.Success = true
+			result.Message = strings.Join(messages, "; ")
+			log.Printf("wiped disk=%s method=%s", d.name, method)
+			return result
+		}
+		log.Printf("failed to wipe disk=%s method=%s: %+v", d.name, method, err)
+		messages = append(messages, fmt.Sprintf("%s: %v", method, err))
+	}
+	result.Message = strings.Join(messages, "; ")
+	return result
+}
+
+func methods(ctx context.Context, d disk) []string {
+	if strings.HasPrefix(d.name, "nvme") {
+		return []string{httpd.WipeMethodNVMeFormat, httpd.WipeMethodBlkdiscard, httpd.WipeMethodZeroFill}
+	}
+	if ataSecureEraseSupported(ctx, d) {
+		return []string{httpd.WipeMethodATASecureErase, httpd.WipeMethodBlkdiscard, httpd.WipeMethodZeroFill}
+	}
+	return []string{httpd.WipeMethodBlkdiscard, httpd.WipeMethodZeroFill}
+}
+
+func wipeBy(ctx context.Context, d disk, method string) error {
+	switch method {
+	case httpd.WipeMethodNVMeFormat:
+		_, err := runCmd(ctx, "nvme", "format", d.path(), "--ses=1", "--force")
+		return err
+	case httpd.WipeMethodATASecureErase:
+		return ataSecureErase(ctx, d)
+	case httpd.WipeMethodBlkdiscard:
+		// --secure fails if the device does not support secure discard
+		if _, err := runCmd(ctx, "blkdiscard", "--secure", d.path()); err == nil {
+			return nil
+		}
+		_, err := runCmd(ctx, "blkdiscard", d.path())
+		return err
+	case httpd.WipeMethodZeroFill:
+		return zeroFill(d)
+	}
+	return fmt.Errorf("invalid wipe method %s", method)
+}
+
+// ataSecureEraseSupported reports whether the disk supports ATA security
+// and is not frozen.
+func ataSecureEraseSupported(ctx context.Context, d disk) bool {
+	out, err := runCmd(ctx, "hdparm", "-I", d.path())
+	if err != nil {
+		return false
+	}
+	security := ataSecurity(out)
+	return security["supported"] && security["not frozen"]
+}
+
+// ataSecurity returns the lines of the Security section of hdparm -I.
+func ataSecurity(out string) map[string]bool {
+	security := map[string]bool{}
+	i := strings.Index(out, "\nSecurity:")
+	if i < 0 {
+		return security
+	}
+	for _, line := range strings.Split(out[i+len("\nSecurity:"):], "\n")[1:] {
+		if !strings.HasPrefix(line, "\t") {
+			break
+		}
+		security[strings.Join(strings.Fields(line), " ")] = true
+	}
+	return security
+}
+
+func ataSecureErase(ctx context.Context, d disk) error {
+	out, err := runCmd(ctx, "hdparm", "-I", d.path())
+	if err != nil {
+		return err
+	}
+	erase := "--security-erase"
+	if ataSecurity(out)["supported: enhanced erase"] {
+		erase = "--security-erase-enhanced"
+	}
+	_, err = runCmd(ctx, "hdparm", "--user-master", "u", "--security-set-pass", ataPassword, d.path())
+	if err != nil {
+		return err
+	}
+	_, err = runCmd(ctx, "hdparm", "--user-master", "u", erase, ataPassword, d.path())
+	return err
+}
+
+func zeroFill(d disk) error {
+	f, err := os.OpenFile(d.path(), os.O_WRONLY|syscall.O_DIRECT, 0)
+	if err != nil {
+		// O_DIRECT is not supported by some devices
+		f, err = os.OpenFile(d.path(), os.O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", d.path(), err)
+		}
+	}
+	defer f.Close()
+
+	buf := make([]byte, 4<<20)
+	var written uint64
+	for written < d.size {
+		n, err := f.Write(buf)
+		written += uint64(n)
+		if errors.Is(err, syscall.ENOSPC) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to write %s at %d: %w", d.path(), written, err)
+		}
+	}
+	err = f.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync %s: %w", d.path(), err)
+	}
+	return nil
+}
+
+func readSysfs(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func runCmd(ctx context.Context, cmd string, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, cmd, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to exec [%s %s] msg=%s: %w", cmd, strings.Join(args, " "), string(out), err)
+	}
+	return string(out), nil
+}
@@ -9,7 +9,21 @@ import (
 )
 
 func main() {
-	err := ursa.Run(context.Background())
+	var err error
+	var command string
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	switch command {
+	case "migrate":
+		err = ursa.Migrate(context.Background(), os.Args[2:])
+	case "export":
+		err = ursa.Export(context.Background(), os.Args[2:])
+	case "import":
+		err = ursa.Import(context.Background(), os.Args[2:])
+	default:
+		err = ursa.Run(context.Background())
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
 		os.Exit(1)
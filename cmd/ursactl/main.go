@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+const usage = `usage: ursactl [-api <url>] [-token <token>] <command> [<args>]
+
+commands:
+  host timeline [-limit <n>] [-json] <name>  show the boot sessions of the host
+  host rename <name> <new-name>              rename the host
+  host rename -regenerate <name>             regenerate the hostname by the naming template
+  host state <name> in-service               put the provisioned host into service
+  audit list [-host <name>] [-host-id <id>] [-since <time>] [-until <time>] [-limit <n>] [-json]
+                                             show the audit log of the datastore
+`
+
+var (
+	apiURL   string
+	apiToken string
+)
+
+func main() {
+	log.SetFlags(0)
+	if err := run(context.Background(), os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, argv []string, outStream, errStream io.Writer) error {
+	log.SetOutput(errStream)
+	log.SetPrefix("[ursactl] ")
+
+	fs := flag.NewFlagSet(fmt.Sprintf("ursactl (v%s rev:%s)", version, revision), flag.ContinueOnError)
+	fs.SetOutput(errStream)
+	fs.Usage = func() {
+		fmt.Fprint(errStream, usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&apiURL, "api", "http://127.0.0.1:8080", "ursa management API URL")
+	fs.StringVar(&apiToken, "token", os.Getenv("URSA_API_TOKEN"), "ursa management API token (default $URSA_API_TOKEN)")
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+
+	args := fs.Args()
+	if len(args) < 2 {
+		fs.Usage()
+		return fmt.Errorf("command is required")
+	}
+	switch args[0] + " " + args[1] {
+	case "host timeline":
+		return hostTimeline(ctx, args[2:], outStream, errStream)
+	case "host rename":
+		return hostRename(ctx, args[2:], outStream, errStream)
+	case "host state":
+		return hostState(ctx, args[2:], outStream, errStream)
+	case "audit list":
+		return auditList(ctx, args[2:], outStream, errStream)
+	}
+	fs.Usage()
+	return fmt.Errorf("unknown command %s %s", args[0], args[1])
+}
+
+func hostTimeline(ctx context.Context, argv []string, outStream, errStream io.Writer) error {
+	fs := flag.NewFlagSet("ursactl host timeline", flag.ContinueOnError)
+	fs.SetOutput(errStream)
+	limit := fs.Int("limit", 0, "number of the latest boot events (default: server default)")
+	asJSON := fs.Bool("json", false, "print the sessions as JSON")
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("host name is required")
+	}
+
+	query := url.Values{}
+	if *limit > 0 {
+		query.Set("limit", strconv.Itoa(*limit))
+	}
+	var sessions []httpd.BootSession
+	err := get(ctx, "/api/v1/hosts/"+url.PathEscape(fs.Arg(0))+"/timeline", query, &sessions)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(outStream)
+		enc.SetIndent("", "  ")
+		return enc.Encode(sessions)
+	}
+	return printTimeline(outStream, sessions)
+}
+
+// printTimeline prints a table of the boot events per session. The time of
+// an event is relative to the start of the session.
+func printTimeline(w io.Writer, sessions []httpd.BootSession) error {
+	if len(sessions) == 0 {
+		_, err := fmt.Fprintln(w, "no boot events")
+		return err
+	}
+	for i, s := range sessions {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "session %d: %s (%s, %d events)\n", i+1, s.StartedAt.Local().Format(time.RFC3339), s.EndedAt.Sub(s.StartedAt).Round(time.Second), len(s.Events))
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "  TIME\tPROTOCOL\tREQUEST\tOUTCOME\tDETAIL")
+		for _, e := range s.Events {
+			fmt.Fprintf(tw, "  +%s\t%s\t%s\t%s\t%s\n", e.CreatedAt.Sub(s.StartedAt).Round(time.Millisecond), strings.ToUpper(e.Protocol), e.Name, e.Outcome, e.Detail)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hostRename(ctx context.Context, argv []string, outStream, errStream io.Writer) error {
+	fs := flag.NewFlagSet("ursactl host rename", flag.ContinueOnError)
+	fs.SetOutput(errStream)
+	regenerate := fs.Bool("regenerate", false, "regenerate the hostname by the naming template and the latest inventory")
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	var name string
+	switch {
+	case *regenerate && fs.NArg() == 1:
+	case !*regenerate && fs.NArg() == 2:
+		name = fs.Arg(1)
+	default:
+		return fmt.Errorf("host name and new name (or -regenerate) are required")
+	}
+
+	var host httpd.Host
+	err := post(ctx, "/api/v1/hosts/"+url.PathEscape(fs.Arg(0))+"/rename", map[string]string{"name": name}, &host)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(outStream, "%s renamed to %s\n", fs.Arg(0), host.Name)
+	return err
+}
+
+func hostState(ctx context.Context, argv []string, outStream, errStream io.Writer) error {
+	fs := flag.NewFlagSet("ursactl host state", flag.ContinueOnError)
+	fs.SetOutput(errStream)
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("host name and state are required")
+	}
+
+	var host httpd.Host
+	err := post(ctx, "/api/v1/hosts/"+url.PathEscape(fs.Arg(0))+"/state", map[string]string{"state": fs.Arg(1)}, &host)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(outStream, "%s is %s\n", host.Name, host.State)
+	return err
+}
+
+func auditList(ctx context.Context, argv []string, outStream, errStream io.Writer) error {
+	fs := flag.NewFlagSet("ursactl audit list", flag.ContinueOnError)
+	fs.SetOutput(errStream)
+	host := fs.String("host", "", "name of the host")
+	hostID := fs.Int("host-id", 0, "id of the host, which selects a deleted host")
+	since := fs.String("since", "", "show the entries at or after the time (RFC3339)")
+	until := fs.String("until", "", "show the entries before the time (RFC3339)")
+	limit := fs.Int("limit", 0, "number of the latest entries (default: server default)")
+	asJSON := fs.Bool("json", false, "print the entries as JSON")
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if *host != "" {
+		query.Set("host", *host)
+	}
+	if *hostID > 0 {
+		query.Set("host_id", strconv.Itoa(*hostID))
+	}
+	if *since != "" {
+		query.Set("since", *since)
+	}
+	if *until != "" {
+		query.Set("until", *until)
+	}
+	if *limit > 0 {
+		query.Set("limit", strconv.Itoa(*limit))
+	}
+	var entries []datastore.AuditEntry
+	err := get(ctx, "/api/v1/audit", query, &entries)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(outStream)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	return printAudit(outStream, entries)
+}
+
+// printAudit prints a table of the audit entries. The values are printed
+// as compact JSON.
+func printAudit(w io.Writer, entries []datastore.AuditEntry) error {
+	if len(entries) == 0 {
+		_, err := fmt.Fprintln(w, "no audit entries")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTIME\tACTOR\tACTION\tHOST\tBEFORE\tAFTER")
+	for _, e := range entries {
+		host := "-"
+		if e.HostID != 0 {
+			host = strconv.Itoa(e.HostID)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", e.ID, e.CreatedAt.Local().Format(time.RFC3339), e.Actor, e.Action, host, e.Before, e.After)
+	}
+	return tw.Flush()
+}
+
+// get gets the API resource at path and decodes the JSON response into v.
+func get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	u := strings.TrimSuffix(apiURL, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	return do(req, path, v)
+}
+
+// post posts body as JSON to the API resource at path and decodes the JSON
+// response into v.
+func post(ctx context.Context, path string, body, v interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(apiURL, "/")+path, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return do(req, path, v)
+}
+
+func do(req *http.Request, path string, v interface{}) error {
+	req.Header.Set("Authorization", "Bearer "+apiToken)
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to %s %s: %w", strings.ToLower(req.Method), path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("failed to %s %s: status=%d %s", strings.ToLower(req.Method), path, resp.StatusCode, e.Error)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+func TestPrintTimeline(t *testing.T) {
+	start := time.Date(2020, 11, 2, 1, 15, 4, 0, time.UTC)
+	events := []httpd.BootEvent{
+		{Protocol: httpd.BootEventProtocolDHCP, Name: "discover", Outcome: httpd.BootEventOutcomeOK, CreatedAt: start},
+		{Protocol: httpd.BootEventProtocolHTTP, Name: "GET /ipxe", Outcome: httpd.BootEventOutcomeOK, Detail: "200", CreatedAt: start.Add(5400 * time.Millisecond)},
+	}
+	transitions := []httpd.HostStateTransition{
+		{From: httpd.HostStateDiscovered, To: httpd.HostStateProvisioning, CreatedAt: start.Add(5400 * time.Millisecond)},
+	}
+	sessions := httpd.SplitBootSessions(httpd.MergeStateTransitions(events, transitions), 10*time.Minute)
+
+	var buff bytes.Buffer
+	if err := printTimeline(&buff, sessions); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buff.String()), "\n")
+	if len(lines) != 5 || !strings.HasSuffix(lines[0], "(5s, 3 events)") {
+		t.Fatalf("timeline = %s", buff.String())
+	}
+	for i, want := range [][]string{
+		{"TIME", "PROTOCOL", "REQUEST", "OUTCOME", "DETAIL"},
+		{"+0s", "DHCP", "discover", "ok"},
+		{"+5.4s", "HTTP", "GET", "/ipxe", "ok", "200"},
+		{"+5.4s", "STATE", "provisioning", "ok", "from", "discovered"},
+	} {
+		if got := strings.Fields(lines[i+1]); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("line %d = %q, want %q", i+1, lines[i+1], want)
+		}
+	}
+
+	buff.Reset()
+	if err := printTimeline(&buff, nil); err != nil {
+		t.Fatal(err)
+	}
+	if buff.String() != "no boot events\n" {
+		t.Errorf("timeline without events = %q", buff.String())
+	}
+}
@@ -0,0 +1,117 @@
+package datastore
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// HostAttributes are the attributes of the host that the assignments are
+// matched against.
+type HostAttributes struct {
+	Host   httpd.Host
+	Labels map[string]string
+	// Groups are the names of the host groups of the host.
+	Groups []string
+}
+
+// scopePrecedence is the order of the scopes.
+var scopePrecedence = []string{
+	httpd.ScopeHost,
+	httpd.ScopeGroup,
+	httpd.ScopeSelector,
+	httpd.ScopeProduct,
+	httpd.ScopeManufacturer,
+	httpd.ScopeDefault,
+}
+
+// ValidateScope validates the scope and returns the value to store: the
+// empty value for the default scope and the canonical form of a selector.
+func ValidateScope(scope, value string) (string, error) {
+	switch scope {
+	case httpd.ScopeDefault:
+		return "", nil
+	case httpd.ScopeHost, httpd.ScopeProduct, httpd.ScopeManufacturer:
+		if value == "" {
+			return "", fmt.Errorf("value is required for scope %s", scope)
+		}
+		return value, nil
+	case httpd.ScopeGroup:
+		err := ValidateGroupName(value)
+		if err != nil {
+			return "", err
+		}
+		return value, nil
+	case httpd.ScopeSelector:
+		sel, err := ParseSelector(value)
+		if err != nil {
+			return "", err
+		}
+		return sel.String(), nil
+	default:
+		return "", fmt.Errorf("invalid scope %s", scope)
+	}
+}
+
+// Match reports whether the assignment matches the host.
+func (a Assignment) Match(attrs HostAttributes) bool {
+	switch a.Scope {
+	case httpd.ScopeHost:
+		return a.Value == attrs.Host.UUID.String()
+	case httpd.ScopeGroup:
+		return contains(attrs.Groups, a.Value)
+	case httpd.ScopeSelector:
+		sel, err := ParseSelector(a.Value)
+		return err == nil && sel.Matches(attrs.Labels)
+	case httpd.ScopeProduct:
+		return a.Value == attrs.Host.Product
+	case httpd.ScopeManufacturer:
+		return a.Value == attrs.Host.Manufacturer
+	case httpd.ScopeDefault:
+		return true
+	}
+	return false
+}
+
+// MatchAssignments returns the assignments that match the host in the order
+// of precedence: host uuid, host group, label selector, product,
+// manufacturer and finally the default assignment. The group and selector
+// assignments that match the same host are ordered by their values.
+func MatchAssignments(assignments []Assignment, attrs HostAttributes) []Assignment {
+	var ret []Assignment
+	for _, scope := range scopePrecedence {
+		var matched []Assignment
+		for _, a := range assignments {
+			if a.Scope == scope && a.Match(attrs) {
+				matched = append(matched, a)
+			}
+		}
+		sort.SliceStable(matched, func(i, j int) bool {
+			return matched[i].Value < matched[j].Value
+		})
+		ret = append(ret, matched...)
+	}
+	return ret
+}
+
+// FilterUserByAccess returns the users that have the access to the host.
+// restricted are the ids of the users that have any access granted, and
+// matched are the accesses that match the host. The other users have the
+// access to every host.
+func FilterUserByAccess(users []httpd.User, restricted []int, matched []Assignment) []httpd.User {
+	granted := map[int]bool{}
+	for _, id := range restricted {
+		granted[id] = false
+	}
+	for _, a := range matched {
+		granted[a.TargetID] = true
+	}
+	var ret []httpd.User
+	for _, u := range users {
+		if ok, found := granted[u.ID]; !found || ok {
+			ret = append(ret, u)
+		}
+	}
+	return ret
+}
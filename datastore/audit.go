@@ -0,0 +1,181 @@
+package datastore
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// Audit actions
+const (
+	AuditSubnetCreate           = "subnet.create"
+	AuditLeaseCreate            = "lease.create"
+	AuditLeaseDelete            = "lease.delete"
+	AuditHostRegister           = "host.register"
+	AuditHostStateUpdate        = "host.state.update"
+	AuditHostRename             = "host.rename"
+	AuditHostLabelsSet          = "host.labels.set"
+	AuditHostPhoneHome          = "host.phone_home"
+	AuditHostTokenIssue         = "host.token.issue"
+	AuditHostTokenRevoke        = "host.token.revoke"
+	AuditHostInventoryCreate    = "host.inventory.create"
+	AuditHostWipeReportCreate   = "host.wipe_report.create"
+	AuditHostDecommission       = "host.decommission"
+	AuditHostRediscover         = "host.rediscover"
+	AuditHostDelete             = "host.delete"
+	AuditBMCCredentialSet       = "bmc_credential.set"
+	AuditBMCRecord              = "bmc.record"
+	AuditBMCLink                = "bmc.link"
+	AuditBootProfileCreate      = "boot_profile.create"
+	AuditBootProfileAssign      = "boot_profile.assign"
+	AuditUserdataTemplateCreate = "userdata_template.create"
+	AuditUserdataTemplateAssign = "userdata_template.assign"
+	AuditNetworkProfileCreate   = "network_profile.create"
+	AuditNetworkProfileAssign   = "network_profile.assign"
+	AuditHostGroupCreate        = "host_group.create"
+	AuditHostGroupDelete        = "host_group.delete"
+	AuditHostGroupMemberAdd     = "host_group.member.add"
+	AuditHostGroupMemberRemove  = "host_group.member.remove"
+	AuditUserAccessGrant        = "user_access.grant"
+	AuditUserAccessRevoke       = "user_access.revoke"
+	AuditImport                 = "datastore.import"
+)
+
+// ActorUnknown is the actor of the changes made with a context without an
+// actor.
+const ActorUnknown = "unknown"
+
+// AuditEntry is a change of the state made by the datastore. The entries are
+// never updated nor deleted, and are kept after the host is deleted.
+type AuditEntry struct {
+	ID     int    `db:"id" json:"id"`
+	Actor  string `db:"actor" json:"actor"`
+	Action string `db:"action" json:"action"`
+	// HostID is the host that the change belongs to, or 0.
+	HostID    int        `db:"host_id" json:"host_id,omitempty"`
+	Before    AuditValue `db:"before_value" json:"before"`
+	After     AuditValue `db:"after_value" json:"after"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+}
+
+// AuditFilter selects the audit entries. The zero value selects all.
+type AuditFilter struct {
+	HostID int
+	Since  time.Time
+	Until  time.Time
+	// Limit is the number of the latest entries, or 0 for all.
+	Limit int
+}
+
+// Match reports whether the entry is selected by the filter, ignoring
+// Limit.
+func (f AuditFilter) Match(e AuditEntry) bool {
+	if f.HostID != 0 && e.HostID != f.HostID {
+		return false
+	}
+	if !f.Since.IsZero() && e.CreatedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.CreatedAt.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// NewAuditEntry returns the entry of the change made with ctx. before and
+// after are encoded to JSON, and nil means that the object does not exist.
+func NewAuditEntry(ctx context.Context, action string, hostID int, before, after interface{}) (*AuditEntry, error) {
+	b, err := json.Marshal(before)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode audit value: %w", err)
+	}
+	a, err := json.Marshal(after)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode audit value: %w", err)
+	}
+	return &AuditEntry{
+		Actor:     ActorFromContext(ctx),
+		Action:    action,
+		HostID:    hostID,
+		Before:    AuditValue(b),
+		After:     AuditValue(a),
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// AuditValue is a JSON value of an object in an audit entry.
+type AuditValue []byte
+
+// MarshalJSON implements the json.Marshaler interface.
+func (v AuditValue) MarshalJSON() ([]byte, error) {
+	if len(v) == 0 {
+		return []byte("null"), nil
+	}
+	return v, nil
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (v *AuditValue) UnmarshalJSON(b []byte) error {
+	*v = append((*v)[0:0], b...)
+	return nil
+}
+
+// Value implements the database/sql/driver Valuer interface.
+func (v AuditValue) Value() (driver.Value, error) {
+	if len(v) == 0 {
+		return driver.Value("null"), nil
+	}
+	return driver.Value(string(v)), nil
+}
+
+// Scan implements the database/sql Scanner interface.
+func (v *AuditValue) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case string:
+		*v = AuditValue(src)
+	case []uint8:
+		*v = append(AuditValue(nil), src...)
+	default:
+		return fmt.Errorf("incompatible type for AuditValue: %T", src)
+	}
+	return nil
+}
+
+type actorKey struct{}
+
+// WithActor returns the context whose changes are recorded as made by the
+// actor, e.g. "daemon:httpd", "api:127.0.0.1" or "cli:import".
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor of the context.
+func ActorFromContext(ctx context.Context) string {
+	actor, ok := ctx.Value(actorKey{}).(string)
+	if !ok || actor == "" {
+		return ActorUnknown
+	}
+	return actor
+}
+
+// ActorHook returns the Hook that sets the actor to the context of the
+// methods unless the context already has one.
+func ActorHook(actor string) Hook {
+	return func(ctx context.Context, method string) (context.Context, func(err error)) {
+		if _, ok := ctx.Value(actorKey{}).(string); !ok {
+			ctx = WithActor(ctx, actor)
+		}
+		return ctx, func(err error) {}
+	}
+}
+
+// PhoneHome is the value of the host.phone_home audit entry.
+type PhoneHome struct {
+	InstanceID   string          `json:"instance_id"`
+	PhonedHomeAt *time.Time      `json:"phoned_home_at"`
+	HostKeys     []httpd.HostKey `json:"host_keys"`
+}
@@ -2,6 +2,7 @@ package datastore
 
 import (
 	"context"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 
@@ -16,18 +17,96 @@ type Datastore interface {
 	GetServiceSubnet(ctx context.Context) (*dhcpd.Subnet, error)
 	CreateManagementSubnet(ctx context.Context, network types.IPNet, start, end types.IP) (*dhcpd.Subnet, error)
 	CreateServiceSubnet(ctx context.Context, network types.IPNet, start, end, gateway, dnsServer types.IP) (*dhcpd.Subnet, error)
+	GetBMCSubnet(ctx context.Context) (*dhcpd.Subnet, error)
+	CreateBMCSubnet(ctx context.Context, network types.IPNet, start, end types.IP) (*dhcpd.Subnet, error)
 
 	GetLeaseByID(ctx context.Context, id int) (*httpd.Lease, error)
 	GetLeaseFromManagementSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error)
 	GetLeaseFromServiceSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error)
 	CreateLeaseFromManagementSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error)
 	CreateLeaseFromServiceSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error)
+	GetLeaseFromBMCSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error)
+	CreateLeaseFromBMCSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error)
+	ListLease(ctx context.Context) ([]dhcpd.Lease, error)
+	DeleteLease(ctx context.Context, id int) error
+	CountLeaseBySubnet(ctx context.Context) (map[int]int, error)
 
 	RegisterHost(ctx context.Context, serverID uuid.UUID, serial, product, manufacturer string, serviceLeaseID, managementLeaseID int) (*httpd.Host, error)
 	GetHostByAddress(ctx context.Context, address types.IP) (*httpd.Host, error)
+	GetHostByUUID(ctx context.Context, serverID uuid.UUID) (*httpd.Host, error)
+	GetHostByName(ctx context.Context, name string) (*httpd.Host, error)
+	UpdateHostState(ctx context.Context, hostID int, state string) (*httpd.Host, error)
+	RenameHost(ctx context.Context, hostID int, name string) (*httpd.Host, error)
+	ListHostStateTransition(ctx context.Context, hostID int) ([]httpd.HostStateTransition, error)
+	RecordPhoneHome(ctx context.Context, hostID int, instanceID string, keys []httpd.HostKey) error
+	ListHostKeyByHostID(ctx context.Context, hostID int) ([]httpd.HostKey, error)
+	IssueHostToken(ctx context.Context, hostID int) (string, error)
+	GetHostByToken(ctx context.Context, token string) (*httpd.Host, error)
+	RevokeHostToken(ctx context.Context, hostID int) error
+	CreateWipeReport(ctx context.Context, hostID int, report httpd.WipeReport) (*httpd.HostWipeReport, error)
+	ListWipeReport(ctx context.Context, hostID int) ([]httpd.HostWipeReport, error)
+	DecommissionHost(ctx context.Context, hostID int) (*httpd.Host, error)
+	RediscoverHost(ctx context.Context, hostID, serviceLeaseID, managementLeaseID int) (*httpd.Host, error)
+	DeleteHost(ctx context.Context, hostID int) error
+	CountHostByState(ctx context.Context) (map[string]int, error)
+
+	GetHostLabels(ctx context.Context, hostID int) (map[string]string, error)
+	SetHostLabels(ctx context.Context, hostID int, labels map[string]string) error
+	CreateHostGroup(ctx context.Context, name string) (*httpd.HostGroup, error)
+	GetHostGroupByName(ctx context.Context, name string) (*httpd.HostGroup, error)
+	ListHostGroup(ctx context.Context) ([]httpd.HostGroup, error)
+	DeleteHostGroup(ctx context.Context, groupID int) error
+	AddHostGroupMember(ctx context.Context, groupID, hostID int) error
+	RemoveHostGroupMember(ctx context.Context, groupID, hostID int) error
+	ListHostByGroup(ctx context.Context, groupID int) ([]httpd.Host, error)
+	ListHostGroupByHost(ctx context.Context, hostID int) ([]httpd.HostGroup, error)
+
+	RecordBootEvent(ctx context.Context, e httpd.BootEvent) error
+	ListBootEventByHost(ctx context.Context, hostID, limit int) ([]httpd.BootEvent, error)
+	PruneBootEvent(ctx context.Context, before time.Time) error
+
+	CreateHostInventory(ctx context.Context, hostID int, inventory httpd.Inventory) (*httpd.HostInventory, error)
+	GetHostInventory(ctx context.Context, hostID, version int) (*httpd.HostInventory, error)
+	GetLatestHostInventory(ctx context.Context, hostID int) (*httpd.HostInventory, error)
+	ListHostInventory(ctx context.Context, hostID int) ([]httpd.HostInventory, error)
+
+	SetBMCCredential(ctx context.Context, cred httpd.BMCCredential) (*httpd.BMCCredential, error)
+	GetBMCCredentialByHostID(ctx context.Context, hostID int) (*httpd.BMCCredential, error)
+	RecordBMC(ctx context.Context, mac types.HardwareAddr, vendorClass, hostname string, leaseID int) (*dhcpd.BMC, error)
+	GetBMCByMAC(ctx context.Context, mac types.HardwareAddr) (*dhcpd.BMC, error)
+	GetBMCByHostID(ctx context.Context, hostID int) (*dhcpd.BMC, error)
+	ListBMC(ctx context.Context) ([]dhcpd.BMC, error)
+	LinkBMC(ctx context.Context, bmcID, hostID int) error
+
+	CreateBootProfile(ctx context.Context, profile httpd.BootProfile) (*httpd.BootProfile, error)
+	GetBootProfileByName(ctx context.Context, name string) (*httpd.BootProfile, error)
+	GetBootProfileByHost(ctx context.Context, host httpd.Host) (*httpd.BootProfile, error)
+	ListBootProfile(ctx context.Context) ([]httpd.BootProfile, error)
+	AssignBootProfile(ctx context.Context, scope, value string, profileID int) error
+
+	CreateUserdataTemplate(ctx context.Context, t httpd.UserdataTemplate) (*httpd.UserdataTemplate, error)
+	GetUserdataTemplateByName(ctx context.Context, name string) (*httpd.UserdataTemplate, error)
+	GetUserdataTemplateByHost(ctx context.Context, host httpd.Host) (*httpd.UserdataTemplate, error)
+	ListUserdataTemplate(ctx context.Context) ([]httpd.UserdataTemplate, error)
+	AssignUserdataTemplate(ctx context.Context, scope, value string, templateID int) error
+
+	CreateNetworkProfile(ctx context.Context, profile httpd.NetworkProfile) (*httpd.NetworkProfile, error)
+	GetNetworkProfileByName(ctx context.Context, name string) (*httpd.NetworkProfile, error)
+	GetNetworkProfileByHost(ctx context.Context, host httpd.Host) (*httpd.NetworkProfile, error)
+	ListNetworkProfile(ctx context.Context) ([]httpd.NetworkProfile, error)
+	AssignNetworkProfile(ctx context.Context, scope, value string, profileID int) error
 
 	ListUser(ctx context.Context) ([]httpd.User, error)
 	ListKeyByUserID(ctx context.Context, userID int) ([]httpd.Key, error)
+	GrantUserAccess(ctx context.Context, userID int, scope, value string) error
+	RevokeUserAccess(ctx context.Context, userID int, scope, value string) error
+	ListUserAccess(ctx context.Context, userID int) ([]Assignment, error)
+	ListUserByHost(ctx context.Context, host httpd.Host) ([]httpd.User, error)
+
+	ListAuditEntry(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+
+	Export(ctx context.Context) (*Dump, error)
+	Import(ctx context.Context, dump Dump) error
 
 	Close() error
 }
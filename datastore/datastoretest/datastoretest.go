@@ -0,0 +1,1296 @@
+// Package datastoretest provides the conformance tests of datastore.Datastore.
+// Every implementation must pass them, so that the daemons behave the same
+// on any backend. Call Run from a test of the implementation:
+//
+//	func TestConformance(t *testing.T) {
+//		datastoretest.Run(t, func(t *testing.T) datastore.Datastore {
+//			ds, err := memory.New(nil)
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return ds
+//		})
+//	}
+package datastoretest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/dhcpd"
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/types"
+)
+
+// Run runs the conformance tests. newDatastore is called for each test and
+// must return an empty datastore that is not shared with the other tests.
+func Run(t *testing.T, newDatastore func(t *testing.T) datastore.Datastore) {
+	for _, tc := range []struct {
+		name string
+		test func(t *testing.T, ds datastore.Datastore)
+	}{
+		{"Subnet", testSubnet},
+		{"Lease", testLease},
+		{"DeleteLease", testDeleteLease},
+		{"Host", testHost},
+		{"HostState", testHostState},
+		{"Hostname", testHostname},
+		{"PhoneHome", testPhoneHome},
+		{"HostToken", testHostToken},
+		{"HostInventory", testHostInventory},
+		{"BMC", testBMC},
+		{"BootProfile", testBootProfile},
+		{"BootProfilePrecedence", testBootProfilePrecedence},
+		{"UserdataTemplate", testUserdataTemplate},
+		{"NetworkProfile", testNetworkProfile},
+		{"HostLabel", testHostLabel},
+		{"HostGroup", testHostGroup},
+		{"SelectorAssignment", testSelectorAssignment},
+		{"UserAccess", testUserAccess},
+		{"Decommission", testDecommission},
+		{"Rediscover", testRediscover},
+		{"BootEvent", testBootEvent},
+		{"ExportImport", testExportImport},
+		{"Audit", testAudit},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ds := newDatastore(t)
+			defer ds.Close()
+			tc.test(t, ds)
+		})
+	}
+}
+
+func parseIP(t *testing.T, s string) types.IP {
+	t.Helper()
+	ip, err := types.ParseIP(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *ip
+}
+
+func parseCIDR(t *testing.T, s string) types.IPNet {
+	t.Helper()
+	n, err := types.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *n
+}
+
+func mac(i int) types.HardwareAddr {
+	return types.HardwareAddr(net.HardwareAddr{0x52, 0x54, 0x00, 0x00, byte(i >> 8), byte(i)})
+}
+
+func hostUUID(i int) uuid.UUID {
+	return uuid.NewV5(uuid.NamespaceOID, fmt.Sprintf("host-%d", i))
+}
+
+func mustNil(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+}
+
+func mustIs(t *testing.T, err, target error) {
+	t.Helper()
+	if !errors.Is(err, target) {
+		t.Fatalf("want %v, but got %+v", target, err)
+	}
+}
+
+func createSubnets(t *testing.T, ds datastore.Datastore) {
+	t.Helper()
+	ctx := context.Background()
+	_, err := ds.CreateManagementSubnet(ctx, parseCIDR(t, "10.0.0.0/24"), parseIP(t, "10.0.0.1"), parseIP(t, "10.0.0.99"))
+	mustNil(t, err)
+	_, err = ds.CreateServiceSubnet(ctx, parseCIDR(t, "192.168.0.0/24"), parseIP(t, "192.168.0.1"), parseIP(t, "192.168.0.99"), parseIP(t, "192.168.0.254"), parseIP(t, "8.8.8.8"))
+	mustNil(t, err)
+	_, err = ds.CreateBMCSubnet(ctx, parseCIDR(t, "10.0.0.0/24"), parseIP(t, "10.0.0.200"), parseIP(t, "10.0.0.250"))
+	mustNil(t, err)
+}
+
+// registerHost creates the leases of i and registers a host with them.
+func registerHost(t *testing.T, ds datastore.Datastore, i int) *httpd.Host {
+	t.Helper()
+	return registerHostOf(t, ds, i, "product", "manufacturer")
+}
+
+func registerHostOf(t *testing.T, ds datastore.Datastore, i int, product, manufacturer string) *httpd.Host {
+	t.Helper()
+	ctx := context.Background()
+	sl, err := ds.CreateLeaseFromServiceSubnet(ctx, mac(i))
+	mustNil(t, err)
+	ml, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(i))
+	mustNil(t, err)
+	host, err := ds.RegisterHost(ctx, hostUUID(i), "serial", product, manufacturer, sl.ID, ml.ID)
+	mustNil(t, err)
+	return host
+}
+
+func testSubnet(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	_, err := ds.GetManagementSubnet(ctx)
+	mustIs(t, err, datastore.ErrNotFound)
+
+	createSubnets(t, ds)
+	subnet, err := ds.GetServiceSubnet(ctx)
+	mustNil(t, err)
+	if subnet.Start.String() != "192.168.0.1" || subnet.End.String() != "192.168.0.99" || subnet.Gateway.String() != "192.168.0.254" {
+		t.Fatalf("unexpected service subnet: %+v", subnet)
+	}
+	subnet, err = ds.GetBMCSubnet(ctx)
+	mustNil(t, err)
+	if subnet.Start.String() != "10.0.0.200" || subnet.Gateway != nil {
+		t.Fatalf("unexpected BMC subnet: %+v", subnet)
+	}
+
+	_, err = ds.CreateManagementSubnet(ctx, parseCIDR(t, "10.0.0.0/24"), parseIP(t, "10.0.0.1"), parseIP(t, "10.0.0.99"))
+	mustIs(t, err, datastore.ErrConflict)
+}
+
+func testLease(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	_, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(1))
+	mustIs(t, err, datastore.ErrNotFound)
+
+	createSubnets(t, ds)
+	for i, want := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		lease, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(i))
+		mustNil(t, err)
+		if lease.IPAddress.String() != want || lease.SubnetID != 0 {
+			t.Fatalf("want %s, but got %+v", want, lease)
+		}
+	}
+	lease, err := ds.CreateLeaseFromBMCSubnet(ctx, mac(0))
+	mustNil(t, err)
+	if lease.IPAddress.String() != "10.0.0.200" {
+		t.Fatalf("want 10.0.0.200, but got %s", lease.IPAddress)
+	}
+
+	_, err = ds.CreateLeaseFromManagementSubnet(ctx, mac(1))
+	mustIs(t, err, datastore.ErrConflict)
+
+	lease, err = ds.GetLeaseFromManagementSubnet(ctx, mac(1))
+	mustNil(t, err)
+	if lease.IPAddress.String() != "10.0.0.2" {
+		t.Fatalf("want 10.0.0.2, but got %s", lease.IPAddress)
+	}
+	_, err = ds.GetLeaseFromServiceSubnet(ctx, mac(1))
+	mustIs(t, err, datastore.ErrNotFound)
+
+	sl, err := ds.CreateLeaseFromServiceSubnet(ctx, mac(1))
+	mustNil(t, err)
+	hl, err := ds.GetLeaseByID(ctx, sl.ID)
+	mustNil(t, err)
+	if hl.IPAddress.String() != "192.168.0.1" || hl.Gateway.String() != "192.168.0.254" || hl.DNSServer.String() != "8.8.8.8" {
+		t.Fatalf("unexpected lease: %+v", hl)
+	}
+	_, err = ds.GetLeaseByID(ctx, sl.ID+100)
+	mustIs(t, err, datastore.ErrNotFound)
+
+	leases, err := ds.ListLease(ctx)
+	mustNil(t, err)
+	if len(leases) != 5 {
+		t.Fatalf("want 5 leases, but got %d", len(leases))
+	}
+	for i := 1; i < len(leases); i++ {
+		if leases[i-1].ID >= leases[i].ID {
+			t.Fatalf("leases are not ordered by id: %+v", leases)
+		}
+	}
+	counts, err := ds.CountLeaseBySubnet(ctx)
+	mustNil(t, err)
+	if counts[0] != 3 || counts[1] != 1 || counts[2] != 1 {
+		t.Fatalf("unexpected counts: %v", counts)
+	}
+}
+
+func testDeleteLease(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+
+	err := ds.DeleteLease(ctx, host.ManagementLeaseID)
+	mustIs(t, err, dhcpd.ErrLeaseInUse)
+
+	lease, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(2))
+	mustNil(t, err)
+	mustNil(t, ds.DeleteLease(ctx, lease.ID))
+	err = ds.DeleteLease(ctx, lease.ID)
+	mustIs(t, err, datastore.ErrNotFound)
+
+	// The address next to the latest lease is allocated, so the released
+	// address is reused.
+	reused, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(3))
+	mustNil(t, err)
+	if reused.IPAddress.String() != lease.IPAddress.String() || reused.ID == lease.ID {
+		t.Fatalf("want %s with a new id, but got %+v", lease.IPAddress, reused)
+	}
+
+	bl, err := ds.CreateLeaseFromBMCSubnet(ctx, mac(4))
+	mustNil(t, err)
+	_, err = ds.RecordBMC(ctx, mac(4), "iDRAC", "bmc", bl.ID)
+	mustNil(t, err)
+	mustNil(t, ds.DeleteLease(ctx, bl.ID))
+	_, err = ds.GetBMCByMAC(ctx, mac(4))
+	mustIs(t, err, datastore.ErrNotFound)
+}
+
+func testHost(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+	if !strings.HasSuffix(host.Name, "0001") || host.State != httpd.HostStateDiscovered {
+		t.Fatalf("unexpected host: %+v", host)
+	}
+	second := registerHost(t, ds, 2)
+	if !strings.HasSuffix(second.Name, "0002") || second.ID == host.ID {
+		t.Fatalf("unexpected host: %+v", second)
+	}
+
+	_, err := ds.RegisterHost(ctx, host.UUID, "serial", "product", "manufacturer", 0, 0)
+	mustIs(t, err, datastore.ErrConflict)
+
+	got, err := ds.GetHostByUUID(ctx, host.UUID)
+	mustNil(t, err)
+	if got.ID != host.ID || got.Name != host.Name || got.ServiceLeaseID != host.ServiceLeaseID {
+		t.Fatalf("want %+v, but got %+v", host, got)
+	}
+	got, err = ds.GetHostByName(ctx, second.Name)
+	mustNil(t, err)
+	if got.ID != second.ID {
+		t.Fatalf("want %+v, but got %+v", second, got)
+	}
+	lease, err := ds.GetLeaseByID(ctx, second.ManagementLeaseID)
+	mustNil(t, err)
+	got, err = ds.GetHostByAddress(ctx, lease.IPAddress)
+	mustNil(t, err)
+	if got.ID != second.ID {
+		t.Fatalf("want %+v, but got %+v", second, got)
+	}
+
+	_, err = ds.GetHostByUUID(ctx, hostUUID(0))
+	mustIs(t, err, datastore.ErrNotFound)
+	_, err = ds.GetHostByName(ctx, "unknown")
+	mustIs(t, err, datastore.ErrNotFound)
+	_, err = ds.GetHostByAddress(ctx, parseIP(t, "10.0.0.98"))
+	mustIs(t, err, datastore.ErrNotFound)
+}
+
+func testHostState(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+
+	got, err := ds.UpdateHostState(ctx, host.ID, httpd.HostStateProvisioning)
+	mustNil(t, err)
+	if got.State != httpd.HostStateProvisioning {
+		t.Fatalf("want %s, but got %s", httpd.HostStateProvisioning, got.State)
+	}
+	_, err = ds.UpdateHostState(ctx, host.ID, httpd.HostStateWiped)
+	mustIs(t, err, httpd.ErrInvalidHostStateTransition)
+	_, err = ds.UpdateHostState(ctx, host.ID+100, httpd.HostStateProvisioning)
+	mustIs(t, err, datastore.ErrNotFound)
+
+	transitions, err := ds.ListHostStateTransition(ctx, host.ID)
+	mustNil(t, err)
+	if len(transitions) != 2 || transitions[0].From != "" || transitions[0].To != httpd.HostStateDiscovered || transitions[1].To != httpd.HostStateProvisioning {
+		t.Fatalf("unexpected transitions: %+v", transitions)
+	}
+
+	registerHost(t, ds, 2)
+	counts, err := ds.CountHostByState(ctx)
+	mustNil(t, err)
+	if counts[httpd.HostStateDiscovered] != 1 || counts[httpd.HostStateProvisioning] != 1 {
+		t.Fatalf("unexpected counts: %v", counts)
+	}
+}
+
+func testHostname(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+	other := registerHost(t, ds, 2)
+
+	renamed, err := ds.RenameHost(ctx, host.ID, "web-01")
+	mustNil(t, err)
+	if renamed.Name != "web-01" {
+		t.Fatalf("unexpected host: %+v", renamed)
+	}
+	got, err := ds.GetHostByName(ctx, "web-01")
+	mustNil(t, err)
+	if got.ID != host.ID {
+		t.Fatalf("unexpected host: %+v", got)
+	}
+	_, err = ds.RenameHost(ctx, host.ID, "web_01")
+	mustIs(t, err, datastore.ErrInvalidHostname)
+	_, err = ds.RenameHost(ctx, other.ID, "web-01")
+	mustIs(t, err, datastore.ErrConflict)
+	_, err = ds.RenameHost(ctx, 9999, "web-02")
+	mustIs(t, err, datastore.ErrNotFound)
+
+	entries, err := ds.ListAuditEntry(ctx, datastore.AuditFilter{HostID: host.ID})
+	mustNil(t, err)
+	last := entries[len(entries)-1]
+	if last.Action != datastore.AuditHostRename {
+		t.Fatalf("unexpected audit entries: %+v", entries)
+	}
+	var before, after httpd.Host
+	mustNil(t, json.Unmarshal(last.Before, &before))
+	mustNil(t, json.Unmarshal(last.After, &after))
+	if before.Name != host.Name || after.Name != "web-01" {
+		t.Fatalf("unexpected values: %s, %s", last.Before, last.After)
+	}
+
+	// An empty name regenerates the hostname by the naming template.
+	regenerated, err := ds.RenameHost(ctx, host.ID, "")
+	mustNil(t, err)
+	if regenerated.Name != host.Name {
+		t.Fatalf("unexpected host: %+v", regenerated)
+	}
+
+	// A host whose name is taken is named with its id suffixed.
+	_, err = ds.RenameHost(ctx, other.ID, fmt.Sprintf("%04d", other.ID+1))
+	mustNil(t, err)
+	third := registerHost(t, ds, 3)
+	if third.ID != other.ID+1 || third.Name != fmt.Sprintf("%04d-%d", third.ID, third.ID) {
+		t.Fatalf("unexpected host: %+v", third)
+	}
+
+	// The hosts registered concurrently never get the same name.
+	const n = 8
+	leases := make([][2]int, n)
+	for i := range leases {
+		sl, err := ds.CreateLeaseFromServiceSubnet(ctx, mac(10+i))
+		mustNil(t, err)
+		ml, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(10+i))
+		mustNil(t, err)
+		leases[i] = [2]int{sl.ID, ml.ID}
+	}
+	names := make(chan string, n)
+	errs := make(chan error, n)
+	for i := range leases {
+		go func(i int) {
+			h, err := ds.RegisterHost(ctx, hostUUID(10+i), "serial", "product", "manufacturer", leases[i][0], leases[i][1])
+			if err != nil {
+				errs <- err
+				return
+			}
+			names <- h.Name
+		}(i)
+	}
+	seen := map[string]bool{host.Name: true, fmt.Sprintf("%04d", other.ID+1): true, third.Name: true}
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-errs:
+			t.Fatalf("unexpected error: %+v", err)
+		case name := <-names:
+			if seen[name] {
+				t.Fatalf("duplicated hostname: %s", name)
+			}
+			seen[name] = true
+		}
+	}
+}
+
+func testPhoneHome(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+
+	err := ds.RecordPhoneHome(ctx, host.ID+100, "i-0", nil)
+	mustIs(t, err, datastore.ErrNotFound)
+
+	mustNil(t, ds.RecordPhoneHome(ctx, host.ID, "i-1", []httpd.HostKey{{Type: "rsa", Key: "rsa-1"}, {Type: "ed25519", Key: "ed25519-1"}}))
+	mustNil(t, ds.RecordPhoneHome(ctx, host.ID, "i-2", []httpd.HostKey{{Type: "rsa", Key: "rsa-2"}}))
+	got, err := ds.GetHostByUUID(ctx, host.UUID)
+	mustNil(t, err)
+	if got.InstanceID != "i-2" || got.PhonedHomeAt == nil {
+		t.Fatalf("unexpected host: %+v", got)
+	}
+	keys, err := ds.ListHostKeyByHostID(ctx, host.ID)
+	mustNil(t, err)
+	found := map[string]string{}
+	for _, k := range keys {
+		found[k.Type] = k.Key
+	}
+	if len(keys) != 2 || found["rsa"] != "rsa-2" || found["ed25519"] != "ed25519-1" {
+		t.Fatalf("unexpected host keys: %+v", keys)
+	}
+}
+
+func testHostToken(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+
+	first, err := ds.IssueHostToken(ctx, host.ID)
+	mustNil(t, err)
+	got, err := ds.GetHostByToken(ctx, first)
+	mustNil(t, err)
+	if got.ID != host.ID {
+		t.Fatalf("want %+v, but got %+v", host, got)
+	}
+
+	second, err := ds.IssueHostToken(ctx, host.ID)
+	mustNil(t, err)
+	_, err = ds.GetHostByToken(ctx, first)
+	mustIs(t, err, datastore.ErrNotFound)
+	_, err = ds.GetHostByToken(ctx, second)
+	mustNil(t, err)
+
+	mustNil(t, ds.RevokeHostToken(ctx, host.ID))
+	_, err = ds.GetHostByToken(ctx, second)
+	mustIs(t, err, datastore.ErrNotFound)
+}
+
+func testHostInventory(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+
+	_, err := ds.GetLatestHostInventory(ctx, host.ID)
+	mustIs(t, err, datastore.ErrNotFound)
+
+	for _, serial := range []string{"s1", "s2"} {
+		_, err = ds.CreateHostInventory(ctx, host.ID, httpd.Inventory{Serial: serial})
+		mustNil(t, err)
+	}
+	latest, err := ds.GetLatestHostInventory(ctx, host.ID)
+	mustNil(t, err)
+	if latest.Version != 2 || latest.Inventory.Serial != "s2" {
+		t.Fatalf("unexpected inventory: %+v", latest)
+	}
+	first, err := ds.GetHostInventory(ctx, host.ID, 1)
+	mustNil(t, err)
+	if first.Inventory.Serial != "s1" {
+		t.Fatalf("unexpected inventory: %+v", first)
+	}
+	_, err = ds.GetHostInventory(ctx, host.ID, 3)
+	mustIs(t, err, datastore.ErrNotFound)
+
+	his, err := ds.ListHostInventory(ctx, host.ID)
+	mustNil(t, err)
+	if len(his) != 2 || his[0].Version != 2 || his[1].Version != 1 {
+		t.Fatalf("unexpected inventories: %+v", his)
+	}
+}
+
+func testBMC(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+
+	_, err := ds.SetBMCCredential(ctx, httpd.BMCCredential{HostID: host.ID, Driver: "unknown"})
+	if err == nil {
+		t.Fatal("want an error for the invalid driver")
+	}
+	_, err = ds.GetBMCCredentialByHostID(ctx, host.ID)
+	mustIs(t, err, datastore.ErrNotFound)
+	_, err = ds.SetBMCCredential(ctx, httpd.BMCCredential{HostID: host.ID, Driver: httpd.BMCDriverIPMI, Address: "10.0.0.200", Username: "admin", Password: "a"})
+	mustNil(t, err)
+	_, err = ds.SetBMCCredential(ctx, httpd.BMCCredential{HostID: host.ID, Driver: httpd.BMCDriverRedfish, Address: "10.0.0.200", Username: "admin", Password: "b"})
+	mustNil(t, err)
+	cred, err := ds.GetBMCCredentialByHostID(ctx, host.ID)
+	mustNil(t, err)
+	if cred.Driver != httpd.BMCDriverRedfish || cred.Password != "b" {
+		t.Fatalf("unexpected credential: %+v", cred)
+	}
+
+	var bmcs []*dhcpd.BMC
+	for i := 1; i <= 2; i++ {
+		lease, err := ds.CreateLeaseFromBMCSubnet(ctx, mac(i))
+		mustNil(t, err)
+		bmc, err := ds.RecordBMC(ctx, mac(i), "iDRAC", "", lease.ID)
+		mustNil(t, err)
+		if bmc.IPAddress.String() != lease.IPAddress.String() || bmc.HostID != nil {
+			t.Fatalf("unexpected BMC: %+v", bmc)
+		}
+		bmcs = append(bmcs, bmc)
+	}
+
+	err = ds.LinkBMC(ctx, bmcs[1].ID+100, host.ID)
+	mustIs(t, err, datastore.ErrNotFound)
+	mustNil(t, ds.LinkBMC(ctx, bmcs[0].ID, host.ID))
+	bmc, err := ds.RecordBMC(ctx, mac(1), "iDRAC", "bmc-1", bmcs[0].LeaseID)
+	mustNil(t, err)
+	if bmc.ID != bmcs[0].ID || bmc.Hostname != "bmc-1" || bmc.HostID == nil || *bmc.HostID != host.ID {
+		t.Fatalf("unexpected BMC: %+v", bmc)
+	}
+
+	mustNil(t, ds.LinkBMC(ctx, bmcs[1].ID, host.ID))
+	bmc, err = ds.GetBMCByHostID(ctx, host.ID)
+	mustNil(t, err)
+	if bmc.ID != bmcs[1].ID {
+		t.Fatalf("want %+v, but got %+v", bmcs[1], bmc)
+	}
+	bmc, err = ds.GetBMCByMAC(ctx, mac(1))
+	mustNil(t, err)
+	if bmc.HostID != nil {
+		t.Fatalf("want the unlinked BMC, but got %+v", bmc)
+	}
+
+	list, err := ds.ListBMC(ctx)
+	mustNil(t, err)
+	if len(list) != 2 || list[0].ID != bmcs[0].ID || list[1].ID != bmcs[1].ID {
+		t.Fatalf("unexpected BMCs: %+v", list)
+	}
+}
+
+func testBootProfile(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+
+	_, err := ds.GetBootProfileByHost(ctx, *host)
+	mustIs(t, err, datastore.ErrNotFound)
+
+	ids := map[string]int{}
+	for _, name := range []string{"default", "manufacturer", "product", "host"} {
+		p, err := ds.CreateBootProfile(ctx, httpd.BootProfile{Name: name, Kind: httpd.BootProfileKindLocal})
+		mustNil(t, err)
+		ids[name] = p.ID
+	}
+	_, err = ds.CreateBootProfile(ctx, httpd.BootProfile{Name: "default", Kind: httpd.BootProfileKindLocal})
+	mustIs(t, err, datastore.ErrConflict)
+	_, err = ds.GetBootProfileByName(ctx, "unknown")
+	mustIs(t, err, datastore.ErrNotFound)
+
+	if ds.AssignBootProfile(ctx, "unknown", "", ids["default"]) == nil {
+		t.Fatal("want an error for the invalid scope")
+	}
+	if ds.AssignBootProfile(ctx, httpd.ScopeProduct, "", ids["product"]) == nil {
+		t.Fatal("want an error for the empty value")
+	}
+
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeProduct, "other", ids["product"]))
+	_, err = ds.GetBootProfileByHost(ctx, *host)
+	mustIs(t, err, datastore.ErrNotFound)
+
+	for _, step := range []struct {
+		scope string
+		value string
+		name  string
+	}{
+		{httpd.ScopeDefault, "", "default"},
+		{httpd.ScopeManufacturer, host.Manufacturer, "manufacturer"},
+		{httpd.ScopeProduct, host.Product, "product"},
+		{httpd.ScopeHost, host.UUID.String(), "host"},
+	} {
+		mustNil(t, ds.AssignBootProfile(ctx, step.scope, step.value, ids[step.name]))
+		p, err := ds.GetBootProfileByHost(ctx, *host)
+		mustNil(t, err)
+		if p.Name != step.name {
+			t.Fatalf("after assigning to %s %s, want %s, but got %s", step.scope, step.value, step.name, p.Name)
+		}
+	}
+
+	// The assignment of the same scope and value is replaced.
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeHost, host.UUID.String(), ids["default"]))
+	p, err := ds.GetBootProfileByHost(ctx, *host)
+	mustNil(t, err)
+	if p.Name != "default" {
+		t.Fatalf("want default, but got %s", p.Name)
+	}
+
+	profiles, err := ds.ListBootProfile(ctx)
+	mustNil(t, err)
+	if len(profiles) != 4 {
+		t.Fatalf("want 4 profiles, but got %d", len(profiles))
+	}
+
+	_, err = ds.CreateBootProfile(ctx, httpd.BootProfile{Name: "flatcar", Kind: httpd.BootProfileKindIgnition, Diskless: true})
+	mustNil(t, err)
+	p, err = ds.GetBootProfileByName(ctx, "flatcar")
+	mustNil(t, err)
+	if !p.Diskless {
+		t.Fatal("want the diskless profile")
+	}
+}
+
+func testBootProfilePrecedence(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	hosts := map[string]*httpd.Host{
+		"host":         registerHostOf(t, ds, 1, "p1", "m1"),
+		"product":      registerHostOf(t, ds, 2, "p1", "m1"),
+		"manufacturer": registerHostOf(t, ds, 3, "p3", "m1"),
+		"default":      registerHostOf(t, ds, 4, "p4", "m4"),
+	}
+	ids := map[string]int{}
+	for _, name := range []string{"default", "manufacturer", "product", "host", "group-a", "group-b", "selector-a", "selector-b"} {
+		p, err := ds.CreateBootProfile(ctx, httpd.BootProfile{Name: name, Kind: httpd.BootProfileKindLocal})
+		mustNil(t, err)
+		ids[name] = p.ID
+	}
+	check := func(t *testing.T, host *httpd.Host, want string) {
+		t.Helper()
+		p, err := ds.GetBootProfileByHost(ctx, *host)
+		if want == "" {
+			mustIs(t, err, datastore.ErrNotFound)
+			return
+		}
+		mustNil(t, err)
+		if p.Name != want {
+			t.Fatalf("want %s for %s/%s, but got %s", want, host.Product, host.Manufacturer, p.Name)
+		}
+	}
+
+	// Each scope matches without the others, regardless of the order of
+	// the assignments.
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeHost, hosts["host"].UUID.String(), ids["host"]))
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeManufacturer, "m1", ids["manufacturer"]))
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeProduct, "p1", ids["product"]))
+	for name, host := range hosts {
+		want := name
+		if name == "default" {
+			want = ""
+		}
+		check(t, host, want)
+	}
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeDefault, "", ids["default"]))
+	for name, host := range hosts {
+		check(t, host, name)
+	}
+
+	// The group and selector assignments that match the same host are
+	// ordered by their values, not by the order of the assignments.
+	host := hosts["default"]
+	for _, name := range []string{"canary", "batch"} {
+		g, err := ds.CreateHostGroup(ctx, name)
+		mustNil(t, err)
+		mustNil(t, ds.AddHostGroupMember(ctx, g.ID, host.ID))
+	}
+	mustNil(t, ds.SetHostLabels(ctx, host.ID, map[string]string{"rack": "r1", "role": "compute"}))
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeSelector, "role=compute", ids["selector-b"]))
+	check(t, host, "selector-b")
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeSelector, "rack=r1", ids["selector-a"]))
+	check(t, host, "selector-a")
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeGroup, "canary", ids["group-b"]))
+	check(t, host, "group-b")
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeGroup, "batch", ids["group-a"]))
+	check(t, host, "group-a")
+
+	// The host scope takes precedence over the group.
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeHost, host.UUID.String(), ids["host"]))
+	check(t, host, "host")
+	check(t, hosts["product"], "product")
+}
+
+func testUserdataTemplate(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+
+	_, err := ds.GetUserdataTemplateByHost(ctx, *host)
+	mustIs(t, err, datastore.ErrNotFound)
+
+	d, err := ds.CreateUserdataTemplate(ctx, httpd.UserdataTemplate{Name: "default", Template: "#cloud-config"})
+	mustNil(t, err)
+	p, err := ds.CreateUserdataTemplate(ctx, httpd.UserdataTemplate{Name: "product", Template: "#cloud-config"})
+	mustNil(t, err)
+	_, err = ds.CreateUserdataTemplate(ctx, httpd.UserdataTemplate{Name: "default", Template: "#cloud-config"})
+	mustIs(t, err, datastore.ErrConflict)
+
+	mustNil(t, ds.AssignUserdataTemplate(ctx, httpd.ScopeProduct, host.Product, p.ID))
+	mustNil(t, ds.AssignUserdataTemplate(ctx, httpd.ScopeDefault, "", d.ID))
+	got, err := ds.GetUserdataTemplateByHost(ctx, *host)
+	mustNil(t, err)
+	if got.ID != p.ID {
+		t.Fatalf("want %+v, but got %+v", p, got)
+	}
+	got, err = ds.GetUserdataTemplateByName(ctx, "default")
+	mustNil(t, err)
+	if got.ID != d.ID {
+		t.Fatalf("want %+v, but got %+v", d, got)
+	}
+	_, err = ds.GetUserdataTemplateByName(ctx, "unknown")
+	mustIs(t, err, datastore.ErrNotFound)
+}
+
+func testNetworkProfile(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+	mustNil(t, ds.SetHostLabels(ctx, host.ID, map[string]string{"role": "storage"}))
+
+	_, err := ds.GetNetworkProfileByHost(ctx, *host)
+	mustIs(t, err, datastore.ErrNotFound)
+
+	d, err := ds.CreateNetworkProfile(ctx, httpd.NetworkProfile{Name: "default", BondDriver: "e1000e", ServiceVLAN: 1000})
+	mustNil(t, err)
+	s, err := ds.CreateNetworkProfile(ctx, httpd.NetworkProfile{Name: "storage", BondDriver: "mlx5_core"})
+	mustNil(t, err)
+	_, err = ds.CreateNetworkProfile(ctx, httpd.NetworkProfile{Name: "default"})
+	mustIs(t, err, datastore.ErrConflict)
+
+	mustNil(t, ds.AssignNetworkProfile(ctx, httpd.ScopeDefault, "", d.ID))
+	got, err := ds.GetNetworkProfileByHost(ctx, *host)
+	mustNil(t, err)
+	if *got != *d {
+		t.Fatalf("want %+v, but got %+v", d, got)
+	}
+	mustNil(t, ds.AssignNetworkProfile(ctx, httpd.ScopeSelector, "role=storage", s.ID))
+	got, err = ds.GetNetworkProfileByHost(ctx, *host)
+	mustNil(t, err)
+	if *got != *s {
+		t.Fatalf("want %+v, but got %+v", s, got)
+	}
+	got, err = ds.GetNetworkProfileByName(ctx, "default")
+	mustNil(t, err)
+	if *got != *d {
+		t.Fatalf("want %+v, but got %+v", d, got)
+	}
+	_, err = ds.GetNetworkProfileByName(ctx, "unknown")
+	mustIs(t, err, datastore.ErrNotFound)
+
+	profiles, err := ds.ListNetworkProfile(ctx)
+	mustNil(t, err)
+	if len(profiles) != 2 {
+		t.Fatalf("want 2 profiles, but got %d", len(profiles))
+	}
+}
+
+func testHostLabel(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+
+	labels, err := ds.GetHostLabels(ctx, host.ID)
+	mustNil(t, err)
+	if len(labels) != 0 {
+		t.Fatalf("want no labels, but got %+v", labels)
+	}
+	mustNil(t, ds.SetHostLabels(ctx, host.ID, map[string]string{"rack": "r1", "role": "compute"}))
+	mustNil(t, ds.SetHostLabels(ctx, host.ID, map[string]string{"rack": "r2", "example.com/gpu": ""}))
+	labels, err = ds.GetHostLabels(ctx, host.ID)
+	mustNil(t, err)
+	if len(labels) != 2 || labels["rack"] != "r2" || labels["example.com/gpu"] != "" {
+		t.Fatalf("unexpected labels: %+v", labels)
+	}
+
+	err = ds.SetHostLabels(ctx, host.ID, map[string]string{"-rack": "r1"})
+	mustIs(t, err, datastore.ErrInvalidLabel)
+	err = ds.SetHostLabels(ctx, host.ID, map[string]string{"rack": "r 1"})
+	mustIs(t, err, datastore.ErrInvalidLabel)
+	err = ds.SetHostLabels(ctx, host.ID+100, map[string]string{"rack": "r1"})
+	mustIs(t, err, datastore.ErrNotFound)
+
+	err = ds.DeleteHost(ctx, host.ID)
+	mustNil(t, err)
+	host = registerHost(t, ds, 1)
+	labels, err = ds.GetHostLabels(ctx, host.ID)
+	mustNil(t, err)
+	if len(labels) != 0 {
+		t.Fatalf("want no labels after re-registration, but got %+v", labels)
+	}
+}
+
+func testHostGroup(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+	other := registerHost(t, ds, 2)
+
+	group, err := ds.CreateHostGroup(ctx, "storage")
+	mustNil(t, err)
+	_, err = ds.CreateHostGroup(ctx, "storage")
+	mustIs(t, err, datastore.ErrConflict)
+	_, err = ds.CreateHostGroup(ctx, "bad group")
+	mustIs(t, err, datastore.ErrInvalidLabel)
+	got, err := ds.GetHostGroupByName(ctx, "storage")
+	mustNil(t, err)
+	if got.ID != group.ID {
+		t.Fatalf("want %+v, but got %+v", group, got)
+	}
+	_, err = ds.GetHostGroupByName(ctx, "unknown")
+	mustIs(t, err, datastore.ErrNotFound)
+
+	mustNil(t, ds.AddHostGroupMember(ctx, group.ID, host.ID))
+	mustNil(t, ds.AddHostGroupMember(ctx, group.ID, host.ID))
+	mustNil(t, ds.AddHostGroupMember(ctx, group.ID, other.ID))
+	mustIs(t, ds.AddHostGroupMember(ctx, group.ID, other.ID+100), datastore.ErrNotFound)
+	mustIs(t, ds.AddHostGroupMember(ctx, group.ID+100, host.ID), datastore.ErrNotFound)
+	hosts, err := ds.ListHostByGroup(ctx, group.ID)
+	mustNil(t, err)
+	if len(hosts) != 2 || hosts[0].ID != host.ID || hosts[1].ID != other.ID {
+		t.Fatalf("unexpected hosts: %+v", hosts)
+	}
+
+	mustNil(t, ds.RemoveHostGroupMember(ctx, group.ID, other.ID))
+	mustIs(t, ds.RemoveHostGroupMember(ctx, group.ID, other.ID), datastore.ErrNotFound)
+	groups, err := ds.ListHostGroupByHost(ctx, host.ID)
+	mustNil(t, err)
+	if len(groups) != 1 || groups[0].Name != "storage" {
+		t.Fatalf("unexpected groups: %+v", groups)
+	}
+	groups, err = ds.ListHostGroupByHost(ctx, other.ID)
+	mustNil(t, err)
+	if len(groups) != 0 {
+		t.Fatalf("want no groups, but got %+v", groups)
+	}
+
+	mustNil(t, ds.DeleteHostGroup(ctx, group.ID))
+	mustIs(t, ds.DeleteHostGroup(ctx, group.ID), datastore.ErrNotFound)
+	groups, err = ds.ListHostGroup(ctx)
+	mustNil(t, err)
+	if len(groups) != 0 {
+		t.Fatalf("want no groups, but got %+v", groups)
+	}
+	groups, err = ds.ListHostGroupByHost(ctx, host.ID)
+	mustNil(t, err)
+	if len(groups) != 0 {
+		t.Fatalf("want no groups after the deletion, but got %+v", groups)
+	}
+}
+
+func testSelectorAssignment(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+	mustNil(t, ds.SetHostLabels(ctx, host.ID, map[string]string{"rack": "r1", "role": "compute"}))
+	group, err := ds.CreateHostGroup(ctx, "canary")
+	mustNil(t, err)
+
+	ids := map[string]int{}
+	for _, name := range []string{"product", "other", "selector", "group", "host"} {
+		p, err := ds.CreateBootProfile(ctx, httpd.BootProfile{Name: name, Kind: httpd.BootProfileKindLocal})
+		mustNil(t, err)
+		ids[name] = p.ID
+	}
+
+	err = ds.AssignBootProfile(ctx, httpd.ScopeSelector, "rack in (r1", ids["selector"])
+	mustIs(t, err, datastore.ErrInvalidSelector)
+	err = ds.AssignBootProfile(ctx, httpd.ScopeSelector, "", ids["selector"])
+	mustIs(t, err, datastore.ErrInvalidSelector)
+	err = ds.AssignBootProfile(ctx, httpd.ScopeGroup, "", ids["group"])
+	mustIs(t, err, datastore.ErrInvalidLabel)
+
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeSelector, "role=storage", ids["other"]))
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeGroup, "canary", ids["group"]))
+	for _, step := range []struct {
+		scope string
+		value string
+		name  string
+	}{
+		{httpd.ScopeProduct, host.Product, "product"},
+		{httpd.ScopeSelector, "role = compute, rack in (r2, r1), !gpu", "selector"},
+	} {
+		mustNil(t, ds.AssignBootProfile(ctx, step.scope, step.value, ids[step.name]))
+		p, err := ds.GetBootProfileByHost(ctx, *host)
+		mustNil(t, err)
+		if p.Name != step.name {
+			t.Fatalf("after assigning to %s %s, want %s, but got %s", step.scope, step.value, step.name, p.Name)
+		}
+	}
+
+	// The selector is stored in the canonical form, so the same selector
+	// written differently replaces the assignment.
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeSelector, "!gpu,rack in (r1,r2),role=compute", ids["other"]))
+	p, err := ds.GetBootProfileByHost(ctx, *host)
+	mustNil(t, err)
+	if p.Name != "other" {
+		t.Fatalf("want other, but got %s", p.Name)
+	}
+
+	// The labels changed after the assignment are matched.
+	mustNil(t, ds.SetHostLabels(ctx, host.ID, map[string]string{"rack": "r1", "role": "compute", "gpu": "a100"}))
+	p, err = ds.GetBootProfileByHost(ctx, *host)
+	mustNil(t, err)
+	if p.Name != "product" {
+		t.Fatalf("want product, but got %s", p.Name)
+	}
+
+	mustNil(t, ds.AddHostGroupMember(ctx, group.ID, host.ID))
+	p, err = ds.GetBootProfileByHost(ctx, *host)
+	mustNil(t, err)
+	if p.Name != "group" {
+		t.Fatalf("want group, but got %s", p.Name)
+	}
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeHost, host.UUID.String(), ids["host"]))
+	p, err = ds.GetBootProfileByHost(ctx, *host)
+	mustNil(t, err)
+	if p.Name != "host" {
+		t.Fatalf("want host, but got %s", p.Name)
+	}
+
+	ut, err := ds.CreateUserdataTemplate(ctx, httpd.UserdataTemplate{Name: "gpu", Template: "#cloud-config"})
+	mustNil(t, err)
+	mustNil(t, ds.AssignUserdataTemplate(ctx, httpd.ScopeSelector, "gpu", ut.ID))
+	got, err := ds.GetUserdataTemplateByHost(ctx, *host)
+	mustNil(t, err)
+	if got.ID != ut.ID {
+		t.Fatalf("want %+v, but got %+v", ut, got)
+	}
+}
+
+func testUserAccess(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+	other := registerHost(t, ds, 2)
+	mustNil(t, ds.SetHostLabels(ctx, host.ID, map[string]string{"team": "db"}))
+
+	// Users are provisioned by the import only.
+	dump, err := ds.Export(ctx)
+	mustNil(t, err)
+	dump.Users = []httpd.User{{ID: 1, Name: "alice"}, {ID: 2, Name: "bob"}}
+	mustNil(t, ds.Import(ctx, *dump))
+
+	users, err := ds.ListUserByHost(ctx, *other)
+	mustNil(t, err)
+	if len(users) != 2 {
+		t.Fatalf("want every user without the access granted, but got %+v", users)
+	}
+
+	mustIs(t, ds.GrantUserAccess(ctx, 3, httpd.ScopeDefault, ""), datastore.ErrNotFound)
+	mustIs(t, ds.GrantUserAccess(ctx, 1, httpd.ScopeSelector, "team=("), datastore.ErrInvalidSelector)
+	mustNil(t, ds.GrantUserAccess(ctx, 1, httpd.ScopeSelector, "team=db"))
+	mustNil(t, ds.GrantUserAccess(ctx, 1, httpd.ScopeSelector, "team = db"))
+	access, err := ds.ListUserAccess(ctx, 1)
+	mustNil(t, err)
+	if len(access) != 1 || access[0].Scope != httpd.ScopeSelector || access[0].Value != "team=db" || access[0].TargetID != 1 {
+		t.Fatalf("unexpected access: %+v", access)
+	}
+
+	for _, tc := range []struct {
+		host httpd.Host
+		want []string
+	}{
+		{*host, []string{"alice", "bob"}},
+		{*other, []string{"bob"}},
+	} {
+		users, err := ds.ListUserByHost(ctx, tc.host)
+		mustNil(t, err)
+		var names []string
+		for _, u := range users {
+			names = append(names, u.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(tc.want, ",") {
+			t.Fatalf("want %v for %s, but got %v", tc.want, tc.host.Name, names)
+		}
+	}
+
+	mustNil(t, ds.RevokeUserAccess(ctx, 1, httpd.ScopeSelector, "team=db"))
+	mustIs(t, ds.RevokeUserAccess(ctx, 1, httpd.ScopeSelector, "team=db"), datastore.ErrNotFound)
+	users, err = ds.ListUserByHost(ctx, *other)
+	mustNil(t, err)
+	if len(users) != 2 {
+		t.Fatalf("want every user after the revocation, but got %+v", users)
+	}
+}
+
+func testRediscover(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+	other := registerHost(t, ds, 2)
+
+	_, err := ds.RediscoverHost(ctx, host.ID, host.ServiceLeaseID, host.ManagementLeaseID)
+	mustIs(t, err, httpd.ErrInvalidHostStateTransition)
+	_, err = ds.RediscoverHost(ctx, host.ID+100, 0, 0)
+	mustIs(t, err, datastore.ErrNotFound)
+
+	_, err = ds.UpdateHostState(ctx, host.ID, httpd.HostStateDecommissioning)
+	mustNil(t, err)
+	_, err = ds.DecommissionHost(ctx, host.ID)
+	mustNil(t, err)
+	// The leases of another host are not given.
+	_, err = ds.RediscoverHost(ctx, host.ID, other.ServiceLeaseID, other.ManagementLeaseID)
+	mustIs(t, err, datastore.ErrConflict)
+
+	sl, err := ds.CreateLeaseFromServiceSubnet(ctx, mac(1))
+	mustNil(t, err)
+	ml, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(1))
+	mustNil(t, err)
+	got, err := ds.RediscoverHost(ctx, host.ID, sl.ID, ml.ID)
+	mustNil(t, err)
+	if got.State != httpd.HostStateDiscovered || got.ServiceLeaseID != sl.ID || got.ManagementLeaseID != ml.ID {
+		t.Fatalf("unexpected host: %+v", got)
+	}
+	stored, err := ds.GetHostByUUID(ctx, host.UUID)
+	mustNil(t, err)
+	if stored.State != got.State || stored.ServiceLeaseID != sl.ID || stored.ManagementLeaseID != ml.ID {
+		t.Fatalf("want %+v, but got %+v", got, stored)
+	}
+	transitions, err := ds.ListHostStateTransition(ctx, host.ID)
+	mustNil(t, err)
+	if last := transitions[len(transitions)-1]; last.From != httpd.HostStateWiped || last.To != httpd.HostStateDiscovered {
+		t.Fatalf("unexpected transition: %+v", last)
+	}
+}
+
+func testDecommission(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+	token, err := ds.IssueHostToken(ctx, host.ID)
+	mustNil(t, err)
+
+	_, err = ds.DecommissionHost(ctx, host.ID)
+	mustIs(t, err, httpd.ErrInvalidHostStateTransition)
+	_, err = ds.DecommissionHost(ctx, host.ID+100)
+	mustIs(t, err, datastore.ErrNotFound)
+
+	_, err = ds.UpdateHostState(ctx, host.ID, httpd.HostStateDecommissioning)
+	mustNil(t, err)
+	got, err := ds.DecommissionHost(ctx, host.ID)
+	mustNil(t, err)
+	if got.State != httpd.HostStateWiped || got.ServiceLeaseID != 0 || got.ManagementLeaseID != 0 {
+		t.Fatalf("unexpected host: %+v", got)
+	}
+	_, err = ds.GetLeaseByID(ctx, host.ManagementLeaseID)
+	mustIs(t, err, datastore.ErrNotFound)
+	_, err = ds.GetHostByToken(ctx, token)
+	mustIs(t, err, datastore.ErrNotFound)
+
+	_, err = ds.CreateHostInventory(ctx, host.ID, httpd.Inventory{})
+	mustNil(t, err)
+	mustNil(t, ds.DeleteHost(ctx, host.ID))
+	_, err = ds.GetHostByUUID(ctx, host.UUID)
+	mustIs(t, err, datastore.ErrNotFound)
+	his, err := ds.ListHostInventory(ctx, host.ID)
+	mustNil(t, err)
+	if len(his) != 0 {
+		t.Fatalf("want no inventory, but got %+v", his)
+	}
+	err = ds.DeleteHost(ctx, host.ID)
+	mustIs(t, err, datastore.ErrNotFound)
+
+	second := registerHost(t, ds, 2)
+	mustNil(t, ds.DeleteHost(ctx, second.ID))
+	leases, err := ds.ListLease(ctx)
+	mustNil(t, err)
+	if len(leases) != 0 {
+		t.Fatalf("want no lease, but got %+v", leases)
+	}
+}
+
+func testBootEvent(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+	lease, err := ds.GetLeaseFromManagementSubnet(ctx, mac(1))
+	mustNil(t, err)
+
+	old := time.Now().UTC().Add(-time.Hour)
+	for _, e := range []httpd.BootEvent{
+		{MACAddress: mac(1).String(), Protocol: httpd.BootEventProtocolDHCP, Name: "discover", Outcome: httpd.BootEventOutcomeOK, CreatedAt: old},
+		{MACAddress: mac(2).String(), Protocol: httpd.BootEventProtocolDHCP, Name: "discover", Outcome: httpd.BootEventOutcomeOK},
+		{IPAddress: lease.IPAddress.String(), Protocol: httpd.BootEventProtocolTFTP, Name: "ipxe.efi", Outcome: httpd.BootEventOutcomeOK},
+		{IPAddress: lease.IPAddress.String(), Protocol: httpd.BootEventProtocolHTTP, Name: "/ipxe", Outcome: httpd.BootEventOutcomeError},
+	} {
+		mustNil(t, ds.RecordBootEvent(ctx, e))
+	}
+
+	events, err := ds.ListBootEventByHost(ctx, host.ID, 10)
+	mustNil(t, err)
+	if len(events) != 3 || events[0].Name != "discover" || events[2].Name != "/ipxe" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	events, err = ds.ListBootEventByHost(ctx, host.ID, 2)
+	mustNil(t, err)
+	if len(events) != 2 || events[0].Name != "ipxe.efi" || events[1].Name != "/ipxe" {
+		t.Fatalf("want the latest 2 events, but got %+v", events)
+	}
+
+	mustNil(t, ds.PruneBootEvent(ctx, old.Add(time.Minute)))
+	events, err = ds.ListBootEventByHost(ctx, host.ID, 10)
+	mustNil(t, err)
+	if len(events) != 2 {
+		t.Fatalf("want 2 events after pruning, but got %+v", events)
+	}
+}
+
+func testExportImport(t *testing.T, ds datastore.Datastore) {
+	ctx := context.Background()
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+	_, err := ds.UpdateHostState(ctx, host.ID, httpd.HostStateProvisioning)
+	mustNil(t, err)
+	mustNil(t, ds.RecordPhoneHome(ctx, host.ID, "i-1", []httpd.HostKey{{Type: "rsa", Key: "rsa-1"}}))
+	token, err := ds.IssueHostToken(ctx, host.ID)
+	mustNil(t, err)
+	_, err = ds.CreateHostInventory(ctx, host.ID, httpd.Inventory{Serial: "s1", Disks: []httpd.Disk{{Name: "sda"}}})
+	mustNil(t, err)
+	_, err = ds.CreateWipeReport(ctx, host.ID, httpd.WipeReport{Disks: []httpd.DiskWipeResult{{Name: "sda", Success: true}}})
+	mustNil(t, err)
+	_, err = ds.SetBMCCredential(ctx, httpd.BMCCredential{HostID: host.ID, Driver: httpd.BMCDriverIPMI, Address: "10.0.0.200", Username: "admin", Password: "secret"})
+	mustNil(t, err)
+	bl, err := ds.CreateLeaseFromBMCSubnet(ctx, mac(1))
+	mustNil(t, err)
+	bmc, err := ds.RecordBMC(ctx, mac(1), "iDRAC", "bmc-1", bl.ID)
+	mustNil(t, err)
+	mustNil(t, ds.LinkBMC(ctx, bmc.ID, host.ID))
+	p, err := ds.CreateBootProfile(ctx, httpd.BootProfile{Name: "local", Kind: httpd.BootProfileKindLocal})
+	mustNil(t, err)
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeProduct, host.Product, p.ID))
+	ut, err := ds.CreateUserdataTemplate(ctx, httpd.UserdataTemplate{Name: "default", Template: "#cloud-config"})
+	mustNil(t, err)
+	mustNil(t, ds.AssignUserdataTemplate(ctx, httpd.ScopeDefault, "", ut.ID))
+	np, err := ds.CreateNetworkProfile(ctx, httpd.NetworkProfile{Name: "untagged", BondDriver: "ixgbe"})
+	mustNil(t, err)
+	mustNil(t, ds.AssignNetworkProfile(ctx, httpd.ScopeHost, host.UUID.String(), np.ID))
+	mustNil(t, ds.SetHostLabels(ctx, host.ID, map[string]string{"rack": "r1", "role": "compute"}))
+	group, err := ds.CreateHostGroup(ctx, "canary")
+	mustNil(t, err)
+	mustNil(t, ds.AddHostGroupMember(ctx, group.ID, host.ID))
+	mustNil(t, ds.AssignBootProfile(ctx, httpd.ScopeSelector, "role=compute", p.ID))
+	mustNil(t, ds.RecordBootEvent(ctx, httpd.BootEvent{MACAddress: mac(1).String(), Protocol: httpd.BootEventProtocolDHCP, Name: "discover", Outcome: httpd.BootEventOutcomeOK}))
+	wiped := registerHost(t, ds, 2)
+	_, err = ds.UpdateHostState(ctx, wiped.ID, httpd.HostStateDecommissioning)
+	mustNil(t, err)
+	_, err = ds.DecommissionHost(ctx, wiped.ID)
+	mustNil(t, err)
+
+	dump, err := ds.Export(ctx)
+	mustNil(t, err)
+	if dump.Version != datastore.DumpVersion || len(dump.Hosts) != 2 || len(dump.BMCCredentials) != 1 || dump.BMCCredentials[0].Password != "secret" || len(dump.HostLabels) != 2 || len(dump.HostGroupMembers) != 1 || len(dump.NetworkProfileAssignments) != 1 {
+		t.Fatalf("unexpected dump: %+v", dump)
+	}
+	// The audit log is kept by the import, so it is compared separately.
+	auditLog := dump.AuditLog
+	dump.AuditLog = nil
+	want, err := json.Marshal(dump)
+	mustNil(t, err)
+
+	// The state after the export is replaced by the import.
+	registerHost(t, ds, 3)
+	_, err = ds.CreateBootProfile(ctx, httpd.BootProfile{Name: "rescue", Kind: httpd.BootProfileKindRescue})
+	mustNil(t, err)
+	_, err = ds.CreateHostGroup(ctx, "other")
+	mustNil(t, err)
+
+	var decoded datastore.Dump
+	mustNil(t, json.Unmarshal(want, &decoded))
+	mustNil(t, ds.Import(ctx, decoded))
+	dump, err = ds.Export(ctx)
+	mustNil(t, err)
+	if n := len(dump.AuditLog); n <= len(auditLog) || dump.AuditLog[n-1].Action != datastore.AuditImport {
+		t.Fatalf("unexpected audit log: %+v", dump.AuditLog)
+	}
+	dump.AuditLog = nil
+	got, err := json.Marshal(dump)
+	mustNil(t, err)
+	if !bytes.Equal(want, got) {
+		t.Fatalf("want %s, but got %s", want, got)
+	}
+
+	_, err = ds.GetHostByUUID(ctx, hostUUID(3))
+	mustIs(t, err, datastore.ErrNotFound)
+	got2, err := ds.GetHostByToken(ctx, token)
+	mustNil(t, err)
+	if got2.ID != host.ID {
+		t.Fatalf("want %+v, but got %+v", host, got2)
+	}
+	profile, err := ds.GetBootProfileByHost(ctx, *host)
+	mustNil(t, err)
+	if profile.ID != p.ID {
+		t.Fatalf("want %+v, but got %+v", p, profile)
+	}
+	next, err := ds.CreateHostGroup(ctx, "next")
+	mustNil(t, err)
+	if next.ID <= group.ID {
+		t.Fatalf("unexpected group: %+v", next)
+	}
+	third := registerHost(t, ds, 3)
+	if third.ID <= wiped.ID || !strings.HasSuffix(third.Name, fmt.Sprintf("%04d", third.ID)) {
+		t.Fatalf("unexpected host: %+v", third)
+	}
+}
+
+func testAudit(t *testing.T, ds datastore.Datastore) {
+	ctx := datastore.WithActor(context.Background(), "test")
+	createSubnets(t, ds)
+	host := registerHost(t, ds, 1)
+	other := registerHost(t, ds, 2)
+	_, err := ds.UpdateHostState(ctx, host.ID, httpd.HostStateProvisioning)
+	mustNil(t, err)
+
+	entries, err := ds.ListAuditEntry(ctx, datastore.AuditFilter{HostID: host.ID})
+	mustNil(t, err)
+	if len(entries) != 2 || entries[0].Action != datastore.AuditHostRegister || entries[1].Action != datastore.AuditHostStateUpdate {
+		t.Fatalf("unexpected audit entries: %+v", entries)
+	}
+	if entries[0].Actor != datastore.ActorUnknown || entries[1].Actor != "test" {
+		t.Fatalf("unexpected actors: %+v", entries)
+	}
+	var before, after httpd.Host
+	mustNil(t, json.Unmarshal(entries[1].Before, &before))
+	mustNil(t, json.Unmarshal(entries[1].After, &after))
+	if before.State != httpd.HostStateDiscovered || after.State != httpd.HostStateProvisioning {
+		t.Fatalf("unexpected values: %s, %s", entries[1].Before, entries[1].After)
+	}
+
+	// The entry of an unchanged BMC is not recorded.
+	lease, err := ds.CreateLeaseFromBMCSubnet(ctx, mac(1))
+	mustNil(t, err)
+	_, err = ds.RecordBMC(ctx, mac(1), "iDRAC", "bmc-1", lease.ID)
+	mustNil(t, err)
+	_, err = ds.RecordBMC(ctx, mac(1), "iDRAC", "bmc-1", lease.ID)
+	mustNil(t, err)
+	entries, err = ds.ListAuditEntry(ctx, datastore.AuditFilter{Limit: 1})
+	mustNil(t, err)
+	if len(entries) != 1 || entries[0].Action != datastore.AuditBMCRecord || string(entries[0].Before) != "null" {
+		t.Fatalf("unexpected audit entries: %+v", entries)
+	}
+
+	// The password of the BMC credential is not recorded.
+	_, err = ds.SetBMCCredential(ctx, httpd.BMCCredential{HostID: host.ID, Driver: httpd.BMCDriverIPMI, Address: "10.0.0.200", Username: "admin", Password: "secret"})
+	mustNil(t, err)
+	entries, err = ds.ListAuditEntry(ctx, datastore.AuditFilter{Limit: 1})
+	mustNil(t, err)
+	if len(entries) != 1 || bytes.Contains(entries[0].After, []byte("secret")) {
+		t.Fatalf("unexpected audit entries: %+v", entries)
+	}
+
+	all, err := ds.ListAuditEntry(ctx, datastore.AuditFilter{})
+	mustNil(t, err)
+	for i := 1; i < len(all); i++ {
+		if all[i].ID <= all[i-1].ID {
+			t.Fatalf("unordered audit entries: %+v", all)
+		}
+	}
+	entries, err = ds.ListAuditEntry(ctx, datastore.AuditFilter{Until: all[0].CreatedAt})
+	mustNil(t, err)
+	if len(entries) != 0 {
+		t.Fatalf("unexpected audit entries: %+v", entries)
+	}
+	entries, err = ds.ListAuditEntry(ctx, datastore.AuditFilter{Since: all[len(all)-1].CreatedAt})
+	mustNil(t, err)
+	if len(entries) == 0 || entries[len(entries)-1].ID != all[len(all)-1].ID {
+		t.Fatalf("unexpected audit entries: %+v", entries)
+	}
+
+	// The entries are kept after the host is deleted.
+	mustNil(t, ds.DeleteHost(ctx, other.ID))
+	entries, err = ds.ListAuditEntry(ctx, datastore.AuditFilter{HostID: other.ID})
+	mustNil(t, err)
+	if len(entries) != 2 || entries[0].Action != datastore.AuditHostRegister || entries[1].Action != datastore.AuditHostDelete || string(entries[1].After) != "null" {
+		t.Fatalf("unexpected audit entries: %+v", entries)
+	}
+
+	dump, err := ds.Export(ctx)
+	mustNil(t, err)
+	mustNil(t, ds.Import(datastore.WithActor(ctx, "cli:import"), *dump))
+	entries, err = ds.ListAuditEntry(ctx, datastore.AuditFilter{})
+	mustNil(t, err)
+	last := entries[len(entries)-1]
+	if len(entries) != len(dump.AuditLog)+1 || last.Action != datastore.AuditImport || last.Actor != "cli:import" {
+		t.Fatalf("unexpected audit entries: %+v", entries)
+	}
+}
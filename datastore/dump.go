@@ -0,0 +1,112 @@
+package datastore
+
+import (
+	"context"
+	"time"
+
+	"github.com/lovi-cloud/ursa/dhcpd"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// DumpVersion is the version of the format of Dump. Increment it when a
+// change of Dump can not be read by the previous version.
+const DumpVersion = 1
+
+// Dump is the full state of a datastore. It does not depend on the backend,
+// so the dump of a datastore can be imported to another kind of datastore.
+// A new table must be added to Dump and to Export and Import of every
+// datastore. The audit log is append-only, so Import keeps the existing
+// entries and imports AuditLog only into an empty audit log.
+type Dump struct {
+	Version int `json:"version"`
+
+	Subnets                     []dhcpd.Subnet              `json:"subnets"`
+	Leases                      []dhcpd.Lease               `json:"leases"`
+	Hosts                       []httpd.Host                `json:"hosts"`
+	HostStateTransitions        []httpd.HostStateTransition `json:"host_state_transitions"`
+	HostKeys                    []httpd.HostKey             `json:"host_keys"`
+	HostTokens                  []HostToken                 `json:"host_tokens"`
+	HostInventories             []httpd.HostInventory       `json:"host_inventories"`
+	HostWipeReports             []httpd.HostWipeReport      `json:"host_wipe_reports"`
+	BMCCredentials              []BMCCredential             `json:"bmc_credentials"`
+	BMCs                        []dhcpd.BMC                 `json:"bmcs"`
+	BootProfiles                []httpd.BootProfile         `json:"boot_profiles"`
+	BootProfileAssignments      []Assignment                `json:"boot_profile_assignments"`
+	UserdataTemplates           []httpd.UserdataTemplate    `json:"userdata_templates"`
+	UserdataTemplateAssignments []Assignment                `json:"userdata_template_assignments"`
+	NetworkProfiles             []httpd.NetworkProfile      `json:"network_profiles"`
+	NetworkProfileAssignments   []Assignment                `json:"network_profile_assignments"`
+	Users                       []httpd.User                `json:"users"`
+	Keys                        []httpd.Key                 `json:"keys"`
+	BootEvents                  []httpd.BootEvent           `json:"boot_events"`
+	AuditLog                    []AuditEntry                `json:"audit_log"`
+	HostnameSequences           []HostnameSequence          `json:"hostname_sequences"`
+	HostLabels                  []HostLabel                 `json:"host_labels"`
+	HostGroups                  []httpd.HostGroup           `json:"host_groups"`
+	HostGroupMembers            []HostGroupMember           `json:"host_group_members"`
+	UserAccess                  []Assignment                `json:"user_access"`
+}
+
+// Summary returns the number of the main objects in the dump.
+func (d Dump) Summary() map[string]int {
+	return map[string]int{
+		"version":            d.Version,
+		"subnets":            len(d.Subnets),
+		"leases":             len(d.Leases),
+		"hosts":              len(d.Hosts),
+		"bmcs":               len(d.BMCs),
+		"boot_profiles":      len(d.BootProfiles),
+		"userdata_templates": len(d.UserdataTemplates),
+		"network_profiles":   len(d.NetworkProfiles),
+		"users":              len(d.Users),
+		"host_groups":        len(d.HostGroups),
+		"audit_log":          len(d.AuditLog),
+	}
+}
+
+// HostToken is the hash of the metadata token of the host.
+type HostToken struct {
+	HostID    int       `db:"host_id" json:"host_id"`
+	TokenHash string    `db:"token_hash" json:"token_hash"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// BMCCredential is httpd.BMCCredential with the password, which is never
+// encoded to JSON by httpd.BMCCredential.
+type BMCCredential struct {
+	httpd.BMCCredential
+	Password string `json:"password"`
+}
+
+// HostnameSequence is the last value of the hostname sequence of the scope.
+type HostnameSequence struct {
+	Scope string `db:"scope" json:"scope"`
+	Value int    `db:"value" json:"value"`
+}
+
+// HostLabel is a label of the host.
+type HostLabel struct {
+	HostID int    `db:"host_id" json:"host_id"`
+	Key    string `db:"key" json:"key"`
+	Value  string `db:"value" json:"value"`
+}
+
+// HostGroupMember is a host in the group.
+type HostGroupMember struct {
+	GroupID int `db:"group_id" json:"group_id"`
+	HostID  int `db:"host_id" json:"host_id"`
+}
+
+// Assignment assigns the boot profile, the user-data template or the user
+// access of TargetID to the scope.
+type Assignment struct {
+	Scope    string `db:"scope" json:"scope"`
+	Value    string `db:"value" json:"value"`
+	TargetID int    `db:"target_id" json:"target_id"`
+}
+
+// Backuper is implemented by the datastore that can write a consistent copy
+// of itself while it is in use.
+type Backuper interface {
+	Backup(ctx context.Context, path string) error
+}
@@ -0,0 +1,41 @@
+package datastore
+
+import "errors"
+
+// Sentinel errors returned by every implementation of Datastore. Test them
+// with errors.Is.
+var (
+	// ErrNotFound is returned when the record does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when the record conflicts with an existing
+	// record, e.g. a duplicated unique key.
+	ErrConflict = errors.New("conflict")
+	// ErrInvalidHostname is returned when the hostname is not a DNS label.
+	ErrInvalidHostname = errors.New("invalid hostname")
+	// ErrInvalidLabel is returned when the key or the value of a label, or
+	// the name of a host group is invalid.
+	ErrInvalidLabel = errors.New("invalid label")
+	// ErrInvalidSelector is returned when the label selector is malformed.
+	ErrInvalidSelector = errors.New("invalid selector")
+)
+
+// Error classifies an error of the backend as a sentinel error. The error
+// of the backend is kept for logging.
+type Error struct {
+	Sentinel error
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error of the backend.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the sentinel error.
+func (e *Error) Is(target error) bool {
+	return target == e.Sentinel
+}
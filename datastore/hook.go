@@ -0,0 +1,617 @@
+package datastore
+
+import (
+	"context"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/lovi-cloud/ursa/dhcpd"
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/types"
+)
+
+// Hook is called before a method of the Datastore with the method name. The
+// returned context is passed to the method and done is called with the
+// error of the method.
+type Hook func(ctx context.Context, method string) (context.Context, func(err error))
+
+// instrumented calls hooks around every method of the Datastore.
+type instrumented struct {
+	Datastore
+	hooks []Hook
+}
+
+// Instrument wraps ds to call hooks around its methods.
+func Instrument(ds Datastore, hooks ...Hook) Datastore {
+	return &instrumented{
+		Datastore: ds,
+		hooks:     hooks,
+	}
+}
+
+func (d *instrumented) before(ctx context.Context, method string) (context.Context, func(err error)) {
+	dones := make([]func(err error), len(d.hooks))
+	for i, hook := range d.hooks {
+		ctx, dones[i] = hook(ctx, method)
+	}
+	return ctx, func(err error) {
+		for i := len(dones) - 1; i >= 0; i-- {
+			dones[i](err)
+		}
+	}
+}
+
+func (d *instrumented) GetManagementSubnet(ctx context.Context) (*dhcpd.Subnet, error) {
+	ctx, done := d.before(ctx, "GetManagementSubnet")
+	ret, err := d.Datastore.GetManagementSubnet(ctx)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetServiceSubnet(ctx context.Context) (*dhcpd.Subnet, error) {
+	ctx, done := d.before(ctx, "GetServiceSubnet")
+	ret, err := d.Datastore.GetServiceSubnet(ctx)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) CreateManagementSubnet(ctx context.Context, network types.IPNet, start, end types.IP) (*dhcpd.Subnet, error) {
+	ctx, done := d.before(ctx, "CreateManagementSubnet")
+	ret, err := d.Datastore.CreateManagementSubnet(ctx, network, start, end)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) CreateServiceSubnet(ctx context.Context, network types.IPNet, start, end, gateway, dnsServer types.IP) (*dhcpd.Subnet, error) {
+	ctx, done := d.before(ctx, "CreateServiceSubnet")
+	ret, err := d.Datastore.CreateServiceSubnet(ctx, network, start, end, gateway, dnsServer)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetBMCSubnet(ctx context.Context) (*dhcpd.Subnet, error) {
+	ctx, done := d.before(ctx, "GetBMCSubnet")
+	ret, err := d.Datastore.GetBMCSubnet(ctx)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) CreateBMCSubnet(ctx context.Context, network types.IPNet, start, end types.IP) (*dhcpd.Subnet, error) {
+	ctx, done := d.before(ctx, "CreateBMCSubnet")
+	ret, err := d.Datastore.CreateBMCSubnet(ctx, network, start, end)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetLeaseByID(ctx context.Context, id int) (*httpd.Lease, error) {
+	ctx, done := d.before(ctx, "GetLeaseByID")
+	ret, err := d.Datastore.GetLeaseByID(ctx, id)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetLeaseFromManagementSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	ctx, done := d.before(ctx, "GetLeaseFromManagementSubnet")
+	ret, err := d.Datastore.GetLeaseFromManagementSubnet(ctx, mac)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetLeaseFromServiceSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	ctx, done := d.before(ctx, "GetLeaseFromServiceSubnet")
+	ret, err := d.Datastore.GetLeaseFromServiceSubnet(ctx, mac)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) CreateLeaseFromManagementSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	ctx, done := d.before(ctx, "CreateLeaseFromManagementSubnet")
+	ret, err := d.Datastore.CreateLeaseFromManagementSubnet(ctx, mac)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) CreateLeaseFromServiceSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	ctx, done := d.before(ctx, "CreateLeaseFromServiceSubnet")
+	ret, err := d.Datastore.CreateLeaseFromServiceSubnet(ctx, mac)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetLeaseFromBMCSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	ctx, done := d.before(ctx, "GetLeaseFromBMCSubnet")
+	ret, err := d.Datastore.GetLeaseFromBMCSubnet(ctx, mac)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) CreateLeaseFromBMCSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	ctx, done := d.before(ctx, "CreateLeaseFromBMCSubnet")
+	ret, err := d.Datastore.CreateLeaseFromBMCSubnet(ctx, mac)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) ListLease(ctx context.Context) ([]dhcpd.Lease, error) {
+	ctx, done := d.before(ctx, "ListLease")
+	ret, err := d.Datastore.ListLease(ctx)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) DeleteLease(ctx context.Context, id int) error {
+	ctx, done := d.before(ctx, "DeleteLease")
+	err := d.Datastore.DeleteLease(ctx, id)
+	done(err)
+	return err
+}
+
+func (d *instrumented) CountLeaseBySubnet(ctx context.Context) (map[int]int, error) {
+	ctx, done := d.before(ctx, "CountLeaseBySubnet")
+	ret, err := d.Datastore.CountLeaseBySubnet(ctx)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) RegisterHost(ctx context.Context, serverID uuid.UUID, serial, product, manufacturer string, serviceLeaseID, managementLeaseID int) (*httpd.Host, error) {
+	ctx, done := d.before(ctx, "RegisterHost")
+	ret, err := d.Datastore.RegisterHost(ctx, serverID, serial, product, manufacturer, serviceLeaseID, managementLeaseID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetHostByAddress(ctx context.Context, address types.IP) (*httpd.Host, error) {
+	ctx, done := d.before(ctx, "GetHostByAddress")
+	ret, err := d.Datastore.GetHostByAddress(ctx, address)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetHostByUUID(ctx context.Context, serverID uuid.UUID) (*httpd.Host, error) {
+	ctx, done := d.before(ctx, "GetHostByUUID")
+	ret, err := d.Datastore.GetHostByUUID(ctx, serverID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetHostByName(ctx context.Context, name string) (*httpd.Host, error) {
+	ctx, done := d.before(ctx, "GetHostByName")
+	ret, err := d.Datastore.GetHostByName(ctx, name)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) UpdateHostState(ctx context.Context, hostID int, state string) (*httpd.Host, error) {
+	ctx, done := d.before(ctx, "UpdateHostState")
+	ret, err := d.Datastore.UpdateHostState(ctx, hostID, state)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) RenameHost(ctx context.Context, hostID int, name string) (*httpd.Host, error) {
+	ctx, done := d.before(ctx, "RenameHost")
+	ret, err := d.Datastore.RenameHost(ctx, hostID, name)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) ListHostStateTransition(ctx context.Context, hostID int) ([]httpd.HostStateTransition, error) {
+	ctx, done := d.before(ctx, "ListHostStateTransition")
+	ret, err := d.Datastore.ListHostStateTransition(ctx, hostID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) RecordPhoneHome(ctx context.Context, hostID int, instanceID string, keys []httpd.HostKey) error {
+	ctx, done := d.before(ctx, "RecordPhoneHome")
+	err := d.Datastore.RecordPhoneHome(ctx, hostID, instanceID, keys)
+	done(err)
+	return err
+}
+
+func (d *instrumented) ListHostKeyByHostID(ctx context.Context, hostID int) ([]httpd.HostKey, error) {
+	ctx, done := d.before(ctx, "ListHostKeyByHostID")
+	ret, err := d.Datastore.ListHostKeyByHostID(ctx, hostID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) IssueHostToken(ctx context.Context, hostID int) (string, error) {
+	ctx, done := d.before(ctx, "IssueHostToken")
+	ret, err := d.Datastore.IssueHostToken(ctx, hostID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetHostByToken(ctx context.Context, token string) (*httpd.Host, error) {
+	ctx, done := d.before(ctx, "GetHostByToken")
+	ret, err := d.Datastore.GetHostByToken(ctx, token)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) RevokeHostToken(ctx context.Context, hostID int) error {
+	ctx, done := d.before(ctx, "RevokeHostToken")
+	err := d.Datastore.RevokeHostToken(ctx, hostID)
+	done(err)
+	return err
+}
+
+func (d *instrumented) CreateWipeReport(ctx context.Context, hostID int, report httpd.WipeReport) (*httpd.HostWipeReport, error) {
+	ctx, done := d.before(ctx, "CreateWipeReport")
+	ret, err := d.Datastore.CreateWipeReport(ctx, hostID, report)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) ListWipeReport(ctx context.Context, hostID int) ([]httpd.HostWipeReport, error) {
+	ctx, done := d.before(ctx, "ListWipeReport")
+	ret, err := d.Datastore.ListWipeReport(ctx, hostID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) DecommissionHost(ctx context.Context, hostID int) (*httpd.Host, error) {
+	ctx, done := d.before(ctx, "DecommissionHost")
+	ret, err := d.Datastore.DecommissionHost(ctx, hostID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) RediscoverHost(ctx context.Context, hostID, serviceLeaseID, managementLeaseID int) (*httpd.Host, error) {
+	ctx, done := d.before(ctx, "RediscoverHost")
+	ret, err := d.Datastore.RediscoverHost(ctx, hostID, serviceLeaseID, managementLeaseID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) DeleteHost(ctx context.Context, hostID int) error {
+	ctx, done := d.before(ctx, "DeleteHost")
+	err := d.Datastore.DeleteHost(ctx, hostID)
+	done(err)
+	return err
+}
+
+func (d *instrumented) CountHostByState(ctx context.Context) (map[string]int, error) {
+	ctx, done := d.before(ctx, "CountHostByState")
+	ret, err := d.Datastore.CountHostByState(ctx)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetHostLabels(ctx context.Context, hostID int) (map[string]string, error) {
+	ctx, done := d.before(ctx, "GetHostLabels")
+	ret, err := d.Datastore.GetHostLabels(ctx, hostID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) SetHostLabels(ctx context.Context, hostID int, labels map[string]string) error {
+	ctx, done := d.before(ctx, "SetHostLabels")
+	err := d.Datastore.SetHostLabels(ctx, hostID, labels)
+	done(err)
+	return err
+}
+
+func (d *instrumented) CreateHostGroup(ctx context.Context, name string) (*httpd.HostGroup, error) {
+	ctx, done := d.before(ctx, "CreateHostGroup")
+	ret, err := d.Datastore.CreateHostGroup(ctx, name)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetHostGroupByName(ctx context.Context, name string) (*httpd.HostGroup, error) {
+	ctx, done := d.before(ctx, "GetHostGroupByName")
+	ret, err := d.Datastore.GetHostGroupByName(ctx, name)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) ListHostGroup(ctx context.Context) ([]httpd.HostGroup, error) {
+	ctx, done := d.before(ctx, "ListHostGroup")
+	ret, err := d.Datastore.ListHostGroup(ctx)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) DeleteHostGroup(ctx context.Context, groupID int) error {
+	ctx, done := d.before(ctx, "DeleteHostGroup")
+	err := d.Datastore.DeleteHostGroup(ctx, groupID)
+	done(err)
+	return err
+}
+
+func (d *instrumented) AddHostGroupMember(ctx context.Context, groupID, hostID int) error {
+	ctx, done := d.before(ctx, "AddHostGroupMember")
+	err := d.Datastore.AddHostGroupMember(ctx, groupID, hostID)
+	done(err)
+	return err
+}
+
+func (d *instrumented) RemoveHostGroupMember(ctx context.Context, groupID, hostID int) error {
+	ctx, done := d.before(ctx, "RemoveHostGroupMember")
+	err := d.Datastore.RemoveHostGroupMember(ctx, groupID, hostID)
+	done(err)
+	return err
+}
+
+func (d *instrumented) ListHostByGroup(ctx context.Context, groupID int) ([]httpd.Host, error) {
+	ctx, done := d.before(ctx, "ListHostByGroup")
+	ret, err := d.Datastore.ListHostByGroup(ctx, groupID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) ListHostGroupByHost(ctx context.Context, hostID int) ([]httpd.HostGroup, error) {
+	ctx, done := d.before(ctx, "ListHostGroupByHost")
+	ret, err := d.Datastore.ListHostGroupByHost(ctx, hostID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) RecordBootEvent(ctx context.Context, e httpd.BootEvent) error {
+	ctx, done := d.before(ctx, "RecordBootEvent")
+	err := d.Datastore.RecordBootEvent(ctx, e)
+	done(err)
+	return err
+}
+
+func (d *instrumented) ListBootEventByHost(ctx context.Context, hostID, limit int) ([]httpd.BootEvent, error) {
+	ctx, done := d.before(ctx, "ListBootEventByHost")
+	ret, err := d.Datastore.ListBootEventByHost(ctx, hostID, limit)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) PruneBootEvent(ctx context.Context, before time.Time) error {
+	ctx, done := d.before(ctx, "PruneBootEvent")
+	err := d.Datastore.PruneBootEvent(ctx, before)
+	done(err)
+	return err
+}
+
+func (d *instrumented) CreateHostInventory(ctx context.Context, hostID int, inventory httpd.Inventory) (*httpd.HostInventory, error) {
+	ctx, done := d.before(ctx, "CreateHostInventory")
+	ret, err := d.Datastore.CreateHostInventory(ctx, hostID, inventory)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetHostInventory(ctx context.Context, hostID, version int) (*httpd.HostInventory, error) {
+	ctx, done := d.before(ctx, "GetHostInventory")
+	ret, err := d.Datastore.GetHostInventory(ctx, hostID, version)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetLatestHostInventory(ctx context.Context, hostID int) (*httpd.HostInventory, error) {
+	ctx, done := d.before(ctx, "GetLatestHostInventory")
+	ret, err := d.Datastore.GetLatestHostInventory(ctx, hostID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) ListHostInventory(ctx context.Context, hostID int) ([]httpd.HostInventory, error) {
+	ctx, done := d.before(ctx, "ListHostInventory")
+	ret, err := d.Datastore.ListHostInventory(ctx, hostID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) SetBMCCredential(ctx context.Context, cred httpd.BMCCredential) (*httpd.BMCCredential, error) {
+	ctx, done := d.before(ctx, "SetBMCCredential")
+	ret, err := d.Datastore.SetBMCCredential(ctx, cred)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetBMCCredentialByHostID(ctx context.Context, hostID int) (*httpd.BMCCredential, error) {
+	ctx, done := d.before(ctx, "GetBMCCredentialByHostID")
+	ret, err := d.Datastore.GetBMCCredentialByHostID(ctx, hostID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) RecordBMC(ctx context.Context, mac types.HardwareAddr, vendorClass, hostname string, leaseID int) (*dhcpd.BMC, error) {
+	ctx, done := d.before(ctx, "RecordBMC")
+	ret, err := d.Datastore.RecordBMC(ctx, mac, vendorClass, hostname, leaseID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetBMCByMAC(ctx context.Context, mac types.HardwareAddr) (*dhcpd.BMC, error) {
+	ctx, done := d.before(ctx, "GetBMCByMAC")
+	ret, err := d.Datastore.GetBMCByMAC(ctx, mac)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetBMCByHostID(ctx context.Context, hostID int) (*dhcpd.BMC, error) {
+	ctx, done := d.before(ctx, "GetBMCByHostID")
+	ret, err := d.Datastore.GetBMCByHostID(ctx, hostID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) ListBMC(ctx context.Context) ([]dhcpd.BMC, error) {
+	ctx, done := d.before(ctx, "ListBMC")
+	ret, err := d.Datastore.ListBMC(ctx)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) LinkBMC(ctx context.Context, bmcID, hostID int) error {
+	ctx, done := d.before(ctx, "LinkBMC")
+	err := d.Datastore.LinkBMC(ctx, bmcID, hostID)
+	done(err)
+	return err
+}
+
+func (d *instrumented) CreateBootProfile(ctx context.Context, profile httpd.BootProfile) (*httpd.BootProfile, error) {
+	ctx, done := d.before(ctx, "CreateBootProfile")
+	ret, err := d.Datastore.CreateBootProfile(ctx, profile)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetBootProfileByName(ctx context.Context, name string) (*httpd.BootProfile, error) {
+	ctx, done := d.before(ctx, "GetBootProfileByName")
+	ret, err := d.Datastore.GetBootProfileByName(ctx, name)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetBootProfileByHost(ctx context.Context, host httpd.Host) (*httpd.BootProfile, error) {
+	ctx, done := d.before(ctx, "GetBootProfileByHost")
+	ret, err := d.Datastore.GetBootProfileByHost(ctx, host)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) ListBootProfile(ctx context.Context) ([]httpd.BootProfile, error) {
+	ctx, done := d.before(ctx, "ListBootProfile")
+	ret, err := d.Datastore.ListBootProfile(ctx)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) AssignBootProfile(ctx context.Context, scope, value string, profileID int) error {
+	ctx, done := d.before(ctx, "AssignBootProfile")
+	err := d.Datastore.AssignBootProfile(ctx, scope, value, profileID)
+	done(err)
+	return err
+}
+
+func (d *instrumented) CreateUserdataTemplate(ctx context.Context, t httpd.UserdataTemplate) (*httpd.UserdataTemplate, error) {
+	ctx, done := d.before(ctx, "CreateUserdataTemplate")
+	ret, err := d.Datastore.CreateUserdataTemplate(ctx, t)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetUserdataTemplateByName(ctx context.Context, name string) (*httpd.UserdataTemplate, error) {
+	ctx, done := d.before(ctx, "GetUserdataTemplateByName")
+	ret, err := d.Datastore.GetUserdataTemplateByName(ctx, name)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetUserdataTemplateByHost(ctx context.Context, host httpd.Host) (*httpd.UserdataTemplate, error) {
+	ctx, done := d.before(ctx, "GetUserdataTemplateByHost")
+	ret, err := d.Datastore.GetUserdataTemplateByHost(ctx, host)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) ListUserdataTemplate(ctx context.Context) ([]httpd.UserdataTemplate, error) {
+	ctx, done := d.before(ctx, "ListUserdataTemplate")
+	ret, err := d.Datastore.ListUserdataTemplate(ctx)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) AssignUserdataTemplate(ctx context.Context, scope, value string, templateID int) error {
+	ctx, done := d.before(ctx, "AssignUserdataTemplate")
+	err := d.Datastore.AssignUserdataTemplate(ctx, scope, value, templateID)
+	done(err)
+	return err
+}
+
+func (d *instrumented) CreateNetworkProfile(ctx context.Context, profile httpd.NetworkProfile) (*httpd.NetworkProfile, error) {
+	ctx, done := d.before(ctx, "CreateNetworkProfile")
+	ret, err := d.Datastore.CreateNetworkProfile(ctx, profile)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetNetworkProfileByName(ctx context.Context, name string) (*httpd.NetworkProfile, error) {
+	ctx, done := d.before(ctx, "GetNetworkProfileByName")
+	ret, err := d.Datastore.GetNetworkProfileByName(ctx, name)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GetNetworkProfileByHost(ctx context.Context, host httpd.Host) (*httpd.NetworkProfile, error) {
+	ctx, done := d.before(ctx, "GetNetworkProfileByHost")
+	ret, err := d.Datastore.GetNetworkProfileByHost(ctx, host)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) ListNetworkProfile(ctx context.Context) ([]httpd.NetworkProfile, error) {
+	ctx, done := d.before(ctx, "ListNetworkProfile")
+	ret, err := d.Datastore.ListNetworkProfile(ctx)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) AssignNetworkProfile(ctx context.Context, scope, value string, profileID int) error {
+	ctx, done := d.before(ctx, "AssignNetworkProfile")
+	err := d.Datastore.AssignNetworkProfile(ctx, scope, value, profileID)
+	done(err)
+	return err
+}
+
+func (d *instrumented) ListUser(ctx context.Context) ([]httpd.User, error) {
+	ctx, done := d.before(ctx, "ListUser")
+	ret, err := d.Datastore.ListUser(ctx)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) ListKeyByUserID(ctx context.Context, userID int) ([]httpd.Key, error) {
+	ctx, done := d.before(ctx, "ListKeyByUserID")
+	ret, err := d.Datastore.ListKeyByUserID(ctx, userID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) GrantUserAccess(ctx context.Context, userID int, scope, value string) error {
+	ctx, done := d.before(ctx, "GrantUserAccess")
+	err := d.Datastore.GrantUserAccess(ctx, userID, scope, value)
+	done(err)
+	return err
+}
+
+func (d *instrumented) RevokeUserAccess(ctx context.Context, userID int, scope, value string) error {
+	ctx, done := d.before(ctx, "RevokeUserAccess")
+	err := d.Datastore.RevokeUserAccess(ctx, userID, scope, value)
+	done(err)
+	return err
+}
+
+func (d *instrumented) ListUserAccess(ctx context.Context, userID int) ([]Assignment, error) {
+	ctx, done := d.before(ctx, "ListUserAccess")
+	ret, err := d.Datastore.ListUserAccess(ctx, userID)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) ListUserByHost(ctx context.Context, host httpd.Host) ([]httpd.User, error) {
+	ctx, done := d.before(ctx, "ListUserByHost")
+	ret, err := d.Datastore.ListUserByHost(ctx, host)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) ListAuditEntry(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	ctx, done := d.before(ctx, "ListAuditEntry")
+	ret, err := d.Datastore.ListAuditEntry(ctx, filter)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) Export(ctx context.Context) (*Dump, error) {
+	ctx, done := d.before(ctx, "Export")
+	ret, err := d.Datastore.Export(ctx)
+	done(err)
+	return ret, err
+}
+
+func (d *instrumented) Import(ctx context.Context, dump Dump) error {
+	ctx, done := d.before(ctx, "Import")
+	err := d.Datastore.Import(ctx, dump)
+	done(err)
+	return err
+}
@@ -0,0 +1,196 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/types"
+)
+
+// DefaultHostnameTemplate names the hosts prefixNNNN by their ids.
+const DefaultHostnameTemplate = `{{.Prefix}}{{printf "%04d" .ID}}`
+
+// HostnameData is the data of a hostname template.
+type HostnameData struct {
+	Prefix string
+	// ID is the id of the host, which is never reused.
+	ID int
+	// ProductSeq is the sequence number of the host in the hosts of the
+	// same product, starting at 1. It is never reused.
+	ProductSeq   int
+	UUID         string
+	Serial       string
+	Product      string
+	Manufacturer string
+	// Switch and SwitchPort are the LLDP neighbor of the management NIC in
+	// the latest inventory. They are empty until the inventory is posted,
+	// e.g. when the host is registered.
+	Switch     string
+	SwitchPort string
+	// Labels are the labels of the host, and Rack and Position are the
+	// labels LabelRack and LabelPosition. They are empty when the host is
+	// registered, so they are used by regenerating the name after the
+	// labels are set.
+	Labels   map[string]string
+	Rack     string
+	Position string
+}
+
+// The labels of the location of the host in HostnameData.
+const (
+	LabelRack     = "rack"
+	LabelPosition = "position"
+)
+
+// NewHostnameData returns the data of the host. inventory and labels may be
+// nil.
+func NewHostnameData(host httpd.Host, productSeq int, inventory *httpd.Inventory, mac types.HardwareAddr, labels map[string]string) HostnameData {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	d := HostnameData{
+		ID:           host.ID,
+		ProductSeq:   productSeq,
+		UUID:         host.UUID.String(),
+		Serial:       host.Serial,
+		Product:      host.Product,
+		Manufacturer: host.Manufacturer,
+		Labels:       labels,
+		Rack:         labels[LabelRack],
+		Position:     labels[LabelPosition],
+	}
+	if n := lldpNeighbor(inventory, mac); n != nil {
+		d.Switch = n.SystemName
+		d.SwitchPort = n.PortID
+	}
+	return d
+}
+
+// lldpNeighbor returns the LLDP neighbor of the NIC of mac, or of the first
+// NIC with a neighbor.
+func lldpNeighbor(inventory *httpd.Inventory, mac types.HardwareAddr) *httpd.LLDPNeighbor {
+	if inventory == nil {
+		return nil
+	}
+	var first *httpd.LLDPNeighbor
+	for _, nic := range inventory.NICs {
+		if nic.LLDPNeighbor == nil {
+			continue
+		}
+		if strings.EqualFold(nic.MACAddress, mac.String()) {
+			return nic.LLDPNeighbor
+		}
+		if first == nil {
+			first = nic.LLDPNeighbor
+		}
+	}
+	return first
+}
+
+// ProductSeqScope is the scope of the hostname sequence of the product.
+func ProductSeqScope(product string) string {
+	return "product:" + product
+}
+
+// Naming generates the hostnames by a template of HostnameData.
+type Naming struct {
+	prefix string
+	tmpl   *template.Template
+}
+
+var hostnameFuncs = template.FuncMap{
+	"lower":    strings.ToLower,
+	"upper":    strings.ToUpper,
+	"sanitize": sanitizeHostname,
+}
+
+// NewNaming parses the template. An empty text is DefaultHostnameTemplate.
+func NewNaming(prefix, text string) (*Naming, error) {
+	if text == "" {
+		text = DefaultHostnameTemplate
+	}
+	tmpl, err := template.New("hostname").Funcs(hostnameFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hostname template: %w", err)
+	}
+	return &Naming{prefix: prefix, tmpl: tmpl}, nil
+}
+
+// Hostname renders the hostname of the data. A nil Naming renders
+// DefaultHostnameTemplate without a prefix.
+func (n *Naming) Hostname(data HostnameData) (string, error) {
+	if n == nil {
+		var err error
+		n, err = NewNaming("", "")
+		if err != nil {
+			return "", err
+		}
+	}
+	data.Prefix = n.prefix
+	var buf bytes.Buffer
+	err := n.tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to render hostname template: %w", err)
+	}
+	name := strings.TrimSpace(buf.String())
+	err = ValidateHostname(name)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Hostnames renders the hostname of the data and returns the names to try
+// in order, so that a template rendering the same name for several hosts
+// (e.g. by a placeholder serial) does not fail the registration: the
+// rendered name, the rendered name suffixed with the id, and the name of
+// DefaultHostnameTemplate. The datastore picks the first name that no other
+// host has.
+func (n *Naming) Hostnames(data HostnameData) ([]string, error) {
+	name, err := n.Hostname(data)
+	if err != nil {
+		return nil, err
+	}
+	suffix := fmt.Sprintf("-%d", data.ID)
+	base := name
+	if len(base)+len(suffix) > 63 {
+		base = strings.TrimRight(base[:63-len(suffix)], "-")
+	}
+	names := []string{name, base + suffix}
+
+	prefix := ""
+	if n != nil {
+		prefix = n.prefix
+	}
+	def, err := NewNaming(prefix, "")
+	if err != nil {
+		return nil, err
+	}
+	if name, err := def.Hostname(data); err == nil {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+var hostnameRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// ValidateHostname returns ErrInvalidHostname unless the name is a DNS label.
+func ValidateHostname(name string) error {
+	if !hostnameRegexp.MatchString(name) {
+		return fmt.Errorf("%q: %w", name, ErrInvalidHostname)
+	}
+	return nil
+}
+
+var invalidHostnameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// sanitizeHostname lowers s and replaces the characters not allowed in a
+// hostname with '-'.
+func sanitizeHostname(s string) string {
+	s = invalidHostnameChars.ReplaceAllString(strings.ToLower(s), "-")
+	return strings.Trim(s, "-")
+}
@@ -0,0 +1,200 @@
+package datastore
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	labelKeyRegexp   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]{0,61}[A-Za-z0-9])?$`)
+	labelValueRegexp = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9._-]{0,61}[A-Za-z0-9])?)?$`)
+)
+
+// ValidateLabels returns ErrInvalidLabel unless the keys are 1-63
+// characters of alphanumerics, '.', '_', '/' and '-', and the values are up
+// to 63 characters of alphanumerics, '.', '_' and '-'. Both begin and end
+// with an alphanumeric.
+func ValidateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if !labelKeyRegexp.MatchString(k) {
+			return fmt.Errorf("key %q: %w", k, ErrInvalidLabel)
+		}
+		if !labelValueRegexp.MatchString(v) {
+			return fmt.Errorf("value %q of %s: %w", v, k, ErrInvalidLabel)
+		}
+	}
+	return nil
+}
+
+// ValidateGroupName returns ErrInvalidLabel unless the name is a non-empty
+// label value, so that a group name can be used in a selector.
+func ValidateGroupName(name string) error {
+	if name == "" || !labelValueRegexp.MatchString(name) {
+		return fmt.Errorf("group name %q: %w", name, ErrInvalidLabel)
+	}
+	return nil
+}
+
+// Selector operators
+const (
+	SelectorEquals    = "="
+	SelectorNotEquals = "!="
+	SelectorIn        = "in"
+	SelectorNotIn     = "notin"
+	SelectorExists    = "exists"
+	SelectorNotExists = "!"
+)
+
+// Selector selects the hosts by their labels. It is the comma separated
+// requirements, all of which must be satisfied:
+//
+//	key=value, key==value  the label is value
+//	key!=value             the label is not value or does not exist
+//	key in (v1, v2)        the label is one of the values
+//	key notin (v1, v2)     the label is none of the values or does not exist
+//	key                    the label exists
+//	!key                   the label does not exist
+type Selector []Requirement
+
+// Requirement is a requirement of a Selector.
+type Requirement struct {
+	Key      string
+	Operator string
+	Values   []string
+}
+
+var setRequirementRegexp = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+
+// ParseSelector parses the selector. It returns ErrInvalidSelector if the
+// selector is empty or malformed.
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, text := range splitRequirements(s) {
+		r, err := parseRequirement(strings.TrimSpace(text))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", s, err)
+		}
+		sel = append(sel, *r)
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("%q: %w", s, ErrInvalidSelector)
+	}
+	return sel, nil
+}
+
+// splitRequirements splits s by the commas out of parentheses.
+func splitRequirements(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	var ret []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				ret = append(ret, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(ret, s[start:])
+}
+
+func parseRequirement(text string) (*Requirement, error) {
+	var r Requirement
+	switch {
+	case strings.HasPrefix(text, "!") && !strings.Contains(text, "="):
+		r = Requirement{Key: strings.TrimSpace(text[1:]), Operator: SelectorNotExists}
+	case setRequirementRegexp.MatchString(text):
+		m := setRequirementRegexp.FindStringSubmatch(text)
+		r = Requirement{Key: m[1], Operator: m[2]}
+		for _, v := range strings.Split(m[3], ",") {
+			r.Values = append(r.Values, strings.TrimSpace(v))
+		}
+	case strings.Contains(text, "!="):
+		kv := strings.SplitN(text, "!=", 2)
+		r = Requirement{Key: strings.TrimSpace(kv[0]), Operator: SelectorNotEquals, Values: []string{strings.TrimSpace(kv[1])}}
+	case strings.Contains(text, "="):
+		kv := strings.SplitN(text, "=", 2)
+		r = Requirement{Key: strings.TrimSpace(kv[0]), Operator: SelectorEquals, Values: []string{strings.TrimSpace(strings.TrimPrefix(kv[1], "="))}}
+	default:
+		r = Requirement{Key: text, Operator: SelectorExists}
+	}
+
+	if !labelKeyRegexp.MatchString(r.Key) {
+		return nil, fmt.Errorf("key %q: %w", r.Key, ErrInvalidSelector)
+	}
+	for _, v := range r.Values {
+		if !labelValueRegexp.MatchString(v) {
+			return nil, fmt.Errorf("value %q of %s: %w", v, r.Key, ErrInvalidSelector)
+		}
+	}
+	return &r, nil
+}
+
+// Matches reports whether the labels satisfy all the requirements.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches reports whether the labels satisfy the requirement.
+func (r Requirement) Matches(labels map[string]string) bool {
+	v, ok := labels[r.Key]
+	switch r.Operator {
+	case SelectorExists:
+		return ok
+	case SelectorNotExists:
+		return !ok
+	case SelectorEquals, SelectorIn:
+		return ok && contains(r.Values, v)
+	case SelectorNotEquals, SelectorNotIn:
+		return !ok || !contains(r.Values, v)
+	}
+	return false
+}
+
+// String returns the canonical form of the selector, which is stored as the
+// value of a selector assignment.
+func (s Selector) String() string {
+	var texts []string
+	for _, r := range s {
+		texts = append(texts, r.String())
+	}
+	return strings.Join(texts, ",")
+}
+
+// String returns the canonical form of the requirement.
+func (r Requirement) String() string {
+	switch r.Operator {
+	case SelectorExists:
+		return r.Key
+	case SelectorNotExists:
+		return "!" + r.Key
+	case SelectorIn, SelectorNotIn:
+		values := append([]string(nil), r.Values...)
+		sort.Strings(values)
+		return fmt.Sprintf("%s %s (%s)", r.Key, r.Operator, strings.Join(values, ","))
+	}
+	return r.Key + r.Operator + r.Values[0]
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package datastore
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/lovi-cloud/ursa/types"
+)
+
+// NextLeaseAddress returns the address to lease next in the subnet: the
+// address after the largest leased address, or start if none is leased.
+// The addresses are stored as text, so they are compared here as numbers
+// instead of by the datastore.
+func NextLeaseAddress(start types.IP, leased []types.IP) types.IP {
+	var latest net.IP
+	for _, ip := range leased {
+		a := net.IP(ip).To16()
+		if latest == nil || bytes.Compare(a, latest) > 0 {
+			latest = a
+		}
+	}
+	if latest == nil {
+		return start
+	}
+	next := make(net.IP, len(latest))
+	copy(next, latest)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] > 0 {
+			break
+		}
+	}
+	return types.IP(next)
+}
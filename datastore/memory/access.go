@@ -0,0 +1,89 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// GrantUserAccess grants the user the access to the hosts in the scope.
+// Granting an access again does nothing.
+func (m *Memory) GrantUserAccess(ctx context.Context, userID int, scope, value string) error {
+	value, err := datastore.ValidateScope(scope, value)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	found := false
+	for _, u := range m.users {
+		if u.ID == userID {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("failed to get user: %w", datastore.ErrNotFound)
+	}
+	a := assignment{scope: scope, value: value, targetID: userID}
+	for _, b := range m.userAccess {
+		if b == a {
+			return nil
+		}
+	}
+	m.userAccess = append(m.userAccess, a)
+	after := datastore.Assignment{Scope: scope, Value: value, TargetID: userID}
+	return m.recordAudit(ctx, datastore.AuditUserAccessGrant, 0, nil, after)
+}
+
+// RevokeUserAccess revokes the access granted by GrantUserAccess.
+func (m *Memory) RevokeUserAccess(ctx context.Context, userID int, scope, value string) error {
+	value, err := datastore.ValidateScope(scope, value)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := assignment{scope: scope, value: value, targetID: userID}
+	for i, b := range m.userAccess {
+		if b == a {
+			m.userAccess = append(m.userAccess[:i], m.userAccess[i+1:]...)
+			before := datastore.Assignment{Scope: scope, Value: value, TargetID: userID}
+			return m.recordAudit(ctx, datastore.AuditUserAccessRevoke, 0, before, nil)
+		}
+	}
+	return fmt.Errorf("failed to revoke user access: %w", datastore.ErrNotFound)
+}
+
+// ListUserAccess returns the accesses granted to the user. TargetID of them
+// is the id of the user.
+func (m *Memory) ListUserAccess(ctx context.Context, userID int) ([]datastore.Assignment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var access []datastore.Assignment
+	for _, a := range m.userAccess {
+		if a.targetID == userID {
+			access = append(access, datastore.Assignment{Scope: a.scope, Value: a.value, TargetID: a.targetID})
+		}
+	}
+	return access, nil
+}
+
+// ListUserByHost returns the users that have the access to the host. A user
+// without any access granted has the access to every host.
+func (m *Memory) ListUserByHost(ctx context.Context, host httpd.Host) ([]httpd.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var restricted []int
+	for _, a := range m.userAccess {
+		restricted = append(restricted, a.targetID)
+	}
+	return datastore.FilterUserByAccess(m.users, restricted, m.matchAssignments(m.userAccess, host)), nil
+}
@@ -0,0 +1,65 @@
+package memory
+
+import (
+	"context"
+	"sort"
+
+	"github.com/lovi-cloud/ursa/datastore"
+)
+
+// recordAudit appends the entry of the change. m.mu must be held.
+func (m *Memory) recordAudit(ctx context.Context, action string, hostID int, before, after interface{}) error {
+	e, err := datastore.NewAuditEntry(ctx, action, hostID, before, after)
+	if err != nil {
+		return err
+	}
+	e.ID = m.nextID("audit_log")
+	m.auditLog = append(m.auditLog, *e)
+	return nil
+}
+
+// ListAuditEntry returns the latest entries selected by the filter in
+// chronological order.
+func (m *Memory) ListAuditEntry(ctx context.Context, filter datastore.AuditFilter) ([]datastore.AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []datastore.AuditEntry
+	for _, e := range m.auditLog {
+		if filter.Match(e) {
+			entries = append(entries, e)
+		}
+	}
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[len(entries)-filter.Limit:]
+	}
+	return entries, nil
+}
+
+// getPhoneHome returns the result of the last phone home of the host.
+func (m *Memory) getPhoneHome(i int) *datastore.PhoneHome {
+	ph := datastore.PhoneHome{
+		InstanceID:   m.hosts[i].InstanceID,
+		PhonedHomeAt: m.hosts[i].PhonedHomeAt,
+	}
+	for _, k := range m.hostKeys {
+		if k.HostID == m.hosts[i].ID {
+			ph.HostKeys = append(ph.HostKeys, k)
+		}
+	}
+	sort.Slice(ph.HostKeys, func(i, j int) bool {
+		return ph.HostKeys[i].Type < ph.HostKeys[j].Type
+	})
+	return &ph
+}
+
+// getAssignment returns the assignment of the scope and the value, or nil
+// if it is not assigned.
+func getAssignment(assignments []assignment, scope, value string) *datastore.Assignment {
+	for _, a := range assignments {
+		if a.scope == scope && a.value == value {
+			return &datastore.Assignment{Scope: a.scope, Value: a.value, TargetID: a.targetID}
+		}
+	}
+	return nil
+}
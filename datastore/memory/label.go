@@ -0,0 +1,224 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// GetHostLabels returns the labels of the host.
+func (m *Memory) GetHostLabels(ctx context.Context, hostID int) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.getHostLabels(hostID), nil
+}
+
+func (m *Memory) getHostLabels(hostID int) map[string]string {
+	labels := map[string]string{}
+	for k, v := range m.labels[hostID] {
+		labels[k] = v
+	}
+	return labels
+}
+
+// SetHostLabels replaces the labels of the host.
+func (m *Memory) SetHostLabels(ctx context.Context, hostID int, labels map[string]string) error {
+	err := datastore.ValidateLabels(labels)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.findHost(hostID); !ok {
+		return fmt.Errorf("failed to get host: %w", datastore.ErrNotFound)
+	}
+	before := m.getHostLabels(hostID)
+	after := map[string]string{}
+	for k, v := range labels {
+		after[k] = v
+	}
+	m.labels[hostID] = after
+	return m.recordAudit(ctx, datastore.AuditHostLabelsSet, hostID, before, after)
+}
+
+func (m *Memory) findHostGroup(groupID int) (int, bool) {
+	for i, g := range m.hostGroups {
+		if g.ID == groupID {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// CreateHostGroup is
+func (m *Memory) CreateHostGroup(ctx context.Context, name string) (*httpd.HostGroup, error) {
+	err := datastore.ValidateGroupName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, g := range m.hostGroups {
+		if g.Name == name {
+			return nil, fmt.Errorf("failed to create new host group: %w", datastore.ErrConflict)
+		}
+	}
+	group := httpd.HostGroup{ID: m.nextID("host_group"), Name: name}
+	m.hostGroups = append(m.hostGroups, group)
+	err = m.recordAudit(ctx, datastore.AuditHostGroupCreate, 0, nil, group)
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// GetHostGroupByName is
+func (m *Memory) GetHostGroupByName(ctx context.Context, name string) (*httpd.HostGroup, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, g := range m.hostGroups {
+		if g.Name == name {
+			return &g, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to get host group: %w", datastore.ErrNotFound)
+}
+
+// ListHostGroup is
+func (m *Memory) ListHostGroup(ctx context.Context) ([]httpd.HostGroup, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var groups []httpd.HostGroup
+	groups = append(groups, m.hostGroups...)
+	sortHostGroups(groups)
+	return groups, nil
+}
+
+func sortHostGroups(groups []httpd.HostGroup) {
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+}
+
+// DeleteHostGroup deletes the group and its members. The assignments to the
+// group are kept and match a new group of the same name.
+func (m *Memory) DeleteHostGroup(ctx context.Context, groupID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, ok := m.findHostGroup(groupID)
+	if !ok {
+		return fmt.Errorf("failed to get host group: %w", datastore.ErrNotFound)
+	}
+	group := m.hostGroups[i]
+	var members []datastore.HostGroupMember
+	for _, gm := range m.groupMembers {
+		if gm.GroupID != groupID {
+			members = append(members, gm)
+		}
+	}
+	m.groupMembers = members
+	m.hostGroups = append(m.hostGroups[:i], m.hostGroups[i+1:]...)
+	return m.recordAudit(ctx, datastore.AuditHostGroupDelete, 0, group, nil)
+}
+
+// AddHostGroupMember adds the host to the group. Adding a member again does
+// nothing.
+func (m *Memory) AddHostGroupMember(ctx context.Context, groupID, hostID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.findHostGroup(groupID); !ok {
+		return fmt.Errorf("failed to get host_group: %w", datastore.ErrNotFound)
+	}
+	if _, ok := m.findHost(hostID); !ok {
+		return fmt.Errorf("failed to get host: %w", datastore.ErrNotFound)
+	}
+	member := datastore.HostGroupMember{GroupID: groupID, HostID: hostID}
+	for _, gm := range m.groupMembers {
+		if gm == member {
+			return nil
+		}
+	}
+	m.groupMembers = append(m.groupMembers, member)
+	return m.recordAudit(ctx, datastore.AuditHostGroupMemberAdd, hostID, nil, member)
+}
+
+// RemoveHostGroupMember removes the host from the group.
+func (m *Memory) RemoveHostGroupMember(ctx context.Context, groupID, hostID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	member := datastore.HostGroupMember{GroupID: groupID, HostID: hostID}
+	for i, gm := range m.groupMembers {
+		if gm == member {
+			m.groupMembers = append(m.groupMembers[:i], m.groupMembers[i+1:]...)
+			return m.recordAudit(ctx, datastore.AuditHostGroupMemberRemove, hostID, member, nil)
+		}
+	}
+	return fmt.Errorf("failed to remove host group member: %w", datastore.ErrNotFound)
+}
+
+// ListHostByGroup returns the hosts in the group.
+func (m *Memory) ListHostByGroup(ctx context.Context, groupID int) ([]httpd.Host, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var hosts []httpd.Host
+	for _, h := range m.hosts {
+		for _, gm := range m.groupMembers {
+			if gm.GroupID == groupID && gm.HostID == h.ID {
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].ID < hosts[j].ID
+	})
+	return hosts, nil
+}
+
+// ListHostGroupByHost returns the groups of the host.
+func (m *Memory) ListHostGroupByHost(ctx context.Context, hostID int) ([]httpd.HostGroup, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.listHostGroupByHost(hostID), nil
+}
+
+func (m *Memory) listHostGroupByHost(hostID int) []httpd.HostGroup {
+	var groups []httpd.HostGroup
+	for _, g := range m.hostGroups {
+		for _, gm := range m.groupMembers {
+			if gm.GroupID == g.ID && gm.HostID == hostID {
+				groups = append(groups, g)
+			}
+		}
+	}
+	sortHostGroups(groups)
+	return groups
+}
+
+// matchAssignments returns the assignments that match the host in the order
+// of precedence. m.mu must be held.
+func (m *Memory) matchAssignments(assignments []assignment, host httpd.Host) []datastore.Assignment {
+	attrs := datastore.HostAttributes{Host: host, Labels: m.getHostLabels(host.ID)}
+	for _, g := range m.listHostGroupByHost(host.ID) {
+		attrs.Groups = append(attrs.Groups, g.Name)
+	}
+	var as []datastore.Assignment
+	for _, a := range assignments {
+		as = append(as, datastore.Assignment{Scope: a.scope, Value: a.value, TargetID: a.targetID})
+	}
+	return datastore.MatchAssignments(as, attrs)
+}
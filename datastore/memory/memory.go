@@ -0,0 +1,1624 @@
+package memory
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/dhcpd"
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/types"
+)
+
+const (
+	managementSubnetID = 0
+	serviceSubnetID    = 1
+	bmcSubnetID        = 2
+)
+
+// Memory is a datastore that keeps everything in memory. It has the same
+// semantics as the SQLite datastore and is meant for tests and ephemeral
+// labs. The records are lost when the process exits.
+type Memory struct {
+	mu     sync.Mutex
+	naming *datastore.Naming
+
+	// seq is the last id of each table. Like AUTOINCREMENT, ids are never
+	// reused.
+	seq map[string]int
+
+	subnets         map[int]dhcpd.Subnet
+	leases          []dhcpd.Lease
+	hosts           []httpd.Host
+	transitions     []httpd.HostStateTransition
+	hostKeys        []httpd.HostKey
+	tokens          map[int]datastore.HostToken
+	inventories     []httpd.HostInventory
+	wipeReports     []httpd.HostWipeReport
+	bmcCredentials  []httpd.BMCCredential
+	bmcs            []dhcpd.BMC
+	bootEvents      []httpd.BootEvent
+	bootProfiles    []httpd.BootProfile
+	profileAssigns  []assignment
+	templates       []httpd.UserdataTemplate
+	templateAssigns []assignment
+	networkProfiles []httpd.NetworkProfile
+	networkAssigns  []assignment
+	users           []httpd.User
+	keys            []httpd.Key
+	userAccess      []assignment
+	labels          map[int]map[string]string
+	hostGroups      []httpd.HostGroup
+	groupMembers    []datastore.HostGroupMember
+	auditLog        []datastore.AuditEntry
+	// hostnameSeqs is the last value of the hostname sequence of each
+	// scope.
+	hostnameSeqs map[string]int
+}
+
+// assignment assigns the record of targetID to the scope.
+type assignment struct {
+	scope    string
+	value    string
+	targetID int
+}
+
+// New returns the in-memory datastore that names new hosts by naming.
+func New(naming *datastore.Naming) (datastore.Datastore, error) {
+	return &Memory{
+		naming:       naming,
+		seq:          map[string]int{},
+		subnets:      map[int]dhcpd.Subnet{},
+		tokens:       map[int]datastore.HostToken{},
+		labels:       map[int]map[string]string{},
+		hostnameSeqs: map[string]int{},
+	}, nil
+}
+
+func (m *Memory) nextID(table string) int {
+	m.seq[table]++
+	return m.seq[table]
+}
+
+func (m *Memory) bumpSeq(table string, id int) {
+	if id > m.seq[table] {
+		m.seq[table] = id
+	}
+}
+
+func (m *Memory) getSubnetByID(subnetID int) (*dhcpd.Subnet, error) {
+	subnet, ok := m.subnets[subnetID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get subnet: %w", datastore.ErrNotFound)
+	}
+	return &subnet, nil
+}
+
+// GetManagementSubnet is
+func (m *Memory) GetManagementSubnet(ctx context.Context) (*dhcpd.Subnet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.getSubnetByID(managementSubnetID)
+}
+
+// GetServiceSubnet is
+func (m *Memory) GetServiceSubnet(ctx context.Context) (*dhcpd.Subnet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.getSubnetByID(serviceSubnetID)
+}
+
+// GetBMCSubnet is
+func (m *Memory) GetBMCSubnet(ctx context.Context) (*dhcpd.Subnet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.getSubnetByID(bmcSubnetID)
+}
+
+func (m *Memory) createSubnet(ctx context.Context, subnet dhcpd.Subnet) (*dhcpd.Subnet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.subnets {
+		switch {
+		case s.ID == subnet.ID,
+			s.Start.String() == subnet.Start.String(),
+			s.End.String() == subnet.End.String(),
+			s.Gateway != nil && subnet.Gateway != nil && s.Gateway.String() == subnet.Gateway.String():
+			return nil, fmt.Errorf("failed to create new subnet: %w", datastore.ErrConflict)
+		}
+	}
+	m.subnets[subnet.ID] = subnet
+	err := m.recordAudit(ctx, datastore.AuditSubnetCreate, 0, nil, subnet)
+	if err != nil {
+		return nil, err
+	}
+	return &subnet, nil
+}
+
+// CreateManagementSubnet is
+func (m *Memory) CreateManagementSubnet(ctx context.Context, network types.IPNet, start, end types.IP) (*dhcpd.Subnet, error) {
+	return m.createSubnet(ctx, dhcpd.Subnet{
+		ID:      managementSubnetID,
+		Network: network,
+		Start:   start,
+		End:     end,
+	})
+}
+
+// CreateServiceSubnet is
+func (m *Memory) CreateServiceSubnet(ctx context.Context, network types.IPNet, start, end, gateway, dnsServer types.IP) (*dhcpd.Subnet, error) {
+	return m.createSubnet(ctx, dhcpd.Subnet{
+		ID:        serviceSubnetID,
+		Network:   network,
+		Start:     start,
+		End:       end,
+		Gateway:   &gateway,
+		DNSServer: &dnsServer,
+	})
+}
+
+// CreateBMCSubnet is
+func (m *Memory) CreateBMCSubnet(ctx context.Context, network types.IPNet, start, end types.IP) (*dhcpd.Subnet, error) {
+	return m.createSubnet(ctx, dhcpd.Subnet{
+		ID:      bmcSubnetID,
+		Network: network,
+		Start:   start,
+		End:     end,
+	})
+}
+
+func (m *Memory) findLease(id int) (int, bool) {
+	for i, l := range m.leases {
+		if l.ID == id {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (m *Memory) getLease(subnetID int, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, l := range m.leases {
+		if l.SubnetID == subnetID && l.MACAddress.String() == mac.String() {
+			return &l, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to get lease: %w", datastore.ErrNotFound)
+}
+
+// GetLeaseByID is
+func (m *Memory) GetLeaseByID(ctx context.Context, id int) (*httpd.Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, ok := m.findLease(id)
+	if !ok {
+		return nil, fmt.Errorf("failed to get lease: %w", datastore.ErrNotFound)
+	}
+	subnet, ok := m.subnets[m.leases[i].SubnetID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get lease: %w", datastore.ErrNotFound)
+	}
+	return &httpd.Lease{
+		ID:        id,
+		IPAddress: m.leases[i].IPAddress,
+		Network:   subnet.Network,
+		Gateway:   subnet.Gateway,
+		DNSServer: subnet.DNSServer,
+	}, nil
+}
+
+// GetLeaseFromManagementSubnet is
+func (m *Memory) GetLeaseFromManagementSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	return m.getLease(managementSubnetID, mac)
+}
+
+// GetLeaseFromServiceSubnet is
+func (m *Memory) GetLeaseFromServiceSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	return m.getLease(serviceSubnetID, mac)
+}
+
+// GetLeaseFromBMCSubnet is
+func (m *Memory) GetLeaseFromBMCSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	return m.getLease(bmcSubnetID, mac)
+}
+
+// createLease allocates the address next to the latest address of the
+// subnet. The addresses are compared as text as SQLite does.
+func (m *Memory) createLease(ctx context.Context, subnetID int, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	subnet, err := m.getSubnetByID(subnetID)
+	if err != nil {
+		return nil, err
+	}
+
+	var leased []types.IP
+	for _, l := range m.leases {
+		if l.SubnetID == subnetID {
+			leased = append(leased, l.IPAddress)
+		}
+	}
+	next := datastore.NextLeaseAddress(subnet.Start, leased)
+
+	for _, l := range m.leases {
+		if (l.SubnetID == subnetID && l.MACAddress.String() == mac.String()) || l.IPAddress.String() == next.String() {
+			return nil, fmt.Errorf("failed to create new lease: %w", datastore.ErrConflict)
+		}
+	}
+
+	lease := dhcpd.Lease{
+		ID:         m.nextID("lease"),
+		MACAddress: mac,
+		IPAddress:  next,
+		SubnetID:   subnetID,
+	}
+	m.leases = append(m.leases, lease)
+	err = m.recordAudit(ctx, datastore.AuditLeaseCreate, 0, nil, lease)
+	if err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// CreateLeaseFromManagementSubnet is
+func (m *Memory) CreateLeaseFromManagementSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	return m.createLease(ctx, managementSubnetID, mac)
+}
+
+// CreateLeaseFromServiceSubnet is
+func (m *Memory) CreateLeaseFromServiceSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	return m.createLease(ctx, serviceSubnetID, mac)
+}
+
+// CreateLeaseFromBMCSubnet is
+func (m *Memory) CreateLeaseFromBMCSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	return m.createLease(ctx, bmcSubnetID, mac)
+}
+
+// ListLease is
+func (m *Memory) ListLease(ctx context.Context) ([]dhcpd.Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var leases []dhcpd.Lease
+	leases = append(leases, m.leases...)
+	return leases, nil
+}
+
+// CountLeaseBySubnet returns the number of leases keyed by the subnet id.
+func (m *Memory) CountLeaseBySubnet(ctx context.Context) (map[int]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := map[int]int{}
+	for _, l := range m.leases {
+		counts[l.SubnetID]++
+	}
+	return counts, nil
+}
+
+// DeleteLease deletes the lease that is not used by a host. The BMC that
+// has the lease is deleted with it.
+func (m *Memory) DeleteLease(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, h := range m.hosts {
+		if h.ServiceLeaseID == id || h.ManagementLeaseID == id {
+			return fmt.Errorf("lease %d is used by a host: %w", id, dhcpd.ErrLeaseInUse)
+		}
+	}
+	i, ok := m.findLease(id)
+	if !ok {
+		return fmt.Errorf("failed to delete lease: %w", datastore.ErrNotFound)
+	}
+
+	var bmcs []dhcpd.BMC
+	for _, b := range m.bmcs {
+		if b.LeaseID != id {
+			bmcs = append(bmcs, b)
+		}
+	}
+	m.bmcs = bmcs
+	lease := m.leases[i]
+	m.leases = append(m.leases[:i], m.leases[i+1:]...)
+	return m.recordAudit(ctx, datastore.AuditLeaseDelete, 0, lease, nil)
+}
+
+func (m *Memory) deleteLeases(ids ...int) {
+	var leases []dhcpd.Lease
+	for _, l := range m.leases {
+		if !containsInt(ids, l.ID) {
+			leases = append(leases, l)
+		}
+	}
+	m.leases = leases
+}
+
+func (m *Memory) findHost(id int) (int, bool) {
+	for i, h := range m.hosts {
+		if h.ID == id {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// generateHostname renders the name of the host with the next sequence
+// number of its product. The sequence is incremented only if the name is
+// used. inventory may be nil.
+func (m *Memory) generateHostname(host httpd.Host, inventory *httpd.Inventory) (string, func(), error) {
+	scope := datastore.ProductSeqScope(host.Product)
+	seq := m.hostnameSeqs[scope] + 1
+	var mac types.HardwareAddr
+	if i, ok := m.findLease(host.ManagementLeaseID); ok && inventory != nil {
+		mac = m.leases[i].MACAddress
+	}
+	names, err := m.naming.Hostnames(datastore.NewHostnameData(host, seq, inventory, mac, m.getHostLabels(host.ID)))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate hostname: %w", err)
+	}
+	for _, name := range names {
+		taken := false
+		for _, h := range m.hosts {
+			if h.Name == name && h.ID != host.ID {
+				taken = true
+			}
+		}
+		if !taken {
+			return name, func() { m.hostnameSeqs[scope] = seq }, nil
+		}
+	}
+	return "", nil, fmt.Errorf("failed to generate hostname %s: %w", names[0], datastore.ErrConflict)
+}
+
+// RegisterHost creates the host and names it by the naming template.
+func (m *Memory) RegisterHost(ctx context.Context, serverID uuid.UUID, serial, product, manufacturer string, serviceLeaseID, managementLeaseID int) (*httpd.Host, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	host := httpd.Host{
+		ID:                m.seq["host"] + 1,
+		UUID:              serverID,
+		Serial:            serial,
+		Product:           product,
+		Manufacturer:      manufacturer,
+		ServiceLeaseID:    serviceLeaseID,
+		ManagementLeaseID: managementLeaseID,
+		State:             httpd.HostStateDiscovered,
+		StateUpdatedAt:    time.Now().UTC(),
+	}
+	name, commitSeq, err := m.generateHostname(host, nil)
+	if err != nil {
+		return nil, err
+	}
+	host.Name = name
+	for _, h := range m.hosts {
+		switch {
+		case uuid.Equal(h.UUID, host.UUID),
+			h.Name == host.Name,
+			host.ServiceLeaseID != 0 && h.ServiceLeaseID == host.ServiceLeaseID,
+			host.ManagementLeaseID != 0 && h.ManagementLeaseID == host.ManagementLeaseID:
+			return nil, fmt.Errorf("failed to create new host: %w", datastore.ErrConflict)
+		}
+	}
+
+	m.nextID("host")
+	commitSeq()
+	m.hosts = append(m.hosts, host)
+	m.insertHostStateTransition(host.ID, "", host.State, host.StateUpdatedAt)
+	err = m.recordAudit(ctx, datastore.AuditHostRegister, host.ID, nil, host)
+	if err != nil {
+		return nil, err
+	}
+	return &host, nil
+}
+
+func (m *Memory) getHost(match func(h httpd.Host) bool) (*httpd.Host, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, h := range m.hosts {
+		if match(h) {
+			return &h, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to get host: %w", datastore.ErrNotFound)
+}
+
+// GetHostByAddress is
+func (m *Memory) GetHostByAddress(ctx context.Context, address types.IP) (*httpd.Host, error) {
+	return m.getHost(func(h httpd.Host) bool {
+		i, ok := m.findLease(h.ManagementLeaseID)
+		return ok && m.leases[i].IPAddress.String() == address.String()
+	})
+}
+
+// GetHostByUUID is
+func (m *Memory) GetHostByUUID(ctx context.Context, serverID uuid.UUID) (*httpd.Host, error) {
+	return m.getHost(func(h httpd.Host) bool {
+		return uuid.Equal(h.UUID, serverID)
+	})
+}
+
+// GetHostByName is
+func (m *Memory) GetHostByName(ctx context.Context, name string) (*httpd.Host, error) {
+	return m.getHost(func(h httpd.Host) bool {
+		return h.Name == name
+	})
+}
+
+// UpdateHostState moves the host to the state if the transition is allowed.
+func (m *Memory) UpdateHostState(ctx context.Context, hostID int, state string) (*httpd.Host, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, ok := m.findHost(hostID)
+	if !ok {
+		return nil, fmt.Errorf("failed to get host: %w", datastore.ErrNotFound)
+	}
+	host := &m.hosts[i]
+	if !httpd.CanTransitHostState(host.State, state) {
+		return nil, fmt.Errorf("%s -> %s: %w", host.State, state, httpd.ErrInvalidHostStateTransition)
+	}
+
+	now := time.Now().UTC()
+	m.insertHostStateTransition(hostID, host.State, state, now)
+	before := *host
+	host.State = state
+	host.StateUpdatedAt = now
+	h := *host
+	err := m.recordAudit(ctx, datastore.AuditHostStateUpdate, hostID, before, h)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// RenameHost renames the host. An empty name renders the naming template
+// again with the latest inventory of the host.
+func (m *Memory) RenameHost(ctx context.Context, hostID int, name string) (*httpd.Host, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, ok := m.findHost(hostID)
+	if !ok {
+		return nil, fmt.Errorf("failed to get host: %w", datastore.ErrNotFound)
+	}
+	commitSeq := func() {}
+	if name == "" {
+		var latest *httpd.HostInventory
+		for j, hi := range m.inventories {
+			if hi.HostID == hostID && (latest == nil || hi.Version > latest.Version) {
+				latest = &m.inventories[j]
+			}
+		}
+		var inventory *httpd.Inventory
+		if latest != nil {
+			inventory = &latest.Inventory
+		}
+		var err error
+		name, commitSeq, err = m.generateHostname(m.hosts[i], inventory)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := datastore.ValidateHostname(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if name == m.hosts[i].Name {
+		h := m.hosts[i]
+		return &h, nil
+	}
+	for _, h := range m.hosts {
+		if h.Name == name {
+			return nil, fmt.Errorf("failed to update hostname: %w", datastore.ErrConflict)
+		}
+	}
+
+	commitSeq()
+	before := m.hosts[i]
+	m.hosts[i].Name = name
+	h := m.hosts[i]
+	err := m.recordAudit(ctx, datastore.AuditHostRename, hostID, before, h)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (m *Memory) insertHostStateTransition(hostID int, from, to string, createdAt time.Time) {
+	m.transitions = append(m.transitions, httpd.HostStateTransition{
+		ID:        m.nextID("host_state_transition"),
+		HostID:    hostID,
+		From:      from,
+		To:        to,
+		CreatedAt: createdAt,
+	})
+}
+
+// ListHostStateTransition is
+func (m *Memory) ListHostStateTransition(ctx context.Context, hostID int) ([]httpd.HostStateTransition, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var transitions []httpd.HostStateTransition
+	for _, t := range m.transitions {
+		if t.HostID == hostID {
+			transitions = append(transitions, t)
+		}
+	}
+	return transitions, nil
+}
+
+// RecordPhoneHome records the completion of cloud-init. Host keys of the
+// same type are replaced.
+func (m *Memory) RecordPhoneHome(ctx context.Context, hostID int, instanceID string, keys []httpd.HostKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, ok := m.findHost(hostID)
+	if !ok {
+		return fmt.Errorf("failed to update host: %w", datastore.ErrNotFound)
+	}
+	before := m.getPhoneHome(i)
+	now := time.Now().UTC()
+	m.hosts[i].InstanceID = instanceID
+	m.hosts[i].PhonedHomeAt = &now
+
+	for _, k := range keys {
+		var hostKeys []httpd.HostKey
+		for _, hk := range m.hostKeys {
+			if hk.HostID != hostID || hk.Type != k.Type {
+				hostKeys = append(hostKeys, hk)
+			}
+		}
+		m.hostKeys = append(hostKeys, httpd.HostKey{
+			ID:     m.nextID("host_key"),
+			HostID: hostID,
+			Type:   k.Type,
+			Key:    k.Key,
+		})
+	}
+	return m.recordAudit(ctx, datastore.AuditHostPhoneHome, hostID, before, m.getPhoneHome(i))
+}
+
+// ListHostKeyByHostID is
+func (m *Memory) ListHostKeyByHostID(ctx context.Context, hostID int) ([]httpd.HostKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []httpd.HostKey
+	for _, k := range m.hostKeys {
+		if k.HostID == hostID {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// IssueHostToken issues a new metadata token of the host. The previous
+// token of the host is replaced. Only the hash of the token is stored.
+func (m *Memory) IssueHostToken(ctx context.Context, hostID int) (string, error) {
+	buff := make([]byte, 32)
+	_, err := rand.Read(buff)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := hex.EncodeToString(buff)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[hostID] = datastore.HostToken{HostID: hostID, TokenHash: hashToken(token), CreatedAt: time.Now().UTC()}
+	// Neither the token nor its hash is recorded.
+	err = m.recordAudit(ctx, datastore.AuditHostTokenIssue, hostID, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// GetHostByToken is
+func (m *Memory) GetHostByToken(ctx context.Context, token string) (*httpd.Host, error) {
+	hash := hashToken(token)
+	return m.getHost(func(h httpd.Host) bool {
+		t, ok := m.tokens[h.ID]
+		return ok && t.TokenHash == hash
+	})
+}
+
+// RevokeHostToken is
+func (m *Memory) RevokeHostToken(ctx context.Context, hostID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.tokens[hostID]; !ok {
+		return nil
+	}
+	delete(m.tokens, hostID)
+	return m.recordAudit(ctx, datastore.AuditHostTokenRevoke, hostID, nil, nil)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateHostInventory stores the inventory as the next version.
+func (m *Memory) CreateHostInventory(ctx context.Context, hostID int, inventory httpd.Inventory) (*httpd.HostInventory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var version int
+	for _, hi := range m.inventories {
+		if hi.HostID == hostID && hi.Version > version {
+			version = hi.Version
+		}
+	}
+	hi := httpd.HostInventory{
+		ID:        m.nextID("host_inventory"),
+		HostID:    hostID,
+		Version:   version + 1,
+		Inventory: inventory,
+		CreatedAt: time.Now().UTC(),
+	}
+	m.inventories = append(m.inventories, hi)
+	err := m.recordAudit(ctx, datastore.AuditHostInventoryCreate, hostID, nil, hi)
+	if err != nil {
+		return nil, err
+	}
+	return &hi, nil
+}
+
+// GetHostInventory is
+func (m *Memory) GetHostInventory(ctx context.Context, hostID, version int) (*httpd.HostInventory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, hi := range m.inventories {
+		if hi.HostID == hostID && hi.Version == version {
+			return &hi, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to get host inventory: %w", datastore.ErrNotFound)
+}
+
+// GetLatestHostInventory is
+func (m *Memory) GetLatestHostInventory(ctx context.Context, hostID int) (*httpd.HostInventory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var latest *httpd.HostInventory
+	for i, hi := range m.inventories {
+		if hi.HostID == hostID && (latest == nil || hi.Version > latest.Version) {
+			latest = &m.inventories[i]
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("failed to get host inventory: %w", datastore.ErrNotFound)
+	}
+	hi := *latest
+	return &hi, nil
+}
+
+// ListHostInventory returns the inventories of the host, newest first.
+// Versions increase with ids, so the order of insertion is the order of
+// versions.
+func (m *Memory) ListHostInventory(ctx context.Context, hostID int) ([]httpd.HostInventory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var his []httpd.HostInventory
+	for i := len(m.inventories) - 1; i >= 0; i-- {
+		if m.inventories[i].HostID == hostID {
+			his = append(his, m.inventories[i])
+		}
+	}
+	return his, nil
+}
+
+// SetBMCCredential creates or replaces the BMC credential of the host.
+func (m *Memory) SetBMCCredential(ctx context.Context, cred httpd.BMCCredential) (*httpd.BMCCredential, error) {
+	switch cred.Driver {
+	case httpd.BMCDriverIPMI, httpd.BMCDriverRedfish:
+	default:
+		return nil, fmt.Errorf("invalid BMC driver %s", cred.Driver)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var before *httpd.BMCCredential
+	var creds []httpd.BMCCredential
+	for _, c := range m.bmcCredentials {
+		if c.HostID != cred.HostID {
+			creds = append(creds, c)
+		} else {
+			c := c
+			before = &c
+		}
+	}
+	cred.ID = m.nextID("bmc_credential")
+	m.bmcCredentials = append(creds, cred)
+	// The password is never encoded to JSON.
+	err := m.recordAudit(ctx, datastore.AuditBMCCredentialSet, cred.HostID, before, cred)
+	if err != nil {
+		return nil, err
+	}
+	return &cred, nil
+}
+
+// GetBMCCredentialByHostID is
+func (m *Memory) GetBMCCredentialByHostID(ctx context.Context, hostID int) (*httpd.BMCCredential, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range m.bmcCredentials {
+		if c.HostID == hostID {
+			return &c, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to get BMC credential: %w", datastore.ErrNotFound)
+}
+
+// RecordBMC creates or updates the BMC discovered by DHCP. The link to the
+// host is kept. The audit entry is recorded only if the BMC is changed.
+func (m *Memory) RecordBMC(ctx context.Context, mac types.HardwareAddr, vendorClass, hostname string, leaseID int) (*dhcpd.BMC, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	match := func(b dhcpd.BMC) bool {
+		return b.MACAddress.String() == mac.String()
+	}
+	before, err := m.getBMC(match)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return nil, err
+	}
+
+	index := -1
+	for i, b := range m.bmcs {
+		if b.MACAddress.String() == mac.String() {
+			index = i
+		} else if b.LeaseID == leaseID {
+			return nil, fmt.Errorf("failed to record BMC: %w", datastore.ErrConflict)
+		}
+	}
+	if index < 0 {
+		m.bmcs = append(m.bmcs, dhcpd.BMC{
+			ID:         m.nextID("bmc"),
+			MACAddress: mac,
+		})
+		index = len(m.bmcs) - 1
+	}
+	m.bmcs[index].VendorClass = vendorClass
+	m.bmcs[index].Hostname = hostname
+	m.bmcs[index].LeaseID = leaseID
+	after, err := m.getBMC(match)
+	if err != nil {
+		return nil, err
+	}
+	if before != nil && reflect.DeepEqual(*before, *after) {
+		return after, nil
+	}
+	hostID := 0
+	if after.HostID != nil {
+		hostID = *after.HostID
+	}
+	err = m.recordAudit(ctx, datastore.AuditBMCRecord, hostID, before, after)
+	if err != nil {
+		return nil, err
+	}
+	return after, nil
+}
+
+// getBMC returns the BMC with the address of its lease. The BMC without
+// the lease is not found.
+func (m *Memory) getBMC(match func(b dhcpd.BMC) bool) (*dhcpd.BMC, error) {
+	for _, b := range m.bmcs {
+		if !match(b) {
+			continue
+		}
+		i, ok := m.findLease(b.LeaseID)
+		if !ok {
+			continue
+		}
+		b.IPAddress = m.leases[i].IPAddress
+		if b.HostID != nil {
+			hostID := *b.HostID
+			b.HostID = &hostID
+		}
+		return &b, nil
+	}
+	return nil, fmt.Errorf("failed to get BMC: %w", datastore.ErrNotFound)
+}
+
+// GetBMCByMAC is
+func (m *Memory) GetBMCByMAC(ctx context.Context, mac types.HardwareAddr) (*dhcpd.BMC, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.getBMC(func(b dhcpd.BMC) bool {
+		return b.MACAddress.String() == mac.String()
+	})
+}
+
+// GetBMCByHostID is
+func (m *Memory) GetBMCByHostID(ctx context.Context, hostID int) (*dhcpd.BMC, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.getBMC(func(b dhcpd.BMC) bool {
+		return b.HostID != nil && *b.HostID == hostID
+	})
+}
+
+// ListBMC is
+func (m *Memory) ListBMC(ctx context.Context) ([]dhcpd.BMC, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var bmcs []dhcpd.BMC
+	for _, b := range m.bmcs {
+		id := b.ID
+		bmc, err := m.getBMC(func(b dhcpd.BMC) bool {
+			return b.ID == id
+		})
+		if err != nil {
+			continue
+		}
+		bmcs = append(bmcs, *bmc)
+	}
+	return bmcs, nil
+}
+
+// LinkBMC links the BMC with the host. The previous BMC of the host is
+// unlinked.
+func (m *Memory) LinkBMC(ctx context.Context, bmcID, hostID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	index := -1
+	for i, b := range m.bmcs {
+		if b.ID == bmcID {
+			index = i
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("failed to link BMC: %w", datastore.ErrNotFound)
+	}
+	before, err := m.getBMC(func(b dhcpd.BMC) bool {
+		return b.HostID != nil && *b.HostID == hostID
+	})
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return err
+	}
+	m.unlinkBMC(hostID)
+	m.bmcs[index].HostID = &hostID
+	after, err := m.getBMC(func(b dhcpd.BMC) bool {
+		return b.ID == bmcID
+	})
+	if err != nil {
+		return err
+	}
+	return m.recordAudit(ctx, datastore.AuditBMCLink, hostID, before, after)
+}
+
+func (m *Memory) unlinkBMC(hostID int) {
+	for i, b := range m.bmcs {
+		if b.HostID != nil && *b.HostID == hostID {
+			m.bmcs[i].HostID = nil
+		}
+	}
+}
+
+// CountHostByState returns the number of hosts keyed by the state.
+func (m *Memory) CountHostByState(ctx context.Context) (map[string]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := map[string]int{}
+	for _, h := range m.hosts {
+		counts[h.State]++
+	}
+	return counts, nil
+}
+
+// CreateWipeReport is
+func (m *Memory) CreateWipeReport(ctx context.Context, hostID int, report httpd.WipeReport) (*httpd.HostWipeReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hr := httpd.HostWipeReport{
+		ID:        m.nextID("host_wipe_report"),
+		HostID:    hostID,
+		Report:    report,
+		CreatedAt: time.Now().UTC(),
+	}
+	m.wipeReports = append(m.wipeReports, hr)
+	err := m.recordAudit(ctx, datastore.AuditHostWipeReportCreate, hostID, nil, hr)
+	if err != nil {
+		return nil, err
+	}
+	return &hr, nil
+}
+
+// ListWipeReport is
+func (m *Memory) ListWipeReport(ctx context.Context, hostID int) ([]httpd.HostWipeReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var reports []httpd.HostWipeReport
+	for _, r := range m.wipeReports {
+		if r.HostID == hostID {
+			reports = append(reports, r)
+		}
+	}
+	return reports, nil
+}
+
+// DecommissionHost releases the service and management leases and the
+// metadata token of the decommissioning host, and marks it as wiped.
+func (m *Memory) DecommissionHost(ctx context.Context, hostID int) (*httpd.Host, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, ok := m.findHost(hostID)
+	if !ok {
+		return nil, fmt.Errorf("failed to get host: %w", datastore.ErrNotFound)
+	}
+	host := &m.hosts[i]
+	if host.State != httpd.HostStateDecommissioning {
+		return nil, fmt.Errorf("%s -> %s: %w", host.State, httpd.HostStateWiped, httpd.ErrInvalidHostStateTransition)
+	}
+
+	now := time.Now().UTC()
+	m.insertHostStateTransition(hostID, host.State, httpd.HostStateWiped, now)
+	m.deleteLeases(host.ServiceLeaseID, host.ManagementLeaseID)
+	delete(m.tokens, hostID)
+	before := *host
+	host.State = httpd.HostStateWiped
+	host.StateUpdatedAt = now
+	host.ServiceLeaseID = 0
+	host.ManagementLeaseID = 0
+	h := *host
+	err := m.recordAudit(ctx, datastore.AuditHostDecommission, hostID, before, h)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// RediscoverHost gives the wiped host the leases and moves it back to
+// discovered, so that the host is provisioned again.
+func (m *Memory) RediscoverHost(ctx context.Context, hostID, serviceLeaseID, managementLeaseID int) (*httpd.Host, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, ok := m.findHost(hostID)
+	if !ok {
+		return nil, fmt.Errorf("failed to get host: %w", datastore.ErrNotFound)
+	}
+	host := &m.hosts[i]
+	if host.State != httpd.HostStateWiped {
+		return nil, fmt.Errorf("%s -> %s: %w", host.State, httpd.HostStateDiscovered, httpd.ErrInvalidHostStateTransition)
+	}
+	for _, h := range m.hosts {
+		if h.ServiceLeaseID == serviceLeaseID || h.ManagementLeaseID == managementLeaseID {
+			return nil, fmt.Errorf("failed to update host: %w", datastore.ErrConflict)
+		}
+	}
+
+	now := time.Now().UTC()
+	m.insertHostStateTransition(hostID, host.State, httpd.HostStateDiscovered, now)
+	before := *host
+	host.State = httpd.HostStateDiscovered
+	host.StateUpdatedAt = now
+	host.ServiceLeaseID = serviceLeaseID
+	host.ManagementLeaseID = managementLeaseID
+	h := *host
+	err := m.recordAudit(ctx, datastore.AuditHostRediscover, hostID, before, h)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// DeleteHost deletes the host with its leases and the records that belong
+// to it. The BMC linked with the host is unlinked.
+func (m *Memory) DeleteHost(ctx context.Context, hostID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, ok := m.findHost(hostID)
+	if !ok {
+		return fmt.Errorf("failed to delete host: %w", datastore.ErrNotFound)
+	}
+	host := m.hosts[i]
+	m.deleteLeases(host.ServiceLeaseID, host.ManagementLeaseID)
+	m.unlinkBMC(hostID)
+	delete(m.tokens, hostID)
+
+	var keys []httpd.HostKey
+	for _, k := range m.hostKeys {
+		if k.HostID != hostID {
+			keys = append(keys, k)
+		}
+	}
+	m.hostKeys = keys
+	var inventories []httpd.HostInventory
+	for _, hi := range m.inventories {
+		if hi.HostID != hostID {
+			inventories = append(inventories, hi)
+		}
+	}
+	m.inventories = inventories
+	var transitions []httpd.HostStateTransition
+	for _, t := range m.transitions {
+		if t.HostID != hostID {
+			transitions = append(transitions, t)
+		}
+	}
+	m.transitions = transitions
+	var reports []httpd.HostWipeReport
+	for _, r := range m.wipeReports {
+		if r.HostID != hostID {
+			reports = append(reports, r)
+		}
+	}
+	m.wipeReports = reports
+	var creds []httpd.BMCCredential
+	for _, c := range m.bmcCredentials {
+		if c.HostID != hostID {
+			creds = append(creds, c)
+		}
+	}
+	m.bmcCredentials = creds
+	delete(m.labels, hostID)
+	var members []datastore.HostGroupMember
+	for _, gm := range m.groupMembers {
+		if gm.HostID != hostID {
+			members = append(members, gm)
+		}
+	}
+	m.groupMembers = members
+
+	m.hosts = append(m.hosts[:i], m.hosts[i+1:]...)
+	return m.recordAudit(ctx, datastore.AuditHostDelete, hostID, host, nil)
+}
+
+// RecordBootEvent is
+func (m *Memory) RecordBootEvent(ctx context.Context, e httpd.BootEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	e.ID = m.nextID("boot_event")
+	m.bootEvents = append(m.bootEvents, e)
+	return nil
+}
+
+// ListBootEventByHost returns the latest limit boot events of the MAC
+// address and the address of the management lease of the host, in
+// chronological order.
+func (m *Memory) ListBootEventByHost(ctx context.Context, hostID, limit int) ([]httpd.BootEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, ok := m.findHost(hostID)
+	if !ok {
+		return nil, nil
+	}
+	j, ok := m.findLease(m.hosts[i].ManagementLeaseID)
+	if !ok {
+		return nil, nil
+	}
+	mac := m.leases[j].MACAddress.String()
+	ip := m.leases[j].IPAddress.String()
+
+	var events []httpd.BootEvent
+	for _, e := range m.bootEvents {
+		if e.MACAddress == mac || e.IPAddress == ip {
+			events = append(events, e)
+		}
+	}
+	if limit >= 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events, nil
+}
+
+// PruneBootEvent deletes the boot events created before.
+func (m *Memory) PruneBootEvent(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var events []httpd.BootEvent
+	for _, e := range m.bootEvents {
+		if !e.CreatedAt.Before(before) {
+			events = append(events, e)
+		}
+	}
+	m.bootEvents = events
+	return nil
+}
+
+// CreateBootProfile is
+func (m *Memory) CreateBootProfile(ctx context.Context, profile httpd.BootProfile) (*httpd.BootProfile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range m.bootProfiles {
+		if p.Name == profile.Name {
+			return nil, fmt.Errorf("failed to create new boot profile: %w", datastore.ErrConflict)
+		}
+	}
+	profile.ID = m.nextID("boot_profile")
+	m.bootProfiles = append(m.bootProfiles, profile)
+	err := m.recordAudit(ctx, datastore.AuditBootProfileCreate, 0, nil, profile)
+	if err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// GetBootProfileByName is
+func (m *Memory) GetBootProfileByName(ctx context.Context, name string) (*httpd.BootProfile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range m.bootProfiles {
+		if p.Name == name {
+			return &p, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to get boot profile: %w", datastore.ErrNotFound)
+}
+
+// GetBootProfileByHost returns the boot profile assigned to the host.
+func (m *Memory) GetBootProfileByHost(ctx context.Context, host httpd.Host) (*httpd.BootProfile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, a := range m.matchAssignments(m.profileAssigns, host) {
+		for _, p := range m.bootProfiles {
+			if p.ID == a.TargetID {
+				return &p, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("failed to get boot profile: %w", datastore.ErrNotFound)
+}
+
+// ListBootProfile is
+func (m *Memory) ListBootProfile(ctx context.Context) ([]httpd.BootProfile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var profiles []httpd.BootProfile
+	profiles = append(profiles, m.bootProfiles...)
+	return profiles, nil
+}
+
+// AssignBootProfile assigns the boot profile to the scope. An existing
+// assignment for the same scope and value is replaced.
+func (m *Memory) AssignBootProfile(ctx context.Context, scope, value string, profileID int) error {
+	value, err := datastore.ValidateScope(scope, value)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	before := getAssignment(m.profileAssigns, scope, value)
+	m.profileAssigns = assign(m.profileAssigns, assignment{scope: scope, value: value, targetID: profileID})
+	after := datastore.Assignment{Scope: scope, Value: value, TargetID: profileID}
+	return m.recordAudit(ctx, datastore.AuditBootProfileAssign, 0, before, after)
+}
+
+// CreateUserdataTemplate is
+func (m *Memory) CreateUserdataTemplate(ctx context.Context, t httpd.UserdataTemplate) (*httpd.UserdataTemplate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, ut := range m.templates {
+		if ut.Name == t.Name {
+			return nil, fmt.Errorf("failed to create new user-data template: %w", datastore.ErrConflict)
+		}
+	}
+	t.ID = m.nextID("userdata_template")
+	m.templates = append(m.templates, t)
+	err := m.recordAudit(ctx, datastore.AuditUserdataTemplateCreate, 0, nil, t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GetUserdataTemplateByName is
+func (m *Memory) GetUserdataTemplateByName(ctx context.Context, name string) (*httpd.UserdataTemplate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, t := range m.templates {
+		if t.Name == name {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to get user-data template: %w", datastore.ErrNotFound)
+}
+
+// GetUserdataTemplateByHost returns the user-data template assigned to the host.
+func (m *Memory) GetUserdataTemplateByHost(ctx context.Context, host httpd.Host) (*httpd.UserdataTemplate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, a := range m.matchAssignments(m.templateAssigns, host) {
+		for _, t := range m.templates {
+			if t.ID == a.TargetID {
+				return &t, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("failed to get user-data template: %w", datastore.ErrNotFound)
+}
+
+// ListUserdataTemplate is
+func (m *Memory) ListUserdataTemplate(ctx context.Context) ([]httpd.UserdataTemplate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ts []httpd.UserdataTemplate
+	ts = append(ts, m.templates...)
+	return ts, nil
+}
+
+// AssignUserdataTemplate assigns the user-data template to the scope. An
+// existing assignment for the same scope and value is replaced.
+func (m *Memory) AssignUserdataTemplate(ctx context.Context, scope, value string, templateID int) error {
+	value, err := datastore.ValidateScope(scope, value)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	before := getAssignment(m.templateAssigns, scope, value)
+	m.templateAssigns = assign(m.templateAssigns, assignment{scope: scope, value: value, targetID: templateID})
+	after := datastore.Assignment{Scope: scope, Value: value, TargetID: templateID}
+	return m.recordAudit(ctx, datastore.AuditUserdataTemplateAssign, 0, before, after)
+}
+
+// CreateNetworkProfile is
+func (m *Memory) CreateNetworkProfile(ctx context.Context, profile httpd.NetworkProfile) (*httpd.NetworkProfile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, np := range m.networkProfiles {
+		if np.Name == profile.Name {
+			return nil, fmt.Errorf("failed to create new network profile: %w", datastore.ErrConflict)
+		}
+	}
+	profile.ID = m.nextID("network_profile")
+	m.networkProfiles = append(m.networkProfiles, profile)
+	err := m.recordAudit(ctx, datastore.AuditNetworkProfileCreate, 0, nil, profile)
+	if err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// GetNetworkProfileByName is
+func (m *Memory) GetNetworkProfileByName(ctx context.Context, name string) (*httpd.NetworkProfile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range m.networkProfiles {
+		if p.Name == name {
+			return &p, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to get network profile: %w", datastore.ErrNotFound)
+}
+
+// GetNetworkProfileByHost returns the network profile assigned to the host.
+func (m *Memory) GetNetworkProfileByHost(ctx context.Context, host httpd.Host) (*httpd.NetworkProfile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, a := range m.matchAssignments(m.networkAssigns, host) {
+		for _, p := range m.networkProfiles {
+			if p.ID == a.TargetID {
+				return &p, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("failed to get network profile: %w", datastore.ErrNotFound)
+}
+
+// ListNetworkProfile is
+func (m *Memory) ListNetworkProfile(ctx context.Context) ([]httpd.NetworkProfile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var profiles []httpd.NetworkProfile
+	profiles = append(profiles, m.networkProfiles...)
+	return profiles, nil
+}
+
+// AssignNetworkProfile assigns the network profile to the scope. An
+// existing assignment for the same scope and value is replaced.
+func (m *Memory) AssignNetworkProfile(ctx context.Context, scope, value string, profileID int) error {
+	value, err := datastore.ValidateScope(scope, value)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	before := getAssignment(m.networkAssigns, scope, value)
+	m.networkAssigns = assign(m.networkAssigns, assignment{scope: scope, value: value, targetID: profileID})
+	after := datastore.Assignment{Scope: scope, Value: value, TargetID: profileID}
+	return m.recordAudit(ctx, datastore.AuditNetworkProfileAssign, 0, before, after)
+}
+
+func assign(assignments []assignment, a assignment) []assignment {
+	var ret []assignment
+	for _, b := range assignments {
+		if b.scope != a.scope || b.value != a.value {
+			ret = append(ret, b)
+		}
+	}
+	return append(ret, a)
+}
+
+// ListUser is
+func (m *Memory) ListUser(ctx context.Context) ([]httpd.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var users []httpd.User
+	users = append(users, m.users...)
+	return users, nil
+}
+
+// ListKeyByUserID is
+func (m *Memory) ListKeyByUserID(ctx context.Context, userID int) ([]httpd.Key, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []httpd.Key
+	for _, k := range m.keys {
+		if k.UserID == userID {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// Export returns the full state.
+func (m *Memory) Export(ctx context.Context) (*datastore.Dump, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dump := datastore.Dump{Version: datastore.DumpVersion}
+	for _, id := range []int{managementSubnetID, serviceSubnetID, bmcSubnetID} {
+		if subnet, ok := m.subnets[id]; ok {
+			dump.Subnets = append(dump.Subnets, subnet)
+		}
+	}
+	dump.Leases = append(dump.Leases, m.leases...)
+	dump.Hosts = append(dump.Hosts, m.hosts...)
+	dump.HostStateTransitions = append(dump.HostStateTransitions, m.transitions...)
+	dump.HostKeys = append(dump.HostKeys, m.hostKeys...)
+	for _, h := range m.hosts {
+		if t, ok := m.tokens[h.ID]; ok {
+			dump.HostTokens = append(dump.HostTokens, t)
+		}
+	}
+	dump.HostInventories = append(dump.HostInventories, m.inventories...)
+	dump.HostWipeReports = append(dump.HostWipeReports, m.wipeReports...)
+	for _, c := range m.bmcCredentials {
+		dump.BMCCredentials = append(dump.BMCCredentials, datastore.BMCCredential{BMCCredential: c, Password: c.Password})
+	}
+	for _, b := range m.bmcs {
+		id := b.ID
+		bmc, err := m.getBMC(func(b dhcpd.BMC) bool {
+			return b.ID == id
+		})
+		if err != nil {
+			continue
+		}
+		dump.BMCs = append(dump.BMCs, *bmc)
+	}
+	dump.BootProfiles = append(dump.BootProfiles, m.bootProfiles...)
+	for _, a := range m.profileAssigns {
+		dump.BootProfileAssignments = append(dump.BootProfileAssignments, datastore.Assignment{Scope: a.scope, Value: a.value, TargetID: a.targetID})
+	}
+	dump.UserdataTemplates = append(dump.UserdataTemplates, m.templates...)
+	for _, a := range m.templateAssigns {
+		dump.UserdataTemplateAssignments = append(dump.UserdataTemplateAssignments, datastore.Assignment{Scope: a.scope, Value: a.value, TargetID: a.targetID})
+	}
+	dump.NetworkProfiles = append(dump.NetworkProfiles, m.networkProfiles...)
+	for _, a := range m.networkAssigns {
+		dump.NetworkProfileAssignments = append(dump.NetworkProfileAssignments, datastore.Assignment{Scope: a.scope, Value: a.value, TargetID: a.targetID})
+	}
+	dump.Users = append(dump.Users, m.users...)
+	dump.Keys = append(dump.Keys, m.keys...)
+	dump.BootEvents = append(dump.BootEvents, m.bootEvents...)
+	dump.AuditLog = append(dump.AuditLog, m.auditLog...)
+	var scopes []string
+	for scope := range m.hostnameSeqs {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	for _, scope := range scopes {
+		dump.HostnameSequences = append(dump.HostnameSequences, datastore.HostnameSequence{Scope: scope, Value: m.hostnameSeqs[scope]})
+	}
+	for _, h := range m.hosts {
+		var keys []string
+		for k := range m.labels[h.ID] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			dump.HostLabels = append(dump.HostLabels, datastore.HostLabel{HostID: h.ID, Key: k, Value: m.labels[h.ID][k]})
+		}
+	}
+	dump.HostGroups = append(dump.HostGroups, m.hostGroups...)
+	dump.HostGroupMembers = append(dump.HostGroupMembers, m.groupMembers...)
+	sort.Slice(dump.HostGroupMembers, func(i, j int) bool {
+		a, b := dump.HostGroupMembers[i], dump.HostGroupMembers[j]
+		return a.GroupID < b.GroupID || a.GroupID == b.GroupID && a.HostID < b.HostID
+	})
+	for _, a := range m.userAccess {
+		dump.UserAccess = append(dump.UserAccess, datastore.Assignment{Scope: a.scope, Value: a.value, TargetID: a.targetID})
+	}
+	return &dump, nil
+}
+
+// Import replaces the full state with the dump. The ids in the dump are
+// kept. The audit log is append-only, so the audit log of the dump is
+// imported only if the audit log is empty.
+func (m *Memory) Import(ctx context.Context, dump datastore.Dump) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.subnets = map[int]dhcpd.Subnet{}
+	for _, subnet := range dump.Subnets {
+		m.subnets[subnet.ID] = subnet
+	}
+	m.leases = append([]dhcpd.Lease(nil), dump.Leases...)
+	m.hosts = append([]httpd.Host(nil), dump.Hosts...)
+	m.transitions = append([]httpd.HostStateTransition(nil), dump.HostStateTransitions...)
+	m.hostKeys = append([]httpd.HostKey(nil), dump.HostKeys...)
+	m.tokens = map[int]datastore.HostToken{}
+	for _, t := range dump.HostTokens {
+		m.tokens[t.HostID] = t
+	}
+	m.inventories = append([]httpd.HostInventory(nil), dump.HostInventories...)
+	m.wipeReports = append([]httpd.HostWipeReport(nil), dump.HostWipeReports...)
+	m.bmcCredentials = nil
+	for _, c := range dump.BMCCredentials {
+		cred := c.BMCCredential
+		cred.Password = c.Password
+		m.bmcCredentials = append(m.bmcCredentials, cred)
+	}
+	m.bmcs = nil
+	for _, b := range dump.BMCs {
+		b.IPAddress = nil
+		m.bmcs = append(m.bmcs, b)
+	}
+	m.bootProfiles = append([]httpd.BootProfile(nil), dump.BootProfiles...)
+	m.profileAssigns = nil
+	for _, a := range dump.BootProfileAssignments {
+		m.profileAssigns = append(m.profileAssigns, assignment{scope: a.Scope, value: a.Value, targetID: a.TargetID})
+	}
+	m.templates = append([]httpd.UserdataTemplate(nil), dump.UserdataTemplates...)
+	m.templateAssigns = nil
+	for _, a := range dump.UserdataTemplateAssignments {
+		m.templateAssigns = append(m.templateAssigns, assignment{scope: a.Scope, value: a.Value, targetID: a.TargetID})
+	}
+	m.networkProfiles = append([]httpd.NetworkProfile(nil), dump.NetworkProfiles...)
+	m.networkAssigns = nil
+	for _, a := range dump.NetworkProfileAssignments {
+		m.networkAssigns = append(m.networkAssigns, assignment{scope: a.Scope, value: a.Value, targetID: a.TargetID})
+	}
+	m.users = append([]httpd.User(nil), dump.Users...)
+	m.keys = append([]httpd.Key(nil), dump.Keys...)
+	m.bootEvents = append([]httpd.BootEvent(nil), dump.BootEvents...)
+	if len(m.auditLog) == 0 {
+		m.auditLog = append(m.auditLog, dump.AuditLog...)
+	}
+	m.hostnameSeqs = map[string]int{}
+	for _, seq := range dump.HostnameSequences {
+		m.hostnameSeqs[seq.Scope] = seq.Value
+	}
+	m.labels = map[int]map[string]string{}
+	for _, l := range dump.HostLabels {
+		if m.labels[l.HostID] == nil {
+			m.labels[l.HostID] = map[string]string{}
+		}
+		m.labels[l.HostID][l.Key] = l.Value
+	}
+	m.hostGroups = append([]httpd.HostGroup(nil), dump.HostGroups...)
+	m.groupMembers = append([]datastore.HostGroupMember(nil), dump.HostGroupMembers...)
+	m.userAccess = nil
+	for _, a := range dump.UserAccess {
+		m.userAccess = append(m.userAccess, assignment{scope: a.Scope, value: a.Value, targetID: a.TargetID})
+	}
+
+	// Like AUTOINCREMENT, the next ids are after the imported ids.
+	for _, l := range m.leases {
+		m.bumpSeq("lease", l.ID)
+	}
+	for _, h := range m.hosts {
+		m.bumpSeq("host", h.ID)
+	}
+	for _, g := range m.hostGroups {
+		m.bumpSeq("host_group", g.ID)
+	}
+	for _, t := range m.transitions {
+		m.bumpSeq("host_state_transition", t.ID)
+	}
+	for _, k := range m.hostKeys {
+		m.bumpSeq("host_key", k.ID)
+	}
+	for _, hi := range m.inventories {
+		m.bumpSeq("host_inventory", hi.ID)
+	}
+	for _, r := range m.wipeReports {
+		m.bumpSeq("host_wipe_report", r.ID)
+	}
+	for _, c := range m.bmcCredentials {
+		m.bumpSeq("bmc_credential", c.ID)
+	}
+	for _, b := range m.bmcs {
+		m.bumpSeq("bmc", b.ID)
+	}
+	for _, p := range m.bootProfiles {
+		m.bumpSeq("boot_profile", p.ID)
+	}
+	for _, t := range m.templates {
+		m.bumpSeq("userdata_template", t.ID)
+	}
+	for _, p := range m.networkProfiles {
+		m.bumpSeq("network_profile", p.ID)
+	}
+	for _, e := range m.bootEvents {
+		m.bumpSeq("boot_event", e.ID)
+	}
+	for _, e := range m.auditLog {
+		m.bumpSeq("audit_log", e.ID)
+	}
+	return m.recordAudit(ctx, datastore.AuditImport, 0, nil, dump.Summary())
+}
+
+// Close is
+func (m *Memory) Close() error {
+	return nil
+}
+
+func containsInt(s []int, v int) bool {
+	for _, i := range s {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
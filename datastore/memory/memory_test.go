@@ -0,0 +1,69 @@
+package memory_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/datastore/datastoretest"
+	"github.com/lovi-cloud/ursa/datastore/memory"
+	"github.com/lovi-cloud/ursa/types"
+)
+
+func TestConformance(t *testing.T) {
+	datastoretest.Run(t, func(t *testing.T) datastore.Datastore {
+		ds, err := memory.New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ds
+	})
+}
+
+func TestHostnameByLabels(t *testing.T) {
+	ctx := context.Background()
+	naming, err := datastore.NewNaming("cn", `{{with .Rack}}{{.}}-{{$.Position}}{{else}}{{.Prefix}}{{printf "%04d" .ID}}{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := memory.New(naming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network, err := types.ParseCIDR("10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, end := types.IP(net.ParseIP("10.0.0.1")), types.IP(net.ParseIP("10.0.0.99"))
+	_, err = ds.CreateManagementSubnet(ctx, *network, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := types.HardwareAddr(net.HardwareAddr{0x52, 0x54, 0x00, 0x00, 0x00, 0x01})
+	lease, err := ds.CreateLeaseFromManagementSubnet(ctx, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := ds.RegisterHost(ctx, uuid.NewV5(uuid.NamespaceOID, "host-1"), "serial", "product", "manufacturer", 0, lease.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Name != "cn0001" {
+		t.Fatalf("want cn0001, but got %s", host.Name)
+	}
+
+	err = ds.SetHostLabels(ctx, host.ID, map[string]string{datastore.LabelRack: "r12", datastore.LabelPosition: "u07"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err = ds.RenameHost(ctx, host.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Name != "r12-u07" {
+		t.Fatalf("want r12-u07, but got %s", host.Name)
+	}
+}
@@ -0,0 +1,130 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// GrantUserAccess grants the user the access to the hosts in the scope.
+// Granting an access again does nothing.
+func (p *Postgres) GrantUserAccess(ctx context.Context, userID int, scope, value string) error {
+	value, err := datastore.ValidateScope(scope, value)
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = existsRow(ctx, tx, "user", userID)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO user_access(user_id, scope, value) VALUES($1, $2, $3) ON CONFLICT DO NOTHING`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	ret, err := stmt.ExecContext(ctx, userID, scope, value)
+	if err != nil {
+		return fmt.Errorf("failed to grant user access: %w", err)
+	}
+	if n, _ := ret.RowsAffected(); n == 0 {
+		return nil
+	}
+	after := datastore.Assignment{Scope: scope, Value: value, TargetID: userID}
+	err = insertAuditEntry(ctx, tx, datastore.AuditUserAccessGrant, 0, nil, after)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// RevokeUserAccess revokes the access granted by GrantUserAccess.
+func (p *Postgres) RevokeUserAccess(ctx context.Context, userID int, scope, value string) error {
+	value, err := datastore.ValidateScope(scope, value)
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM user_access WHERE user_id = $1 AND scope = $2 AND value = $3`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	ret, err := stmt.ExecContext(ctx, userID, scope, value)
+	if err != nil {
+		return fmt.Errorf("failed to revoke user access: %w", err)
+	}
+	if n, _ := ret.RowsAffected(); n == 0 {
+		return fmt.Errorf("failed to revoke user access: %w", datastore.ErrNotFound)
+	}
+	before := datastore.Assignment{Scope: scope, Value: value, TargetID: userID}
+	err = insertAuditEntry(ctx, tx, datastore.AuditUserAccessRevoke, 0, before, nil)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// ListUserAccess returns the accesses granted to the user. TargetID of them
+// is the id of the user.
+func (p *Postgres) ListUserAccess(ctx context.Context, userID int) ([]datastore.Assignment, error) {
+	query := `SELECT scope, value, user_id AS target_id FROM user_access WHERE user_id = $1 ORDER BY id`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var access []datastore.Assignment
+	err = stmt.SelectContext(ctx, &access, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user access list: %w", err)
+	}
+	return access, nil
+}
+
+// ListUserByHost returns the users that have the access to the host. A user
+// without any access granted has the access to every host.
+func (p *Postgres) ListUserByHost(ctx context.Context, host httpd.Host) ([]httpd.User, error) {
+	users, err := p.ListUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	matched, err := p.matchAssignments(ctx, "user_access", "user_id", host)
+	if err != nil {
+		return nil, err
+	}
+	query := `SELECT DISTINCT user_id FROM user_access`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var restricted []int
+	err = stmt.SelectContext(ctx, &restricted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user access list: %w", err)
+	}
+	return datastore.FilterUserByAccess(users, restricted, matched), nil
+}
@@ -0,0 +1,67 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/lovi-cloud/ursa/datastore"
+)
+
+// insertAuditEntry records the change in the transaction that makes it, so
+// a change is never committed without its entry.
+func insertAuditEntry(ctx context.Context, tx *sqlx.Tx, action string, hostID int, before, after interface{}) error {
+	e, err := datastore.NewAuditEntry(ctx, action, hostID, before, after)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO audit_log(actor, action, host_id, before_value, after_value, created_at) VALUES($1, $2, $3, $4, $5, $6)`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, e.Actor, e.Action, nullID(e.HostID), e.Before, e.After, e.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create audit entry: %w", err)
+	}
+	return nil
+}
+
+// ListAuditEntry returns the latest entries selected by the filter in
+// chronological order.
+func (p *Postgres) ListAuditEntry(ctx context.Context, filter datastore.AuditFilter) ([]datastore.AuditEntry, error) {
+	conds := []string{"TRUE"}
+	var args []interface{}
+	if filter.HostID != 0 {
+		args = append(args, filter.HostID)
+		conds = append(conds, fmt.Sprintf("host_id = $%d", len(args)))
+	}
+	if !filter.Since.IsZero() {
+		args = append(args, filter.Since.UTC())
+		conds = append(conds, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if !filter.Until.IsZero() {
+		args = append(args, filter.Until.UTC())
+		conds = append(conds, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+	// LIMIT NULL is no limit.
+	var limit interface{}
+	if filter.Limit > 0 {
+		limit = filter.Limit
+	}
+	args = append(args, limit)
+
+	query := fmt.Sprintf(`SELECT * FROM (SELECT id, actor, action, COALESCE(host_id, 0) AS host_id, before_value, after_value, created_at FROM audit_log WHERE %s ORDER BY id DESC LIMIT $%d) AS e ORDER BY id`, strings.Join(conds, " AND "), len(args))
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var entries []datastore.AuditEntry
+	err = stmt.SelectContext(ctx, &entries, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get audit entry list: %w", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,283 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// dumpTables are the tables of Dump in the order of insertion. A table is
+// inserted after the tables that it references.
+var dumpTables = []string{
+	"subnet",
+	"lease",
+	"host",
+	"host_state_transition",
+	"host_key",
+	"host_token",
+	"host_inventory",
+	"host_wipe_report",
+	"bmc_credential",
+	"bmc",
+	"boot_profile",
+	"boot_profile_assignment",
+	"userdata_template",
+	"userdata_template_assignment",
+	"network_profile",
+	"network_profile_assignment",
+	"user",
+	"key",
+	"boot_event",
+	"hostname_sequence",
+	"host_label",
+	"host_group",
+	"host_group_member",
+	"user_access",
+}
+
+// Export returns the full state in a read only transaction, which sees a
+// snapshot of the database.
+func (p *Postgres) Export(ctx context.Context) (*datastore.Dump, error) {
+	tx, err := p.db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	dump := datastore.Dump{Version: datastore.DumpVersion}
+	var creds []httpd.BMCCredential
+	for _, q := range []struct {
+		table string
+		dest  interface{}
+		query string
+	}{
+		{"subnet", &dump.Subnets, `SELECT id, network, start, "end", gateway, dns_server FROM subnet ORDER BY id`},
+		{"lease", &dump.Leases, `SELECT id, mac_address, ip_address, subnet_id FROM lease ORDER BY id`},
+		{"host", &dump.Hosts, `SELECT id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host ORDER BY id`},
+		{"host_state_transition", &dump.HostStateTransitions, `SELECT id, host_id, from_state, to_state, created_at FROM host_state_transition ORDER BY id`},
+		{"host_key", &dump.HostKeys, `SELECT id, host_id, type, key FROM host_key ORDER BY id`},
+		{"host_token", &dump.HostTokens, `SELECT host_id, token_hash, created_at FROM host_token ORDER BY host_id`},
+		{"host_inventory", &dump.HostInventories, `SELECT id, host_id, version, inventory, created_at FROM host_inventory ORDER BY id`},
+		{"host_wipe_report", &dump.HostWipeReports, `SELECT id, host_id, report, created_at FROM host_wipe_report ORDER BY id`},
+		{"bmc_credential", &creds, `SELECT id, host_id, driver, address, username, password, insecure FROM bmc_credential ORDER BY id`},
+		{"bmc", &dump.BMCs, `SELECT ` + bmcColumns + ` FROM bmc JOIN lease ON bmc.lease_id = lease.id ORDER BY bmc.id`},
+		{"boot_profile", &dump.BootProfiles, `SELECT id, name, kind, kernel, initrd, rootfs, cmdline, script, installer, install_disk, install_layout, diskless FROM boot_profile ORDER BY id`},
+		{"boot_profile_assignment", &dump.BootProfileAssignments, `SELECT scope, value, boot_profile_id AS target_id FROM boot_profile_assignment ORDER BY id`},
+		{"userdata_template", &dump.UserdataTemplates, `SELECT id, name, template FROM userdata_template ORDER BY id`},
+		{"userdata_template_assignment", &dump.UserdataTemplateAssignments, `SELECT scope, value, userdata_template_id AS target_id FROM userdata_template_assignment ORDER BY id`},
+		{"network_profile", &dump.NetworkProfiles, `SELECT id, name, bond_driver, service_vlan FROM network_profile ORDER BY id`},
+		{"network_profile_assignment", &dump.NetworkProfileAssignments, `SELECT scope, value, network_profile_id AS target_id FROM network_profile_assignment ORDER BY id`},
+		{"user", &dump.Users, `SELECT id, name FROM "user" ORDER BY id`},
+		{"key", &dump.Keys, `SELECT id, key, user_id FROM key ORDER BY id`},
+		{"boot_event", &dump.BootEvents, `SELECT id, mac_address, ip_address, protocol, name, outcome, detail, created_at FROM boot_event ORDER BY id`},
+		{"hostname_sequence", &dump.HostnameSequences, `SELECT scope, value FROM hostname_sequence ORDER BY scope`},
+		{"host_label", &dump.HostLabels, `SELECT host_id, key, value FROM host_label ORDER BY host_id, key`},
+		{"host_group", &dump.HostGroups, `SELECT id, name FROM host_group ORDER BY id`},
+		{"host_group_member", &dump.HostGroupMembers, `SELECT group_id, host_id FROM host_group_member ORDER BY group_id, host_id`},
+		{"user_access", &dump.UserAccess, `SELECT scope, value, user_id AS target_id FROM user_access ORDER BY id`},
+		{"audit_log", &dump.AuditLog, `SELECT id, actor, action, COALESCE(host_id, 0) AS host_id, before_value, after_value, created_at FROM audit_log ORDER BY id`},
+	} {
+		stmt, err := tx.Preparex(q.query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare statement: %w", err)
+		}
+		err = stmt.SelectContext(ctx, q.dest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export %s: %w", q.table, err)
+		}
+	}
+	for _, c := range creds {
+		dump.BMCCredentials = append(dump.BMCCredentials, datastore.BMCCredential{BMCCredential: c, Password: c.Password})
+	}
+	return &dump, nil
+}
+
+// serialTables are the tables of which id is SERIAL. The ids of subnet
+// are fixed, and host_token, host_label and host_group_member have no id.
+var serialTables = map[string]bool{
+	"lease":                        true,
+	"host":                         true,
+	"host_state_transition":        true,
+	"host_key":                     true,
+	"host_inventory":               true,
+	"host_wipe_report":             true,
+	"bmc_credential":               true,
+	"bmc":                          true,
+	"boot_profile":                 true,
+	"boot_profile_assignment":      true,
+	"userdata_template":            true,
+	"userdata_template_assignment": true,
+	"network_profile":              true,
+	"network_profile_assignment":   true,
+	"user":                         true,
+	"key":                          true,
+	"boot_event":                   true,
+	"audit_log":                    true,
+	"host_group":                   true,
+	"user_access":                  true,
+}
+
+// Import replaces the full state with the dump in a transaction. The ids
+// in the dump are kept. The audit log is append-only, so the audit log of
+// the dump is imported only if the audit log is empty.
+func (p *Postgres) Import(ctx context.Context, dump datastore.Dump) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for i := len(dumpTables) - 1; i >= 0; i-- {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%s"`, dumpTables[i]))
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %w", dumpTables[i], err)
+		}
+	}
+
+	var rows []row
+	for _, r := range dump.Subnets {
+		rows = append(rows, row{"subnet", `INSERT INTO subnet(id, network, start, "end", gateway, dns_server) VALUES($1, $2, $3, $4, $5, $6)`, []interface{}{r.ID, r.Network, r.Start, r.End, r.Gateway, r.DNSServer}})
+	}
+	for _, r := range dump.Leases {
+		rows = append(rows, row{"lease", `INSERT INTO lease(id, mac_address, ip_address, subnet_id) VALUES($1, $2, $3, $4)`, []interface{}{r.ID, r.MACAddress, r.IPAddress, r.SubnetID}})
+	}
+	for _, r := range dump.Hosts {
+		rows = append(rows, row{"host", `INSERT INTO host(id, uuid, name, serial, product, manufacturer, service_lease_id, management_lease_id, state, state_updated_at, instance_id, phoned_home_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`, []interface{}{r.ID, r.UUID, r.Name, r.Serial, r.Product, r.Manufacturer, nullID(r.ServiceLeaseID), nullID(r.ManagementLeaseID), r.State, r.StateUpdatedAt, r.InstanceID, r.PhonedHomeAt}})
+	}
+	for _, r := range dump.HostStateTransitions {
+		rows = append(rows, row{"host_state_transition", `INSERT INTO host_state_transition(id, host_id, from_state, to_state, created_at) VALUES($1, $2, $3, $4, $5)`, []interface{}{r.ID, r.HostID, r.From, r.To, r.CreatedAt}})
+	}
+	for _, r := range dump.HostKeys {
+		rows = append(rows, row{"host_key", `INSERT INTO host_key(id, host_id, type, key) VALUES($1, $2, $3, $4)`, []interface{}{r.ID, r.HostID, r.Type, r.Key}})
+	}
+	for _, r := range dump.HostTokens {
+		rows = append(rows, row{"host_token", `INSERT INTO host_token(host_id, token_hash, created_at) VALUES($1, $2, $3)`, []interface{}{r.HostID, r.TokenHash, r.CreatedAt}})
+	}
+	for _, r := range dump.HostInventories {
+		rows = append(rows, row{"host_inventory", `INSERT INTO host_inventory(id, host_id, version, inventory, created_at) VALUES($1, $2, $3, $4, $5)`, []interface{}{r.ID, r.HostID, r.Version, r.Inventory, r.CreatedAt}})
+	}
+	for _, r := range dump.HostWipeReports {
+		rows = append(rows, row{"host_wipe_report", `INSERT INTO host_wipe_report(id, host_id, report, created_at) VALUES($1, $2, $3, $4)`, []interface{}{r.ID, r.HostID, r.Report, r.CreatedAt}})
+	}
+	for _, r := range dump.BMCCredentials {
+		rows = append(rows, row{"bmc_credential", `INSERT INTO bmc_credential(id, host_id, driver, address, username, password, insecure) VALUES($1, $2, $3, $4, $5, $6, $7)`, []interface{}{r.ID, r.HostID, r.Driver, r.Address, r.Username, r.Password, r.Insecure}})
+	}
+	for _, r := range dump.BMCs {
+		rows = append(rows, row{"bmc", `INSERT INTO bmc(id, mac_address, vendor_class, hostname, lease_id, host_id) VALUES($1, $2, $3, $4, $5, $6)`, []interface{}{r.ID, r.MACAddress, r.VendorClass, r.Hostname, r.LeaseID, r.HostID}})
+	}
+	for _, r := range dump.BootProfiles {
+		rows = append(rows, row{"boot_profile", `INSERT INTO boot_profile(id, name, kind, kernel, initrd, rootfs, cmdline, script, installer, install_disk, install_layout, diskless) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`, []interface{}{r.ID, r.Name, r.Kind, r.Kernel, r.Initrd, r.RootFS, r.Cmdline, r.Script, r.Installer, r.Disk, r.Layout, r.Diskless}})
+	}
+	for _, r := range dump.BootProfileAssignments {
+		rows = append(rows, row{"boot_profile_assignment", `INSERT INTO boot_profile_assignment(scope, value, boot_profile_id) VALUES($1, $2, $3)`, []interface{}{r.Scope, r.Value, r.TargetID}})
+	}
+	for _, r := range dump.UserdataTemplates {
+		rows = append(rows, row{"userdata_template", `INSERT INTO userdata_template(id, name, template) VALUES($1, $2, $3)`, []interface{}{r.ID, r.Name, r.Template}})
+	}
+	for _, r := range dump.UserdataTemplateAssignments {
+		rows = append(rows, row{"userdata_template_assignment", `INSERT INTO userdata_template_assignment(scope, value, userdata_template_id) VALUES($1, $2, $3)`, []interface{}{r.Scope, r.Value, r.TargetID}})
+	}
+	for _, r := range dump.NetworkProfiles {
+		rows = append(rows, row{"network_profile", `INSERT INTO network_profile(id, name, bond_driver, service_vlan) VALUES($1, $2, $3, $4)`, []interface{}{r.ID, r.Name, r.BondDriver, r.ServiceVLAN}})
+	}
+	for _, r := range dump.NetworkProfileAssignments {
+		rows = append(rows, row{"network_profile_assignment", `INSERT INTO network_profile_assignment(scope, value, network_profile_id) VALUES($1, $2, $3)`, []interface{}{r.Scope, r.Value, r.TargetID}})
+	}
+	for _, r := range dump.Users {
+		rows = append(rows, row{"user", `INSERT INTO "user"(id, name) VALUES($1, $2)`, []interface{}{r.ID, r.Name}})
+	}
+	for _, r := range dump.Keys {
+		rows = append(rows, row{"key", `INSERT INTO key(id, key, user_id) VALUES($1, $2, $3)`, []interface{}{r.ID, r.Key, r.UserID}})
+	}
+	for _, r := range dump.BootEvents {
+		rows = append(rows, row{"boot_event", `INSERT INTO boot_event(id, mac_address, ip_address, protocol, name, outcome, detail, created_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8)`, []interface{}{r.ID, r.MACAddress, r.IPAddress, r.Protocol, r.Name, r.Outcome, r.Detail, r.CreatedAt}})
+	}
+	for _, r := range dump.HostnameSequences {
+		rows = append(rows, row{"hostname_sequence", `INSERT INTO hostname_sequence(scope, value) VALUES($1, $2)`, []interface{}{r.Scope, r.Value}})
+	}
+	for _, r := range dump.HostLabels {
+		rows = append(rows, row{"host_label", `INSERT INTO host_label(host_id, key, value) VALUES($1, $2, $3)`, []interface{}{r.HostID, r.Key, r.Value}})
+	}
+	for _, r := range dump.HostGroups {
+		rows = append(rows, row{"host_group", `INSERT INTO host_group(id, name) VALUES($1, $2)`, []interface{}{r.ID, r.Name}})
+	}
+	for _, r := range dump.HostGroupMembers {
+		rows = append(rows, row{"host_group_member", `INSERT INTO host_group_member(group_id, host_id) VALUES($1, $2)`, []interface{}{r.GroupID, r.HostID}})
+	}
+	for _, r := range dump.UserAccess {
+		rows = append(rows, row{"user_access", `INSERT INTO user_access(user_id, scope, value) VALUES($1, $2, $3)`, []interface{}{r.TargetID, r.Scope, r.Value}})
+	}
+	var n int
+	err = tx.GetContext(ctx, &n, `SELECT COUNT(*) FROM audit_log`)
+	if err != nil {
+		return fmt.Errorf("failed to count audit entry: %w", err)
+	}
+	if n == 0 {
+		for _, r := range dump.AuditLog {
+			rows = append(rows, row{"audit_log", `INSERT INTO audit_log(id, actor, action, host_id, before_value, after_value, created_at) VALUES($1, $2, $3, $4, $5, $6, $7)`, []interface{}{r.ID, r.Actor, r.Action, nullID(r.HostID), r.Before, r.After, r.CreatedAt}})
+		}
+	}
+	err = insertRows(ctx, tx, rows)
+	if err != nil {
+		return err
+	}
+
+	// The ids are inserted explicitly, so the sequences must be moved
+	// after them.
+	for table := range serialTables {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`SELECT setval(pg_get_serial_sequence('"%s"', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM "%s"`, table, table))
+		if err != nil {
+			return fmt.Errorf("failed to reset sequence of %s: %w", table, err)
+		}
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditImport, 0, nil, dump.Summary())
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// row is a row to insert by Import.
+type row struct {
+	table string
+	query string
+	args  []interface{}
+}
+
+func insertRows(ctx context.Context, tx *sqlx.Tx, rows []row) error {
+	stmts := map[string]*sqlx.Stmt{}
+	for _, r := range rows {
+		stmt, ok := stmts[r.query]
+		if !ok {
+			var err error
+			stmt, err = tx.Preparex(r.query)
+			if err != nil {
+				return fmt.Errorf("failed to prepare statement: %w", err)
+			}
+			stmts[r.query] = stmt
+		}
+		_, err := stmt.ExecContext(ctx, r.args...)
+		if err != nil {
+			return fmt.Errorf("failed to import %s: %w", r.table, wrapError(err))
+		}
+	}
+	return nil
+}
+
+// nullID returns NULL for the zero id, which means no reference.
+func nullID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
@@ -0,0 +1,340 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// GetHostLabels returns the labels of the host.
+func (p *Postgres) GetHostLabels(ctx context.Context, hostID int) (map[string]string, error) {
+	return getHostLabels(ctx, p.db, hostID)
+}
+
+func getHostLabels(ctx context.Context, q sqlx.QueryerContext, hostID int) (map[string]string, error) {
+	var rows []datastore.HostLabel
+	err := sqlx.SelectContext(ctx, q, &rows, `SELECT host_id, key, value FROM host_label WHERE host_id = $1`, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host labels: %w", err)
+	}
+	labels := map[string]string{}
+	for _, r := range rows {
+		labels[r.Key] = r.Value
+	}
+	return labels, nil
+}
+
+// SetHostLabels replaces the labels of the host.
+func (p *Postgres) SetHostLabels(ctx context.Context, hostID int, labels map[string]string) error {
+	err := datastore.ValidateLabels(labels)
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = existsRow(ctx, tx, "host", hostID)
+	if err != nil {
+		return err
+	}
+	before, err := getHostLabels(ctx, tx, hostID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM host_label WHERE host_id = $1`, hostID)
+	if err != nil {
+		return fmt.Errorf("failed to delete host labels: %w", err)
+	}
+	query := `INSERT INTO host_label(host_id, key, value) VALUES($1, $2, $3)`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	after := map[string]string{}
+	for k, v := range labels {
+		_, err = stmt.ExecContext(ctx, hostID, k, v)
+		if err != nil {
+			return fmt.Errorf("failed to create host label: %w", err)
+		}
+		after[k] = v
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostLabelsSet, hostID, before, after)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// existsRow returns ErrNotFound unless the row of the id exists in the
+// table.
+func existsRow(ctx context.Context, tx *sqlx.Tx, table string, id int) error {
+	var n int
+	err := tx.GetContext(ctx, &n, fmt.Sprintf(`SELECT COUNT(*) FROM "%s" WHERE id = $1`, table), id)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", table, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("failed to get %s: %w", table, datastore.ErrNotFound)
+	}
+	return nil
+}
+
+// CreateHostGroup is
+func (p *Postgres) CreateHostGroup(ctx context.Context, name string) (*httpd.HostGroup, error) {
+	err := datastore.ValidateGroupName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO host_group(name) VALUES($1) RETURNING id`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var id int
+	err = stmt.GetContext(ctx, &id, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new host group: %w", wrapError(err))
+	}
+	group := httpd.HostGroup{ID: id, Name: name}
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostGroupCreate, 0, nil, group)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &group, nil
+}
+
+// GetHostGroupByName is
+func (p *Postgres) GetHostGroupByName(ctx context.Context, name string) (*httpd.HostGroup, error) {
+	query := `SELECT id, name FROM host_group WHERE name = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var group httpd.HostGroup
+	err = stmt.GetContext(ctx, &group, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host group: %w", wrapError(err))
+	}
+	return &group, nil
+}
+
+// ListHostGroup is
+func (p *Postgres) ListHostGroup(ctx context.Context) ([]httpd.HostGroup, error) {
+	query := `SELECT id, name FROM host_group ORDER BY name`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var groups []httpd.HostGroup
+	err = stmt.SelectContext(ctx, &groups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host group list: %w", err)
+	}
+	return groups, nil
+}
+
+// DeleteHostGroup deletes the group and its members. The assignments to the
+// group are kept and match a new group of the same name.
+func (p *Postgres) DeleteHostGroup(ctx context.Context, groupID int) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, name FROM host_group WHERE id = $1`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var group httpd.HostGroup
+	err = stmt.GetContext(ctx, &group, groupID)
+	if err != nil {
+		return fmt.Errorf("failed to get host group: %w", wrapError(err))
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM host_group_member WHERE group_id = $1`, groupID)
+	if err != nil {
+		return fmt.Errorf("failed to delete host group member: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM host_group WHERE id = $1`, groupID)
+	if err != nil {
+		return fmt.Errorf("failed to delete host group: %w", err)
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostGroupDelete, 0, group, nil)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// AddHostGroupMember adds the host to the group. Adding a member again does
+// nothing.
+func (p *Postgres) AddHostGroupMember(ctx context.Context, groupID, hostID int) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = existsRow(ctx, tx, "host_group", groupID)
+	if err != nil {
+		return err
+	}
+	err = existsRow(ctx, tx, "host", hostID)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO host_group_member(group_id, host_id) VALUES($1, $2) ON CONFLICT DO NOTHING`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	ret, err := stmt.ExecContext(ctx, groupID, hostID)
+	if err != nil {
+		return fmt.Errorf("failed to add host group member: %w", err)
+	}
+	if n, _ := ret.RowsAffected(); n == 0 {
+		return nil
+	}
+	member := datastore.HostGroupMember{GroupID: groupID, HostID: hostID}
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostGroupMemberAdd, hostID, nil, member)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// RemoveHostGroupMember removes the host from the group.
+func (p *Postgres) RemoveHostGroupMember(ctx context.Context, groupID, hostID int) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM host_group_member WHERE group_id = $1 AND host_id = $2`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	ret, err := stmt.ExecContext(ctx, groupID, hostID)
+	if err != nil {
+		return fmt.Errorf("failed to remove host group member: %w", err)
+	}
+	if n, _ := ret.RowsAffected(); n == 0 {
+		return fmt.Errorf("failed to remove host group member: %w", datastore.ErrNotFound)
+	}
+	member := datastore.HostGroupMember{GroupID: groupID, HostID: hostID}
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostGroupMemberRemove, hostID, member, nil)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// ListHostByGroup returns the hosts in the group.
+func (p *Postgres) ListHostByGroup(ctx context.Context, groupID int) ([]httpd.Host, error) {
+	query := `SELECT id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host WHERE id IN (SELECT host_id FROM host_group_member WHERE group_id = $1) ORDER BY id`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var hosts []httpd.Host
+	err = stmt.SelectContext(ctx, &hosts, groupID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host list: %w", err)
+	}
+	return hosts, nil
+}
+
+// ListHostGroupByHost returns the groups of the host.
+func (p *Postgres) ListHostGroupByHost(ctx context.Context, hostID int) ([]httpd.HostGroup, error) {
+	return listHostGroupByHost(ctx, p.db, hostID)
+}
+
+func listHostGroupByHost(ctx context.Context, q sqlx.QueryerContext, hostID int) ([]httpd.HostGroup, error) {
+	var groups []httpd.HostGroup
+	err := sqlx.SelectContext(ctx, q, &groups, `SELECT id, name FROM host_group WHERE id IN (SELECT group_id FROM host_group_member WHERE host_id = $1) ORDER BY name`, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host group list: %w", err)
+	}
+	return groups, nil
+}
+
+// hostAttributes returns the attributes of the host to match the
+// assignments.
+func (p *Postgres) hostAttributes(ctx context.Context, host httpd.Host) (*datastore.HostAttributes, error) {
+	labels, err := getHostLabels(ctx, p.db, host.ID)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := listHostGroupByHost(ctx, p.db, host.ID)
+	if err != nil {
+		return nil, err
+	}
+	attrs := &datastore.HostAttributes{Host: host, Labels: labels}
+	for _, g := range groups {
+		attrs.Groups = append(attrs.Groups, g.Name)
+	}
+	return attrs, nil
+}
+
+// matchAssignments returns the assignments in the table that match the host
+// in the order of precedence.
+func (p *Postgres) matchAssignments(ctx context.Context, table, column string, host httpd.Host) ([]datastore.Assignment, error) {
+	attrs, err := p.hostAttributes(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(`SELECT scope, value, %s AS target_id FROM %s ORDER BY id`, column, table)
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var assignments []datastore.Assignment
+	err = stmt.SelectContext(ctx, &assignments)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get assignment list: %w", err)
+	}
+	return datastore.MatchAssignments(assignments, *attrs), nil
+}
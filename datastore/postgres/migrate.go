@@ -0,0 +1,82 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// migrationLockID is the key of the advisory lock that serializes the
+// migrations of ursa instances sharing the database.
+const migrationLockID = 0x75727361
+
+// migration is a set of statements that changes the schema.
+type migration struct {
+	description string
+	statements  []string
+}
+
+// Migrate applies the migrations that are not applied yet to the database
+// of dsn, and returns the versions of the schema before and after.
+func Migrate(ctx context.Context, dsn string) (int, int, error) {
+	db, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open postgres connection: %w", err)
+	}
+	defer db.Close()
+	return migrate(ctx, db)
+}
+
+// migrate applies the migrations. The databases created before the
+// migrations were introduced have the tables of the first migration, which
+// are kept as they are.
+func migrate(ctx context.Context, db *sqlx.DB) (int, int, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLockID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to lock schema: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version(
+version INTEGER PRIMARY KEY,
+description TEXT NOT NULL,
+applied_at TIMESTAMPTZ NOT NULL
+)`)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create schema_version: %w", err)
+	}
+	var from int
+	err = tx.GetContext(ctx, &from, `SELECT COALESCE(MAX(version), 0) FROM schema_version`)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get schema version: %w", err)
+	}
+	if from > len(migrations) {
+		return 0, 0, fmt.Errorf("schema version %d is newer than this ursa (%d)", from, len(migrations))
+	}
+
+	for i := from; i < len(migrations); i++ {
+		m := migrations[i]
+		for _, stmt := range m.statements {
+			_, err = tx.ExecContext(ctx, stmt)
+			if err != nil {
+				return 0, 0, fmt.Errorf("failed to migrate to version %d (%s): %w", i+1, m.description, err)
+			}
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_version(version, description, applied_at) VALUES($1, $2, $3)`, i+1, m.description, time.Now().UTC())
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to record schema version: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return from, len(migrations), nil
+}
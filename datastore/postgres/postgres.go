@@ -0,0 +1,1840 @@
+package postgres
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/lib/pq"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/dhcpd"
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/types"
+)
+
+const (
+	managementSubnetID = 0
+	serviceSubnetID    = 1
+	bmcSubnetID        = 2
+)
+
+// Postgres is
+type Postgres struct {
+	db     *sqlx.DB
+	naming *datastore.Naming
+}
+
+// New opens the PostgreSQL datastore of dsn and names new hosts by naming.
+func New(ctx context.Context, dsn string, naming *datastore.Naming) (datastore.Datastore, error) {
+	db, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgres connection: %w", err)
+	}
+
+	_, _, err = migrate(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Postgres{
+		db:     db,
+		naming: naming,
+	}, nil
+}
+
+func (p *Postgres) getSubnetByID(ctx context.Context, subnetID int) (*dhcpd.Subnet, error) {
+	query := `SELECT id, network, start, "end", gateway, dns_server FROM subnet WHERE id = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var subnet dhcpd.Subnet
+	err = stmt.GetContext(ctx, &subnet, subnetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subnet: %w", wrapError(err))
+	}
+	return &subnet, nil
+}
+
+// GetManagementSubnet is
+func (p *Postgres) GetManagementSubnet(ctx context.Context) (*dhcpd.Subnet, error) {
+	return p.getSubnetByID(ctx, managementSubnetID)
+}
+
+// GetServiceSubnet is
+func (p *Postgres) GetServiceSubnet(ctx context.Context) (*dhcpd.Subnet, error) {
+	return p.getSubnetByID(ctx, serviceSubnetID)
+}
+
+// GetBMCSubnet is
+func (p *Postgres) GetBMCSubnet(ctx context.Context) (*dhcpd.Subnet, error) {
+	return p.getSubnetByID(ctx, bmcSubnetID)
+}
+
+func (p *Postgres) createSubnet(ctx context.Context, subnet dhcpd.Subnet) (*dhcpd.Subnet, error) {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO subnet(id, network, start, "end", gateway, dns_server) VALUES($1, $2, $3, $4, $5, $6)`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare stetment: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, subnet.ID, subnet.Network, subnet.Start, subnet.End, subnet.Gateway, subnet.DNSServer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new subnet: %w", wrapError(err))
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditSubnetCreate, 0, nil, subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &subnet, nil
+}
+
+// CreateManagementSubnet is
+func (p *Postgres) CreateManagementSubnet(ctx context.Context, network types.IPNet, start, end types.IP) (*dhcpd.Subnet, error) {
+	return p.createSubnet(ctx, dhcpd.Subnet{
+		ID:        managementSubnetID,
+		Network:   network,
+		Start:     start,
+		End:       end,
+		Gateway:   nil,
+		DNSServer: nil,
+	})
+}
+
+// CreateServiceSubnet is
+func (p *Postgres) CreateServiceSubnet(ctx context.Context, network types.IPNet, start, end, gateway, dnsServer types.IP) (*dhcpd.Subnet, error) {
+	return p.createSubnet(ctx, dhcpd.Subnet{
+		ID:        serviceSubnetID,
+		Network:   network,
+		Start:     start,
+		End:       end,
+		Gateway:   &gateway,
+		DNSServer: &dnsServer,
+	})
+}
+
+// CreateBMCSubnet is. The BMC subnet is a separate pool in the management
+// network.
+func (p *Postgres) CreateBMCSubnet(ctx context.Context, network types.IPNet, start, end types.IP) (*dhcpd.Subnet, error) {
+	return p.createSubnet(ctx, dhcpd.Subnet{
+		ID:        bmcSubnetID,
+		Network:   network,
+		Start:     start,
+		End:       end,
+		Gateway:   nil,
+		DNSServer: nil,
+	})
+}
+
+func (p *Postgres) getLease(ctx context.Context, subnetID int, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	query := `SELECT id, mac_address, ip_address, subnet_id FROM lease WHERE subnet_id = $1 AND mac_address = $2`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare stetment: %w", err)
+	}
+	var lease dhcpd.Lease
+	err = stmt.GetContext(ctx, &lease, subnetID, mac)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lease: %w", wrapError(err))
+	}
+
+	return &lease, nil
+}
+
+// GetLeaseByID is
+func (p *Postgres) GetLeaseByID(ctx context.Context, id int) (*httpd.Lease, error) {
+	query := `SELECT lease.id AS id, ip_address, network, gateway, dns_server FROM lease JOIN subnet ON lease.subnet_id = subnet.id WHERE lease.id = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare stetment: %w", err)
+	}
+	var lease httpd.Lease
+	err = stmt.GetContext(ctx, &lease, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lease: %w", wrapError(err))
+	}
+
+	return &lease, nil
+}
+
+// GetLeaseFromManagementSubnet is
+func (p *Postgres) GetLeaseFromManagementSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	return p.getLease(ctx, managementSubnetID, mac)
+}
+
+// GetLeaseFromServiceSubnet is
+func (p *Postgres) GetLeaseFromServiceSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	return p.getLease(ctx, serviceSubnetID, mac)
+}
+
+// GetLeaseFromBMCSubnet is
+func (p *Postgres) GetLeaseFromBMCSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	return p.getLease(ctx, bmcSubnetID, mac)
+}
+
+func (p *Postgres) createLease(ctx context.Context, subnetID int, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	subnet, err := p.getSubnetByID(ctx, subnetID)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Serialize the allocation of addresses.
+	_, err = tx.ExecContext(ctx, `LOCK TABLE lease IN SHARE ROW EXCLUSIVE MODE`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock lease: %w", err)
+	}
+	query := `SELECT ip_address FROM lease WHERE subnet_id = $1`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var leased []types.IP
+	err = stmt.SelectContext(ctx, &leased, subnetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get leased addresses: %w", err)
+	}
+	next := datastore.NextLeaseAddress(subnet.Start, leased)
+
+	query = `INSERT INTO lease(mac_address, ip_address, subnet_id) VALUES($1, $2, $3) RETURNING id`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare stetment: %w", err)
+	}
+	var id int
+	err = stmt.GetContext(ctx, &id, mac, next, subnetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new lease: %w", wrapError(err))
+	}
+	lease := dhcpd.Lease{
+		ID:         id,
+		MACAddress: mac,
+		IPAddress:  next,
+		SubnetID:   subnetID,
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditLeaseCreate, 0, nil, lease)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &lease, nil
+}
+
+// CreateLeaseFromManagementSubnet is
+func (p *Postgres) CreateLeaseFromManagementSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	return p.createLease(ctx, managementSubnetID, mac)
+}
+
+// CreateLeaseFromServiceSubnet is
+func (p *Postgres) CreateLeaseFromServiceSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	return p.createLease(ctx, serviceSubnetID, mac)
+}
+
+// CreateLeaseFromBMCSubnet is
+func (p *Postgres) CreateLeaseFromBMCSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	return p.createLease(ctx, bmcSubnetID, mac)
+}
+
+// ListLease is
+func (p *Postgres) ListLease(ctx context.Context) ([]dhcpd.Lease, error) {
+	query := `SELECT id, mac_address, ip_address, subnet_id FROM lease ORDER BY id`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var leases []dhcpd.Lease
+	err = stmt.SelectContext(ctx, &leases)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lease list: %w", err)
+	}
+	return leases, nil
+}
+
+// CountLeaseBySubnet returns the number of leases keyed by the subnet id.
+func (p *Postgres) CountLeaseBySubnet(ctx context.Context) (map[int]int, error) {
+	query := `SELECT subnet_id, COUNT(*) AS count FROM lease GROUP BY subnet_id`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var rows []struct {
+		SubnetID int `db:"subnet_id"`
+		Count    int `db:"count"`
+	}
+	err = stmt.SelectContext(ctx, &rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count lease: %w", err)
+	}
+	counts := map[int]int{}
+	for _, r := range rows {
+		counts[r.SubnetID] = r.Count
+	}
+	return counts, nil
+}
+
+// DeleteLease deletes the lease that is not used by a host. The BMC that
+// has the lease is deleted with it.
+func (p *Postgres) DeleteLease(ctx context.Context, id int) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, mac_address, ip_address, subnet_id FROM lease WHERE id = $1`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var lease dhcpd.Lease
+	err = stmt.GetContext(ctx, &lease, id)
+	if err != nil {
+		return fmt.Errorf("failed to get lease: %w", wrapError(err))
+	}
+
+	query = `SELECT COUNT(*) FROM host WHERE service_lease_id = $1 OR management_lease_id = $2`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var n int
+	err = stmt.GetContext(ctx, &n, id, id)
+	if err != nil {
+		return fmt.Errorf("failed to count host: %w", err)
+	}
+	if n != 0 {
+		return fmt.Errorf("lease %d is used by a host: %w", id, dhcpd.ErrLeaseInUse)
+	}
+
+	query = `DELETE FROM bmc WHERE lease_id = $1`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete BMC: %w", err)
+	}
+
+	query = `DELETE FROM lease WHERE id = $1`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	ret, err := stmt.ExecContext(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete lease: %w", err)
+	}
+	affected, err := ret.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("failed to delete lease: %w", datastore.ErrNotFound)
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditLeaseDelete, 0, lease, nil)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// RegisterHost creates the host and names it by the naming template in a
+// transaction, so concurrent registrations never get the same name.
+func (p *Postgres) RegisterHost(ctx context.Context, serverID uuid.UUID, serial, product, manufacturer string, serviceLeaseID, managementLeaseID int) (*httpd.Host, error) {
+	host := httpd.Host{
+		UUID:              serverID,
+		Serial:            serial,
+		Product:           product,
+		Manufacturer:      manufacturer,
+		ServiceLeaseID:    serviceLeaseID,
+		ManagementLeaseID: managementLeaseID,
+		State:             httpd.HostStateDiscovered,
+		StateUpdatedAt:    time.Now().UTC(),
+	}
+
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The name is unique, so the host is inserted with its uuid as the name
+	// until the id is allocated.
+	query := `INSERT INTO host(uuid, name, serial, product, manufacturer, service_lease_id, management_lease_id, state, state_updated_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var id int
+	err = stmt.GetContext(ctx, &id, host.UUID, host.UUID.String(), host.Serial, host.Product, host.Manufacturer, host.ServiceLeaseID, host.ManagementLeaseID, host.State, host.StateUpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new host: %w", wrapError(err))
+	}
+	host.ID = id
+	host.Name, err = p.generateHostname(ctx, tx, host, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = updateHostname(ctx, tx, host.ID, host.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertHostStateTransition(ctx, tx, host.ID, "", host.State, host.StateUpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostRegister, host.ID, nil, host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &host, nil
+}
+
+// GetHostByAddress is
+func (p *Postgres) GetHostByAddress(ctx context.Context, address types.IP) (*httpd.Host, error) {
+	query := `SELECT host.id AS id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM lease JOIN host ON lease.id = host.management_lease_id WHERE ip_address = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var host httpd.Host
+	err = stmt.GetContext(ctx, &host, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
+	}
+	return &host, nil
+}
+
+// GetHostByUUID is
+func (p *Postgres) GetHostByUUID(ctx context.Context, serverID uuid.UUID) (*httpd.Host, error) {
+	query := `SELECT id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host WHERE uuid = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var host httpd.Host
+	err = stmt.GetContext(ctx, &host, serverID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
+	}
+	return &host, nil
+}
+
+// GetHostByName is
+func (p *Postgres) GetHostByName(ctx context.Context, name string) (*httpd.Host, error) {
+	query := `SELECT id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host WHERE name = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var host httpd.Host
+	err = stmt.GetContext(ctx, &host, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
+	}
+	return &host, nil
+}
+
+// UpdateHostState moves the host to the state if the transition is allowed.
+func (p *Postgres) UpdateHostState(ctx context.Context, hostID int, state string) (*httpd.Host, error) {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host WHERE id = $1`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var host httpd.Host
+	err = stmt.GetContext(ctx, &host, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
+	}
+	if !httpd.CanTransitHostState(host.State, state) {
+		return nil, fmt.Errorf("%s -> %s: %w", host.State, state, httpd.ErrInvalidHostStateTransition)
+	}
+
+	now := time.Now().UTC()
+	query = `UPDATE host SET state = $1, state_updated_at = $2 WHERE id = $3`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, state, now, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update host state: %w", err)
+	}
+	err = insertHostStateTransition(ctx, tx, hostID, host.State, state, now)
+	if err != nil {
+		return nil, err
+	}
+	before := host
+	host.State = state
+	host.StateUpdatedAt = now
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostStateUpdate, hostID, before, host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &host, nil
+}
+
+func insertHostStateTransition(ctx context.Context, tx *sqlx.Tx, hostID int, from, to string, createdAt time.Time) error {
+	query := `INSERT INTO host_state_transition(host_id, from_state, to_state, created_at) VALUES($1, $2, $3, $4)`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, hostID, from, to, createdAt)
+	if err != nil {
+		return fmt.Errorf("failed to create host state transition: %w", err)
+	}
+	return nil
+}
+
+// ListHostStateTransition is
+func (p *Postgres) ListHostStateTransition(ctx context.Context, hostID int) ([]httpd.HostStateTransition, error) {
+	query := `SELECT id, host_id, from_state, to_state, created_at FROM host_state_transition WHERE host_id = $1 ORDER BY id`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var transitions []httpd.HostStateTransition
+	err = stmt.SelectContext(ctx, &transitions, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host state transition list: %w", err)
+	}
+	return transitions, nil
+}
+
+// RecordPhoneHome records the completion of cloud-init. Host keys of the
+// same type are replaced.
+func (p *Postgres) RecordPhoneHome(ctx context.Context, hostID int, instanceID string, keys []httpd.HostKey) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := getPhoneHome(ctx, tx, hostID)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE host SET instance_id = $1, phoned_home_at = $2 WHERE id = $3`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, instanceID, time.Now().UTC(), hostID)
+	if err != nil {
+		return fmt.Errorf("failed to update host: %w", err)
+	}
+
+	query = `INSERT INTO host_key(host_id, type, key) VALUES($1, $2, $3) ON CONFLICT(host_id, type) DO UPDATE SET key = excluded.key`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	for _, k := range keys {
+		_, err = stmt.ExecContext(ctx, hostID, k.Type, k.Key)
+		if err != nil {
+			return fmt.Errorf("failed to create host key: %w", err)
+		}
+	}
+
+	after, err := getPhoneHome(ctx, tx, hostID)
+	if err != nil {
+		return err
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostPhoneHome, hostID, before, after)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// getPhoneHome returns the result of the last phone home of the host.
+func getPhoneHome(ctx context.Context, tx *sqlx.Tx, hostID int) (*datastore.PhoneHome, error) {
+	query := `SELECT instance_id, phoned_home_at FROM host WHERE id = $1`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var ph datastore.PhoneHome
+	err = stmt.QueryRowxContext(ctx, hostID).Scan(&ph.InstanceID, &ph.PhonedHomeAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
+	}
+
+	query = `SELECT id, host_id, type, key FROM host_key WHERE host_id = $1 ORDER BY type`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	err = stmt.SelectContext(ctx, &ph.HostKeys, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host key list: %w", err)
+	}
+	return &ph, nil
+}
+
+// ListHostKeyByHostID is
+func (p *Postgres) ListHostKeyByHostID(ctx context.Context, hostID int) ([]httpd.HostKey, error) {
+	query := `SELECT id, host_id, type, key FROM host_key WHERE host_id = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var keys []httpd.HostKey
+	err = stmt.SelectContext(ctx, &keys, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host key list: %w", err)
+	}
+	return keys, nil
+}
+
+// IssueHostToken issues a new metadata token of the host. The previous
+// token of the host is replaced. Only the hash of the token is stored.
+func (p *Postgres) IssueHostToken(ctx context.Context, hostID int) (string, error) {
+	buff := make([]byte, 32)
+	_, err := rand.Read(buff)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := hex.EncodeToString(buff)
+
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return "", fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO host_token(host_id, token_hash, created_at) VALUES($1, $2, $3) ON CONFLICT(host_id) DO UPDATE SET token_hash = excluded.token_hash, created_at = excluded.created_at`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return "", fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, hostID, hashToken(token), time.Now().UTC())
+	if err != nil {
+		return "", fmt.Errorf("failed to create host token: %w", err)
+	}
+	// Neither the token nor its hash is recorded.
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostTokenIssue, hostID, nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return token, nil
+}
+
+// GetHostByToken is
+func (p *Postgres) GetHostByToken(ctx context.Context, token string) (*httpd.Host, error) {
+	query := `SELECT host.id AS id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host_token JOIN host ON host_token.host_id = host.id WHERE token_hash = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var host httpd.Host
+	err = stmt.GetContext(ctx, &host, hashToken(token))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
+	}
+	return &host, nil
+}
+
+// RevokeHostToken is
+func (p *Postgres) RevokeHostToken(ctx context.Context, hostID int) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM host_token WHERE host_id = $1`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	ret, err := stmt.ExecContext(ctx, hostID)
+	if err != nil {
+		return fmt.Errorf("failed to delete host token: %w", err)
+	}
+	n, err := ret.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if n == 0 {
+		return nil
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostTokenRevoke, hostID, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateHostInventory stores the inventory as the next version.
+func (p *Postgres) CreateHostInventory(ctx context.Context, hostID int, inventory httpd.Inventory) (*httpd.HostInventory, error) {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT COALESCE(MAX(version), 0) AS version FROM host_inventory WHERE host_id = $1`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var version int
+	err = stmt.GetContext(ctx, &version, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest version: %w", err)
+	}
+
+	hi := httpd.HostInventory{
+		HostID:    hostID,
+		Version:   version + 1,
+		Inventory: inventory,
+		CreatedAt: time.Now().UTC(),
+	}
+	query = `INSERT INTO host_inventory(host_id, version, inventory, created_at) VALUES($1, $2, $3, $4) RETURNING id`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var id int
+	err = stmt.GetContext(ctx, &id, hi.HostID, hi.Version, hi.Inventory, hi.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create host inventory: %w", wrapError(err))
+	}
+	hi.ID = id
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostInventoryCreate, hostID, nil, hi)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &hi, nil
+}
+
+// GetHostInventory is
+func (p *Postgres) GetHostInventory(ctx context.Context, hostID, version int) (*httpd.HostInventory, error) {
+	query := `SELECT id, host_id, version, inventory, created_at FROM host_inventory WHERE host_id = $1 AND version = $2`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var hi httpd.HostInventory
+	err = stmt.GetContext(ctx, &hi, hostID, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host inventory: %w", wrapError(err))
+	}
+	return &hi, nil
+}
+
+// GetLatestHostInventory is
+func (p *Postgres) GetLatestHostInventory(ctx context.Context, hostID int) (*httpd.HostInventory, error) {
+	query := `SELECT id, host_id, version, inventory, created_at FROM host_inventory WHERE host_id = $1 ORDER BY version DESC LIMIT 1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var hi httpd.HostInventory
+	err = stmt.GetContext(ctx, &hi, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host inventory: %w", wrapError(err))
+	}
+	return &hi, nil
+}
+
+// ListHostInventory returns the inventories of the host, newest first.
+func (p *Postgres) ListHostInventory(ctx context.Context, hostID int) ([]httpd.HostInventory, error) {
+	query := `SELECT id, host_id, version, inventory, created_at FROM host_inventory WHERE host_id = $1 ORDER BY version DESC`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var his []httpd.HostInventory
+	err = stmt.SelectContext(ctx, &his, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host inventory list: %w", err)
+	}
+	return his, nil
+}
+
+// SetBMCCredential creates or replaces the BMC credential of the host.
+func (p *Postgres) SetBMCCredential(ctx context.Context, cred httpd.BMCCredential) (*httpd.BMCCredential, error) {
+	switch cred.Driver {
+	case httpd.BMCDriverIPMI, httpd.BMCDriverRedfish:
+	default:
+		return nil, fmt.Errorf("invalid BMC driver %s", cred.Driver)
+	}
+
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := getBMCCredential(ctx, tx, cred.HostID)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return nil, err
+	}
+
+	query := `INSERT INTO bmc_credential(host_id, driver, address, username, password, insecure) VALUES($1, $2, $3, $4, $5, $6)
+ON CONFLICT(host_id) DO UPDATE SET driver = excluded.driver, address = excluded.address, username = excluded.username, password = excluded.password, insecure = excluded.insecure`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, cred.HostID, cred.Driver, cred.Address, cred.Username, cred.Password, cred.Insecure)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set BMC credential: %w", err)
+	}
+	after, err := getBMCCredential(ctx, tx, cred.HostID)
+	if err != nil {
+		return nil, err
+	}
+	// The password is never encoded to JSON.
+	err = insertAuditEntry(ctx, tx, datastore.AuditBMCCredentialSet, cred.HostID, before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return after, nil
+}
+
+func getBMCCredential(ctx context.Context, tx *sqlx.Tx, hostID int) (*httpd.BMCCredential, error) {
+	query := `SELECT id, host_id, driver, address, username, password, insecure FROM bmc_credential WHERE host_id = $1`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var cred httpd.BMCCredential
+	err = stmt.GetContext(ctx, &cred, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get BMC credential: %w", wrapError(err))
+	}
+	return &cred, nil
+}
+
+// GetBMCCredentialByHostID is
+func (p *Postgres) GetBMCCredentialByHostID(ctx context.Context, hostID int) (*httpd.BMCCredential, error) {
+	query := `SELECT id, host_id, driver, address, username, password, insecure FROM bmc_credential WHERE host_id = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var cred httpd.BMCCredential
+	err = stmt.GetContext(ctx, &cred, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get BMC credential: %w", wrapError(err))
+	}
+	return &cred, nil
+}
+
+// RecordBMC creates or updates the BMC discovered by DHCP. The link to the
+// host is kept. The audit entry is recorded only if the BMC is changed.
+func (p *Postgres) RecordBMC(ctx context.Context, mac types.HardwareAddr, vendorClass, hostname string, leaseID int) (*dhcpd.BMC, error) {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := getBMC(ctx, tx, `bmc.mac_address = $1`, mac)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return nil, err
+	}
+
+	query := `INSERT INTO bmc(mac_address, vendor_class, hostname, lease_id) VALUES($1, $2, $3, $4)
+ON CONFLICT(mac_address) DO UPDATE SET vendor_class = excluded.vendor_class, hostname = excluded.hostname, lease_id = excluded.lease_id`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, mac, vendorClass, hostname, leaseID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record BMC: %w", err)
+	}
+	after, err := getBMC(ctx, tx, `bmc.mac_address = $1`, mac)
+	if err != nil {
+		return nil, err
+	}
+	if before != nil && reflect.DeepEqual(*before, *after) {
+		return after, nil
+	}
+	hostID := 0
+	if after.HostID != nil {
+		hostID = *after.HostID
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditBMCRecord, hostID, before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return after, nil
+}
+
+const bmcColumns = `bmc.id AS id, bmc.mac_address AS mac_address, ip_address, vendor_class, hostname, lease_id, host_id`
+
+// getBMC returns the BMC selected by the condition in the transaction.
+func getBMC(ctx context.Context, tx *sqlx.Tx, cond string, args ...interface{}) (*dhcpd.BMC, error) {
+	query := `SELECT ` + bmcColumns + ` FROM bmc JOIN lease ON bmc.lease_id = lease.id WHERE ` + cond
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var bmc dhcpd.BMC
+	err = stmt.GetContext(ctx, &bmc, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get BMC: %w", wrapError(err))
+	}
+	return &bmc, nil
+}
+
+// GetBMCByMAC is
+func (p *Postgres) GetBMCByMAC(ctx context.Context, mac types.HardwareAddr) (*dhcpd.BMC, error) {
+	query := `SELECT ` + bmcColumns + ` FROM bmc JOIN lease ON bmc.lease_id = lease.id WHERE bmc.mac_address = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var bmc dhcpd.BMC
+	err = stmt.GetContext(ctx, &bmc, mac)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get BMC: %w", wrapError(err))
+	}
+	return &bmc, nil
+}
+
+// GetBMCByHostID is
+func (p *Postgres) GetBMCByHostID(ctx context.Context, hostID int) (*dhcpd.BMC, error) {
+	query := `SELECT ` + bmcColumns + ` FROM bmc JOIN lease ON bmc.lease_id = lease.id WHERE host_id = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var bmc dhcpd.BMC
+	err = stmt.GetContext(ctx, &bmc, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get BMC: %w", wrapError(err))
+	}
+	return &bmc, nil
+}
+
+// ListBMC is
+func (p *Postgres) ListBMC(ctx context.Context) ([]dhcpd.BMC, error) {
+	query := `SELECT ` + bmcColumns + ` FROM bmc JOIN lease ON bmc.lease_id = lease.id ORDER BY bmc.id`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var bmcs []dhcpd.BMC
+	err = stmt.SelectContext(ctx, &bmcs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get BMC list: %w", err)
+	}
+	return bmcs, nil
+}
+
+// LinkBMC links the BMC with the host. The previous BMC of the host is
+// unlinked.
+func (p *Postgres) LinkBMC(ctx context.Context, bmcID, hostID int) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := getBMC(ctx, tx, `host_id = $1`, hostID)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return err
+	}
+
+	query := `UPDATE bmc SET host_id = NULL WHERE host_id = $1`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, hostID)
+	if err != nil {
+		return fmt.Errorf("failed to unlink BMC: %w", err)
+	}
+
+	query = `UPDATE bmc SET host_id = $1 WHERE id = $2`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	ret, err := stmt.ExecContext(ctx, hostID, bmcID)
+	if err != nil {
+		return fmt.Errorf("failed to link BMC: %w", err)
+	}
+	n, err := ret.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("failed to link BMC: %w", datastore.ErrNotFound)
+	}
+	after, err := getBMC(ctx, tx, `bmc.id = $1`, bmcID)
+	if err != nil {
+		return err
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditBMCLink, hostID, before, after)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// CountHostByState returns the number of hosts keyed by the state.
+func (p *Postgres) CountHostByState(ctx context.Context) (map[string]int, error) {
+	query := `SELECT state, COUNT(*) AS count FROM host GROUP BY state`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var rows []struct {
+		State string `db:"state"`
+		Count int    `db:"count"`
+	}
+	err = stmt.SelectContext(ctx, &rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count host: %w", err)
+	}
+	counts := map[string]int{}
+	for _, r := range rows {
+		counts[r.State] = r.Count
+	}
+	return counts, nil
+}
+
+// CreateWipeReport is
+func (p *Postgres) CreateWipeReport(ctx context.Context, hostID int, report httpd.WipeReport) (*httpd.HostWipeReport, error) {
+	hr := httpd.HostWipeReport{
+		HostID:    hostID,
+		Report:    report,
+		CreatedAt: time.Now().UTC(),
+	}
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO host_wipe_report(host_id, report, created_at) VALUES($1, $2, $3) RETURNING id`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var id int
+	err = stmt.GetContext(ctx, &id, hr.HostID, hr.Report, hr.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create wipe report: %w", err)
+	}
+	hr.ID = id
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostWipeReportCreate, hostID, nil, hr)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &hr, nil
+}
+
+// ListWipeReport is
+func (p *Postgres) ListWipeReport(ctx context.Context, hostID int) ([]httpd.HostWipeReport, error) {
+	query := `SELECT id, host_id, report, created_at FROM host_wipe_report WHERE host_id = $1 ORDER BY id`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var reports []httpd.HostWipeReport
+	err = stmt.SelectContext(ctx, &reports, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get wipe report list: %w", err)
+	}
+	return reports, nil
+}
+
+// DecommissionHost releases the service and management leases and the
+// metadata token of the decommissioning host, and marks it as wiped.
+func (p *Postgres) DecommissionHost(ctx context.Context, hostID int) (*httpd.Host, error) {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host WHERE id = $1`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var host httpd.Host
+	err = stmt.GetContext(ctx, &host, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
+	}
+	if host.State != httpd.HostStateDecommissioning {
+		return nil, fmt.Errorf("%s -> %s: %w", host.State, httpd.HostStateWiped, httpd.ErrInvalidHostStateTransition)
+	}
+
+	now := time.Now().UTC()
+	query = `UPDATE host SET state = $1, state_updated_at = $2, service_lease_id = NULL, management_lease_id = NULL WHERE id = $3`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, httpd.HostStateWiped, now, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update host: %w", err)
+	}
+	err = insertHostStateTransition(ctx, tx, hostID, host.State, httpd.HostStateWiped, now)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `DELETE FROM lease WHERE id IN ($1, $2)`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, host.ServiceLeaseID, host.ManagementLeaseID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete lease: %w", err)
+	}
+
+	query = `DELETE FROM host_token WHERE host_id = $1`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete host token: %w", err)
+	}
+
+	before := host
+	host.State = httpd.HostStateWiped
+	host.StateUpdatedAt = now
+	host.ServiceLeaseID = 0
+	host.ManagementLeaseID = 0
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostDecommission, hostID, before, host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &host, nil
+}
+
+// RediscoverHost gives the wiped host the leases and moves it back to
+// discovered, so that the host is provisioned again.
+func (p *Postgres) RediscoverHost(ctx context.Context, hostID, serviceLeaseID, managementLeaseID int) (*httpd.Host, error) {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host WHERE id = $1`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var host httpd.Host
+	err = stmt.GetContext(ctx, &host, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
+	}
+	if host.State != httpd.HostStateWiped {
+		return nil, fmt.Errorf("%s -> %s: %w", host.State, httpd.HostStateDiscovered, httpd.ErrInvalidHostStateTransition)
+	}
+
+	now := time.Now().UTC()
+	query = `UPDATE host SET state = $1, state_updated_at = $2, service_lease_id = $3, management_lease_id = $4 WHERE id = $5`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, httpd.HostStateDiscovered, now, serviceLeaseID, managementLeaseID, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update host: %w", wrapError(err))
+	}
+	err = insertHostStateTransition(ctx, tx, hostID, host.State, httpd.HostStateDiscovered, now)
+	if err != nil {
+		return nil, err
+	}
+
+	before := host
+	host.State = httpd.HostStateDiscovered
+	host.StateUpdatedAt = now
+	host.ServiceLeaseID = serviceLeaseID
+	host.ManagementLeaseID = managementLeaseID
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostRediscover, hostID, before, host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &host, nil
+}
+
+// DeleteHost deletes the host with its leases and the records that belong
+// to it. The BMC linked with the host is unlinked.
+func (p *Postgres) DeleteHost(ctx context.Context, hostID int) error {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host WHERE id = $1`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var host httpd.Host
+	err = stmt.GetContext(ctx, &host, hostID)
+	if err != nil {
+		return fmt.Errorf("failed to get host: %w", wrapError(err))
+	}
+
+	query = `UPDATE bmc SET host_id = NULL WHERE host_id = $1`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, hostID)
+	if err != nil {
+		return fmt.Errorf("failed to unlink BMC: %w", err)
+	}
+
+	for _, table := range []string{"host_token", "host_key", "host_inventory", "host_state_transition", "host_wipe_report", "bmc_credential", "host_label", "host_group_member"} {
+		stmt, err = tx.Preparex(fmt.Sprintf("DELETE FROM %s WHERE host_id = $1", table))
+		if err != nil {
+			return fmt.Errorf("failed to prepare statement: %w", err)
+		}
+		_, err = stmt.ExecContext(ctx, hostID)
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %w", table, err)
+		}
+	}
+
+	// The leases are referenced by the host until it is deleted.
+	query = `DELETE FROM host WHERE id = $1 RETURNING COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var leases struct {
+		ServiceLeaseID    int `db:"service_lease_id"`
+		ManagementLeaseID int `db:"management_lease_id"`
+	}
+	err = stmt.GetContext(ctx, &leases, hostID)
+	if err != nil {
+		return fmt.Errorf("failed to delete host: %w", wrapError(err))
+	}
+
+	query = `DELETE FROM lease WHERE id IN ($1, $2)`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, leases.ServiceLeaseID, leases.ManagementLeaseID)
+	if err != nil {
+		return fmt.Errorf("failed to delete lease: %w", err)
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostDelete, hostID, host, nil)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// RecordBootEvent is
+func (p *Postgres) RecordBootEvent(ctx context.Context, e httpd.BootEvent) error {
+	query := `INSERT INTO boot_event(mac_address, ip_address, protocol, name, outcome, detail, created_at) VALUES($1, $2, $3, $4, $5, $6, $7)`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	_, err = stmt.ExecContext(ctx, e.MACAddress, e.IPAddress, e.Protocol, e.Name, e.Outcome, e.Detail, e.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record boot event: %w", err)
+	}
+	return nil
+}
+
+// ListBootEventByHost returns the latest limit boot events of the MAC
+// address and the address of the management lease of the host, in
+// chronological order.
+func (p *Postgres) ListBootEventByHost(ctx context.Context, hostID, limit int) ([]httpd.BootEvent, error) {
+	query := `SELECT * FROM (SELECT boot_event.id AS id, boot_event.mac_address AS mac_address, boot_event.ip_address AS ip_address, boot_event.protocol AS protocol, boot_event.name AS name, boot_event.outcome AS outcome, boot_event.detail AS detail, boot_event.created_at AS created_at FROM host JOIN lease ON host.management_lease_id = lease.id JOIN boot_event ON boot_event.mac_address = lease.mac_address OR boot_event.ip_address = lease.ip_address WHERE host.id = $1 ORDER BY boot_event.id DESC LIMIT $2) AS e ORDER BY id`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var events []httpd.BootEvent
+	err = stmt.SelectContext(ctx, &events, hostID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get boot event list: %w", err)
+	}
+	return events, nil
+}
+
+// PruneBootEvent deletes the boot events created before.
+func (p *Postgres) PruneBootEvent(ctx context.Context, before time.Time) error {
+	query := `DELETE FROM boot_event WHERE created_at < $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, before)
+	if err != nil {
+		return fmt.Errorf("failed to prune boot event: %w", err)
+	}
+	return nil
+}
+
+// CreateBootProfile is
+func (p *Postgres) CreateBootProfile(ctx context.Context, profile httpd.BootProfile) (*httpd.BootProfile, error) {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO boot_profile(name, kind, kernel, initrd, rootfs, cmdline, script, installer, install_disk, install_layout, diskless) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var id int
+	err = stmt.GetContext(ctx, &id, profile.Name, profile.Kind, profile.Kernel, profile.Initrd, profile.RootFS, profile.Cmdline, profile.Script, profile.Installer, profile.Disk, profile.Layout, profile.Diskless)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new boot profile: %w", wrapError(err))
+	}
+	profile.ID = id
+	err = insertAuditEntry(ctx, tx, datastore.AuditBootProfileCreate, 0, nil, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &profile, nil
+}
+
+// GetBootProfileByName is
+func (p *Postgres) GetBootProfileByName(ctx context.Context, name string) (*httpd.BootProfile, error) {
+	query := `SELECT id, name, kind, kernel, initrd, rootfs, cmdline, script, installer, install_disk, install_layout, diskless FROM boot_profile WHERE name = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var profile httpd.BootProfile
+	err = stmt.GetContext(ctx, &profile, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get boot profile: %w", wrapError(err))
+	}
+	return &profile, nil
+}
+
+// GetBootProfileByHost returns the boot profile assigned to the host.
+func (p *Postgres) GetBootProfileByHost(ctx context.Context, host httpd.Host) (*httpd.BootProfile, error) {
+	assignments, err := p.matchAssignments(ctx, "boot_profile_assignment", "boot_profile_id", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(assignments) == 0 {
+		return nil, fmt.Errorf("failed to get boot profile: %w", datastore.ErrNotFound)
+	}
+	query := `SELECT id, name, kind, kernel, initrd, rootfs, cmdline, script, installer, install_disk, install_layout, diskless FROM boot_profile WHERE id = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var profile httpd.BootProfile
+	err = stmt.GetContext(ctx, &profile, assignments[0].TargetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get boot profile: %w", wrapError(err))
+	}
+	return &profile, nil
+}
+
+// ListBootProfile is
+func (p *Postgres) ListBootProfile(ctx context.Context) ([]httpd.BootProfile, error) {
+	query := `SELECT id, name, kind, kernel, initrd, rootfs, cmdline, script, installer, install_disk, install_layout, diskless FROM boot_profile`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var profiles []httpd.BootProfile
+	err = stmt.SelectContext(ctx, &profiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get boot profile list: %w", err)
+	}
+	return profiles, nil
+}
+
+// AssignBootProfile assigns the boot profile to the scope. An existing
+// assignment for the same scope and value is replaced.
+func (p *Postgres) AssignBootProfile(ctx context.Context, scope, value string, profileID int) error {
+	value, err := datastore.ValidateScope(scope, value)
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := getAssignment(ctx, tx, "boot_profile_assignment", "boot_profile_id", scope, value)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO boot_profile_assignment(scope, value, boot_profile_id) VALUES($1, $2, $3) ON CONFLICT(scope, value) DO UPDATE SET boot_profile_id = excluded.boot_profile_id`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, scope, value, profileID)
+	if err != nil {
+		return fmt.Errorf("failed to assign boot profile: %w", err)
+	}
+	after := datastore.Assignment{Scope: scope, Value: value, TargetID: profileID}
+	err = insertAuditEntry(ctx, tx, datastore.AuditBootProfileAssign, 0, before, after)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// CreateUserdataTemplate is
+func (p *Postgres) CreateUserdataTemplate(ctx context.Context, t httpd.UserdataTemplate) (*httpd.UserdataTemplate, error) {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO userdata_template(name, template) VALUES($1, $2) RETURNING id`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var id int
+	err = stmt.GetContext(ctx, &id, t.Name, t.Template)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new user-data template: %w", wrapError(err))
+	}
+	t.ID = id
+	err = insertAuditEntry(ctx, tx, datastore.AuditUserdataTemplateCreate, 0, nil, t)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &t, nil
+}
+
+// GetUserdataTemplateByName is
+func (p *Postgres) GetUserdataTemplateByName(ctx context.Context, name string) (*httpd.UserdataTemplate, error) {
+	query := `SELECT id, name, template FROM userdata_template WHERE name = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var t httpd.UserdataTemplate
+	err = stmt.GetContext(ctx, &t, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user-data template: %w", wrapError(err))
+	}
+	return &t, nil
+}
+
+// GetUserdataTemplateByHost returns the user-data template assigned to the host.
+func (p *Postgres) GetUserdataTemplateByHost(ctx context.Context, host httpd.Host) (*httpd.UserdataTemplate, error) {
+	assignments, err := p.matchAssignments(ctx, "userdata_template_assignment", "userdata_template_id", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(assignments) == 0 {
+		return nil, fmt.Errorf("failed to get user-data template: %w", datastore.ErrNotFound)
+	}
+	query := `SELECT id, name, template FROM userdata_template WHERE id = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var t httpd.UserdataTemplate
+	err = stmt.GetContext(ctx, &t, assignments[0].TargetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user-data template: %w", wrapError(err))
+	}
+	return &t, nil
+}
+
+// ListUserdataTemplate is
+func (p *Postgres) ListUserdataTemplate(ctx context.Context) ([]httpd.UserdataTemplate, error) {
+	query := `SELECT id, name, template FROM userdata_template`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var ts []httpd.UserdataTemplate
+	err = stmt.SelectContext(ctx, &ts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user-data template list: %w", err)
+	}
+	return ts, nil
+}
+
+// AssignUserdataTemplate assigns the user-data template to the scope. An
+// existing assignment for the same scope and value is replaced.
+func (p *Postgres) AssignUserdataTemplate(ctx context.Context, scope, value string, templateID int) error {
+	value, err := datastore.ValidateScope(scope, value)
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := getAssignment(ctx, tx, "userdata_template_assignment", "userdata_template_id", scope, value)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO userdata_template_assignment(scope, value, userdata_template_id) VALUES($1, $2, $3) ON CONFLICT(scope, value) DO UPDATE SET userdata_template_id = excluded.userdata_template_id`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, scope, value, templateID)
+	if err != nil {
+		return fmt.Errorf("failed to assign user-data template: %w", err)
+	}
+	after := datastore.Assignment{Scope: scope, Value: value, TargetID: templateID}
+	err = insertAuditEntry(ctx, tx, datastore.AuditUserdataTemplateAssign, 0, before, after)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// CreateNetworkProfile is
+func (p *Postgres) CreateNetworkProfile(ctx context.Context, profile httpd.NetworkProfile) (*httpd.NetworkProfile, error) {
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO network_profile(name, bond_driver, service_vlan) VALUES($1, $2, $3) RETURNING id`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var id int
+	err = stmt.GetContext(ctx, &id, profile.Name, profile.BondDriver, profile.ServiceVLAN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new network profile: %w", wrapError(err))
+	}
+	profile.ID = id
+	err = insertAuditEntry(ctx, tx, datastore.AuditNetworkProfileCreate, 0, nil, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &profile, nil
+}
+
+// GetNetworkProfileByName is
+func (p *Postgres) GetNetworkProfileByName(ctx context.Context, name string) (*httpd.NetworkProfile, error) {
+	query := `SELECT id, name, bond_driver, service_vlan FROM network_profile WHERE name = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var profile httpd.NetworkProfile
+	err = stmt.GetContext(ctx, &profile, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network profile: %w", wrapError(err))
+	}
+	return &profile, nil
+}
+
+// GetNetworkProfileByHost returns the network profile assigned to the host.
+func (p *Postgres) GetNetworkProfileByHost(ctx context.Context, host httpd.Host) (*httpd.NetworkProfile, error) {
+	assignments, err := p.matchAssignments(ctx, "network_profile_assignment", "network_profile_id", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(assignments) == 0 {
+		return nil, fmt.Errorf("failed to get network profile: %w", datastore.ErrNotFound)
+	}
+	query := `SELECT id, name, bond_driver, service_vlan FROM network_profile WHERE id = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var profile httpd.NetworkProfile
+	err = stmt.GetContext(ctx, &profile, assignments[0].TargetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network profile: %w", wrapError(err))
+	}
+	return &profile, nil
+}
+
+// ListNetworkProfile is
+func (p *Postgres) ListNetworkProfile(ctx context.Context) ([]httpd.NetworkProfile, error) {
+	query := `SELECT id, name, bond_driver, service_vlan FROM network_profile`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var profiles []httpd.NetworkProfile
+	err = stmt.SelectContext(ctx, &profiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network profile list: %w", err)
+	}
+	return profiles, nil
+}
+
+// AssignNetworkProfile assigns the network profile to the scope. An
+// existing assignment for the same scope and value is replaced.
+func (p *Postgres) AssignNetworkProfile(ctx context.Context, scope, value string, profileID int) error {
+	value, err := datastore.ValidateScope(scope, value)
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := getAssignment(ctx, tx, "network_profile_assignment", "network_profile_id", scope, value)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO network_profile_assignment(scope, value, network_profile_id) VALUES($1, $2, $3) ON CONFLICT(scope, value) DO UPDATE SET network_profile_id = excluded.network_profile_id`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, scope, value, profileID)
+	if err != nil {
+		return fmt.Errorf("failed to assign network profile: %w", err)
+	}
+	after := datastore.Assignment{Scope: scope, Value: value, TargetID: profileID}
+	err = insertAuditEntry(ctx, tx, datastore.AuditNetworkProfileAssign, 0, before, after)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// getAssignment returns the assignment of the scope and the value in the
+// table, or nil if it is not assigned.
+func getAssignment(ctx context.Context, tx *sqlx.Tx, table, column, scope, value string) (*datastore.Assignment, error) {
+	query := fmt.Sprintf(`SELECT scope, value, %s AS target_id FROM %s WHERE scope = $1 AND value = $2`, column, table)
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var a datastore.Assignment
+	err = stmt.GetContext(ctx, &a, scope, value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get assignment: %w", err)
+	}
+	return &a, nil
+}
+
+// ListUser is
+func (p *Postgres) ListUser(ctx context.Context) ([]httpd.User, error) {
+	query := `SELECT id, name FROM "user"`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var users []httpd.User
+	err = stmt.SelectContext(ctx, &users)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user list: %w", err)
+	}
+	return users, nil
+}
+
+// ListKeyByUserID is
+func (p *Postgres) ListKeyByUserID(ctx context.Context, userID int) ([]httpd.Key, error) {
+	query := `SELECT id, key, user_id FROM key WHERE user_id = $1`
+	stmt, err := p.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var keys []httpd.Key
+	err = stmt.SelectContext(ctx, &keys, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key list: %w", err)
+	}
+	return keys, nil
+}
+
+// Close closes the database connections.
+func (p *Postgres) Close() error {
+	return p.db.Close()
+}
+
+// wrapError classifies the error of the driver as a sentinel error of
+// datastore.
+func wrapError(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return &datastore.Error{Sentinel: datastore.ErrNotFound, Err: err}
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation" {
+		return &datastore.Error{Sentinel: datastore.ErrConflict, Err: err}
+	}
+	return err
+}
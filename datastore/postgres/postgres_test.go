@@ -0,0 +1,170 @@
+package postgres_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/datastore/datastoretest"
+	"github.com/lovi-cloud/ursa/datastore/postgres"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// dsnEnv is the environment variable of the dsn of the database to test
+// against, e.g. "postgres://ursa@localhost/ursa_test?sslmode=disable".
+// Every table in the public schema of the database is dropped by the tests.
+const dsnEnv = "URSA_TEST_POSTGRES_DSN"
+
+// newDSN returns the dsn of the empty database, or skips the test if dsnEnv
+// is not set.
+func newDSN(t *testing.T) string {
+	t.Helper()
+	dsn := os.Getenv(dsnEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", dsnEnv)
+	}
+	db, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`DROP SCHEMA public CASCADE; CREATE SCHEMA public`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dsn
+}
+
+func TestConformance(t *testing.T) {
+	if os.Getenv(dsnEnv) == "" {
+		t.Skipf("%s is not set", dsnEnv)
+	}
+	datastoretest.Run(t, func(t *testing.T) datastore.Datastore {
+		ds, err := postgres.New(context.Background(), newDSN(t), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ds
+	})
+}
+
+// baselineSchema is a part of the schema created before the migrations were
+// introduced.
+var baselineSchema = []string{
+	`CREATE TABLE subnet(
+id INTEGER PRIMARY KEY,
+network TEXT NOT NULL,
+start TEXT NOT NULL UNIQUE,
+"end" TEXT NOT NULL UNIQUE,
+gateway TEXT UNIQUE,
+dns_server TEXT
+)`,
+	`CREATE TABLE lease(
+id SERIAL PRIMARY KEY,
+mac_address TEXT NOT NULL,
+ip_address TEXT NOT NULL UNIQUE,
+subnet_id INTEGER NOT NULL REFERENCES subnet(id) ON DELETE RESTRICT,
+UNIQUE(mac_address, subnet_id)
+)`,
+	`CREATE TABLE host(
+id SERIAL PRIMARY KEY,
+uuid TEXT NOT NULL UNIQUE,
+name TEXT NOT NULL UNIQUE,
+serial TEXT NOT NULL,
+product TEXT NOT NULL,
+manufacturer TEXT NOT NULL,
+service_lease_id INTEGER UNIQUE REFERENCES lease(id) ON DELETE RESTRICT,
+management_lease_id INTEGER UNIQUE REFERENCES lease(id) ON DELETE RESTRICT,
+state TEXT NOT NULL DEFAULT 'discovered',
+state_updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+instance_id TEXT NOT NULL DEFAULT '',
+phoned_home_at TIMESTAMPTZ
+)`,
+	`CREATE TABLE "user"(
+id SERIAL PRIMARY KEY,
+name TEXT NOT NULL UNIQUE
+)`,
+	`CREATE TABLE key(
+id SERIAL PRIMARY KEY,
+key TEXT NOT NULL UNIQUE,
+user_id INTEGER NOT NULL REFERENCES "user"(id) ON DELETE RESTRICT
+)`,
+	`INSERT INTO subnet(id, network, start, "end", gateway, dns_server) VALUES(0, '10.0.0.0/24', '10.0.0.1', '10.0.0.99', NULL, NULL)`,
+	`INSERT INTO subnet(id, network, start, "end", gateway, dns_server) VALUES(1, '192.168.0.0/24', '192.168.0.1', '192.168.0.99', '192.168.0.254', '8.8.8.8')`,
+	`INSERT INTO lease(mac_address, ip_address, subnet_id) VALUES('52:54:00:00:00:01', '192.168.0.1', 1)`,
+	`INSERT INTO lease(mac_address, ip_address, subnet_id) VALUES('52:54:00:00:00:01', '10.0.0.1', 0)`,
+	`INSERT INTO host(uuid, name, serial, product, manufacturer, service_lease_id, management_lease_id) VALUES('6ba7b812-9dad-11d1-80b4-00c04fd430c8', 'cn0001', 'sn1', 'PowerEdge R640', 'Dell Inc.', 1, 2)`,
+	`INSERT INTO "user"(name) VALUES('alice')`,
+	`INSERT INTO key(key, user_id) VALUES('ssh-ed25519 AAAA alice', 1)`,
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	ctx := context.Background()
+	dsn := newDSN(t)
+	db, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range baselineSchema {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from, to, err := postgres.Migrate(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 0 || to == 0 {
+		t.Fatalf("unexpected versions: %d, %d", from, to)
+	}
+	// Migrating again does nothing.
+	again, to2, err := postgres.Migrate(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != to || to2 != to {
+		t.Fatalf("want %d, but got %d, %d", to, again, to2)
+	}
+	var versions []int
+	err = db.Select(&versions, `SELECT version FROM schema_version ORDER BY version`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != to || versions[len(versions)-1] != to {
+		t.Fatalf("unexpected schema versions: %v", versions)
+	}
+
+	ds, err := postgres.New(ctx, dsn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	host, err := ds.GetHostByUUID(ctx, uuid.FromStringOrNil("6ba7b812-9dad-11d1-80b4-00c04fd430c8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.Name != "cn0001" || host.Product != "PowerEdge R640" || host.State != httpd.HostStateDiscovered {
+		t.Fatalf("unexpected host: %+v", host)
+	}
+	users, err := ds.ListUser(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Name != "alice" {
+		t.Fatalf("unexpected users: %+v", users)
+	}
+	keys, err := ds.ListKeyByUserID(ctx, users[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Key != "ssh-ed25519 AAAA alice" {
+		t.Fatalf("unexpected keys: %+v", keys)
+	}
+}
@@ -0,0 +1,229 @@
+package postgres
+
+// migrations are applied in order and the version of the schema is the
+// number of the applied migrations. Append a new migration to change the
+// schema, never edit an applied one. A table must be created after the
+// tables that it references.
+var migrations = []migration{
+	{
+		description: "create tables",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS subnet(
+id INTEGER PRIMARY KEY,
+network TEXT NOT NULL,
+start TEXT NOT NULL UNIQUE,
+"end" TEXT NOT NULL UNIQUE,
+gateway TEXT UNIQUE,
+dns_server TEXT
+)`,
+			`CREATE TABLE IF NOT EXISTS lease(
+id SERIAL PRIMARY KEY,
+mac_address TEXT NOT NULL,
+ip_address TEXT NOT NULL UNIQUE,
+subnet_id INTEGER NOT NULL REFERENCES subnet(id) ON DELETE RESTRICT,
+UNIQUE(mac_address, subnet_id)
+)`,
+			`CREATE TABLE IF NOT EXISTS host(
+id SERIAL PRIMARY KEY,
+uuid TEXT NOT NULL UNIQUE,
+name TEXT NOT NULL UNIQUE,
+serial TEXT NOT NULL,
+product TEXT NOT NULL,
+manufacturer TEXT NOT NULL,
+service_lease_id INTEGER UNIQUE REFERENCES lease(id) ON DELETE RESTRICT,
+management_lease_id INTEGER UNIQUE REFERENCES lease(id) ON DELETE RESTRICT,
+state TEXT NOT NULL DEFAULT 'discovered',
+state_updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+instance_id TEXT NOT NULL DEFAULT '',
+phoned_home_at TIMESTAMPTZ
+)`,
+			`CREATE TABLE IF NOT EXISTS "user"(
+id SERIAL PRIMARY KEY,
+name TEXT NOT NULL UNIQUE
+)`,
+			`CREATE TABLE IF NOT EXISTS key(
+id SERIAL PRIMARY KEY,
+key TEXT NOT NULL UNIQUE,
+user_id INTEGER NOT NULL REFERENCES "user"(id) ON DELETE RESTRICT
+)`,
+			`CREATE TABLE IF NOT EXISTS boot_profile(
+id SERIAL PRIMARY KEY,
+name TEXT NOT NULL UNIQUE,
+kind TEXT NOT NULL,
+kernel TEXT NOT NULL DEFAULT '',
+initrd TEXT NOT NULL DEFAULT '',
+rootfs TEXT NOT NULL DEFAULT '',
+cmdline TEXT NOT NULL DEFAULT '',
+script TEXT NOT NULL DEFAULT '',
+installer TEXT NOT NULL DEFAULT '',
+install_disk TEXT NOT NULL DEFAULT '',
+install_layout TEXT NOT NULL DEFAULT ''
+)`,
+			`CREATE TABLE IF NOT EXISTS boot_profile_assignment(
+id SERIAL PRIMARY KEY,
+scope TEXT NOT NULL,
+value TEXT NOT NULL,
+boot_profile_id INTEGER NOT NULL REFERENCES boot_profile(id) ON DELETE CASCADE,
+UNIQUE(scope, value)
+)`,
+			`CREATE TABLE IF NOT EXISTS host_state_transition(
+id SERIAL PRIMARY KEY,
+host_id INTEGER NOT NULL REFERENCES host(id) ON DELETE CASCADE,
+from_state TEXT NOT NULL,
+to_state TEXT NOT NULL,
+created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`,
+			`CREATE TABLE IF NOT EXISTS host_key(
+id SERIAL PRIMARY KEY,
+host_id INTEGER NOT NULL REFERENCES host(id) ON DELETE CASCADE,
+type TEXT NOT NULL,
+key TEXT NOT NULL,
+UNIQUE(host_id, type)
+)`,
+			`CREATE TABLE IF NOT EXISTS userdata_template(
+id SERIAL PRIMARY KEY,
+name TEXT NOT NULL UNIQUE,
+template TEXT NOT NULL
+)`,
+			`CREATE TABLE IF NOT EXISTS userdata_template_assignment(
+id SERIAL PRIMARY KEY,
+scope TEXT NOT NULL,
+value TEXT NOT NULL,
+userdata_template_id INTEGER NOT NULL REFERENCES userdata_template(id) ON DELETE CASCADE,
+UNIQUE(scope, value)
+)`,
+			`CREATE TABLE IF NOT EXISTS host_token(
+host_id INTEGER PRIMARY KEY REFERENCES host(id) ON DELETE CASCADE,
+token_hash TEXT NOT NULL UNIQUE,
+created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`,
+			`CREATE TABLE IF NOT EXISTS host_inventory(
+id SERIAL PRIMARY KEY,
+host_id INTEGER NOT NULL REFERENCES host(id) ON DELETE CASCADE,
+version INTEGER NOT NULL,
+inventory TEXT NOT NULL,
+created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+UNIQUE(host_id, version)
+)`,
+			`CREATE TABLE IF NOT EXISTS bmc_credential(
+id SERIAL PRIMARY KEY,
+host_id INTEGER NOT NULL UNIQUE REFERENCES host(id) ON DELETE CASCADE,
+driver TEXT NOT NULL,
+address TEXT NOT NULL,
+username TEXT NOT NULL,
+password TEXT NOT NULL,
+insecure BOOLEAN NOT NULL DEFAULT FALSE
+)`,
+			`CREATE TABLE IF NOT EXISTS bmc(
+id SERIAL PRIMARY KEY,
+mac_address TEXT NOT NULL UNIQUE,
+vendor_class TEXT NOT NULL DEFAULT '',
+hostname TEXT NOT NULL DEFAULT '',
+lease_id INTEGER NOT NULL UNIQUE REFERENCES lease(id) ON DELETE CASCADE,
+host_id INTEGER UNIQUE REFERENCES host(id) ON DELETE SET NULL
+)`,
+			`CREATE TABLE IF NOT EXISTS host_wipe_report(
+id SERIAL PRIMARY KEY,
+host_id INTEGER NOT NULL REFERENCES host(id) ON DELETE CASCADE,
+report TEXT NOT NULL,
+created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`,
+			`CREATE TABLE IF NOT EXISTS boot_event(
+id SERIAL PRIMARY KEY,
+mac_address TEXT NOT NULL DEFAULT '',
+ip_address TEXT NOT NULL DEFAULT '',
+protocol TEXT NOT NULL,
+name TEXT NOT NULL,
+outcome TEXT NOT NULL,
+detail TEXT NOT NULL DEFAULT '',
+created_at TIMESTAMPTZ NOT NULL
+)`,
+		},
+	},
+	{
+		description: "create audit log",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS audit_log(
+id SERIAL PRIMARY KEY,
+actor TEXT NOT NULL,
+action TEXT NOT NULL,
+host_id INTEGER,
+before_value TEXT NOT NULL DEFAULT 'null',
+after_value TEXT NOT NULL DEFAULT 'null',
+created_at TIMESTAMPTZ NOT NULL
+)`,
+			`CREATE INDEX IF NOT EXISTS audit_log_host_id ON audit_log(host_id)`,
+			`CREATE INDEX IF NOT EXISTS audit_log_created_at ON audit_log(created_at)`,
+			`CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN RAISE EXCEPTION 'audit_log is append-only'; END
+$$ LANGUAGE plpgsql`,
+			`CREATE TRIGGER audit_log_no_update_delete BEFORE UPDATE OR DELETE ON audit_log
+FOR EACH ROW EXECUTE PROCEDURE audit_log_append_only()`,
+			`CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+FOR EACH STATEMENT EXECUTE PROCEDURE audit_log_append_only()`,
+		},
+	},
+	{
+		description: "create hostname sequence",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS hostname_sequence(
+scope TEXT PRIMARY KEY,
+value INTEGER NOT NULL
+)`,
+		},
+	},
+	{
+		description: "create host labels, host groups and user access",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS host_label(
+host_id INTEGER NOT NULL REFERENCES host(id) ON DELETE CASCADE,
+key TEXT NOT NULL,
+value TEXT NOT NULL,
+PRIMARY KEY(host_id, key)
+)`,
+			`CREATE TABLE IF NOT EXISTS host_group(
+id SERIAL PRIMARY KEY,
+name TEXT NOT NULL UNIQUE
+)`,
+			`CREATE TABLE IF NOT EXISTS host_group_member(
+group_id INTEGER NOT NULL REFERENCES host_group(id) ON DELETE CASCADE,
+host_id INTEGER NOT NULL REFERENCES host(id) ON DELETE CASCADE,
+PRIMARY KEY(group_id, host_id)
+)`,
+			`CREATE TABLE IF NOT EXISTS user_access(
+id SERIAL PRIMARY KEY,
+user_id INTEGER NOT NULL REFERENCES "user"(id) ON DELETE CASCADE,
+scope TEXT NOT NULL,
+value TEXT NOT NULL,
+UNIQUE(user_id, scope, value)
+)`,
+		},
+	},
+	{
+		// Ignition profiles boot from the network only, so they keep
+		// booting after the host is provisioned as they did before.
+		description: "add diskless boot profiles",
+		statements: []string{
+			`ALTER TABLE boot_profile ADD COLUMN diskless BOOLEAN NOT NULL DEFAULT FALSE`,
+			`UPDATE boot_profile SET diskless = TRUE WHERE kind = 'ignition'`,
+		},
+	},
+	{
+		description: "create network profiles",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS network_profile(
+id SERIAL PRIMARY KEY,
+name TEXT NOT NULL UNIQUE,
+bond_driver TEXT NOT NULL DEFAULT '',
+service_vlan INTEGER NOT NULL DEFAULT 0
+)`,
+			`CREATE TABLE IF NOT EXISTS network_profile_assignment(
+id SERIAL PRIMARY KEY,
+scope TEXT NOT NULL,
+value TEXT NOT NULL,
+network_profile_id INTEGER NOT NULL REFERENCES network_profile(id) ON DELETE CASCADE,
+UNIQUE(scope, value)
+)`,
+		},
+	},
+}
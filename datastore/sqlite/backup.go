@@ -0,0 +1,78 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Backup writes a consistent copy of the database to path by the online
+// backup API of SQLite. The database can be used during the backup. The
+// copy is written to a temporary file and renamed, so path is never left
+// incomplete.
+func (s *SQLite) Backup(ctx context.Context, path string) error {
+	tmp := path + ".tmp"
+	err := os.Remove(tmp)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", tmp, err)
+	}
+	err = backup(ctx, s.db.DB, tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return fmt.Errorf("failed to rename backup: %w", err)
+	}
+	return nil
+}
+
+func backup(ctx context.Context, src *sql.DB, path string) error {
+	dst, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer dst.Close()
+
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to backup: %w", err)
+	}
+	defer dstConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer srcConn.Close()
+
+	return dstConn.Raw(func(dc interface{}) error {
+		return srcConn.Raw(func(sc interface{}) error {
+			d, ok := dc.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("unexpected connection of backup: %T", dc)
+			}
+			s, ok := sc.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("unexpected connection of database: %T", sc)
+			}
+			b, err := d.Backup("main", s, "main")
+			if err != nil {
+				return fmt.Errorf("failed to start backup: %w", err)
+			}
+			_, err = b.Step(-1)
+			if err != nil {
+				b.Finish()
+				return fmt.Errorf("failed to back up: %w", err)
+			}
+			err = b.Finish()
+			if err != nil {
+				return fmt.Errorf("failed to finish backup: %w", err)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,170 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/types"
+)
+
+// nextHostnameSequence increments the hostname sequence of the scope in
+// the transaction and returns the new value.
+func nextHostnameSequence(ctx context.Context, tx *sqlx.Tx, scope string) (int, error) {
+	query := `INSERT INTO hostname_sequence(scope, value) VALUES(?, 1) ON CONFLICT(scope) DO UPDATE SET value = value + 1`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, scope)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update hostname sequence: %w", err)
+	}
+
+	query = `SELECT value FROM hostname_sequence WHERE scope = ?`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var value int
+	err = stmt.GetContext(ctx, &value, scope)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get hostname sequence: %w", err)
+	}
+	return value, nil
+}
+
+// generateHostname renders the name of the host with a new sequence number
+// of its product, falling back to the other names of Naming.Hostnames if
+// the name is taken. inventory may be nil.
+func (s *SQLite) generateHostname(ctx context.Context, tx *sqlx.Tx, host httpd.Host, inventory *httpd.Inventory) (string, error) {
+	seq, err := nextHostnameSequence(ctx, tx, datastore.ProductSeqScope(host.Product))
+	if err != nil {
+		return "", err
+	}
+	var mac types.HardwareAddr
+	if inventory != nil {
+		query := `SELECT mac_address FROM lease WHERE id = ?`
+		stmt, err := tx.Preparex(query)
+		if err != nil {
+			return "", fmt.Errorf("failed to prepare statement: %w", err)
+		}
+		err = stmt.GetContext(ctx, &mac, host.ManagementLeaseID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("failed to get lease: %w", err)
+		}
+	}
+	labels, err := getHostLabels(ctx, tx, host.ID)
+	if err != nil {
+		return "", err
+	}
+	names, err := s.naming.Hostnames(datastore.NewHostnameData(host, seq, inventory, mac, labels))
+	if err != nil {
+		return "", fmt.Errorf("failed to generate hostname: %w", err)
+	}
+	return pickHostname(ctx, tx, host.ID, names)
+}
+
+// pickHostname returns the first name of names that no other host has.
+func pickHostname(ctx context.Context, tx *sqlx.Tx, hostID int, names []string) (string, error) {
+	query := `SELECT COUNT(*) FROM host WHERE name = ? AND id != ?`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return "", fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	for _, name := range names {
+		var count int
+		err = stmt.GetContext(ctx, &count, name, hostID)
+		if err != nil {
+			return "", fmt.Errorf("failed to count host: %w", err)
+		}
+		if count == 0 {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("failed to generate hostname %s: %w", names[0], datastore.ErrConflict)
+}
+
+func updateHostname(ctx context.Context, tx *sqlx.Tx, hostID int, name string) error {
+	query := `UPDATE host SET name = ? WHERE id = ?`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, name, hostID)
+	if err != nil {
+		return fmt.Errorf("failed to update hostname: %w", wrapError(err))
+	}
+	return nil
+}
+
+// RenameHost renames the host. An empty name renders the naming template
+// again with the latest inventory of the host.
+func (s *SQLite) RenameHost(ctx context.Context, hostID int, name string) (*httpd.Host, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host WHERE id = ?`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var host httpd.Host
+	err = stmt.GetContext(ctx, &host, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
+	}
+
+	if name == "" {
+		query = `SELECT inventory FROM host_inventory WHERE host_id = ? ORDER BY version DESC LIMIT 1`
+		stmt, err = tx.Preparex(query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare statement: %w", err)
+		}
+		var inventory *httpd.Inventory
+		var i httpd.Inventory
+		err = stmt.GetContext(ctx, &i, hostID)
+		if err == nil {
+			inventory = &i
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("failed to get host inventory: %w", err)
+		}
+		name, err = s.generateHostname(ctx, tx, host, inventory)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = datastore.ValidateHostname(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if name == host.Name {
+		return &host, nil
+	}
+
+	err = updateHostname(ctx, tx, hostID, name)
+	if err != nil {
+		return nil, err
+	}
+	before := host
+	host.Name = name
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostRename, hostID, before, host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &host, nil
+}
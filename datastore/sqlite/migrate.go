@@ -0,0 +1,170 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// migration is a set of statements that changes the schema.
+type migration struct {
+	description string
+	statements  []string
+}
+
+var createTableRegexp = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\w+)\(`)
+
+// Migrate applies the migrations that are not applied yet to the database
+// of dsn, and returns the versions of the schema before and after.
+func Migrate(ctx context.Context, dsn string) (int, int, error) {
+	db, err := open(dsn)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer db.Close()
+	return migrate(ctx, db)
+}
+
+func migrate(ctx context.Context, db *sqlx.DB) (int, int, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version(
+version INTEGER PRIMARY KEY,
+description TEXT NOT NULL,
+applied_at DATETIME NOT NULL
+)`)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create schema_version: %w", err)
+	}
+	var from int
+	err = tx.GetContext(ctx, &from, `SELECT COALESCE(MAX(version), 0) FROM schema_version`)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get schema version: %w", err)
+	}
+	if from > len(migrations) {
+		return 0, 0, fmt.Errorf("schema version %d is newer than this ursa (%d)", from, len(migrations))
+	}
+
+	if from == 0 {
+		err = adoptLegacySchema(ctx, tx)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	for i := from; i < len(migrations); i++ {
+		m := migrations[i]
+		for _, stmt := range m.statements {
+			_, err = tx.ExecContext(ctx, stmt)
+			if err != nil {
+				return 0, 0, fmt.Errorf("failed to migrate to version %d (%s): %w", i+1, m.description, err)
+			}
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_version(version, description, applied_at) VALUES(?, ?, ?)`, i+1, m.description, time.Now().UTC())
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to record schema version: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return from, len(migrations), nil
+}
+
+// adoptLegacySchema rebuilds the tables created before the migrations were
+// introduced with the definitions of the first migration. The columns that
+// exist in both are copied, and the added columns get the default values.
+func adoptLegacySchema(ctx context.Context, tx *sqlx.Tx) error {
+	for _, stmt := range migrations[0].statements {
+		m := createTableRegexp.FindStringSubmatch(stmt)
+		if m == nil {
+			continue
+		}
+		table := m[1]
+		var n int
+		err := tx.GetContext(ctx, &n, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, table)
+		if err != nil {
+			return fmt.Errorf("failed to find table %s: %w", table, err)
+		}
+		if n == 0 {
+			continue
+		}
+		err = rebuildTable(ctx, tx, table, stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildTable recreates the table with the statement and copies the rows.
+func rebuildTable(ctx context.Context, tx *sqlx.Tx, table, stmt string) error {
+	tmp := table + "_migrating"
+	_, err := tx.ExecContext(ctx, strings.Replace(stmt, "IF NOT EXISTS "+table+"(", `"`+tmp+`"(`, 1))
+	if err != nil {
+		return fmt.Errorf("failed to create table %s: %w", tmp, err)
+	}
+	oldColumns, err := tableColumns(ctx, tx, table)
+	if err != nil {
+		return err
+	}
+	exists := map[string]bool{}
+	for _, c := range oldColumns {
+		exists[c] = true
+	}
+	newColumns, err := tableColumns(ctx, tx, tmp)
+	if err != nil {
+		return err
+	}
+	var columns []string
+	for _, c := range newColumns {
+		if exists[c] {
+			columns = append(columns, `"`+c+`"`)
+		}
+	}
+
+	for _, q := range []string{
+		fmt.Sprintf(`INSERT INTO "%s"(%s) SELECT %s FROM "%s"`, tmp, strings.Join(columns, ", "), strings.Join(columns, ", "), table),
+		fmt.Sprintf(`DROP TABLE "%s"`, table),
+		fmt.Sprintf(`ALTER TABLE "%s" RENAME TO "%s"`, tmp, table),
+	} {
+		_, err = tx.ExecContext(ctx, q)
+		if err != nil {
+			return fmt.Errorf("failed to rebuild table %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// tableColumns returns the column names of the table in order.
+func tableColumns(ctx context.Context, tx *sqlx.Tx, table string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`PRAGMA table_info("%s")`, table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, typ        string
+			defaultValue     interface{}
+		)
+		err = rows.Scan(&cid, &name, &typ, &notNull, &defaultValue, &pk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get columns of %s: %w", table, err)
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
@@ -0,0 +1,151 @@
+package sqlite_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/lovi-cloud/ursa/datastore/sqlite"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// baselineSchema is the schema created before the migrations were
+// introduced.
+var baselineSchema = []string{
+	`CREATE TABLE IF NOT EXISTS subnet(
+id INTEGER PRIMARY KEY,
+network TEXT NOT NULL UNIQUE,
+start TEXT NOT NULL UNIQUE,
+end TEXT NOT NULL UNIQUE,
+gateway TEXT UNIQUE,
+dns_server TEXT 
+)`,
+	`CREATE TABLE IF NOT EXISTS lease(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+mac_address TEXT NOT NULL,
+ip_address TEXT NOT NULL UNIQUE,
+subnet_id INTEGER NOT NULL,
+UNIQUE(mac_address, subnet_id),
+FOREIGN KEY(subnet_id) REFERENCES subnet(id) ON DELETE RESTRICT
+)`,
+	`CREATE TABLE IF NOT EXISTS host(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+uuid TEXT NOT NULL UNIQUE,
+name TEXT NOT NULL UNIQUE,
+serial TEXT NOT NULL,
+product TEXT NOT NULL,
+manufacturer TEXT NOT NULL,
+service_lease_id INTEGER NOT NULL UNIQUE,
+management_lease_id INTEGER NOT NULL UNIQUE,
+FOREIGN KEY(service_lease_id) REFERENCES lease(id) ON DELETE RESTRICT,
+FOREIGN KEY(management_lease_id) REFERENCES lease(id) ON DELETE RESTRICT
+)`,
+	`CREATE TABLE IF NOT EXISTS user(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+name TEXT NOT NULL UNIQUE
+)`,
+	`CREATE TABLE IF NOT EXISTS key(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+key TEXT NOT NULL UNIQUE,
+user_id INTEGER NOT NULL,
+FOREIGN KEY(user_id) REFERENCES user(id) ON DELETE RESTRICT
+)`,
+	`INSERT INTO subnet(id, network, start, end, gateway, dns_server) VALUES(0, '10.0.0.0/24', '10.0.0.1', '10.0.0.99', NULL, NULL)`,
+	`INSERT INTO subnet(id, network, start, end, gateway, dns_server) VALUES(1, '192.168.0.0/24', '192.168.0.1', '192.168.0.99', '192.168.0.254', '8.8.8.8')`,
+	`INSERT INTO lease(id, mac_address, ip_address, subnet_id) VALUES(1, '52:54:00:00:00:01', '192.168.0.1', 1)`,
+	`INSERT INTO lease(id, mac_address, ip_address, subnet_id) VALUES(2, '52:54:00:00:00:01', '10.0.0.1', 0)`,
+	`INSERT INTO host(id, uuid, name, serial, product, manufacturer, service_lease_id, management_lease_id) VALUES(1, '6ba7b812-9dad-11d1-80b4-00c04fd430c8', 'cn0001', 'sn1', 'PowerEdge R640', 'Dell Inc.', 1, 2)`,
+	`INSERT INTO user(id, name) VALUES(1, 'alice')`,
+	`INSERT INTO key(id, key, user_id) VALUES(1, 'ssh-ed25519 AAAA alice', 1)`,
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	ctx := context.Background()
+	dsn := newDSN(t)
+	db, err := sqlx.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range baselineSchema {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	from, to, err := sqlite.Migrate(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 0 || to == 0 {
+		t.Fatalf("unexpected versions: %d, %d", from, to)
+	}
+	// Migrating again does nothing.
+	again, to2, err := sqlite.Migrate(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != to || to2 != to {
+		t.Fatalf("want %d, but got %d, %d", to, again, to2)
+	}
+
+	db, err = sqlx.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var versions []int
+	err = db.Select(&versions, `SELECT version FROM schema_version ORDER BY version`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != to || versions[len(versions)-1] != to {
+		t.Fatalf("unexpected schema versions: %v", versions)
+	}
+
+	ds, err := sqlite.New(ctx, dsn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	host, err := ds.GetHostByUUID(ctx, uuid.FromStringOrNil("6ba7b812-9dad-11d1-80b4-00c04fd430c8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.ID != 1 || host.Name != "cn0001" || host.Product != "PowerEdge R640" || host.ServiceLeaseID != 1 || host.ManagementLeaseID != 2 || host.State != httpd.HostStateDiscovered {
+		t.Fatalf("unexpected host: %+v", host)
+	}
+	lease, err := ds.GetLeaseByID(ctx, host.ManagementLeaseID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.IPAddress.String() != "10.0.0.1" {
+		t.Fatalf("unexpected lease: %+v", lease)
+	}
+	users, err := ds.ListUser(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Name != "alice" {
+		t.Fatalf("unexpected users: %+v", users)
+	}
+	keys, err := ds.ListKeyByUserID(ctx, users[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Key != "ssh-ed25519 AAAA alice" {
+		t.Fatalf("unexpected keys: %+v", keys)
+	}
+
+	// The migrated database works as a new one.
+	subnet, err := ds.GetServiceSubnet(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subnet.Network.String() != "192.168.0.0/24" {
+		t.Fatalf("unexpected subnet: %+v", subnet)
+	}
+}
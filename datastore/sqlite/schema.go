@@ -1,15 +1,21 @@
 package sqlite
 
-var tables = map[string]string{
-	"subnet": `CREATE TABLE IF NOT EXISTS subnet(
+// migrations are applied in order and the version of the schema is the
+// number of the applied migrations. Append a new migration to change the
+// schema, never edit an applied one.
+var migrations = []migration{
+	{
+		description: "create tables",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS subnet(
 id INTEGER PRIMARY KEY,
-network TEXT NOT NULL UNIQUE,
+network TEXT NOT NULL,
 start TEXT NOT NULL UNIQUE,
 end TEXT NOT NULL UNIQUE,
 gateway TEXT UNIQUE,
-dns_server TEXT 
+dns_server TEXT
 )`,
-	"lease": `CREATE TABLE IF NOT EXISTS lease(
+			`CREATE TABLE IF NOT EXISTS lease(
 id INTEGER PRIMARY KEY AUTOINCREMENT,
 mac_address TEXT NOT NULL,
 ip_address TEXT NOT NULL UNIQUE,
@@ -17,26 +23,222 @@ subnet_id INTEGER NOT NULL,
 UNIQUE(mac_address, subnet_id),
 FOREIGN KEY(subnet_id) REFERENCES subnet(id) ON DELETE RESTRICT
 )`,
-	"host": `CREATE TABLE IF NOT EXISTS host(
+			`CREATE TABLE IF NOT EXISTS host(
 id INTEGER PRIMARY KEY AUTOINCREMENT,
 uuid TEXT NOT NULL UNIQUE,
 name TEXT NOT NULL UNIQUE,
 serial TEXT NOT NULL,
 product TEXT NOT NULL,
 manufacturer TEXT NOT NULL,
-service_lease_id INTEGER NOT NULL UNIQUE,
-management_lease_id INTEGER NOT NULL UNIQUE,
+service_lease_id INTEGER UNIQUE,
+management_lease_id INTEGER UNIQUE,
+state TEXT NOT NULL DEFAULT 'discovered',
+state_updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+instance_id TEXT NOT NULL DEFAULT '',
+phoned_home_at DATETIME,
 FOREIGN KEY(service_lease_id) REFERENCES lease(id) ON DELETE RESTRICT,
 FOREIGN KEY(management_lease_id) REFERENCES lease(id) ON DELETE RESTRICT
 )`,
-	"user": `CREATE TABLE IF NOT EXISTS user(
+			`CREATE TABLE IF NOT EXISTS user(
 id INTEGER PRIMARY KEY AUTOINCREMENT,
 name TEXT NOT NULL UNIQUE
 )`,
-	"key": `CREATE TABLE IF NOT EXISTS key(
+			`CREATE TABLE IF NOT EXISTS key(
 id INTEGER PRIMARY KEY AUTOINCREMENT,
 key TEXT NOT NULL UNIQUE,
 user_id INTEGER NOT NULL,
 FOREIGN KEY(user_id) REFERENCES user(id) ON DELETE RESTRICT
 )`,
+			`CREATE TABLE IF NOT EXISTS boot_profile(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+name TEXT NOT NULL UNIQUE,
+kind TEXT NOT NULL,
+kernel TEXT NOT NULL DEFAULT '',
+initrd TEXT NOT NULL DEFAULT '',
+rootfs TEXT NOT NULL DEFAULT '',
+cmdline TEXT NOT NULL DEFAULT '',
+script TEXT NOT NULL DEFAULT '',
+installer TEXT NOT NULL DEFAULT '',
+install_disk TEXT NOT NULL DEFAULT '',
+install_layout TEXT NOT NULL DEFAULT ''
+)`,
+			`CREATE TABLE IF NOT EXISTS boot_profile_assignment(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+scope TEXT NOT NULL,
+value TEXT NOT NULL,
+boot_profile_id INTEGER NOT NULL,
+UNIQUE(scope, value),
+FOREIGN KEY(boot_profile_id) REFERENCES boot_profile(id) ON DELETE CASCADE
+)`,
+			`CREATE TABLE IF NOT EXISTS host_state_transition(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+host_id INTEGER NOT NULL,
+from_state TEXT NOT NULL,
+to_state TEXT NOT NULL,
+created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+FOREIGN KEY(host_id) REFERENCES host(id) ON DELETE CASCADE
+)`,
+			`CREATE TABLE IF NOT EXISTS host_key(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+host_id INTEGER NOT NULL,
+type TEXT NOT NULL,
+key TEXT NOT NULL,
+UNIQUE(host_id, type),
+FOREIGN KEY(host_id) REFERENCES host(id) ON DELETE CASCADE
+)`,
+			`CREATE TABLE IF NOT EXISTS userdata_template(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+name TEXT NOT NULL UNIQUE,
+template TEXT NOT NULL
+)`,
+			`CREATE TABLE IF NOT EXISTS userdata_template_assignment(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+scope TEXT NOT NULL,
+value TEXT NOT NULL,
+userdata_template_id INTEGER NOT NULL,
+UNIQUE(scope, value),
+FOREIGN KEY(userdata_template_id) REFERENCES userdata_template(id) ON DELETE CASCADE
+)`,
+			`CREATE TABLE IF NOT EXISTS host_token(
+host_id INTEGER PRIMARY KEY,
+token_hash TEXT NOT NULL UNIQUE,
+created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+FOREIGN KEY(host_id) REFERENCES host(id) ON DELETE CASCADE
+)`,
+			`CREATE TABLE IF NOT EXISTS host_inventory(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+host_id INTEGER NOT NULL,
+version INTEGER NOT NULL,
+inventory TEXT NOT NULL,
+created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+UNIQUE(host_id, version),
+FOREIGN KEY(host_id) REFERENCES host(id) ON DELETE CASCADE
+)`,
+			`CREATE TABLE IF NOT EXISTS bmc_credential(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+host_id INTEGER NOT NULL UNIQUE,
+driver TEXT NOT NULL,
+address TEXT NOT NULL,
+username TEXT NOT NULL,
+password TEXT NOT NULL,
+insecure BOOLEAN NOT NULL DEFAULT 0,
+FOREIGN KEY(host_id) REFERENCES host(id) ON DELETE CASCADE
+)`,
+			`CREATE TABLE IF NOT EXISTS bmc(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+mac_address TEXT NOT NULL UNIQUE,
+vendor_class TEXT NOT NULL DEFAULT '',
+hostname TEXT NOT NULL DEFAULT '',
+lease_id INTEGER NOT NULL UNIQUE,
+host_id INTEGER UNIQUE,
+FOREIGN KEY(lease_id) REFERENCES lease(id) ON DELETE CASCADE,
+FOREIGN KEY(host_id) REFERENCES host(id) ON DELETE SET NULL
+)`,
+			`CREATE TABLE IF NOT EXISTS host_wipe_report(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+host_id INTEGER NOT NULL,
+report TEXT NOT NULL,
+created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+FOREIGN KEY(host_id) REFERENCES host(id) ON DELETE CASCADE
+)`,
+			`CREATE TABLE IF NOT EXISTS boot_event(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+mac_address TEXT NOT NULL DEFAULT '',
+ip_address TEXT NOT NULL DEFAULT '',
+protocol TEXT NOT NULL,
+name TEXT NOT NULL,
+outcome TEXT NOT NULL,
+detail TEXT NOT NULL DEFAULT '',
+created_at DATETIME NOT NULL
+)`,
+		},
+	},
+	{
+		description: "create audit log",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS audit_log(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+actor TEXT NOT NULL,
+action TEXT NOT NULL,
+host_id INTEGER,
+before_value TEXT NOT NULL DEFAULT 'null',
+after_value TEXT NOT NULL DEFAULT 'null',
+created_at DATETIME NOT NULL
+)`,
+			`CREATE INDEX IF NOT EXISTS audit_log_host_id ON audit_log(host_id)`,
+			`CREATE INDEX IF NOT EXISTS audit_log_created_at ON audit_log(created_at)`,
+			`CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`,
+			`CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`,
+		},
+	},
+	{
+		description: "create hostname sequence",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS hostname_sequence(
+scope TEXT PRIMARY KEY,
+value INTEGER NOT NULL
+)`,
+		},
+	},
+	{
+		description: "create host labels, host groups and user access",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS host_label(
+host_id INTEGER NOT NULL,
+key TEXT NOT NULL,
+value TEXT NOT NULL,
+PRIMARY KEY(host_id, key),
+FOREIGN KEY(host_id) REFERENCES host(id) ON DELETE CASCADE
+)`,
+			`CREATE TABLE IF NOT EXISTS host_group(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+name TEXT NOT NULL UNIQUE
+)`,
+			`CREATE TABLE IF NOT EXISTS host_group_member(
+group_id INTEGER NOT NULL,
+host_id INTEGER NOT NULL,
+PRIMARY KEY(group_id, host_id),
+FOREIGN KEY(group_id) REFERENCES host_group(id) ON DELETE CASCADE,
+FOREIGN KEY(host_id) REFERENCES host(id) ON DELETE CASCADE
+)`,
+			`CREATE TABLE IF NOT EXISTS user_access(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+user_id INTEGER NOT NULL,
+scope TEXT NOT NULL,
+value TEXT NOT NULL,
+UNIQUE(user_id, scope, value),
+FOREIGN KEY(user_id) REFERENCES user(id) ON DELETE CASCADE
+)`,
+		},
+	},
+	{
+		// Ignition profiles boot from the network only, so they keep
+		// booting after the host is provisioned as they did before.
+		description: "add diskless boot profiles",
+		statements: []string{
+			`ALTER TABLE boot_profile ADD COLUMN diskless BOOLEAN NOT NULL DEFAULT 0`,
+			`UPDATE boot_profile SET diskless = 1 WHERE kind = 'ignition'`,
+		},
+	},
+	{
+		description: "create network profiles",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS network_profile(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+name TEXT NOT NULL UNIQUE,
+bond_driver TEXT NOT NULL DEFAULT '',
+service_vlan INTEGER NOT NULL DEFAULT 0
+)`,
+			`CREATE TABLE IF NOT EXISTS network_profile_assignment(
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+scope TEXT NOT NULL,
+value TEXT NOT NULL,
+network_profile_id INTEGER NOT NULL,
+UNIQUE(scope, value),
+FOREIGN KEY(network_profile_id) REFERENCES network_profile(id) ON DELETE CASCADE
+)`,
+		},
+	},
 }
@@ -2,15 +2,19 @@ package sqlite
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"net"
+	"reflect"
+	"strings"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 
-	// SQLite driver
-	_ "github.com/mattn/go-sqlite3"
+	sqlite3 "github.com/mattn/go-sqlite3"
 
 	"github.com/jmoiron/sqlx"
 
@@ -23,32 +27,53 @@ import (
 const (
 	managementSubnetID = 0
 	serviceSubnetID    = 1
+	bmcSubnetID        = 2
 )
 
 // SQLite is
 type SQLite struct {
-	db             *sqlx.DB
-	hostnamePrefix string
+	db     *sqlx.DB
+	naming *datastore.Naming
 }
 
-// New is
-func New(ctx context.Context, dsn, hostnamePrefix string) (datastore.Datastore, error) {
-	db, err := sqlx.Open("sqlite3", dsn)
+// New opens the SQLite datastore of dsn and names new hosts by naming.
+func New(ctx context.Context, dsn string, naming *datastore.Naming) (datastore.Datastore, error) {
+	db, err := open(dsn)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open sqlite connection: %w", err)
+		return nil, err
 	}
 
-	err = createTable(db)
+	_, _, err = migrate(ctx, db)
 	if err != nil {
 		return nil, err
 	}
 
 	return &SQLite{
-		db:             db,
-		hostnamePrefix: hostnamePrefix,
+		db:     db,
+		naming: naming,
 	}, nil
 }
 
+// open opens the database. The transactions take the write lock when they
+// begin (_txlock=immediate), so that the concurrent writers wait for each
+// other by the busy timeout instead of failing to upgrade their locks.
+// Shared cache (cache=shared) must not be used, as its table locks fail
+// without waiting.
+func open(dsn string) (*sqlx.DB, error) {
+	if !strings.Contains(dsn, "_txlock=") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + "_txlock=immediate"
+	}
+	db, err := sqlx.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite connection: %w", err)
+	}
+	return db, nil
+}
+
 func (s *SQLite) getSubnetByID(ctx context.Context, subnetID int) (*dhcpd.Subnet, error) {
 	query := `SELECT id, network, start, end, gateway, dns_server FROM subnet WHERE id = ?`
 	stmt, err := s.db.Preparex(query)
@@ -58,7 +83,7 @@ func (s *SQLite) getSubnetByID(ctx context.Context, subnetID int) (*dhcpd.Subnet
 	var subnet dhcpd.Subnet
 	err = stmt.GetContext(ctx, &subnet, subnetID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get subnet: %w", err)
+		return nil, fmt.Errorf("failed to get subnet: %w", wrapError(err))
 	}
 	return &subnet, nil
 }
@@ -73,15 +98,35 @@ func (s *SQLite) GetServiceSubnet(ctx context.Context) (*dhcpd.Subnet, error) {
 	return s.getSubnetByID(ctx, serviceSubnetID)
 }
 
+// GetBMCSubnet is
+func (s *SQLite) GetBMCSubnet(ctx context.Context) (*dhcpd.Subnet, error) {
+	return s.getSubnetByID(ctx, bmcSubnetID)
+}
+
 func (s *SQLite) createSubnet(ctx context.Context, subnet dhcpd.Subnet) (*dhcpd.Subnet, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
 	query := `INSERT INTO subnet(id, network, start, end, gateway, dns_server) VALUES(?, ?, ?, ?, ?, ?)`
-	stmt, err := s.db.Preparex(query)
+	stmt, err := tx.Preparex(query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare stetment: %w", err)
 	}
 	_, err = stmt.ExecContext(ctx, subnet.ID, subnet.Network, subnet.Start, subnet.End, subnet.Gateway, subnet.DNSServer)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new subnet: %w", err)
+		return nil, fmt.Errorf("failed to create new subnet: %w", wrapError(err))
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditSubnetCreate, 0, nil, subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 	return &subnet, nil
 }
@@ -110,6 +155,19 @@ func (s *SQLite) CreateServiceSubnet(ctx context.Context, network types.IPNet, s
 	})
 }
 
+// CreateBMCSubnet is. The BMC subnet is a separate pool in the management
+// network.
+func (s *SQLite) CreateBMCSubnet(ctx context.Context, network types.IPNet, start, end types.IP) (*dhcpd.Subnet, error) {
+	return s.createSubnet(ctx, dhcpd.Subnet{
+		ID:        bmcSubnetID,
+		Network:   network,
+		Start:     start,
+		End:       end,
+		Gateway:   nil,
+		DNSServer: nil,
+	})
+}
+
 func (s *SQLite) getLease(ctx context.Context, subnetID int, mac types.HardwareAddr) (*dhcpd.Lease, error) {
 	query := `SELECT id, mac_address, ip_address, subnet_id FROM lease WHERE subnet_id = ? AND mac_address = ?`
 	stmt, err := s.db.Preparex(query)
@@ -119,7 +177,7 @@ func (s *SQLite) getLease(ctx context.Context, subnetID int, mac types.HardwareA
 	var lease dhcpd.Lease
 	err = stmt.GetContext(ctx, &lease, subnetID, mac)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get lease: %w", err)
+		return nil, fmt.Errorf("failed to get lease: %w", wrapError(err))
 	}
 
 	return &lease, nil
@@ -135,7 +193,7 @@ func (s *SQLite) GetLeaseByID(ctx context.Context, id int) (*httpd.Lease, error)
 	var lease httpd.Lease
 	err = stmt.GetContext(ctx, &lease, id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get lease: %w", err)
+		return nil, fmt.Errorf("failed to get lease: %w", wrapError(err))
 	}
 
 	return &lease, nil
@@ -151,6 +209,11 @@ func (s *SQLite) GetLeaseFromServiceSubnet(ctx context.Context, mac types.Hardwa
 	return s.getLease(ctx, serviceSubnetID, mac)
 }
 
+// GetLeaseFromBMCSubnet is
+func (s *SQLite) GetLeaseFromBMCSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	return s.getLease(ctx, bmcSubnetID, mac)
+}
+
 func (s *SQLite) createLease(ctx context.Context, subnetID int, mac types.HardwareAddr) (*dhcpd.Lease, error) {
 	subnet, err := s.getSubnetByID(ctx, subnetID)
 	if err != nil {
@@ -162,21 +225,17 @@ func (s *SQLite) createLease(ctx context.Context, subnetID int, mac types.Hardwa
 	}
 	defer tx.Rollback()
 
-	query := `SELECT id, mac_address, ip_address, subnet_id FROM lease WHERE subnet_id = ? ORDER BY ip_address DESC LIMIT 1`
-	var latest dhcpd.Lease
-	var next types.IP
+	query := `SELECT ip_address FROM lease WHERE subnet_id = ?`
 	stmt, err := tx.Preparex(query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare statement: %w", err)
 	}
-	err = stmt.GetContext(ctx, &latest, subnetID)
-	if errors.Is(err, sql.ErrNoRows) {
-		next = subnet.Start
-	} else if err == nil {
-		next = getNextAddress(latest.IPAddress)
-	} else {
-		return nil, fmt.Errorf("failed to get latest lease: %w", err)
+	var leased []types.IP
+	err = stmt.SelectContext(ctx, &leased, subnetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get leased addresses: %w", err)
 	}
+	next := datastore.NextLeaseAddress(subnet.Start, leased)
 
 	query = `INSERT INTO lease(mac_address, ip_address, subnet_id) VALUES(?, ?, ?)`
 	stmt, err = tx.Preparex(query)
@@ -185,24 +244,29 @@ func (s *SQLite) createLease(ctx context.Context, subnetID int, mac types.Hardwa
 	}
 	ret, err := stmt.ExecContext(ctx, mac, next, subnetID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new lease: %w", err)
+		return nil, fmt.Errorf("failed to create new lease: %w", wrapError(err))
 	}
 	id, err := ret.LastInsertId()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get inserted id: %w", err)
 	}
+	lease := dhcpd.Lease{
+		ID:         int(id),
+		MACAddress: mac,
+		IPAddress:  next,
+		SubnetID:   subnetID,
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditLeaseCreate, 0, nil, lease)
+	if err != nil {
+		return nil, err
+	}
 
 	err = tx.Commit()
 	if err != nil {
 		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return &dhcpd.Lease{
-		ID:         int(id),
-		MACAddress: mac,
-		IPAddress:  next,
-		SubnetID:   subnetID,
-	}, nil
+	return &lease, nil
 }
 
 // CreateLeaseFromManagementSubnet is
@@ -215,54 +279,185 @@ func (s *SQLite) CreateLeaseFromServiceSubnet(ctx context.Context, mac types.Har
 	return s.createLease(ctx, serviceSubnetID, mac)
 }
 
-func (s *SQLite) generateHostname(ctx context.Context) (string, error) {
-	query := `SELECT COALESCE(MAX(id), 0) AS id FROM host`
-	var id int
+// CreateLeaseFromBMCSubnet is
+func (s *SQLite) CreateLeaseFromBMCSubnet(ctx context.Context, mac types.HardwareAddr) (*dhcpd.Lease, error) {
+	return s.createLease(ctx, bmcSubnetID, mac)
+}
+
+// ListLease is
+func (s *SQLite) ListLease(ctx context.Context) ([]dhcpd.Lease, error) {
+	query := `SELECT id, mac_address, ip_address, subnet_id FROM lease ORDER BY id`
 	stmt, err := s.db.Preparex(query)
 	if err != nil {
-		return "", fmt.Errorf("failed to prepare statement: %w", err)
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
 	}
-	err = stmt.GetContext(ctx, &id)
+	var leases []dhcpd.Lease
+	err = stmt.SelectContext(ctx, &leases)
 	if err != nil {
-		return "", fmt.Errorf("failed to get maximum id: %w", err)
+		return nil, fmt.Errorf("failed to get lease list: %w", err)
 	}
-	return fmt.Sprintf("%s%04d", s.hostnamePrefix, id+1), nil
+	return leases, nil
 }
 
-// RegisterHost is
-func (s *SQLite) RegisterHost(ctx context.Context, serverID uuid.UUID, serial, product, manufacturer string, serviceLeaseID, managementLeaseID int) (*httpd.Host, error) {
-	name, err := s.generateHostname(ctx)
+// CountLeaseBySubnet returns the number of leases keyed by the subnet id.
+func (s *SQLite) CountLeaseBySubnet(ctx context.Context) (map[int]int, error) {
+	query := `SELECT subnet_id, COUNT(*) AS count FROM lease GROUP BY subnet_id`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var rows []struct {
+		SubnetID int `db:"subnet_id"`
+		Count    int `db:"count"`
+	}
+	err = stmt.SelectContext(ctx, &rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count lease: %w", err)
+	}
+	counts := map[int]int{}
+	for _, r := range rows {
+		counts[r.SubnetID] = r.Count
+	}
+	return counts, nil
+}
+
+// DeleteLease deletes the lease that is not used by a host. The BMC that
+// has the lease is deleted with it.
+func (s *SQLite) DeleteLease(ctx context.Context, id int) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, mac_address, ip_address, subnet_id FROM lease WHERE id = ?`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var lease dhcpd.Lease
+	err = stmt.GetContext(ctx, &lease, id)
+	if err != nil {
+		return fmt.Errorf("failed to get lease: %w", wrapError(err))
+	}
+
+	query = `SELECT COUNT(*) FROM host WHERE service_lease_id = ? OR management_lease_id = ?`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var n int
+	err = stmt.GetContext(ctx, &n, id, id)
+	if err != nil {
+		return fmt.Errorf("failed to count host: %w", err)
+	}
+	if n != 0 {
+		return fmt.Errorf("lease %d is used by a host: %w", id, dhcpd.ErrLeaseInUse)
+	}
+
+	query = `DELETE FROM bmc WHERE lease_id = ?`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete BMC: %w", err)
+	}
+
+	query = `DELETE FROM lease WHERE id = ?`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	ret, err := stmt.ExecContext(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete lease: %w", err)
+	}
+	affected, err := ret.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("failed to delete lease: %w", datastore.ErrNotFound)
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditLeaseDelete, 0, lease, nil)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate hostname: %w", err)
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
+	return nil
+}
+
+// RegisterHost creates the host and names it by the naming template in a
+// transaction, so concurrent registrations never get the same name.
+func (s *SQLite) RegisterHost(ctx context.Context, serverID uuid.UUID, serial, product, manufacturer string, serviceLeaseID, managementLeaseID int) (*httpd.Host, error) {
 	host := httpd.Host{
 		UUID:              serverID,
-		Name:              name,
+		Serial:            serial,
+		Product:           product,
+		Manufacturer:      manufacturer,
 		ServiceLeaseID:    serviceLeaseID,
 		ManagementLeaseID: managementLeaseID,
+		State:             httpd.HostStateDiscovered,
+		StateUpdatedAt:    time.Now().UTC(),
 	}
 
-	query := `INSERT INTO host(uuid, name, serial, product, manufacturer, service_lease_id, management_lease_id) VALUES(?, ?, ?, ?, ?, ?, ?)`
-	stmt, err := s.db.Preparex(query)
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The name is unique, so the host is inserted with its uuid as the name
+	// until the id is allocated.
+	query := `INSERT INTO host(uuid, name, serial, product, manufacturer, service_lease_id, management_lease_id, state, state_updated_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	stmt, err := tx.Preparex(query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare statement: %w", err)
 	}
-	ret, err := stmt.ExecContext(ctx, host.UUID, host.Name, serial, product, manufacturer, host.ServiceLeaseID, host.ManagementLeaseID)
+	ret, err := stmt.ExecContext(ctx, host.UUID, host.UUID.String(), host.Serial, host.Product, host.Manufacturer, host.ServiceLeaseID, host.ManagementLeaseID, host.State, host.StateUpdatedAt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new host: %w", err)
+		return nil, fmt.Errorf("failed to create new host: %w", wrapError(err))
 	}
 	id, err := ret.LastInsertId()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get inserted id: %w", err)
 	}
 	host.ID = int(id)
+	host.Name, err = s.generateHostname(ctx, tx, host, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = updateHostname(ctx, tx, host.ID, host.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertHostStateTransition(ctx, tx, host.ID, "", host.State, host.StateUpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostRegister, host.ID, nil, host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
 
 	return &host, nil
 }
 
 // GetHostByAddress is
 func (s *SQLite) GetHostByAddress(ctx context.Context, address types.IP) (*httpd.Host, error) {
-	query := `SELECT host.id AS id, uuid, name, service_lease_id, management_lease_id FROM lease JOIN host ON lease.id = host.management_lease_id WHERE ip_address = ?`
+	query := `SELECT host.id AS id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM lease JOIN host ON lease.id = host.management_lease_id WHERE ip_address = ?`
 	stmt, err := s.db.Preparex(query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare statement: %w", err)
@@ -270,63 +465,1418 @@ func (s *SQLite) GetHostByAddress(ctx context.Context, address types.IP) (*httpd
 	var host httpd.Host
 	err = stmt.GetContext(ctx, &host, address)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get host: %w", err)
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
 	}
 	return &host, nil
 }
 
-// ListUser is
-func (s *SQLite) ListUser(ctx context.Context) ([]httpd.User, error) {
-	query := `SELECT id, name FROM user`
+// GetHostByUUID is
+func (s *SQLite) GetHostByUUID(ctx context.Context, serverID uuid.UUID) (*httpd.Host, error) {
+	query := `SELECT id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host WHERE uuid = ?`
 	stmt, err := s.db.Preparex(query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare statement: %w", err)
 	}
-	var users []httpd.User
-	err = stmt.SelectContext(ctx, &users)
+	var host httpd.Host
+	err = stmt.GetContext(ctx, &host, serverID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user list: %w", err)
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
 	}
-	return users, nil
+	return &host, nil
 }
 
-// ListKeyByUserID is
-func (s *SQLite) ListKeyByUserID(ctx context.Context, userID int) ([]httpd.Key, error) {
-	query := `SELECT id, key, user_id FROM key WHERE user_id = ?`
+// GetHostByName is
+func (s *SQLite) GetHostByName(ctx context.Context, name string) (*httpd.Host, error) {
+	query := `SELECT id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host WHERE name = ?`
 	stmt, err := s.db.Preparex(query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare statement: %w", err)
 	}
-	var keys []httpd.Key
-	err = stmt.SelectContext(ctx, &keys, userID)
+	var host httpd.Host
+	err = stmt.GetContext(ctx, &host, name)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get key list: %w", err)
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
 	}
-	return keys, nil
+	return &host, nil
 }
 
-// Close closes the database connections.
-func (s *SQLite) Close() error {
-	return s.db.Close()
+// UpdateHostState moves the host to the state if the transition is allowed.
+func (s *SQLite) UpdateHostState(ctx context.Context, hostID int, state string) (*httpd.Host, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host WHERE id = ?`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var host httpd.Host
+	err = stmt.GetContext(ctx, &host, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
+	}
+	if !httpd.CanTransitHostState(host.State, state) {
+		return nil, fmt.Errorf("%s -> %s: %w", host.State, state, httpd.ErrInvalidHostStateTransition)
+	}
+
+	now := time.Now().UTC()
+	query = `UPDATE host SET state = ?, state_updated_at = ? WHERE id = ?`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, state, now, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update host state: %w", err)
+	}
+	err = insertHostStateTransition(ctx, tx, hostID, host.State, state, now)
+	if err != nil {
+		return nil, err
+	}
+	before := host
+	host.State = state
+	host.StateUpdatedAt = now
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostStateUpdate, hostID, before, host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &host, nil
+}
+
+func insertHostStateTransition(ctx context.Context, tx *sqlx.Tx, hostID int, from, to string, createdAt time.Time) error {
+	query := `INSERT INTO host_state_transition(host_id, from_state, to_state, created_at) VALUES(?, ?, ?, ?)`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, hostID, from, to, createdAt)
+	if err != nil {
+		return fmt.Errorf("failed to create host state transition: %w", err)
+	}
+	return nil
+}
+
+// ListHostStateTransition is
+func (s *SQLite) ListHostStateTransition(ctx context.Context, hostID int) ([]httpd.HostStateTransition, error) {
+	query := `SELECT id, host_id, from_state, to_state, created_at FROM host_state_transition WHERE host_id = ? ORDER BY id`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var transitions []httpd.HostStateTransition
+	err = stmt.SelectContext(ctx, &transitions, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host state transition list: %w", err)
+	}
+	return transitions, nil
 }
 
-func createTable(db *sqlx.DB) error {
-	for _, table := range tables {
-		_, err := db.Exec(table)
+// RecordPhoneHome records the completion of cloud-init. Host keys of the
+// same type are replaced.
+func (s *SQLite) RecordPhoneHome(ctx context.Context, hostID int, instanceID string, keys []httpd.HostKey) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := getPhoneHome(ctx, tx, hostID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	query := `UPDATE host SET instance_id = ?, phoned_home_at = ? WHERE id = ?`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, instanceID, now, hostID)
+	if err != nil {
+		return fmt.Errorf("failed to update host: %w", err)
+	}
+
+	query = `INSERT OR REPLACE INTO host_key(host_id, type, key) VALUES(?, ?, ?)`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	for _, k := range keys {
+		_, err = stmt.ExecContext(ctx, hostID, k.Type, k.Key)
 		if err != nil {
-			return fmt.Errorf("failed to create lease tables: %w", err)
+			return fmt.Errorf("failed to create host key: %w", err)
 		}
 	}
+
+	after, err := getPhoneHome(ctx, tx, hostID)
+	if err != nil {
+		return err
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostPhoneHome, hostID, before, after)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
 	return nil
 }
 
-func getNextAddress(ip types.IP) types.IP {
-	a := net.ParseIP(ip.String())
-	for i := len(a) - 1; i >= 0; i-- {
-		a[i]++
-		if a[i] > 0 {
-			break
+// getPhoneHome returns the result of the last phone home of the host.
+func getPhoneHome(ctx context.Context, tx *sqlx.Tx, hostID int) (*datastore.PhoneHome, error) {
+	query := `SELECT instance_id, phoned_home_at FROM host WHERE id = ?`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var ph datastore.PhoneHome
+	err = stmt.QueryRowxContext(ctx, hostID).Scan(&ph.InstanceID, &ph.PhonedHomeAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
+	}
+
+	query = `SELECT id, host_id, type, key FROM host_key WHERE host_id = ? ORDER BY type`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	err = stmt.SelectContext(ctx, &ph.HostKeys, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host key list: %w", err)
+	}
+	return &ph, nil
+}
+
+// ListHostKeyByHostID is
+func (s *SQLite) ListHostKeyByHostID(ctx context.Context, hostID int) ([]httpd.HostKey, error) {
+	query := `SELECT id, host_id, type, key FROM host_key WHERE host_id = ?`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var keys []httpd.HostKey
+	err = stmt.SelectContext(ctx, &keys, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host key list: %w", err)
+	}
+	return keys, nil
+}
+
+// IssueHostToken issues a new metadata token of the host. The previous
+// token of the host is replaced. Only the hash of the token is stored.
+func (s *SQLite) IssueHostToken(ctx context.Context, hostID int) (string, error) {
+	buff := make([]byte, 32)
+	_, err := rand.Read(buff)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := hex.EncodeToString(buff)
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return "", fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT OR REPLACE INTO host_token(host_id, token_hash, created_at) VALUES(?, ?, ?)`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return "", fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, hostID, hashToken(token), time.Now().UTC())
+	if err != nil {
+		return "", fmt.Errorf("failed to create host token: %w", err)
+	}
+	// Neither the token nor its hash is recorded.
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostTokenIssue, hostID, nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return token, nil
+}
+
+// GetHostByToken is
+func (s *SQLite) GetHostByToken(ctx context.Context, token string) (*httpd.Host, error) {
+	query := `SELECT host.id AS id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host_token JOIN host ON host_token.host_id = host.id WHERE token_hash = ?`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var host httpd.Host
+	err = stmt.GetContext(ctx, &host, hashToken(token))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
+	}
+	return &host, nil
+}
+
+// RevokeHostToken is
+func (s *SQLite) RevokeHostToken(ctx context.Context, hostID int) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM host_token WHERE host_id = ?`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	ret, err := stmt.ExecContext(ctx, hostID)
+	if err != nil {
+		return fmt.Errorf("failed to delete host token: %w", err)
+	}
+	n, err := ret.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if n == 0 {
+		return nil
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostTokenRevoke, hostID, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateHostInventory stores the inventory as the next version.
+func (s *SQLite) CreateHostInventory(ctx context.Context, hostID int, inventory httpd.Inventory) (*httpd.HostInventory, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT COALESCE(MAX(version), 0) AS version FROM host_inventory WHERE host_id = ?`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var version int
+	err = stmt.GetContext(ctx, &version, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest version: %w", err)
+	}
+
+	hi := httpd.HostInventory{
+		HostID:    hostID,
+		Version:   version + 1,
+		Inventory: inventory,
+		CreatedAt: time.Now().UTC(),
+	}
+	query = `INSERT INTO host_inventory(host_id, version, inventory, created_at) VALUES(?, ?, ?, ?)`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	ret, err := stmt.ExecContext(ctx, hi.HostID, hi.Version, hi.Inventory, hi.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create host inventory: %w", wrapError(err))
+	}
+	id, err := ret.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inserted id: %w", err)
+	}
+	hi.ID = int(id)
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostInventoryCreate, hostID, nil, hi)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &hi, nil
+}
+
+// GetHostInventory is
+func (s *SQLite) GetHostInventory(ctx context.Context, hostID, version int) (*httpd.HostInventory, error) {
+	query := `SELECT id, host_id, version, inventory, created_at FROM host_inventory WHERE host_id = ? AND version = ?`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var hi httpd.HostInventory
+	err = stmt.GetContext(ctx, &hi, hostID, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host inventory: %w", wrapError(err))
+	}
+	return &hi, nil
+}
+
+// GetLatestHostInventory is
+func (s *SQLite) GetLatestHostInventory(ctx context.Context, hostID int) (*httpd.HostInventory, error) {
+	query := `SELECT id, host_id, version, inventory, created_at FROM host_inventory WHERE host_id = ? ORDER BY version DESC LIMIT 1`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var hi httpd.HostInventory
+	err = stmt.GetContext(ctx, &hi, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host inventory: %w", wrapError(err))
+	}
+	return &hi, nil
+}
+
+// ListHostInventory returns the inventories of the host, newest first.
+func (s *SQLite) ListHostInventory(ctx context.Context, hostID int) ([]httpd.HostInventory, error) {
+	query := `SELECT id, host_id, version, inventory, created_at FROM host_inventory WHERE host_id = ? ORDER BY version DESC`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var his []httpd.HostInventory
+	err = stmt.SelectContext(ctx, &his, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host inventory list: %w", err)
+	}
+	return his, nil
+}
+
+// SetBMCCredential creates or replaces the BMC credential of the host.
+func (s *SQLite) SetBMCCredential(ctx context.Context, cred httpd.BMCCredential) (*httpd.BMCCredential, error) {
+	switch cred.Driver {
+	case httpd.BMCDriverIPMI, httpd.BMCDriverRedfish:
+	default:
+		return nil, fmt.Errorf("invalid BMC driver %s", cred.Driver)
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := getBMCCredential(ctx, tx, cred.HostID)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return nil, err
+	}
+
+	query := `INSERT OR REPLACE INTO bmc_credential(host_id, driver, address, username, password, insecure) VALUES(?, ?, ?, ?, ?, ?)`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, cred.HostID, cred.Driver, cred.Address, cred.Username, cred.Password, cred.Insecure)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set BMC credential: %w", err)
+	}
+	after, err := getBMCCredential(ctx, tx, cred.HostID)
+	if err != nil {
+		return nil, err
+	}
+	// The password is never encoded to JSON.
+	err = insertAuditEntry(ctx, tx, datastore.AuditBMCCredentialSet, cred.HostID, before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return after, nil
+}
+
+func getBMCCredential(ctx context.Context, tx *sqlx.Tx, hostID int) (*httpd.BMCCredential, error) {
+	query := `SELECT id, host_id, driver, address, username, password, insecure FROM bmc_credential WHERE host_id = ?`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var cred httpd.BMCCredential
+	err = stmt.GetContext(ctx, &cred, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get BMC credential: %w", wrapError(err))
+	}
+	return &cred, nil
+}
+
+// GetBMCCredentialByHostID is
+func (s *SQLite) GetBMCCredentialByHostID(ctx context.Context, hostID int) (*httpd.BMCCredential, error) {
+	query := `SELECT id, host_id, driver, address, username, password, insecure FROM bmc_credential WHERE host_id = ?`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var cred httpd.BMCCredential
+	err = stmt.GetContext(ctx, &cred, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get BMC credential: %w", wrapError(err))
+	}
+	return &cred, nil
+}
+
+// RecordBMC creates or updates the BMC discovered by DHCP. The link to the
+// host is kept. The audit entry is recorded only if the BMC is changed.
+func (s *SQLite) RecordBMC(ctx context.Context, mac types.HardwareAddr, vendorClass, hostname string, leaseID int) (*dhcpd.BMC, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := getBMC(ctx, tx, `bmc.mac_address = ?`, mac)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return nil, err
+	}
+
+	query := `INSERT INTO bmc(mac_address, vendor_class, hostname, lease_id) VALUES(?, ?, ?, ?)
+ON CONFLICT(mac_address) DO UPDATE SET vendor_class = excluded.vendor_class, hostname = excluded.hostname, lease_id = excluded.lease_id`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, mac, vendorClass, hostname, leaseID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record BMC: %w", err)
+	}
+	after, err := getBMC(ctx, tx, `bmc.mac_address = ?`, mac)
+	if err != nil {
+		return nil, err
+	}
+	if before != nil && reflect.DeepEqual(*before, *after) {
+		return after, nil
+	}
+	hostID := 0
+	if after.HostID != nil {
+		hostID = *after.HostID
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditBMCRecord, hostID, before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return after, nil
+}
+
+const bmcColumns = `bmc.id AS id, bmc.mac_address AS mac_address, ip_address, vendor_class, hostname, lease_id, host_id`
+
+// getBMC returns the BMC selected by the condition in the transaction.
+func getBMC(ctx context.Context, tx *sqlx.Tx, cond string, args ...interface{}) (*dhcpd.BMC, error) {
+	query := `SELECT ` + bmcColumns + ` FROM bmc JOIN lease ON bmc.lease_id = lease.id WHERE ` + cond
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var bmc dhcpd.BMC
+	err = stmt.GetContext(ctx, &bmc, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get BMC: %w", wrapError(err))
+	}
+	return &bmc, nil
+}
+
+// GetBMCByMAC is
+func (s *SQLite) GetBMCByMAC(ctx context.Context, mac types.HardwareAddr) (*dhcpd.BMC, error) {
+	query := `SELECT ` + bmcColumns + ` FROM bmc JOIN lease ON bmc.lease_id = lease.id WHERE bmc.mac_address = ?`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var bmc dhcpd.BMC
+	err = stmt.GetContext(ctx, &bmc, mac)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get BMC: %w", wrapError(err))
+	}
+	return &bmc, nil
+}
+
+// GetBMCByHostID is
+func (s *SQLite) GetBMCByHostID(ctx context.Context, hostID int) (*dhcpd.BMC, error) {
+	query := `SELECT ` + bmcColumns + ` FROM bmc JOIN lease ON bmc.lease_id = lease.id WHERE host_id = ?`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var bmc dhcpd.BMC
+	err = stmt.GetContext(ctx, &bmc, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get BMC: %w", wrapError(err))
+	}
+	return &bmc, nil
+}
+
+// ListBMC is
+func (s *SQLite) ListBMC(ctx context.Context) ([]dhcpd.BMC, error) {
+	query := `SELECT ` + bmcColumns + ` FROM bmc JOIN lease ON bmc.lease_id = lease.id ORDER BY bmc.id`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var bmcs []dhcpd.BMC
+	err = stmt.SelectContext(ctx, &bmcs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get BMC list: %w", err)
+	}
+	return bmcs, nil
+}
+
+// LinkBMC links the BMC with the host. The previous BMC of the host is
+// unlinked.
+func (s *SQLite) LinkBMC(ctx context.Context, bmcID, hostID int) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := getBMC(ctx, tx, `host_id = ?`, hostID)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return err
+	}
+
+	query := `UPDATE bmc SET host_id = NULL WHERE host_id = ?`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, hostID)
+	if err != nil {
+		return fmt.Errorf("failed to unlink BMC: %w", err)
+	}
+
+	query = `UPDATE bmc SET host_id = ? WHERE id = ?`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	ret, err := stmt.ExecContext(ctx, hostID, bmcID)
+	if err != nil {
+		return fmt.Errorf("failed to link BMC: %w", err)
+	}
+	n, err := ret.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("failed to link BMC: %w", datastore.ErrNotFound)
+	}
+	after, err := getBMC(ctx, tx, `bmc.id = ?`, bmcID)
+	if err != nil {
+		return err
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditBMCLink, hostID, before, after)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// CountHostByState returns the number of hosts keyed by the state.
+func (s *SQLite) CountHostByState(ctx context.Context) (map[string]int, error) {
+	query := `SELECT state, COUNT(*) AS count FROM host GROUP BY state`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var rows []struct {
+		State string `db:"state"`
+		Count int    `db:"count"`
+	}
+	err = stmt.SelectContext(ctx, &rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count host: %w", err)
+	}
+	counts := map[string]int{}
+	for _, r := range rows {
+		counts[r.State] = r.Count
+	}
+	return counts, nil
+}
+
+// CreateWipeReport is
+func (s *SQLite) CreateWipeReport(ctx context.Context, hostID int, report httpd.WipeReport) (*httpd.HostWipeReport, error) {
+	hr := httpd.HostWipeReport{
+		HostID:    hostID,
+		Report:    report,
+		CreatedAt: time.Now().UTC(),
+	}
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO host_wipe_report(host_id, report, created_at) VALUES(?, ?, ?)`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	ret, err := stmt.ExecContext(ctx, hr.HostID, hr.Report, hr.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create wipe report: %w", err)
+	}
+	id, err := ret.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inserted id: %w", err)
+	}
+	hr.ID = int(id)
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostWipeReportCreate, hostID, nil, hr)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &hr, nil
+}
+
+// ListWipeReport is
+func (s *SQLite) ListWipeReport(ctx context.Context, hostID int) ([]httpd.HostWipeReport, error) {
+	query := `SELECT id, host_id, report, created_at FROM host_wipe_report WHERE host_id = ? ORDER BY id`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var reports []httpd.HostWipeReport
+	err = stmt.SelectContext(ctx, &reports, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get wipe report list: %w", err)
+	}
+	return reports, nil
+}
+
+// DecommissionHost releases the service and management leases and the
+// metadata token of the decommissioning host, and marks it as wiped.
+func (s *SQLite) DecommissionHost(ctx context.Context, hostID int) (*httpd.Host, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host WHERE id = ?`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var host httpd.Host
+	err = stmt.GetContext(ctx, &host, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
+	}
+	if host.State != httpd.HostStateDecommissioning {
+		return nil, fmt.Errorf("%s -> %s: %w", host.State, httpd.HostStateWiped, httpd.ErrInvalidHostStateTransition)
+	}
+
+	now := time.Now().UTC()
+	query = `UPDATE host SET state = ?, state_updated_at = ?, service_lease_id = NULL, management_lease_id = NULL WHERE id = ?`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, httpd.HostStateWiped, now, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update host: %w", err)
+	}
+	err = insertHostStateTransition(ctx, tx, hostID, host.State, httpd.HostStateWiped, now)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `DELETE FROM lease WHERE id IN (?, ?)`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, host.ServiceLeaseID, host.ManagementLeaseID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete lease: %w", err)
+	}
+
+	query = `DELETE FROM host_token WHERE host_id = ?`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete host token: %w", err)
+	}
+
+	before := host
+	host.State = httpd.HostStateWiped
+	host.StateUpdatedAt = now
+	host.ServiceLeaseID = 0
+	host.ManagementLeaseID = 0
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostDecommission, hostID, before, host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &host, nil
+}
+
+// RediscoverHost gives the wiped host the leases and moves it back to
+// discovered, so that the host is provisioned again.
+func (s *SQLite) RediscoverHost(ctx context.Context, hostID, serviceLeaseID, managementLeaseID int) (*httpd.Host, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host WHERE id = ?`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var host httpd.Host
+	err = stmt.GetContext(ctx, &host, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host: %w", wrapError(err))
+	}
+	if host.State != httpd.HostStateWiped {
+		return nil, fmt.Errorf("%s -> %s: %w", host.State, httpd.HostStateDiscovered, httpd.ErrInvalidHostStateTransition)
+	}
+
+	now := time.Now().UTC()
+	query = `UPDATE host SET state = ?, state_updated_at = ?, service_lease_id = ?, management_lease_id = ? WHERE id = ?`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, httpd.HostStateDiscovered, now, serviceLeaseID, managementLeaseID, hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update host: %w", wrapError(err))
+	}
+	err = insertHostStateTransition(ctx, tx, hostID, host.State, httpd.HostStateDiscovered, now)
+	if err != nil {
+		return nil, err
+	}
+
+	before := host
+	host.State = httpd.HostStateDiscovered
+	host.StateUpdatedAt = now
+	host.ServiceLeaseID = serviceLeaseID
+	host.ManagementLeaseID = managementLeaseID
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostRediscover, hostID, before, host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &host, nil
+}
+
+// DeleteHost deletes the host with its leases and the records that belong
+// to it. The BMC linked with the host is unlinked.
+func (s *SQLite) DeleteHost(ctx context.Context, hostID int) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, uuid, name, serial, product, manufacturer, COALESCE(service_lease_id, 0) AS service_lease_id, COALESCE(management_lease_id, 0) AS management_lease_id, state, state_updated_at, instance_id, phoned_home_at FROM host WHERE id = ?`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var host httpd.Host
+	err = stmt.GetContext(ctx, &host, hostID)
+	if err != nil {
+		return fmt.Errorf("failed to get host: %w", wrapError(err))
+	}
+
+	query = `DELETE FROM lease WHERE id IN (SELECT service_lease_id FROM host WHERE id = ? UNION SELECT management_lease_id FROM host WHERE id = ?)`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, hostID, hostID)
+	if err != nil {
+		return fmt.Errorf("failed to delete lease: %w", err)
+	}
+
+	query = `UPDATE bmc SET host_id = NULL WHERE host_id = ?`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, hostID)
+	if err != nil {
+		return fmt.Errorf("failed to unlink BMC: %w", err)
+	}
+
+	for _, table := range []string{"host_token", "host_key", "host_inventory", "host_state_transition", "host_wipe_report", "bmc_credential", "host_label", "host_group_member"} {
+		stmt, err = tx.Preparex(fmt.Sprintf("DELETE FROM %s WHERE host_id = ?", table))
+		if err != nil {
+			return fmt.Errorf("failed to prepare statement: %w", err)
+		}
+		_, err = stmt.ExecContext(ctx, hostID)
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %w", table, err)
+		}
+	}
+
+	query = `DELETE FROM host WHERE id = ?`
+	stmt, err = tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	ret, err := stmt.ExecContext(ctx, hostID)
+	if err != nil {
+		return fmt.Errorf("failed to delete host: %w", err)
+	}
+	n, err := ret.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("failed to delete host: %w", datastore.ErrNotFound)
+	}
+	err = insertAuditEntry(ctx, tx, datastore.AuditHostDelete, hostID, host, nil)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// RecordBootEvent is
+func (s *SQLite) RecordBootEvent(ctx context.Context, e httpd.BootEvent) error {
+	query := `INSERT INTO boot_event(mac_address, ip_address, protocol, name, outcome, detail, created_at) VALUES(?, ?, ?, ?, ?, ?, ?)`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	_, err = stmt.ExecContext(ctx, e.MACAddress, e.IPAddress, e.Protocol, e.Name, e.Outcome, e.Detail, e.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record boot event: %w", err)
+	}
+	return nil
+}
+
+// ListBootEventByHost returns the latest limit boot events of the MAC
+// address and the address of the management lease of the host, in
+// chronological order.
+func (s *SQLite) ListBootEventByHost(ctx context.Context, hostID, limit int) ([]httpd.BootEvent, error) {
+	query := `SELECT * FROM (SELECT boot_event.id AS id, boot_event.mac_address AS mac_address, boot_event.ip_address AS ip_address, boot_event.protocol AS protocol, boot_event.name AS name, boot_event.outcome AS outcome, boot_event.detail AS detail, boot_event.created_at AS created_at FROM boot_event JOIN lease JOIN host ON host.management_lease_id = lease.id WHERE host.id = ? AND (boot_event.mac_address = lease.mac_address OR boot_event.ip_address = lease.ip_address) ORDER BY boot_event.id DESC LIMIT ?) ORDER BY id`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var events []httpd.BootEvent
+	err = stmt.SelectContext(ctx, &events, hostID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get boot event list: %w", err)
+	}
+	return events, nil
+}
+
+// PruneBootEvent deletes the boot events created before.
+func (s *SQLite) PruneBootEvent(ctx context.Context, before time.Time) error {
+	query := `DELETE FROM boot_event WHERE created_at < ?`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, before)
+	if err != nil {
+		return fmt.Errorf("failed to prune boot event: %w", err)
+	}
+	return nil
+}
+
+// CreateBootProfile is
+func (s *SQLite) CreateBootProfile(ctx context.Context, profile httpd.BootProfile) (*httpd.BootProfile, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO boot_profile(name, kind, kernel, initrd, rootfs, cmdline, script, installer, install_disk, install_layout, diskless) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	ret, err := stmt.ExecContext(ctx, profile.Name, profile.Kind, profile.Kernel, profile.Initrd, profile.RootFS, profile.Cmdline, profile.Script, profile.Installer, profile.Disk, profile.Layout, profile.Diskless)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new boot profile: %w", wrapError(err))
+	}
+	id, err := ret.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inserted id: %w", err)
+	}
+	profile.ID = int(id)
+	err = insertAuditEntry(ctx, tx, datastore.AuditBootProfileCreate, 0, nil, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &profile, nil
+}
+
+// GetBootProfileByName is
+func (s *SQLite) GetBootProfileByName(ctx context.Context, name string) (*httpd.BootProfile, error) {
+	query := `SELECT id, name, kind, kernel, initrd, rootfs, cmdline, script, installer, install_disk, install_layout, diskless FROM boot_profile WHERE name = ?`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var profile httpd.BootProfile
+	err = stmt.GetContext(ctx, &profile, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get boot profile: %w", wrapError(err))
+	}
+	return &profile, nil
+}
+
+// GetBootProfileByHost returns the boot profile assigned to the host.
+func (s *SQLite) GetBootProfileByHost(ctx context.Context, host httpd.Host) (*httpd.BootProfile, error) {
+	assignments, err := s.matchAssignments(ctx, "boot_profile_assignment", "boot_profile_id", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(assignments) == 0 {
+		return nil, fmt.Errorf("failed to get boot profile: %w", datastore.ErrNotFound)
+	}
+	query := `SELECT id, name, kind, kernel, initrd, rootfs, cmdline, script, installer, install_disk, install_layout, diskless FROM boot_profile WHERE id = ?`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var profile httpd.BootProfile
+	err = stmt.GetContext(ctx, &profile, assignments[0].TargetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get boot profile: %w", wrapError(err))
+	}
+	return &profile, nil
+}
+
+// ListBootProfile is
+func (s *SQLite) ListBootProfile(ctx context.Context) ([]httpd.BootProfile, error) {
+	query := `SELECT id, name, kind, kernel, initrd, rootfs, cmdline, script, installer, install_disk, install_layout, diskless FROM boot_profile`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var profiles []httpd.BootProfile
+	err = stmt.SelectContext(ctx, &profiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get boot profile list: %w", err)
+	}
+	return profiles, nil
+}
+
+// AssignBootProfile assigns the boot profile to the scope. An existing
+// assignment for the same scope and value is replaced.
+func (s *SQLite) AssignBootProfile(ctx context.Context, scope, value string, profileID int) error {
+	value, err := datastore.ValidateScope(scope, value)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := getAssignment(ctx, tx, "boot_profile_assignment", "boot_profile_id", scope, value)
+	if err != nil {
+		return err
+	}
+	query := `INSERT OR REPLACE INTO boot_profile_assignment(scope, value, boot_profile_id) VALUES(?, ?, ?)`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, scope, value, profileID)
+	if err != nil {
+		return fmt.Errorf("failed to assign boot profile: %w", err)
+	}
+	after := datastore.Assignment{Scope: scope, Value: value, TargetID: profileID}
+	err = insertAuditEntry(ctx, tx, datastore.AuditBootProfileAssign, 0, before, after)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// CreateUserdataTemplate is
+func (s *SQLite) CreateUserdataTemplate(ctx context.Context, t httpd.UserdataTemplate) (*httpd.UserdataTemplate, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO userdata_template(name, template) VALUES(?, ?)`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	ret, err := stmt.ExecContext(ctx, t.Name, t.Template)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new user-data template: %w", wrapError(err))
+	}
+	id, err := ret.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inserted id: %w", err)
+	}
+	t.ID = int(id)
+	err = insertAuditEntry(ctx, tx, datastore.AuditUserdataTemplateCreate, 0, nil, t)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &t, nil
+}
+
+// GetUserdataTemplateByName is
+func (s *SQLite) GetUserdataTemplateByName(ctx context.Context, name string) (*httpd.UserdataTemplate, error) {
+	query := `SELECT id, name, template FROM userdata_template WHERE name = ?`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var t httpd.UserdataTemplate
+	err = stmt.GetContext(ctx, &t, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user-data template: %w", wrapError(err))
+	}
+	return &t, nil
+}
+
+// GetUserdataTemplateByHost returns the user-data template assigned to the host.
+func (s *SQLite) GetUserdataTemplateByHost(ctx context.Context, host httpd.Host) (*httpd.UserdataTemplate, error) {
+	assignments, err := s.matchAssignments(ctx, "userdata_template_assignment", "userdata_template_id", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(assignments) == 0 {
+		return nil, fmt.Errorf("failed to get user-data template: %w", datastore.ErrNotFound)
+	}
+	query := `SELECT id, name, template FROM userdata_template WHERE id = ?`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var t httpd.UserdataTemplate
+	err = stmt.GetContext(ctx, &t, assignments[0].TargetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user-data template: %w", wrapError(err))
+	}
+	return &t, nil
+}
+
+// ListUserdataTemplate is
+func (s *SQLite) ListUserdataTemplate(ctx context.Context) ([]httpd.UserdataTemplate, error) {
+	query := `SELECT id, name, template FROM userdata_template`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var ts []httpd.UserdataTemplate
+	err = stmt.SelectContext(ctx, &ts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user-data template list: %w", err)
+	}
+	return ts, nil
+}
+
+// AssignUserdataTemplate assigns the user-data template to the scope. An
+// existing assignment for the same scope and value is replaced.
+func (s *SQLite) AssignUserdataTemplate(ctx context.Context, scope, value string, templateID int) error {
+	value, err := datastore.ValidateScope(scope, value)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := getAssignment(ctx, tx, "userdata_template_assignment", "userdata_template_id", scope, value)
+	if err != nil {
+		return err
+	}
+	query := `INSERT OR REPLACE INTO userdata_template_assignment(scope, value, userdata_template_id) VALUES(?, ?, ?)`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, scope, value, templateID)
+	if err != nil {
+		return fmt.Errorf("failed to assign user-data template: %w", err)
+	}
+	after := datastore.Assignment{Scope: scope, Value: value, TargetID: templateID}
+	err = insertAuditEntry(ctx, tx, datastore.AuditUserdataTemplateAssign, 0, before, after)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// CreateNetworkProfile is
+func (s *SQLite) CreateNetworkProfile(ctx context.Context, profile httpd.NetworkProfile) (*httpd.NetworkProfile, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO network_profile(name, bond_driver, service_vlan) VALUES(?, ?, ?)`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	ret, err := stmt.ExecContext(ctx, profile.Name, profile.BondDriver, profile.ServiceVLAN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new network profile: %w", wrapError(err))
+	}
+	id, err := ret.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inserted id: %w", err)
+	}
+	profile.ID = int(id)
+	err = insertAuditEntry(ctx, tx, datastore.AuditNetworkProfileCreate, 0, nil, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &profile, nil
+}
+
+// GetNetworkProfileByName is
+func (s *SQLite) GetNetworkProfileByName(ctx context.Context, name string) (*httpd.NetworkProfile, error) {
+	query := `SELECT id, name, bond_driver, service_vlan FROM network_profile WHERE name = ?`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var profile httpd.NetworkProfile
+	err = stmt.GetContext(ctx, &profile, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network profile: %w", wrapError(err))
+	}
+	return &profile, nil
+}
+
+// GetNetworkProfileByHost returns the network profile assigned to the host.
+func (s *SQLite) GetNetworkProfileByHost(ctx context.Context, host httpd.Host) (*httpd.NetworkProfile, error) {
+	assignments, err := s.matchAssignments(ctx, "network_profile_assignment", "network_profile_id", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(assignments) == 0 {
+		return nil, fmt.Errorf("failed to get network profile: %w", datastore.ErrNotFound)
+	}
+	query := `SELECT id, name, bond_driver, service_vlan FROM network_profile WHERE id = ?`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var profile httpd.NetworkProfile
+	err = stmt.GetContext(ctx, &profile, assignments[0].TargetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network profile: %w", wrapError(err))
+	}
+	return &profile, nil
+}
+
+// ListNetworkProfile is
+func (s *SQLite) ListNetworkProfile(ctx context.Context) ([]httpd.NetworkProfile, error) {
+	query := `SELECT id, name, bond_driver, service_vlan FROM network_profile`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var profiles []httpd.NetworkProfile
+	err = stmt.SelectContext(ctx, &profiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network profile list: %w", err)
+	}
+	return profiles, nil
+}
+
+// AssignNetworkProfile assigns the network profile to the scope. An
+// existing assignment for the same scope and value is replaced.
+func (s *SQLite) AssignNetworkProfile(ctx context.Context, scope, value string, profileID int) error {
+	value, err := datastore.ValidateScope(scope, value)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := getAssignment(ctx, tx, "network_profile_assignment", "network_profile_id", scope, value)
+	if err != nil {
+		return err
+	}
+	query := `INSERT OR REPLACE INTO network_profile_assignment(scope, value, network_profile_id) VALUES(?, ?, ?)`
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	_, err = stmt.ExecContext(ctx, scope, value, profileID)
+	if err != nil {
+		return fmt.Errorf("failed to assign network profile: %w", err)
+	}
+	after := datastore.Assignment{Scope: scope, Value: value, TargetID: profileID}
+	err = insertAuditEntry(ctx, tx, datastore.AuditNetworkProfileAssign, 0, before, after)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// getAssignment returns the assignment of the scope and the value in the
+// table, or nil if it is not assigned.
+func getAssignment(ctx context.Context, tx *sqlx.Tx, table, column, scope, value string) (*datastore.Assignment, error) {
+	query := fmt.Sprintf(`SELECT scope, value, %s AS target_id FROM %s WHERE scope = ? AND value = ?`, column, table)
+	stmt, err := tx.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var a datastore.Assignment
+	err = stmt.GetContext(ctx, &a, scope, value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get assignment: %w", err)
+	}
+	return &a, nil
+}
+
+// ListUser is
+func (s *SQLite) ListUser(ctx context.Context) ([]httpd.User, error) {
+	query := `SELECT id, name FROM user`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var users []httpd.User
+	err = stmt.SelectContext(ctx, &users)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user list: %w", err)
+	}
+	return users, nil
+}
+
+// ListKeyByUserID is
+func (s *SQLite) ListKeyByUserID(ctx context.Context, userID int) ([]httpd.Key, error) {
+	query := `SELECT id, key, user_id FROM key WHERE user_id = ?`
+	stmt, err := s.db.Preparex(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	var keys []httpd.Key
+	err = stmt.SelectContext(ctx, &keys, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key list: %w", err)
+	}
+	return keys, nil
+}
+
+// Close closes the database connections.
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
+
+// wrapError classifies the error of the driver as a sentinel error of
+// datastore.
+func wrapError(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return &datastore.Error{Sentinel: datastore.ErrNotFound, Err: err}
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.ExtendedCode {
+		case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+			return &datastore.Error{Sentinel: datastore.ErrConflict, Err: err}
 		}
 	}
-	return types.IP(a)
+	return err
 }
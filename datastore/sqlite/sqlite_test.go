@@ -0,0 +1,116 @@
+package sqlite_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/datastore/datastoretest"
+	"github.com/lovi-cloud/ursa/datastore/sqlite"
+	"github.com/lovi-cloud/ursa/types"
+)
+
+// newDSN returns the dsn of a new database file removed after the test.
+func newDSN(t *testing.T) string {
+	t.Helper()
+	return "file:" + filepath.Join(t.TempDir(), "ursa.db")
+}
+
+func TestConformance(t *testing.T) {
+	datastoretest.Run(t, func(t *testing.T) datastore.Datastore {
+		ds, err := sqlite.New(context.Background(), newDSN(t), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ds
+	})
+}
+
+func mustParseIP(t *testing.T, s string) types.IP {
+	t.Helper()
+	ip, err := types.ParseIP(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *ip
+}
+
+func mustParseCIDR(t *testing.T, s string) types.IPNet {
+	t.Helper()
+	n, err := types.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *n
+}
+
+// TestConcurrentRegisterHost registers the hosts at the same time from the
+// connections of the pool, as the DHCP and HTTP handlers do.
+func TestConcurrentRegisterHost(t *testing.T) {
+	const n = 40
+	ctx := context.Background()
+	ds, err := sqlite.New(ctx, newDSN(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	_, err = ds.CreateManagementSubnet(ctx, mustParseCIDR(t, "10.0.0.0/24"), mustParseIP(t, "10.0.0.1"), mustParseIP(t, "10.0.0.200"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.CreateServiceSubnet(ctx, mustParseCIDR(t, "192.168.0.0/24"), mustParseIP(t, "192.168.0.1"), mustParseIP(t, "192.168.0.200"), mustParseIP(t, "192.168.0.254"), mustParseIP(t, "8.8.8.8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	names := make(chan string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mac := types.HardwareAddr(net.HardwareAddr{0x52, 0x54, 0x00, 0x00, 0x00, byte(i)})
+			sl, err := ds.CreateLeaseFromServiceSubnet(ctx, mac)
+			if err != nil {
+				errs <- err
+				return
+			}
+			ml, err := ds.CreateLeaseFromManagementSubnet(ctx, mac)
+			if err != nil {
+				errs <- err
+				return
+			}
+			id := uuid.NewV5(uuid.NamespaceOID, fmt.Sprintf("host-%d", i))
+			host, err := ds.RegisterHost(ctx, id, "serial", "product", "manufacturer", sl.ID, ml.ID)
+			if err != nil {
+				errs <- err
+				return
+			}
+			names <- host.Name
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	close(names)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	seen := map[string]bool{}
+	for name := range names {
+		if seen[name] {
+			t.Errorf("%s is allocated twice", name)
+		}
+		seen[name] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("want %d hosts, but got %d", n, len(seen))
+	}
+}
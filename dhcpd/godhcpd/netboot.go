@@ -2,7 +2,6 @@ package godhcpd
 
 import (
 	"context"
-	"database/sql"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -13,20 +12,33 @@ import (
 
 	"github.com/lovi-cloud/ursa/datastore"
 	"github.com/lovi-cloud/ursa/dhcpd"
+	"github.com/lovi-cloud/ursa/event"
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/metrics"
+	"github.com/lovi-cloud/ursa/trace"
 	"github.com/lovi-cloud/ursa/types"
 )
 
 // GoDHCPd is
 type GoDHCPd struct {
-	ds     datastore.Datastore
-	logger *zap.Logger
+	ds        datastore.Datastore
+	logger    *zap.Logger
+	bmcFilter *dhcpd.BMCFilter
+	bus       *event.Bus
+	metrics   *metrics.Metrics
+	tracer    *trace.Tracer
 }
 
-// New is
-func New(ds datastore.Datastore, logger *zap.Logger) (dhcpd.DHCPd, error) {
+// New is. If bmcFilter is not nil, the matched clients are leased from the
+// BMC subnet and recorded as BMCs.
+func New(ds datastore.Datastore, logger *zap.Logger, bmcFilter *dhcpd.BMCFilter, bus *event.Bus, m *metrics.Metrics, tracer *trace.Tracer) (dhcpd.DHCPd, error) {
 	return &GoDHCPd{
-		ds:     ds,
-		logger: logger,
+		ds:        ds,
+		logger:    logger,
+		bmcFilter: bmcFilter,
+		bus:       bus,
+		metrics:   m,
+		tracer:    tracer,
 	}, nil
 }
 
@@ -42,39 +54,174 @@ func (n *GoDHCPd) Serve(ctx context.Context, addr net.IP, iface string) error {
 		req, riface, err := conn.RecvDHCP()
 		if err != nil {
 			n.logger.Error("failed to receive dhcp request", zap.Error(err))
+			n.metrics.DHCPPackets.Inc("unknown", "error")
 			continue
 		}
+		msgType := messageType(req.Type)
 		if riface.Name != iface {
+			n.metrics.DHCPPackets.Inc(msgType, "ignored")
 			continue
 		}
 		n.logger.Info("received request", zap.String("req", fmt.Sprintf("%+v", req)))
 
-		subnet, err := n.ds.GetManagementSubnet(ctx)
+		err = n.reply(ctx, conn, addr, req, riface)
 		if err != nil {
-			n.logger.Error("failed to get subnet", zap.Error(err))
+			n.logger.Error("failed to reply dhcp request", zap.Error(err))
+			n.bus.Publish(event.TypeError, "", map[string]string{
+				"component": "dhcpd",
+				"mac":       req.HardwareAddr.String(),
+				"error":     err.Error(),
+			})
+			n.metrics.DHCPPackets.Inc(msgType, "error")
 			continue
 		}
-		var lease *dhcpd.Lease
-		lease, err = n.ds.GetLeaseFromManagementSubnet(ctx, types.HardwareAddr(req.HardwareAddr))
-		if err != nil && errors.Is(err, sql.ErrNoRows) {
-			lease, err = n.ds.CreateLeaseFromManagementSubnet(ctx, types.HardwareAddr(req.HardwareAddr))
-		}
-		if err != nil {
-			n.logger.Error("failed to get lease", zap.Error(err))
-			continue
-		}
-		resp, err := makeResponse(addr, *req, *subnet, *lease)
-		if err != nil {
-			n.logger.Error("failed to make response", zap.Error(err))
-			continue
+		n.metrics.DHCPPackets.Inc(msgType, "replied")
+	}
+}
+
+// reply sends the response to the request.
+func (n *GoDHCPd) reply(ctx context.Context, conn *dhcp4.Conn, addr net.IP, req *dhcp4.Packet, riface *net.Interface) error {
+	resp, err := n.respond(ctx, addr, req)
+	if err != nil {
+		return err
+	}
+	err = conn.SendDHCP(resp, riface)
+	if err != nil {
+		return fmt.Errorf("failed to send dhcp response: %w", err)
+	}
+	n.logger.Info("send DCHP response", zap.String("resp", fmt.Sprintf("%+v", resp)))
+	return nil
+}
+
+// respond leases the address to the client and makes the response. The
+// request of a host, not a BMC, is traced as a part of the boot.
+func (n *GoDHCPd) respond(ctx context.Context, addr net.IP, req *dhcp4.Packet) (resp *dhcp4.Packet, err error) {
+	vendorClass, _ := req.Options.String(dhcp4.OptVendorIdentifier)
+	isBMC := n.bmcFilter != nil && n.bmcFilter.Match(vendorClass, req.HardwareAddr)
+	var subnet *dhcpd.Subnet
+	var lease *dhcpd.Lease
+	if !isBMC {
+		var span *trace.Span
+		ctx, span = n.tracer.StartBoot(ctx, trace.BootKey{MAC: req.HardwareAddr}, "dhcp "+messageType(req.Type))
+		defer func() {
+			span.SetError(err)
+			span.End()
+			n.recordBootEvent(ctx, req, lease, err)
+		}()
+	}
+
+	if isBMC {
+		subnet, lease, err = n.leaseBMC(ctx, *req, vendorClass)
+	} else {
+		subnet, lease, err = n.leaseManagement(ctx, *req)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lease: %w", err)
+	}
+	if !isBMC {
+		n.tracer.BindBoot(trace.BootKey{MAC: req.HardwareAddr, IP: net.IP(lease.IPAddress)})
+	}
+	resp, err = makeResponse(addr, *req, *subnet, *lease)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make response: %w", err)
+	}
+	return resp, nil
+}
+
+func (n *GoDHCPd) leaseManagement(ctx context.Context, req dhcp4.Packet) (*dhcpd.Subnet, *dhcpd.Lease, error) {
+	subnet, err := n.ds.GetManagementSubnet(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get subnet: %w", err)
+	}
+	lease, err := n.ds.GetLeaseFromManagementSubnet(ctx, types.HardwareAddr(req.HardwareAddr))
+	if err != nil && errors.Is(err, datastore.ErrNotFound) {
+		lease, err = n.ds.CreateLeaseFromManagementSubnet(ctx, types.HardwareAddr(req.HardwareAddr))
+		if err == nil {
+			n.publishLeaseCreated(*lease, "management")
 		}
-		err = conn.SendDHCP(resp, riface)
-		if err != nil {
-			n.logger.Error("failed to send dhcp response", zap.Error(err))
-			continue
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return subnet, lease, nil
+}
+
+// leaseBMC leases the address from the BMC subnet and records the BMC.
+func (n *GoDHCPd) leaseBMC(ctx context.Context, req dhcp4.Packet, vendorClass string) (*dhcpd.Subnet, *dhcpd.Lease, error) {
+	subnet, err := n.ds.GetBMCSubnet(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get BMC subnet: %w", err)
+	}
+	lease, err := n.ds.GetLeaseFromBMCSubnet(ctx, types.HardwareAddr(req.HardwareAddr))
+	if err != nil && errors.Is(err, datastore.ErrNotFound) {
+		lease, err = n.ds.CreateLeaseFromBMCSubnet(ctx, types.HardwareAddr(req.HardwareAddr))
+		if err == nil {
+			n.publishLeaseCreated(*lease, "bmc")
 		}
-		n.logger.Info("send DCHP response", zap.String("resp", fmt.Sprintf("%+v", resp)))
 	}
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := req.Options.String(dhcp4.OptHostname)
+	bmc, err := n.ds.RecordBMC(ctx, types.HardwareAddr(req.HardwareAddr), vendorClass, hostname, lease.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	n.logger.Info("discovered BMC", zap.String("mac", bmc.MACAddress.String()), zap.String("vendor_class", vendorClass), zap.String("hostname", hostname))
+	n.bus.Publish(event.TypeBMCDiscovered, "", map[string]string{
+		"mac":          bmc.MACAddress.String(),
+		"ip_address":   lease.IPAddress.String(),
+		"vendor_class": vendorClass,
+		"hostname":     hostname,
+	})
+	return subnet, lease, nil
+}
+
+// recordBootEvent records the exchange in the boot timeline of the client.
+func (n *GoDHCPd) recordBootEvent(ctx context.Context, req *dhcp4.Packet, lease *dhcpd.Lease, err error) {
+	e := httpd.BootEvent{
+		MACAddress: req.HardwareAddr.String(),
+		Protocol:   httpd.BootEventProtocolDHCP,
+		Name:       messageType(req.Type),
+		Outcome:    httpd.BootEventOutcomeOK,
+	}
+	if userClass, _ := req.Options.String(77); userClass != "" {
+		e.Detail = userClass
+	}
+	if lease != nil {
+		e.IPAddress = lease.IPAddress.String()
+	}
+	if err != nil {
+		e.Outcome = httpd.BootEventOutcomeError
+		e.Detail = err.Error()
+	}
+	if err := n.ds.RecordBootEvent(ctx, e); err != nil {
+		n.logger.Warn("failed to record boot event", zap.Error(err))
+	}
+}
+
+func (n *GoDHCPd) publishLeaseCreated(lease dhcpd.Lease, subnet string) {
+	n.bus.Publish(event.TypeLeaseCreated, "", map[string]string{
+		"subnet":     subnet,
+		"mac":        lease.MACAddress.String(),
+		"ip_address": lease.IPAddress.String(),
+	})
+}
+
+func messageType(t dhcp4.MessageType) string {
+	switch t {
+	case dhcp4.MsgDiscover:
+		return "discover"
+	case dhcp4.MsgRequest:
+		return "request"
+	case dhcp4.MsgDecline:
+		return "decline"
+	case dhcp4.MsgRelease:
+		return "release"
+	case dhcp4.MsgInform:
+		return "inform"
+	}
+	return "other"
 }
 
 func makeResponse(addr net.IP, req dhcp4.Packet, subnet dhcpd.Subnet, lease dhcpd.Lease) (*dhcp4.Packet, error) {
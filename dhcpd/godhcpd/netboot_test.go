@@ -0,0 +1,257 @@
+package godhcpd
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"go.uber.org/zap"
+	"go.universe.tf/netboot/dhcp4"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/datastore/memory"
+	"github.com/lovi-cloud/ursa/dhcpd"
+	"github.com/lovi-cloud/ursa/event"
+	"github.com/lovi-cloud/ursa/metrics"
+	"github.com/lovi-cloud/ursa/types"
+)
+
+var serverAddr = net.IPv4(10, 0, 0, 254)
+
+func mustParseIP(t *testing.T, s string) types.IP {
+	t.Helper()
+	ip, err := types.ParseIP(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *ip
+}
+
+func mustParseCIDR(t *testing.T, s string) types.IPNet {
+	t.Helper()
+	n, err := types.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *n
+}
+
+// newGoDHCPd returns the daemon with the management, service and BMC
+// subnets that recognizes the BMCs by the filter.
+func newGoDHCPd(t *testing.T, filter *dhcpd.BMCFilter) (*GoDHCPd, datastore.Datastore, *event.Bus) {
+	t.Helper()
+	ctx := context.Background()
+	naming, err := datastore.NewNaming("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := memory.New(naming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.CreateManagementSubnet(ctx, mustParseCIDR(t, "10.0.0.0/24"), mustParseIP(t, "10.0.0.1"), mustParseIP(t, "10.0.0.99"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.CreateServiceSubnet(ctx, mustParseCIDR(t, "192.168.0.0/24"), mustParseIP(t, "192.168.0.1"), mustParseIP(t, "192.168.0.99"), mustParseIP(t, "192.168.0.254"), mustParseIP(t, "8.8.8.8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.CreateBMCSubnet(ctx, mustParseCIDR(t, "10.1.0.0/24"), mustParseIP(t, "10.1.0.1"), mustParseIP(t, "10.1.0.99"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := event.NewBus(16)
+	d, err := New(ds, zap.NewNop(), filter, bus, metrics.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.(*GoDHCPd), ds, bus
+}
+
+func mac(i int) net.HardwareAddr {
+	return net.HardwareAddr{0x52, 0x54, 0x00, 0x00, 0x00, byte(i)}
+}
+
+func packet(typ dhcp4.MessageType, hw net.HardwareAddr, options dhcp4.Options) *dhcp4.Packet {
+	if options == nil {
+		options = dhcp4.Options{}
+	}
+	return &dhcp4.Packet{Type: typ, TransactionID: []byte{1, 2, 3, 4}, HardwareAddr: hw, Options: options}
+}
+
+func eventTypes(bus *event.Bus) []string {
+	var types []string
+	for _, e := range bus.Since(0) {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestRespondManagement(t *testing.T) {
+	ctx := context.Background()
+	n, ds, bus := newGoDHCPd(t, nil)
+
+	resp, err := n.respond(ctx, serverAddr, packet(dhcp4.MsgDiscover, mac(1), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Type != dhcp4.MsgOffer || !resp.YourAddr.Equal(net.IPv4(10, 0, 0, 1)) || !resp.ServerAddr.Equal(serverAddr) {
+		t.Fatalf("response = %+v, want an offer of 10.0.0.1", resp)
+	}
+	if file, _ := resp.Options.String(dhcp4.OptBootFile); file != "ipxe.efi" {
+		t.Errorf("boot file = %q, want ipxe.efi", file)
+	}
+	if mask := resp.Options[dhcp4.OptSubnetMask]; net.IPMask(mask).String() != "ffffff00" {
+		t.Errorf("subnet mask = %v, want /24", mask)
+	}
+	if _, ok := resp.Options[dhcp4.OptRouters]; ok {
+		t.Error("want no router on the management subnet")
+	}
+
+	// iPXE is offered the same lease and chainloaded over HTTP.
+	resp, err = n.respond(ctx, serverAddr, packet(dhcp4.MsgRequest, mac(1), dhcp4.Options{77: []byte("iPXE")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Type != dhcp4.MsgAck || !resp.YourAddr.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("response = %+v, want an ack of 10.0.0.1", resp)
+	}
+	want := "http://10.0.0.254/ipxe?uuid=${uuid}&mac=${mac:hexhyp}&serial=${serial}&product=${product}&manufacturer=${manufacturer}"
+	if file, _ := resp.Options.String(dhcp4.OptBootFile); file != want {
+		t.Errorf("boot file = %q, want %q", file, want)
+	}
+	if got := eventTypes(bus); len(got) != 1 || got[0] != event.TypeLeaseCreated {
+		t.Errorf("events = %v, want a lease created", got)
+	}
+	leases, err := ds.ListLease(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 1 {
+		t.Errorf("leases = %+v, want 1", leases)
+	}
+}
+
+func TestRespondRegisteredHost(t *testing.T) {
+	ctx := context.Background()
+	n, ds, _ := newGoDHCPd(t, nil)
+	hw := types.HardwareAddr(mac(1))
+	management, err := ds.CreateLeaseFromManagementSubnet(ctx, hw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := ds.CreateLeaseFromServiceSubnet(ctx, hw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ds.RegisterHost(ctx, uuid.NewV5(uuid.NamespaceOID, "host-1"), "SN1", "product", "manufacturer", service.ID, management.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// DHCP offers the management lease, not the service lease, of the host.
+	resp, err := n.respond(ctx, serverAddr, packet(dhcp4.MsgDiscover, mac(1), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.YourAddr.Equal(net.IP(management.IPAddress)) {
+		t.Errorf("offered %s, want the management lease %s", resp.YourAddr, management.IPAddress)
+	}
+	if _, err := ds.GetLeaseFromServiceSubnet(ctx, hw); err != nil {
+		t.Errorf("want the service lease kept: %v", err)
+	}
+
+	events, err := ds.ListBootEventByHost(ctx, h.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Name != "discover" || events[0].IPAddress != management.IPAddress.String() {
+		t.Errorf("boot events = %+v, want the discover", events)
+	}
+}
+
+func TestRespondBMC(t *testing.T) {
+	ctx := context.Background()
+	oui := net.HardwareAddr{0x00, 0x25, 0x90}
+	n, ds, bus := newGoDHCPd(t, &dhcpd.BMCFilter{VendorClasses: []string{"iDRAC"}, OUIs: []net.HardwareAddr{oui}})
+
+	tests := []struct {
+		name    string
+		req     *dhcp4.Packet
+		network string
+	}{
+		{
+			name:    "vendor class",
+			req:     packet(dhcp4.MsgDiscover, mac(1), dhcp4.Options{dhcp4.OptVendorIdentifier: []byte("iDRAC9"), dhcp4.OptHostname: []byte("idrac-sn1")}),
+			network: "10.1.0.0/24",
+		},
+		{
+			name:    "OUI",
+			req:     packet(dhcp4.MsgDiscover, net.HardwareAddr{0x00, 0x25, 0x90, 0x00, 0x00, 0x02}, nil),
+			network: "10.1.0.0/24",
+		},
+		{
+			name:    "host",
+			req:     packet(dhcp4.MsgDiscover, mac(3), dhcp4.Options{dhcp4.OptVendorIdentifier: []byte("PXEClient:Arch:00007")}),
+			network: "10.0.0.0/24",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := n.respond(ctx, serverAddr, test.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			network := mustParseCIDR(t, test.network)
+			if !(*net.IPNet)(&network).Contains(resp.YourAddr) {
+				t.Errorf("offered %s, want from %s", resp.YourAddr, test.network)
+			}
+			bmc, err := ds.GetBMCByMAC(ctx, types.HardwareAddr(test.req.HardwareAddr))
+			isBMC := test.network == "10.1.0.0/24"
+			if isBMC && (err != nil || !net.IP(bmc.IPAddress).Equal(resp.YourAddr)) {
+				t.Errorf("BMC = %+v, %v, want recorded", bmc, err)
+			}
+			if !isBMC && err == nil {
+				t.Errorf("want the host not recorded as a BMC, but got %+v", bmc)
+			}
+		})
+	}
+	bmc, err := ds.GetBMCByMAC(ctx, types.HardwareAddr(mac(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bmc.VendorClass != "iDRAC9" || bmc.Hostname != "idrac-sn1" {
+		t.Errorf("BMC = %+v, want the vendor class and the hostname", bmc)
+	}
+	var discovered int
+	for _, typ := range eventTypes(bus) {
+		if typ == event.TypeBMCDiscovered {
+			discovered++
+		}
+	}
+	if discovered != 2 {
+		t.Errorf("%d BMCs discovered, want 2", discovered)
+	}
+}
+
+func TestBMCFilter(t *testing.T) {
+	f := dhcpd.BMCFilter{VendorClasses: []string{"iDRAC", ""}, OUIs: []net.HardwareAddr{{0x00, 0x25, 0x90}}}
+	tests := []struct {
+		vendorClass string
+		mac         net.HardwareAddr
+		want        bool
+	}{
+		{vendorClass: "iDRAC9", mac: mac(1), want: true},
+		{vendorClass: "PXEClient", mac: net.HardwareAddr{0x00, 0x25, 0x90, 0x01, 0x02, 0x03}, want: true},
+		{vendorClass: "PXEClient", mac: mac(1), want: false},
+		{vendorClass: "", mac: mac(1), want: false},
+		{vendorClass: "", mac: net.HardwareAddr{0x00, 0x25}, want: false},
+	}
+	for _, test := range tests {
+		if got := f.Match(test.vendorClass, test.mac); got != test.want {
+			t.Errorf("Match(%q, %s) = %t, want %t", test.vendorClass, test.mac, got, test.want)
+		}
+	}
+}
@@ -1,21 +1,64 @@
 package dhcpd
 
-import "github.com/lovi-cloud/ursa/types"
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/lovi-cloud/ursa/types"
+)
 
 // Subnet is subnet configuration.
 type Subnet struct {
-	ID        int         `db:"id"`
-	Network   types.IPNet `db:"network"`
-	Start     types.IP    `db:"start"`
-	End       types.IP    `db:"end"`
-	Gateway   *types.IP   `db:"gateway"`
-	DNSServer *types.IP   `db:"dns_server"`
+	ID        int         `db:"id" json:"id"`
+	Network   types.IPNet `db:"network" json:"network"`
+	Start     types.IP    `db:"start" json:"start"`
+	End       types.IP    `db:"end" json:"end"`
+	Gateway   *types.IP   `db:"gateway" json:"gateway"`
+	DNSServer *types.IP   `db:"dns_server" json:"dns_server"`
 }
 
 // Lease is
 type Lease struct {
-	ID         int                `db:"id"`
-	MACAddress types.HardwareAddr `db:"mac_address"`
-	IPAddress  types.IP           `db:"ip_address"`
-	SubnetID   int                `db:"subnet_id"`
+	ID         int                `db:"id" json:"id"`
+	MACAddress types.HardwareAddr `db:"mac_address" json:"mac_address"`
+	IPAddress  types.IP           `db:"ip_address" json:"ip_address"`
+	SubnetID   int                `db:"subnet_id" json:"subnet_id"`
+}
+
+// ErrLeaseInUse is returned when the lease to delete is used by a host.
+var ErrLeaseInUse = errors.New("lease is in use")
+
+// BMC is a BMC discovered by DHCP. HostID is set when the BMC is
+// correlated with its host.
+type BMC struct {
+	ID          int                `db:"id" json:"id"`
+	MACAddress  types.HardwareAddr `db:"mac_address" json:"mac_address"`
+	IPAddress   types.IP           `db:"ip_address" json:"ip_address"`
+	VendorClass string             `db:"vendor_class" json:"vendor_class"`
+	Hostname    string             `db:"hostname" json:"hostname"`
+	LeaseID     int                `db:"lease_id" json:"lease_id"`
+	HostID      *int               `db:"host_id" json:"host_id"`
+}
+
+// BMCFilter recognizes BMC DHCP clients by the prefix of the vendor class
+// identifier (option 60) or the OUI of the MAC address.
+type BMCFilter struct {
+	VendorClasses []string
+	OUIs          []net.HardwareAddr
+}
+
+// Match is
+func (f BMCFilter) Match(vendorClass string, mac net.HardwareAddr) bool {
+	for _, vc := range f.VendorClasses {
+		if vc != "" && strings.HasPrefix(vendorClass, vc) {
+			return true
+		}
+	}
+	for _, oui := range f.OUIs {
+		if len(mac) >= 3 && len(oui) >= 3 && mac[0] == oui[0] && mac[1] == oui[1] && mac[2] == oui[2] {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,129 @@
+package event
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	TypeLeaseCreated       = "lease.created"
+	TypeLeaseReleased      = "lease.released"
+	TypeBMCDiscovered      = "bmc.discovered"
+	TypeHostRegistered     = "host.registered"
+	TypeHostStateChanged   = "host.state_changed"
+	TypeHostRenamed        = "host.renamed"
+	TypeHostDeleted        = "host.deleted"
+	TypeIPXEServed         = "ipxe.served"
+	TypeCloudInitFetched   = "cloud-init.fetched"
+	TypeInventoryReceived  = "inventory.received"
+	TypeProvisioned        = "host.provisioned"
+	TypeWipeReportReceived = "wipe.reported"
+	TypeError              = "error"
+)
+
+// Event is a lifecycle event of ursa. Host is the name of the host if the
+// event is about a host.
+type Event struct {
+	ID   uint64            `json:"id"`
+	Type string            `json:"type"`
+	Time time.Time         `json:"time"`
+	Host string            `json:"host,omitempty"`
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// Bus is the in-process event bus. It keeps the recent events so that a
+// client can resume from the last event it received.
+type Bus struct {
+	mu          sync.Mutex
+	nextID      uint64
+	recent      []Event
+	size        int
+	subscribers map[chan Event]struct{}
+}
+
+// NewBus returns the bus that keeps size recent events.
+func NewBus(size int) *Bus {
+	return &Bus{
+		nextID:      1,
+		size:        size,
+		subscribers: map[chan Event]struct{}{},
+	}
+}
+
+// Publish publishes the event to the subscribers. A subscriber that does
+// not keep up loses the event. Publish on a nil Bus does nothing.
+func (b *Bus) Publish(typ, host string, data map[string]string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e := Event{
+		ID:   b.nextID,
+		Type: typ,
+		Time: time.Now().UTC(),
+		Host: host,
+		Data: data,
+	}
+	b.nextID++
+	b.recent = append(b.recent, e)
+	if len(b.recent) > b.size {
+		b.recent = b.recent[len(b.recent)-b.size:]
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns the channel that receives the events published after
+// the call. cancel must be called to release the channel.
+func (b *Bus) Subscribe(buffer int) (events <-chan Event, cancel func()) {
+	ch := make(chan Event, buffer)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// Since returns the recent events newer than id.
+func (b *Bus) Since(id uint64) []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var events []Event
+	for _, e := range b.recent {
+		if e.ID > id {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// Wait returns the recent events newer than id. If there is no such event,
+// it waits until an event is published or ctx is done.
+func (b *Bus) Wait(ctx context.Context, id uint64) []Event {
+	ch, cancel := b.Subscribe(1)
+	defer cancel()
+	if events := b.Since(id); len(events) != 0 {
+		return events
+	}
+	select {
+	case e := <-ch:
+		return []Event{e}
+	case <-ctx.Done():
+		return nil
+	}
+}
@@ -0,0 +1,158 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"go.uber.org/zap"
+
+	"github.com/lovi-cloud/ursa/event"
+)
+
+const (
+	maxAttempts    = 6
+	initialBackoff = time.Second
+	queueSize      = 1024
+)
+
+// Headers of a delivery
+const (
+	HeaderEvent     = "X-Ursa-Event"
+	HeaderDelivery  = "X-Ursa-Delivery"
+	HeaderSignature = "X-Ursa-Signature"
+)
+
+// Dispatcher delivers the events of the bus to webhooks.
+type Dispatcher struct {
+	bus     *event.Bus
+	logger  *zap.Logger
+	urls    []string
+	secret  []byte
+	client  *http.Client
+	backoff time.Duration
+}
+
+// New is. If secret is not empty, the body is signed by HMAC-SHA256 of the
+// secret and the signature is sent in the X-Ursa-Signature header as
+// "sha256=<hex>".
+func New(bus *event.Bus, logger *zap.Logger, urls []string, secret string) (*Dispatcher, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no webhook URL")
+	}
+	return &Dispatcher{
+		bus:     bus,
+		logger:  logger,
+		urls:    urls,
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		backoff: initialBackoff,
+	}, nil
+}
+
+// Run delivers the events until ctx is done. Each webhook has its own queue,
+// so a slow webhook does not delay the others. A failed delivery is retried
+// with exponential backoff, with the same random delivery ID in the
+// X-Ursa-Delivery header.
+func (d *Dispatcher) Run(ctx context.Context) error {
+	events, cancel := d.bus.Subscribe(queueSize)
+	defer cancel()
+
+	queues := make([]chan event.Event, len(d.urls))
+	for i, url := range d.urls {
+		queues[i] = make(chan event.Event, queueSize)
+		go d.deliverLoop(ctx, url, queues[i])
+	}
+	for {
+		select {
+		case e := <-events:
+			for i, q := range queues {
+				select {
+				case q <- e:
+				default:
+					d.logger.Warn("webhook queue is full, drop event", zap.String("url", d.urls[i]), zap.Uint64("id", e.ID))
+				}
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (d *Dispatcher) deliverLoop(ctx context.Context, url string, queue <-chan event.Event) {
+	for {
+		select {
+		case e := <-queue:
+			err := d.deliverWithRetry(ctx, url, e)
+			if err != nil {
+				d.logger.Error("failed to deliver event", zap.String("url", url), zap.Uint64("id", e.ID), zap.String("type", e.Type), zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) deliverWithRetry(ctx context.Context, url string, e event.Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	delivery, err := uuid.NewV4()
+	if err != nil {
+		return fmt.Errorf("failed to generate delivery id: %w", err)
+	}
+	backoff := d.backoff
+	for attempt := 1; ; attempt++ {
+		err = d.deliver(ctx, url, e, delivery.String(), body)
+		if err == nil {
+			return nil
+		}
+		if attempt == maxAttempts {
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+		d.logger.Warn("failed to deliver event, retrying", zap.String("url", url), zap.Uint64("id", e.ID), zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, url string, e event.Event, delivery string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, e.Type)
+	req.Header.Set(HeaderDelivery, delivery)
+	if len(d.secret) != 0 {
+		req.Header.Set(HeaderSignature, Sign(d.secret, body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post event: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to post event: status=%d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the value of the X-Ursa-Signature header of the body.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
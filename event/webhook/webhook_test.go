@@ -0,0 +1,185 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"go.uber.org/zap"
+
+	"github.com/lovi-cloud/ursa/event"
+)
+
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+// receiver records the deliveries and fails the first failures of them
+// with 503.
+type receiver struct {
+	mu         sync.Mutex
+	failures   int
+	deliveries []delivery
+	received   chan struct{}
+}
+
+func newReceiver(failures int) *receiver {
+	return &receiver{failures: failures, received: make(chan struct{}, 64)}
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	rc.mu.Lock()
+	rc.deliveries = append(rc.deliveries, delivery{header: r.Header, body: body})
+	fail := len(rc.deliveries) <= rc.failures
+	rc.mu.Unlock()
+	if fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	select {
+	case rc.received <- struct{}{}:
+	default:
+	}
+}
+
+func (rc *receiver) wait(t *testing.T, n int) []delivery {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-rc.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for delivery %d", i+1)
+		}
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]delivery{}, rc.deliveries...)
+}
+
+func newDispatcher(t *testing.T, bus *event.Bus, url string) *Dispatcher {
+	t.Helper()
+	d, err := New(bus, zap.NewNop(), []string{url}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.backoff = time.Millisecond
+	return d
+}
+
+func TestDeliverWithRetry(t *testing.T) {
+	rc := newReceiver(1)
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	d := newDispatcher(t, event.NewBus(16), srv.URL)
+
+	e := event.Event{ID: 7, Type: event.TypeHostRegistered, Host: "cn0001", Data: map[string]string{"uuid": "u"}}
+	err := d.deliverWithRetry(context.Background(), srv.URL, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveries := rc.wait(t, 2)
+	if len(deliveries) != 2 {
+		t.Fatalf("want a retry after 503, but got %d deliveries", len(deliveries))
+	}
+	id := deliveries[0].header.Get(HeaderDelivery)
+	if _, err := uuid.FromString(id); err != nil {
+		t.Errorf("delivery id %q is not a UUID: %v", id, err)
+	}
+	for _, dl := range deliveries {
+		if got := dl.header.Get(HeaderDelivery); got != id {
+			t.Errorf("delivery id of the retry = %s, want %s", got, id)
+		}
+		if got := dl.header.Get(HeaderEvent); got != event.TypeHostRegistered {
+			t.Errorf("event header = %s, want %s", got, event.TypeHostRegistered)
+		}
+		if got, want := dl.header.Get(HeaderSignature), Sign([]byte("secret"), dl.body); got != want {
+			t.Errorf("signature = %s, want %s", got, want)
+		}
+		var got event.Event
+		err := json.Unmarshal(dl.body, &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != e.ID || got.Host != e.Host || got.Data["uuid"] != "u" {
+			t.Errorf("body = %+v, want %+v", got, e)
+		}
+	}
+
+	// Another delivery of the same event has another id.
+	err = d.deliverWithRetry(context.Background(), srv.URL, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rc.wait(t, 1)[2].header.Get(HeaderDelivery); got == id {
+		t.Errorf("want a new delivery id, but got %s again", got)
+	}
+}
+
+func TestDeliverWithRetryGivesUp(t *testing.T) {
+	rc := newReceiver(maxAttempts)
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	d := newDispatcher(t, event.NewBus(16), srv.URL)
+
+	err := d.deliverWithRetry(context.Background(), srv.URL, event.Event{ID: 1, Type: event.TypeError})
+	if err == nil {
+		t.Fatal("want an error after the attempts")
+	}
+	if n := len(rc.wait(t, maxAttempts)); n != maxAttempts {
+		t.Fatalf("deliveries = %d, want %d", n, maxAttempts)
+	}
+}
+
+func TestRun(t *testing.T) {
+	rc := newReceiver(0)
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	bus := event.NewBus(16)
+	d := newDispatcher(t, bus, srv.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- d.Run(ctx)
+	}()
+
+	// The events published before Run subscribes are not delivered, so
+	// publish until one is delivered.
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(5 * time.Second)
+	for delivered := false; !delivered; {
+		select {
+		case <-ticker.C:
+			bus.Publish(event.TypeHostRenamed, "cn0001", map[string]string{"from": "cn0002"})
+		case <-rc.received:
+			delivered = true
+		case <-timeout:
+			t.Fatal("timed out waiting for delivery")
+		}
+	}
+	rc.mu.Lock()
+	dl := rc.deliveries[0]
+	rc.mu.Unlock()
+	var got event.Event
+	err := json.Unmarshal(dl.body, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != event.TypeHostRenamed || got.Host != "cn0001" || dl.header.Get(HeaderSignature) != Sign([]byte("secret"), dl.body) {
+		t.Fatalf("unexpected delivery: %+v %v", got, dl.header)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
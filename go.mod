@@ -4,6 +4,7 @@ go 1.15
 
 require (
 	github.com/jmoiron/sqlx v1.2.0
+	github.com/lib/pq v1.7.0
 	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/rakyll/statik v0.1.7
 	github.com/safchain/ethtool v0.0.0-20200609180057-ab94f15152e7
@@ -0,0 +1,65 @@
+package gohttpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/dhcpd"
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/types"
+)
+
+// errBMCLinked is returned when the BMC of the inventory is linked with
+// another host.
+var errBMCLinked = errors.New("BMC is linked with another host")
+
+// linkBMC correlates the BMC discovered by DHCP with the host. The BMC MAC
+// address in the inventory is used first, and then the serial number of the
+// host is looked up in the DHCP hostname of the BMCs (e.g. idrac-<service
+// tag>, ILO<serial>). A BMC linked with another host is never relinked.
+func linkBMC(ctx context.Context, ds datastore.Datastore, h httpd.Host, inventory httpd.Inventory) error {
+	if inventory.BMC != nil && inventory.BMC.MACAddress != "" {
+		mac, err := types.ParseMAC(inventory.BMC.MACAddress)
+		if err != nil {
+			return fmt.Errorf("failed to parse BMC mac address: %w", err)
+		}
+		bmc, err := ds.GetBMCByMAC(ctx, *mac)
+		if err == nil {
+			return linkBMCIfChanged(ctx, ds, *bmc, h)
+		} else if !errors.Is(err, datastore.ErrNotFound) {
+			return err
+		}
+	}
+
+	serial := inventory.Serial
+	if serial == "" {
+		serial = h.Serial
+	}
+	// too short serials like "0" match an unrelated hostname.
+	if len(serial) < 4 {
+		return nil
+	}
+	bmcs, err := ds.ListBMC(ctx)
+	if err != nil {
+		return err
+	}
+	for _, bmc := range bmcs {
+		if bmc.HostID == nil && strings.Contains(strings.ToLower(bmc.Hostname), strings.ToLower(serial)) {
+			return linkBMCIfChanged(ctx, ds, bmc, h)
+		}
+	}
+	return nil
+}
+
+func linkBMCIfChanged(ctx context.Context, ds datastore.Datastore, bmc dhcpd.BMC, h httpd.Host) error {
+	if bmc.HostID == nil {
+		return ds.LinkBMC(ctx, bmc.ID, h.ID)
+	}
+	if *bmc.HostID != h.ID {
+		return fmt.Errorf("BMC %s is linked with host id %d: %w", bmc.MACAddress, *bmc.HostID, errBMCLinked)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package gohttpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/dhcpd"
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/types"
+)
+
+func bmcMAC(i int) types.HardwareAddr {
+	return types.HardwareAddr(net.HardwareAddr{0x52, 0x54, 0x00, 0x00, 0x01, byte(i)})
+}
+
+// recordBMC records the BMC i discovered by DHCP with the hostname.
+func recordBMC(t *testing.T, ds datastore.Datastore, i int, hostname string) {
+	t.Helper()
+	ctx := context.Background()
+	l, err := ds.CreateLeaseFromBMCSubnet(ctx, bmcMAC(i))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.RecordBMC(ctx, bmcMAC(i), "iDRAC", hostname, l.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getBMC(t *testing.T, ds datastore.Datastore, i int) *dhcpd.BMC {
+	t.Helper()
+	bmc, err := ds.GetBMCByMAC(context.Background(), bmcMAC(i))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bmc
+}
+
+func TestLinkBMC(t *testing.T) {
+	ctx := context.Background()
+	ds := newDatastore(t, "")
+	_, err := ds.CreateBMCSubnet(ctx, mustParseCIDR(t, "10.0.0.0/24"), mustParseIP(t, "10.0.0.200"), mustParseIP(t, "10.0.0.250"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hosts []httpd.Host
+	for i := 1; i <= 3; i++ {
+		_, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = registerHostIfNotExists(ctx, ds, nil, mac(i), hostUUID(i), fmt.Sprintf("SN%04d", i), "product", "manufacturer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := ds.GetHostByUUID(ctx, hostUUID(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts = append(hosts, *h)
+	}
+	recordBMC(t, ds, 1, "idrac-a")
+	recordBMC(t, ds, 2, "idrac-sn0002")
+	recordBMC(t, ds, 3, "idrac-0")
+
+	// The BMC in the inventory is linked.
+	err = linkBMC(ctx, ds, hosts[0], httpd.Inventory{BMC: &httpd.BMC{MACAddress: bmcMAC(1).String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bmc := getBMC(t, ds, 1); bmc.HostID == nil || *bmc.HostID != hosts[0].ID {
+		t.Fatalf("want the BMC linked with %s, but got %+v", hosts[0].Name, bmc)
+	}
+	// Linking again is a no-op.
+	err = linkBMC(ctx, ds, hosts[0], httpd.Inventory{BMC: &httpd.BMC{MACAddress: bmcMAC(1).String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The BMC linked with another host is not relinked.
+	err = linkBMC(ctx, ds, hosts[1], httpd.Inventory{BMC: &httpd.BMC{MACAddress: bmcMAC(1).String()}})
+	if !errors.Is(err, errBMCLinked) {
+		t.Fatalf("want %v, but got %v", errBMCLinked, err)
+	}
+	if bmc := getBMC(t, ds, 1); *bmc.HostID != hosts[0].ID {
+		t.Fatalf("want the BMC kept linked with %s, but got %+v", hosts[0].Name, bmc)
+	}
+
+	// The BMC is found by the serial in its hostname.
+	err = linkBMC(ctx, ds, hosts[1], httpd.Inventory{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bmc := getBMC(t, ds, 2); bmc.HostID == nil || *bmc.HostID != hosts[1].ID {
+		t.Fatalf("want the BMC linked with %s by the serial, but got %+v", hosts[1].Name, bmc)
+	}
+
+	// A short serial does not match.
+	err = linkBMC(ctx, ds, hosts[2], httpd.Inventory{Serial: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bmc := getBMC(t, ds, 3); bmc.HostID != nil {
+		t.Fatalf("want the BMC not linked by a short serial, but got %+v", bmc)
+	}
+}
@@ -1,62 +1,204 @@
 package gohttpd
 
 import (
+	"bytes"
 	"context"
-	"database/sql"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
-	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
-	yaml "gopkg.in/yaml.v2"
-	sqlite3 "github.com/mattn/go-sqlite3"
 	uuid "github.com/satori/go.uuid"
+	yaml "gopkg.in/yaml.v2"
 
 	"go.uber.org/zap"
 
 	"github.com/lovi-cloud/ursa/datastore"
-	"github.com/lovi-cloud/ursa/types"
+	"github.com/lovi-cloud/ursa/dhcpd"
+	"github.com/lovi-cloud/ursa/event"
 	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/metrics"
+	"github.com/lovi-cloud/ursa/pki"
+	"github.com/lovi-cloud/ursa/trace"
+	"github.com/lovi-cloud/ursa/types"
+)
+
+const (
+	staticDir = "static"
+
+	maxInventorySize = 1 << 20
 )
 
 // GoHTTPd is
 type GoHTTPd struct {
-	ds     datastore.Datastore
-	logger *zap.Logger
+	ds          datastore.Datastore
+	logger      *zap.Logger
+	verifyImage bool
+	bus         *event.Bus
+	metrics     *metrics.Metrics
+	tracer      *trace.Tracer
+	network     NetworkOptions
+	vendorData  string
 }
 
-// New is
-func New(ds datastore.Datastore, logger *zap.Logger) (httpd.HTTPd, error) {
+// New is. If verifyImage is true, iPXE scripts verify the signatures of
+// boot artifacts made by SignBootProfile. network configures the network
+// of the hosts, and vendorData is the path of the site-wide vendor-data.
+func New(ds datastore.Datastore, logger *zap.Logger, verifyImage bool, bus *event.Bus, m *metrics.Metrics, tracer *trace.Tracer, network NetworkOptions, vendorData string) (httpd.HTTPd, error) {
 	return &GoHTTPd{
-		ds:     ds,
-		logger: logger,
+		ds:          ds,
+		logger:      logger,
+		verifyImage: verifyImage,
+		bus:         bus,
+		metrics:     m,
+		tracer:      tracer,
+		network:     network,
+		vendorData:  vendorData,
 	}, nil
 }
 
 // Serve is
 func (g *GoHTTPd) Serve(ctx context.Context, addr string) error {
+	return http.ListenAndServe(addr, g.handler())
+}
+
+// ServeTLS serves the same handlers as Serve over HTTPS. URLs in iPXE
+// scripts and cloud-init configs follow the scheme of the request, so a
+// host that fetched /ipxe over HTTPS keeps using HTTPS.
+func (g *GoHTTPd) ServeTLS(ctx context.Context, addr string, cert tls.Certificate) error {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: g.handler(),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+	return server.ListenAndServeTLS("", "")
+}
+
+func (g *GoHTTPd) handler() http.Handler {
 	mux := http.NewServeMux()
-	mux.Handle("/", g.loggingHandler(http.NotFoundHandler()))
-	mux.Handle("/ipxe", g.loggingHandler(g.ipxeHandler()))
-	mux.Handle("/static/", g.loggingHandler(http.StripPrefix("/static/", http.FileServer(http.Dir("static")))))
-	mux.Handle("/init/meta-data", g.loggingHandler(g.metadataHandler()))
-	mux.Handle("/init/user-data", g.loggingHandler(g.userdataHandler()))
+	mux.Handle("/", g.loggingHandler("/", http.NotFoundHandler()))
+	mux.Handle("/ipxe", g.loggingHandler("/ipxe", g.ipxeHandler()))
+	mux.Handle("/static/", g.loggingHandler("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(staticDir)))))
+	mux.Handle("/init/", g.loggingHandler("/init/", g.initHandler(map[string]http.Handler{
+		"meta-data":      g.metadataHandler(),
+		"user-data":      g.userdataHandler(),
+		"network-config": g.networkConfigHandler(),
+		"vendor-data":    g.vendordataHandler(),
+		"phone-home":     g.phoneHomeHandler(),
+		"inventory":      g.inventoryHandler(),
+		"preseed.cfg":    g.installConfigHandler(httpd.InstallerPreseed),
+		"kickstart.cfg":  g.installConfigHandler(httpd.InstallerKickstart),
+		"ignition.json":  g.ignitionHandler(),
+		"wipe-report":    g.wipeReportHandler(),
+	})))
 
-	return http.ListenAndServe(addr, mux)
+	return mux
 }
 
-func (g *GoHTTPd) loggingHandler(handler http.Handler) http.Handler {
+// loggingHandler logs the request and records the metrics of the handler
+// registered as route.
+func (g *GoHTTPd) loggingHandler(route string, handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		g.logger.Info("http request log", zap.String("url", r.URL.String()), zap.String("remote", r.RemoteAddr))
-		rec := httptest.NewRecorder()
-		handler.ServeHTTP(rec, r)
-		g.logger.Info("http response log", zap.Int("code", rec.Code))
-		w.WriteHeader(rec.Code)
-		rec.Body.WriteTo(w)
+		start := time.Now()
+		ctx, span := g.tracer.StartBoot(r.Context(), bootKey(r), "http "+route)
+		span.SetAttribute("http.target", redactToken(r.URL.Path))
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		handler.ServeHTTP(sw, r.WithContext(ctx))
+		g.logger.Info("http response log", zap.Int("code", sw.code))
+		span.SetAttribute("http.status_code", strconv.Itoa(sw.code))
+		if sw.code >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("status=%d", sw.code))
+		}
+		span.End()
+		g.recordBootEvent(r, sw.code)
+		g.metrics.HTTPRequests.Inc("httpd", route, strconv.Itoa(sw.code))
+		g.metrics.HTTPDuration.Observe(time.Since(start).Seconds(), "httpd", route)
+		if route == "/static/" && sw.code == http.StatusOK {
+			g.metrics.ArtifactBytes.Add(float64(sw.written), strings.TrimPrefix(r.URL.Path, "/static/"))
+		}
+		if sw.code >= http.StatusInternalServerError {
+			g.bus.Publish(event.TypeError, "", map[string]string{
+				"component": "httpd",
+				"path":      redactToken(r.URL.Path),
+				"code":      strconv.Itoa(sw.code),
+			})
+		}
 	})
 }
 
+// statusWriter records the status code and the size of the body written
+// by the handler.
+type statusWriter struct {
+	http.ResponseWriter
+	code    int
+	written int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// bootKey returns the key of the boot that the request belongs to. /ipxe
+// has the MAC address and the UUID of the host, and the other requests are
+// identified by the source address.
+func bootKey(r *http.Request) trace.BootKey {
+	var key trace.BootKey
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		key.IP = net.ParseIP(host)
+	}
+	if r.URL.Path == "/ipxe" {
+		key.MAC, _ = net.ParseMAC(r.URL.Query().Get("mac"))
+		key.UUID = r.URL.Query().Get("uuid")
+	}
+	return key
+}
+
+// recordBootEvent records the request in the boot timeline of the client.
+// The requests that fail with 4xx or 5xx are recorded as errors.
+func (g *GoHTTPd) recordBootEvent(r *http.Request, code int) {
+	key := bootKey(r)
+	e := httpd.BootEvent{
+		Protocol: httpd.BootEventProtocolHTTP,
+		Name:     r.Method + " " + redactToken(r.URL.Path),
+		Outcome:  httpd.BootEventOutcomeOK,
+		Detail:   strconv.Itoa(code),
+	}
+	if key.MAC != nil {
+		e.MACAddress = key.MAC.String()
+	}
+	if key.IP != nil {
+		e.IPAddress = key.IP.String()
+	}
+	if code >= http.StatusBadRequest {
+		e.Outcome = httpd.BootEventOutcomeError
+	}
+	if err := g.ds.RecordBootEvent(r.Context(), e); err != nil {
+		g.logger.Warn("failed to record boot event", zap.Error(err))
+	}
+}
+
 func (g *GoHTTPd) ipxeHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		hostID, err := uuid.FromString(r.URL.Query().Get("uuid"))
@@ -74,156 +216,622 @@ func (g *GoHTTPd) ipxeHandler() http.Handler {
 		serial := r.URL.Query().Get("serial")
 		product := r.URL.Query().Get("product")
 		manufacturer := r.URL.Query().Get("manufacturer")
-		err = registerHostIfNotExists(r.Context(), g.ds, types.HardwareAddr(mac), hostID, serial, product, manufacturer)
+		registered, err := registerHostIfNotExists(r.Context(), g.ds, g.bus, types.HardwareAddr(mac), hostID, serial, product, manufacturer)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			g.logger.Error("failed to register host", zap.Error(err))
 			return
 		}
-		err = tmpl.Execute(w, ipxeParams{
-			Initrd:   fmt.Sprintf("http://%s/static/initrd.img", r.Host),
-			Kernel:   fmt.Sprintf("http://%s/static/kernel", r.Host),
-			RootFS:   fmt.Sprintf("http://%s/static/filesystem.squashfs", r.Host),
-			Metadata: fmt.Sprintf("http://%s/init/", r.Host),
+		h, err := g.ds.GetHostByUUID(r.Context(), hostID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			g.logger.Error("failed to get host by uuid", zap.Error(err))
+			return
+		}
+		if h.State == httpd.HostStateWiped {
+			rediscovered, err := rediscoverHost(r.Context(), g.ds, g.bus, *h, types.HardwareAddr(mac), r)
+			if err != nil {
+				w.WriteHeader(http.StatusForbidden)
+				g.logger.Warn("rejected rediscovery of wiped host", zap.String("host", h.Name), zap.String("remote", r.RemoteAddr), zap.Error(err))
+				return
+			}
+			g.publishHostStateChanged(*h, httpd.HostStateDiscovered)
+			h = rediscovered
+		}
+		err = verifyHostSource(r.Context(), g.ds, *h, types.HardwareAddr(mac), r)
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			g.logger.Warn("rejected ipxe request", zap.String("host", h.Name), zap.String("remote", r.RemoteAddr), zap.Error(err))
+			return
+		}
+		if registered {
+			g.bus.Publish(event.TypeHostRegistered, h.Name, map[string]string{
+				"uuid":         h.UUID.String(),
+				"mac":          mac.String(),
+				"serial":       h.Serial,
+				"product":      h.Product,
+				"manufacturer": h.Manufacturer,
+			})
+		}
+		profile, err := g.getBootProfile(r.Context(), h)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			g.logger.Error("failed to get boot profile", zap.Error(err))
+			return
+		}
+		var token string
+		if issuesToken(*h, *profile) {
+			token, err = g.ds.IssueHostToken(r.Context(), h.ID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				g.logger.Error("failed to issue host token", zap.Error(err))
+				return
+			}
+		}
+		metadata := fmt.Sprintf("%s/init/%s/", baseURL(r), token)
+		err = renderIPXE(w, *profile, ipxeParams{
+			Initrd:   artifactURL(baseURL(r), profile.Initrd),
+			Kernel:   artifactURL(baseURL(r), profile.Kernel),
+			RootFS:   artifactURL(baseURL(r), profile.RootFS),
+			Cmdline:  profile.Cmdline,
+			Metadata: metadata,
+			Install:  installerArgs(*profile, metadata, *h),
+			Host:     *h,
+			Verify:   g.verifyImage,
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			g.logger.Error("failed to exec template", zap.String("profile", profile.Name), zap.Error(err))
+			return
+		}
+		g.bus.Publish(event.TypeIPXEServed, h.Name, map[string]string{
+			"profile": profile.Name,
+			"kind":    profile.Kind,
 		})
+		span := trace.FromContext(r.Context())
+		span.SetAttribute("host.name", h.Name)
+		span.SetAttribute("boot.profile", profile.Name)
+		if profile.Kind == httpd.BootProfileKindLocal {
+			// the host boots from the local disk and will not talk to ursa anymore
+			g.tracer.EndBoot(trace.BootKey{UUID: h.UUID.String()}, nil)
+		}
+	})
+}
+
+// getBootProfile returns the boot profile for the host and drives the
+// provisioning state. A provisioned host boots from the local disk unless
+// its profile is diskless, and a decommissioning host boots the wipe
+// image. A wiped host is rediscovered before, so it is provisioned again.
+func (g *GoHTTPd) getBootProfile(ctx context.Context, h *httpd.Host) (*httpd.BootProfile, error) {
+	profile, err := g.ds.GetBootProfileByHost(ctx, *h)
+	if errors.Is(err, datastore.ErrNotFound) {
+		profile = &defaultBootProfile
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch h.State {
+	case httpd.HostStateDiscovered:
+		if profile.Kind == httpd.BootProfileKindLocal {
+			break
+		}
+		_, err = g.ds.UpdateHostState(ctx, h.ID, httpd.HostStateProvisioning)
 		if err != nil {
+			return nil, fmt.Errorf("failed to update host state: %w", err)
+		}
+		g.publishHostStateChanged(*h, httpd.HostStateProvisioning)
+	case httpd.HostStateProvisioned, httpd.HostStateInService:
+		if !profile.Diskless {
+			profile = &localBootProfile
+		}
+	case httpd.HostStateDecommissioning:
+		profile, err = getWipeBootProfile(ctx, g.ds)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return profile, nil
+}
+
+// issuesToken reports whether the host booting the profile is given a
+// metadata token. Only a host being provisioned or decommissioned is given
+// a token, except a provisioned or in-service host booting a diskless
+// profile: it fetches its config on every boot, so it is given a new token
+// on every boot, which its phone home revokes.
+func issuesToken(h httpd.Host, profile httpd.BootProfile) bool {
+	if profile.Kind == httpd.BootProfileKindLocal {
+		return false
+	}
+	switch h.State {
+	case httpd.HostStateDiscovered, httpd.HostStateProvisioning, httpd.HostStateDecommissioning:
+		return true
+	case httpd.HostStateProvisioned, httpd.HostStateInService:
+		return profile.Diskless
+	}
+	return false
+}
+
+func renderIPXE(w io.Writer, profile httpd.BootProfile, params ipxeParams) error {
+	t, ok := ipxeTemplates[profile.Kind]
+	if profile.Kind == httpd.BootProfileKindCustom {
+		var err error
+		t, err = template.New("iPXE").Parse(profile.Script)
+		if err != nil {
+			return fmt.Errorf("failed to parse custom script: %w", err)
+		}
+	} else if !ok {
+		return fmt.Errorf("unknown boot profile kind %s", profile.Kind)
+	}
+
+	var buff bytes.Buffer
+	err := t.Execute(&buff, params)
+	if err != nil {
+		return err
+	}
+	_, err = buff.WriteTo(w)
+	return err
+}
+
+// artifactURL returns the URL of a boot artifact. A relative path is
+// served from the static directory.
+func artifactURL(base, path string) string {
+	if path == "" || strings.Contains(path, "://") {
+		return path
+	}
+	return fmt.Sprintf("%s/static/%s", base, strings.TrimPrefix(path, "/"))
+}
+
+// SignBootProfiles signs the artifacts of the default and all stored boot
+// profiles that are served from the static directory.
+func SignBootProfiles(ctx context.Context, ds datastore.Datastore, signer *pki.CodeSigner) error {
+	profiles, err := ds.ListBootProfile(ctx)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return fmt.Errorf("failed to list boot profile: %w", err)
+	}
+	for _, profile := range append(profiles, defaultBootProfile) {
+		err = SignBootProfile(signer, profile)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SignBootProfile signs the kernel and the initrd of the boot profile that
+// are served from the static directory. Remote artifacts must be signed by
+// the owner. The rootfs is not signed, since it is fetched by the booted
+// initrd, not by iPXE, and is not verified.
+func SignBootProfile(signer *pki.CodeSigner, profile httpd.BootProfile) error {
+	for _, p := range []string{profile.Kernel, profile.Initrd} {
+		if p == "" || strings.Contains(p, "://") {
+			continue
+		}
+		err := signer.SignFile(filepath.Join(staticDir, filepath.Clean("/"+p)))
+		if err != nil {
+			return fmt.Errorf("failed to sign boot profile %s: %w", profile.Name, err)
+		}
+	}
+	return nil
+}
+
+// baseURL returns the scheme and host of the request.
+func baseURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+type hostContextKey struct{}
+
+func hostFromContext(ctx context.Context) *httpd.Host {
+	return ctx.Value(hostContextKey{}).(*httpd.Host)
+}
+
+// initHandler serves /init/{token}/{resource}. The host is identified by
+// the token that ipxeHandler embedded in the kernel command line, not by
+// the source address, and the token is revoked once the host phoned home.
+func (g *GoHTTPd) initHandler(handlers map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		words := strings.Split(strings.TrimPrefix(r.URL.Path, "/init/"), "/")
+		if len(words) != 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		handler, ok := handlers[words[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		h, err := g.ds.GetHostByToken(r.Context(), words[0])
+		if errors.Is(err, datastore.ErrNotFound) {
+			w.WriteHeader(http.StatusForbidden)
+			g.logger.Warn("invalid host token", zap.String("remote", r.RemoteAddr))
+			return
+		} else if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
-			g.logger.Error("failed to exec template", zap.Error(err))
+			g.logger.Error("failed to get host by token", zap.Error(err))
 			return
 		}
-		return
+		if r.Method == http.MethodGet {
+			g.bus.Publish(event.TypeCloudInitFetched, h.Name, map[string]string{"file": words[1]})
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), hostContextKey{}, h)))
+	})
+}
+
+// redactToken removes the host token from the path of /init/<token>/.
+func redactToken(p string) string {
+	words := strings.Split(strings.TrimPrefix(p, "/init/"), "/")
+	if !strings.HasPrefix(p, "/init/") || len(words) != 2 {
+		return p
+	}
+	return "/init/-/" + words[1]
+}
+
+func (g *GoHTTPd) publishHostStateChanged(h httpd.Host, to string) {
+	g.bus.Publish(event.TypeHostStateChanged, h.Name, map[string]string{
+		"from": h.State,
+		"to":   to,
 	})
 }
 
 func (g *GoHTTPd) metadataHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		h := hostFromContext(r.Context())
+		out := fmt.Sprintf("instance-id: %s\nhostname: %s\n", h.UUID, h.Name)
+		w.Write([]byte(out))
+	})
+}
+
+// userdataHandler serves the user-data, the Ubuntu autoinstall config
+// while the host is provisioned by an autoinstall profile, or the wipe
+// config while the host is decommissioning.
+func (g *GoHTTPd) userdataHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := hostFromContext(r.Context())
+		seed := fmt.Sprintf("%s%s/", baseURL(r), path.Dir(r.URL.Path))
+		if h.State == httpd.HostStateDecommissioning {
+			out, err := renderWipeUserdata(*h, baseURL(r), seed)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				g.logger.Error("failed to render wipe user-data", zap.Error(err))
+				return
+			}
+			w.Write(out)
+			return
+		}
+		profile, err := g.getInstallProfile(r.Context(), h, httpd.InstallerAutoinstall)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			g.logger.Error("failed to resolve address", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			g.logger.Error("failed to get install profile", zap.Error(err))
 			return
 		}
-		h, err := g.ds.GetHostByAddress(r.Context(), types.IP(addr.IP))
+		var out []byte
+		if profile != nil {
+			out, err = renderInstallConfig(r.Context(), g.ds, *h, *profile, baseURL(r), seed, g.network)
+		} else {
+			out, err = RenderUserdata(r.Context(), g.ds, *h, baseURL(r), seed, "")
+		}
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			g.logger.Error("failed to get host by address", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			g.logger.Error("failed to render user-data", zap.Error(err))
 			return
 		}
-		out := fmt.Sprintf("hostname: %s\n", h.Name)
-		w.Write([]byte(out))
+		w.Write(out)
 	})
 }
 
-func (g *GoHTTPd) userdataHandler() http.Handler {
+func (g *GoHTTPd) ignitionHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		h := hostFromContext(r.Context())
+		seed := fmt.Sprintf("%s%s/", baseURL(r), path.Dir(r.URL.Path))
+		out, err := renderIgnition(r.Context(), g.ds, *h, baseURL(r), seed, g.network)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			g.logger.Error("failed to resolve address", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			g.logger.Error("failed to render ignition config", zap.Error(err))
 			return
 		}
-		h, err := g.ds.GetHostByAddress(r.Context(), types.IP(addr.IP))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	})
+}
+
+// installConfigHandler serves the automated installation config of the
+// installer while the host is provisioned by a profile of the installer.
+func (g *GoHTTPd) installConfigHandler(installer string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := hostFromContext(r.Context())
+		profile, err := g.getInstallProfile(r.Context(), h, installer)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			g.logger.Error("failed to get host by address", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			g.logger.Error("failed to get install profile", zap.Error(err))
+			return
+		}
+		if profile == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		seed := fmt.Sprintf("%s%s/", baseURL(r), path.Dir(r.URL.Path))
+		out, err := renderInstallConfig(r.Context(), g.ds, *h, *profile, baseURL(r), seed, g.network)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			g.logger.Error("failed to render install config", zap.String("installer", installer), zap.Error(err))
 			return
 		}
+		w.Write(out)
+	})
+}
+
+// getInstallProfile returns the boot profile assigned to the host if it is
+// an installer profile of the installer and the host is provisioning.
+// Otherwise it returns nil.
+func (g *GoHTTPd) getInstallProfile(ctx context.Context, h *httpd.Host, installer string) (*httpd.BootProfile, error) {
+	if h.State != httpd.HostStateProvisioning {
+		return nil, nil
+	}
+	profile, err := g.ds.GetBootProfileByHost(ctx, *h)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if profile.Kind != httpd.BootProfileKindInstaller || profile.Installer != installer {
+		return nil, nil
+	}
+	return profile, nil
+}
+
+func (g *GoHTTPd) networkConfigHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := hostFromContext(r.Context())
 		l, err := g.ds.GetLeaseByID(r.Context(), h.ServiceLeaseID)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			g.logger.Error("failed to get lease by id", zap.Error(err))
 			return
 		}
-		config := config{
-			ManageEtcHosts: true,
-			RunCMD: []string{
-				"echo \"dash dash/sh boolean false\" | debconf-set-selections",
-				"DEBIAN_FRONTEND=noninteractive dpkg-reconfigure dash",
-				"echo \"configure system description '$(dmidecode -s system-serial-number)'\" >> /etc/lldpd.conf",
-				"systemctl restart lldpd",
-				fmt.Sprintf("wget http://%s/static/ursa-bonder -O /tmp/ursa-bonder", r.Host),
-				"chmod +x /tmp/ursa-bonder",
-				"pkill dhclient",
-				fmt.Sprintf("/tmp/ursa-bonder -driver %s -vlan %d -addr %s -mask %s -gw %s -dns %s",
-					"e1000e", 1000, l.IPAddress, net.IP(l.Network.Mask), l.Gateway, l.DNSServer),
-			},
-			FQDN:     h.Name,
-			Hostname: h.Name,
+		nc, err := getNetworkConfig(r.Context(), g.ds, *h, *l, g.network)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			g.logger.Error("failed to get network config", zap.Error(err))
+			return
+		}
+		out, err := yaml.Marshal(nc)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			g.logger.Error("failed to marshal network config", zap.Error(err))
+			return
 		}
+		w.Write(out)
+	})
+}
 
-		us, err := g.ds.ListUser(r.Context())
-		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+// vendordataHandler serves the site-wide vendor-data. It is read from
+// g.vendorData on every request, so it can be changed without restarting.
+func (g *GoHTTPd) vendordataHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out, err := ioutil.ReadFile(g.vendorData)
+		if errors.Is(err, os.ErrNotExist) {
+			w.Write([]byte("#cloud-config\n{}\n"))
+			return
+		} else if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
-			g.logger.Error("failed to list user", zap.Error(err))
+			g.logger.Error("failed to read vendor-data", zap.Error(err))
 			return
 		}
-		for _, u := range us {
-			ks, err := g.ds.ListKeyByUserID(r.Context(), u.ID)
-			if errors.Is(err, sql.ErrNoRows) {
+		w.Write(out)
+	})
+}
+
+// inventoryHandler receives the hardware inventory posted by ursa-inventory.
+func (g *GoHTTPd) inventoryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		h := hostFromContext(r.Context())
+		var inventory httpd.Inventory
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxInventorySize)).Decode(&inventory)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			g.logger.Error("failed to decode inventory", zap.Error(err))
+			return
+		}
+		hi, err := g.ds.CreateHostInventory(r.Context(), h.ID, inventory)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			g.logger.Error("failed to create host inventory", zap.Error(err))
+			return
+		}
+		g.logger.Info("received inventory", zap.String("host", h.Name), zap.Int("version", hi.Version))
+		g.bus.Publish(event.TypeInventoryReceived, h.Name, map[string]string{"version": strconv.Itoa(hi.Version)})
+
+		err = linkBMC(r.Context(), g.ds, *h, inventory)
+		if errors.Is(err, errBMCLinked) {
+			g.logger.Warn("BMC in inventory conflicts with another host", zap.String("host", h.Name), zap.Error(err))
+		} else if err != nil {
+			g.logger.Warn("failed to link BMC", zap.String("host", h.Name), zap.Error(err))
+		}
+	})
+}
+
+// phoneHomeHandler receives the cloud-init phone_home request that is sent
+// after cloud-init finished.
+func (g *GoHTTPd) phoneHomeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		h := hostFromContext(r.Context())
+		err := r.ParseForm()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			g.logger.Error("failed to parse form", zap.Error(err))
+			return
+		}
+
+		var keys []httpd.HostKey
+		for _, t := range []string{"dsa", "rsa", "ecdsa", "ed25519"} {
+			k := strings.TrimSpace(r.PostForm.Get("pub_key_" + t))
+			if k == "" || k == "N/A" {
 				continue
-			} else if err != nil {
+			}
+			keys = append(keys, httpd.HostKey{
+				HostID: h.ID,
+				Type:   t,
+				Key:    k,
+			})
+		}
+		err = g.ds.RecordPhoneHome(r.Context(), h.ID, r.PostForm.Get("instance_id"), keys)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			g.logger.Error("failed to record phone home", zap.Error(err))
+			return
+		}
+
+		if h.State == httpd.HostStateProvisioning {
+			_, err = g.ds.UpdateHostState(r.Context(), h.ID, httpd.HostStateProvisioned)
+			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
-				g.logger.Error("failed to list key by user_id", zap.Error(err))
+				g.logger.Error("failed to update host state", zap.String("host", h.Name), zap.Error(err))
 				return
 			}
-			var keys []string
-			for _, k := range ks {
-				keys = append(keys, k.Key)
-			}
-			config.Users = append(config.Users, user{
-				Name:              u.Name,
-				Sudo:              "ALL=(ALL) NOPASSWD:ALL",
-				Groups:            "users, admin",
-				SSHAuthorizedKeys: keys,
-			})
+			g.publishHostStateChanged(*h, httpd.HostStateProvisioned)
+			g.bus.Publish(event.TypeProvisioned, h.Name, map[string]string{"instance_id": r.PostForm.Get("instance_id")})
 		}
-		out, err := yaml.Marshal(config)
+		g.tracer.EndBoot(trace.BootKey{UUID: h.UUID.String()}, nil)
+		err = g.ds.RevokeHostToken(r.Context(), h.ID)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			g.logger.Error("failed to parse yaml", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			g.logger.Error("failed to revoke host token", zap.String("host", h.Name), zap.Error(err))
 			return
 		}
-		out = append([]byte("#cloud-config\n"), out...)
-		w.Write(out)
+		g.logger.Info("host phoned home", zap.String("host", h.Name), zap.String("instance_id", r.PostForm.Get("instance_id")))
 	})
 }
 
-func registerHostIfNotExists(ctx context.Context, ds datastore.Datastore, mac types.HardwareAddr, hostID uuid.UUID, serial, product, manufacturer string) error {
-	var sqliteErr sqlite3.Error
+// verifyHostSource returns an error unless the request for the host comes
+// from its management lease, so that a client cannot get the token of
+// another host by its uuid.
+func verifyHostSource(ctx context.Context, ds datastore.Datastore, h httpd.Host, mac types.HardwareAddr, r *http.Request) error {
+	lease, err := ds.GetLeaseFromManagementSubnet(ctx, mac)
+	if err != nil {
+		return fmt.Errorf("failed to get lease: %w", err)
+	}
+	if lease.ID != h.ManagementLeaseID {
+		return fmt.Errorf("mac %s is not of host %s", mac, h.Name)
+	}
+	return verifyLeaseSource(*lease, r)
+}
 
-	managementLease, err := ds.GetLeaseFromManagementSubnet(ctx, mac)
+// verifyLeaseSource returns an error unless the request comes from the
+// address of the lease.
+func verifyLeaseSource(lease dhcpd.Lease, r *http.Request) error {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to parse remote address: %w", err)
+	}
+	if !net.ParseIP(addr).Equal(net.IP(lease.IPAddress)) {
+		return fmt.Errorf("source address %s is not the lease %s", addr, lease.IPAddress)
 	}
+	return nil
+}
 
-	serviceLease, err := ds.CreateLeaseFromServiceSubnet(ctx, mac)
-	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
-		return nil
-	} else if err != nil {
-		return err
+// registerHostIfNotExists registers the host and reports whether the host
+// is newly registered. The service lease created for the host is released
+// if the registration fails, so that the next boot of the host retries it.
+// The creation and the release of the lease are published to bus.
+func registerHostIfNotExists(ctx context.Context, ds datastore.Datastore, bus *event.Bus, mac types.HardwareAddr, hostID uuid.UUID, serial, product, manufacturer string) (bool, error) {
+	_, err := ds.GetHostByUUID(ctx, hostID)
+	if err == nil {
+		return false, nil
+	} else if !errors.Is(err, datastore.ErrNotFound) {
+		return false, err
+	}
+
+	managementLease, err := ds.GetLeaseFromManagementSubnet(ctx, mac)
+	if err != nil {
+		return false, err
+	}
+	serviceLease, created, err := leaseFromServiceSubnet(ctx, ds, bus, mac)
+	if err != nil {
+		return false, err
 	}
 
 	_, err = ds.RegisterHost(ctx, hostID, serial, product, manufacturer, serviceLease.ID, managementLease.ID)
-	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
-		return nil
-	} else if err != nil {
-		return err
+	if err == nil {
+		return true, nil
 	}
+	if errors.Is(err, datastore.ErrConflict) {
+		// The host has been registered concurrently.
+		if _, gerr := ds.GetHostByUUID(ctx, hostID); gerr == nil {
+			return false, nil
+		}
+	}
+	if created {
+		if derr := releaseLease(ctx, ds, bus, serviceLease.ID); derr != nil {
+			return false, fmt.Errorf("failed to register host: %v (and failed to release lease: %w)", err, derr)
+		}
+	}
+	return false, fmt.Errorf("failed to register host: %w", err)
+}
 
-	return nil
+// rediscoverHost gives the wiped host the management lease of mac and a
+// service lease, and moves it back to discovered. The request must come
+// from the management lease, and the service lease is released if it fails.
+func rediscoverHost(ctx context.Context, ds datastore.Datastore, bus *event.Bus, h httpd.Host, mac types.HardwareAddr, r *http.Request) (*httpd.Host, error) {
+	managementLease, err := ds.GetLeaseFromManagementSubnet(ctx, mac)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lease: %w", err)
+	}
+	err = verifyLeaseSource(*managementLease, r)
+	if err != nil {
+		return nil, err
+	}
+	serviceLease, created, err := leaseFromServiceSubnet(ctx, ds, bus, mac)
+	if err != nil {
+		return nil, err
+	}
+	rediscovered, err := ds.RediscoverHost(ctx, h.ID, serviceLease.ID, managementLease.ID)
+	if err != nil {
+		if created {
+			if derr := releaseLease(ctx, ds, bus, serviceLease.ID); derr != nil {
+				return nil, fmt.Errorf("failed to rediscover host: %v (and failed to release lease: %w)", err, derr)
+			}
+		}
+		return nil, fmt.Errorf("failed to rediscover host: %w", err)
+	}
+	return rediscovered, nil
 }
 
-type config struct {
-	ManageEtcHosts bool     `yaml:"manage_etc_hosts"`
-	FQDN           string   `yaml:"fqdn"`
-	Hostname       string   `yaml:"hostname"`
-	Users          []user   `yaml:"users"`
-	RunCMD         []string `yaml:"runcmd"`
+// leaseFromServiceSubnet creates the service lease of mac and reports
+// whether it is newly created.
+func leaseFromServiceSubnet(ctx context.Context, ds datastore.Datastore, bus *event.Bus, mac types.HardwareAddr) (*dhcpd.Lease, bool, error) {
+	lease, err := ds.CreateLeaseFromServiceSubnet(ctx, mac)
+	if errors.Is(err, datastore.ErrConflict) {
+		// The lease is left by a failed registration, or is being used by
+		// a concurrent registration of the same host.
+		lease, err = ds.GetLeaseFromServiceSubnet(ctx, mac)
+		return lease, false, err
+	} else if err != nil {
+		return nil, false, err
+	}
+	bus.Publish(event.TypeLeaseCreated, "", map[string]string{
+		"subnet":     "service",
+		"mac":        lease.MACAddress.String(),
+		"ip_address": lease.IPAddress.String(),
+	})
+	return lease, true, nil
 }
 
-type user struct {
-	Name              string   `yaml:"name"`
-	Sudo              string   `yaml:"sudo"`
-	Groups            string   `yaml:"groups"`
-	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys"`
+func releaseLease(ctx context.Context, ds datastore.Datastore, bus *event.Bus, id int) error {
+	err := ds.DeleteLease(ctx, id)
+	if err != nil {
+		return err
+	}
+	bus.Publish(event.TypeLeaseReleased, "", map[string]string{"id": strconv.Itoa(id)})
+	return nil
 }
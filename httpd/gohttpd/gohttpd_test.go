@@ -0,0 +1,521 @@
+package gohttpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"go.uber.org/zap"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/datastore/memory"
+	"github.com/lovi-cloud/ursa/event"
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/metrics"
+	"github.com/lovi-cloud/ursa/types"
+)
+
+func mustParseIP(t *testing.T, s string) types.IP {
+	t.Helper()
+	ip, err := types.ParseIP(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *ip
+}
+
+func mustParseCIDR(t *testing.T, s string) types.IPNet {
+	t.Helper()
+	n, err := types.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *n
+}
+
+// newDatastore returns a datastore with the subnets that names the hosts by
+// the template.
+func newDatastore(t *testing.T, template string) datastore.Datastore {
+	t.Helper()
+	ctx := context.Background()
+	naming, err := datastore.NewNaming("", template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := memory.New(naming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.CreateManagementSubnet(ctx, mustParseCIDR(t, "10.0.0.0/24"), mustParseIP(t, "10.0.0.1"), mustParseIP(t, "10.0.0.99"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.CreateServiceSubnet(ctx, mustParseCIDR(t, "192.168.0.0/24"), mustParseIP(t, "192.168.0.1"), mustParseIP(t, "192.168.0.99"), mustParseIP(t, "192.168.0.254"), mustParseIP(t, "8.8.8.8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func mac(i int) types.HardwareAddr {
+	return types.HardwareAddr(net.HardwareAddr{0x52, 0x54, 0x00, 0x00, 0x00, byte(i)})
+}
+
+func hostUUID(i int) uuid.UUID {
+	return uuid.NewV5(uuid.NamespaceOID, fmt.Sprintf("host-%d", i))
+}
+
+func TestRegisterHostIfNotExists(t *testing.T) {
+	ctx := context.Background()
+	ds := newDatastore(t, `{{.Serial | sanitize}}`)
+	var names []string
+	for i := 1; i <= 2; i++ {
+		_, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		registered, err := registerHostIfNotExists(ctx, ds, nil, mac(i), hostUUID(i), "OEM", "product", "manufacturer")
+		if err != nil || !registered {
+			t.Fatalf("want registered, but got %v, %v", registered, err)
+		}
+		registered, err = registerHostIfNotExists(ctx, ds, nil, mac(i), hostUUID(i), "OEM", "product", "manufacturer")
+		if err != nil || registered {
+			t.Fatalf("want registered already, but got %v, %v", registered, err)
+		}
+		h, err := ds.GetHostByUUID(ctx, hostUUID(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+	}
+	if names[0] != "oem" || names[1] != "oem-2" {
+		t.Fatalf("unexpected names: %v", names)
+	}
+}
+
+func TestRegisterHostIfNotExistsReleasesLease(t *testing.T) {
+	ctx := context.Background()
+	ds := newDatastore(t, `{{.Serial}}`)
+	_, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := event.NewBus(16)
+	_, err = registerHostIfNotExists(ctx, ds, bus, mac(1), hostUUID(1), "To Be Filled", "product", "manufacturer")
+	if !errors.Is(err, datastore.ErrInvalidHostname) {
+		t.Fatalf("want invalid hostname, but got %v", err)
+	}
+	_, err = ds.GetLeaseFromServiceSubnet(ctx, mac(1))
+	if !errors.Is(err, datastore.ErrNotFound) {
+		t.Fatalf("want the service lease released, but got %v", err)
+	}
+	events := bus.Since(0)
+	if len(events) != 2 || events[0].Type != event.TypeLeaseCreated || events[0].Data["subnet"] != "service" || events[1].Type != event.TypeLeaseReleased || events[1].Data["id"] == "" {
+		t.Fatalf("want the lease created and released, but got %+v", events)
+	}
+
+	// A lease left by a failed registration is reused.
+	_, err = ds.CreateLeaseFromServiceSubnet(ctx, mac(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered, err := registerHostIfNotExists(ctx, ds, nil, mac(1), hostUUID(1), "sn1", "product", "manufacturer")
+	if err != nil || !registered {
+		t.Fatalf("want registered, but got %v, %v", registered, err)
+	}
+}
+
+func newGoHTTPd(t *testing.T, ds datastore.Datastore) *GoHTTPd {
+	t.Helper()
+	h, err := New(ds, zap.NewNop(), false, event.NewBus(16), metrics.New(), nil, NetworkOptions{BondDriver: "e1000e", ServiceVLAN: 1000}, "vendor-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.(*GoHTTPd)
+}
+
+// ipxe requests /ipxe of the host i from remote.
+func ipxe(g *GoHTTPd, i int, remote string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/ipxe?uuid=%s&mac=%s&serial=sn%d", hostUUID(i), mac(i), i), nil)
+	r.RemoteAddr = remote + ":1234"
+	w := httptest.NewRecorder()
+	g.handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestIPXEHostSource(t *testing.T) {
+	ctx := context.Background()
+	ds := newDatastore(t, "")
+	g := newGoHTTPd(t, ds)
+	for i := 1; i <= 2; i++ {
+		_, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := ipxe(g, 1, "10.0.0.1")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/init/") {
+		t.Fatalf("unexpected response: %d %s", w.Code, w.Body.String())
+	}
+	if w := ipxe(g, 2, "10.0.0.2"); w.Code != http.StatusOK {
+		t.Fatalf("unexpected response: %d %s", w.Code, w.Body.String())
+	}
+
+	// The host 2 asks for the token of the host 1 by its uuid.
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/ipxe?uuid=%s&mac=%s", hostUUID(1), mac(2)), nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	w = httptest.NewRecorder()
+	g.handler().ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("want 403 for the mac of another host, but got %d", w.Code)
+	}
+	if w := ipxe(g, 1, "10.0.0.2"); w.Code != http.StatusForbidden {
+		t.Fatalf("want 403 for the address of another host, but got %d", w.Code)
+	}
+}
+
+func TestIPXEWipedHost(t *testing.T) {
+	ctx := context.Background()
+	ds := newDatastore(t, "")
+	g := newGoHTTPd(t, ds)
+	_, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := ipxe(g, 1, "10.0.0.1"); w.Code != http.StatusOK {
+		t.Fatalf("unexpected response: %d %s", w.Code, w.Body.String())
+	}
+	h, err := ds.GetHostByUUID(ctx, hostUUID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.UpdateHostState(ctx, h.ID, httpd.HostStateDecommissioning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.DecommissionHost(ctx, h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The wiped host gets a management lease by DHCP again.
+	l, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := ipxe(g, 1, "10.0.0.50"); w.Code != http.StatusForbidden {
+		t.Fatalf("want 403 for the address of another lease, but got %d", w.Code)
+	}
+	w := ipxe(g, 1, l.IPAddress.String())
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/init/") {
+		t.Fatalf("unexpected response: %d %s", w.Code, w.Body.String())
+	}
+	h, err = ds.GetHostByUUID(ctx, hostUUID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.State != httpd.HostStateProvisioning || h.ManagementLeaseID != l.ID || h.ServiceLeaseID == 0 {
+		t.Fatalf("want the wiped host provisioned again, but got %+v", h)
+	}
+	transitions, err := ds.ListHostStateTransition(ctx, h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, tr := range transitions {
+		got = append(got, tr.To)
+	}
+	want := []string{httpd.HostStateDiscovered, httpd.HostStateProvisioning, httpd.HostStateDecommissioning, httpd.HostStateWiped, httpd.HostStateDiscovered, httpd.HostStateProvisioning}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("transitions = %v, want %v", got, want)
+	}
+}
+
+func TestGetBootProfileProvisioned(t *testing.T) {
+	ctx := context.Background()
+	ds := newDatastore(t, "")
+	g := newGoHTTPd(t, ds)
+	_, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = registerHostIfNotExists(ctx, ds, nil, mac(1), hostUUID(1), "SN1", "product", "manufacturer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ds.GetHostByUUID(ctx, hostUUID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range []string{httpd.HostStateProvisioning, httpd.HostStateProvisioned} {
+		h, err = ds.UpdateHostState(ctx, h.ID, state)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := g.getBootProfile(ctx, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != localBootProfile.Name {
+		t.Errorf("boot profile without assignment = %s, want %s", got.Name, localBootProfile.Name)
+	}
+
+	for _, test := range []struct {
+		profile httpd.BootProfile
+		want    string
+	}{
+		{httpd.BootProfile{Name: "live", Kind: httpd.BootProfileKindLive}, localBootProfile.Name},
+		{httpd.BootProfile{Name: "flatcar", Kind: httpd.BootProfileKindIgnition}, localBootProfile.Name},
+		{httpd.BootProfile{Name: "diskless", Kind: httpd.BootProfileKindLive, Diskless: true}, "diskless"},
+	} {
+		p, err := ds.CreateBootProfile(ctx, test.profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ds.AssignBootProfile(ctx, httpd.ScopeDefault, "", p.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := g.getBootProfile(ctx, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != test.want {
+			t.Errorf("boot profile of %s = %s, want %s", test.profile.Name, got.Name, test.want)
+		}
+	}
+}
+
+func TestLoggingHandlerKeepsHeaders(t *testing.T) {
+	ctx := context.Background()
+	ds := newDatastore(t, "")
+	g := newGoHTTPd(t, ds)
+	_, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = registerHostIfNotExists(ctx, ds, nil, mac(1), hostUUID(1), "SN1", "product", "manufacturer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ds.GetHostByUUID(ctx, hostUUID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := ds.IssueHostToken(ctx, h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/init/%s/ignition.json", token), nil)
+	w := httptest.NewRecorder()
+	g.handler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response: %d %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+}
+
+// tokenOf returns the metadata token in the iPXE script, or "" if the
+// script has none.
+func tokenOf(script string) string {
+	i := strings.Index(script, "/init/")
+	if i < 0 {
+		return ""
+	}
+	token := script[i+len("/init/"):]
+	return token[:strings.Index(token, "/")]
+}
+
+// request requests path by the handler of g from remote.
+func request(g *GoHTTPd, method, path, remote string, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, body)
+	r.RemoteAddr = remote + ":1234"
+	if method == http.MethodPost {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	g.handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestIPXETokenIssuance(t *testing.T) {
+	ctx := context.Background()
+	ds := newDatastore(t, "")
+	g := newGoHTTPd(t, ds)
+	for i := 1; i <= 2; i++ {
+		_, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	token := tokenOf(ipxe(g, 1, "10.0.0.1").Body.String())
+	if token == "" {
+		t.Fatal("want a token for the discovered host")
+	}
+	if w := request(g, http.MethodGet, "/init/"+token+"/user-data", "10.0.0.1", nil); w.Code != http.StatusOK {
+		t.Fatalf("user-data status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := request(g, http.MethodPost, "/init/"+token+"/phone-home", "10.0.0.1", strings.NewReader("instance_id=i-1")); w.Code != http.StatusOK {
+		t.Fatalf("phone-home status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// The provisioned host boots from the local disk without a token, and
+	// the old token is rejected.
+	w := ipxe(g, 1, "10.0.0.1")
+	if w.Code != http.StatusOK || tokenOf(w.Body.String()) != "" {
+		t.Fatalf("want no token for the provisioned host, but got %d %s", w.Code, w.Body.String())
+	}
+	if w := request(g, http.MethodGet, "/init/"+token+"/user-data", "10.0.0.1", nil); w.Code != http.StatusForbidden {
+		t.Fatalf("user-data status with the old token = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	// A provisioned diskless host is given a new token on every boot.
+	p, err := ds.CreateBootProfile(ctx, httpd.BootProfile{Name: "flatcar", Kind: httpd.BootProfileKindIgnition, Kernel: "vmlinuz", Initrd: "initrd", Diskless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ds.AssignBootProfile(ctx, httpd.ScopeHost, hostUUID(2).String(), p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := tokenOf(ipxe(g, 2, "10.0.0.2").Body.String())
+	if w := request(g, http.MethodPost, "/init/"+first+"/phone-home", "10.0.0.2", strings.NewReader("instance_id=i-2")); w.Code != http.StatusOK {
+		t.Fatalf("phone-home status = %d, want %d", w.Code, http.StatusOK)
+	}
+	second := tokenOf(ipxe(g, 2, "10.0.0.2").Body.String())
+	if second == "" || second == first {
+		t.Fatalf("want a new token for the diskless host, but got %q", second)
+	}
+	if w := request(g, http.MethodGet, "/init/"+second+"/ignition.json", "10.0.0.2", nil); w.Code != http.StatusOK {
+		t.Fatalf("ignition.json status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := request(g, http.MethodGet, "/init/"+first+"/ignition.json", "10.0.0.2", nil); w.Code != http.StatusForbidden {
+		t.Fatalf("ignition.json status with the old token = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestPhoneHome(t *testing.T) {
+	ctx := context.Background()
+	ds := newDatastore(t, "")
+	g := newGoHTTPd(t, ds)
+	_, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := tokenOf(ipxe(g, 1, "10.0.0.1").Body.String())
+	h, err := ds.GetHostByUUID(ctx, hostUUID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.State != httpd.HostStateProvisioning {
+		t.Fatalf("state = %s, want %s", h.State, httpd.HostStateProvisioning)
+	}
+
+	body := "instance_id=i-1&hostname=" + h.Name + "&pub_key_rsa=ssh-rsa+AAAA+&pub_key_dsa=N%2FA&pub_key_ed25519=ssh-ed25519+BBBB"
+	if w := request(g, http.MethodPost, "/init/"+token+"/phone-home", "10.0.0.1", strings.NewReader(body)); w.Code != http.StatusOK {
+		t.Fatalf("phone-home status = %d, want %d", w.Code, http.StatusOK)
+	}
+	h, err = ds.GetHostByUUID(ctx, hostUUID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.State != httpd.HostStateProvisioned {
+		t.Errorf("state = %s, want %s", h.State, httpd.HostStateProvisioned)
+	}
+	keys, err := ds.ListHostKeyByHostID(ctx, h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, k := range keys {
+		got[k.Type] = k.Key
+	}
+	if len(got) != 2 || got["rsa"] != "ssh-rsa AAAA" || got["ed25519"] != "ssh-ed25519 BBBB" {
+		t.Errorf("host keys = %+v, want rsa and ed25519", keys)
+	}
+	var provisioned bool
+	for _, e := range g.bus.Since(0) {
+		if e.Type == event.TypeProvisioned && e.Host == h.Name && e.Data["instance_id"] == "i-1" {
+			provisioned = true
+		}
+	}
+	if !provisioned {
+		t.Errorf("events = %+v, want the host provisioned", g.bus.Since(0))
+	}
+
+	// The token is revoked, so the second phone home is rejected and the
+	// state is kept.
+	if w := request(g, http.MethodPost, "/init/"+token+"/phone-home", "10.0.0.1", strings.NewReader("instance_id=i-2")); w.Code != http.StatusForbidden {
+		t.Fatalf("second phone-home status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	transitions, err := ds.ListHostStateTransition(ctx, h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := transitions[len(transitions)-1]; last.To != httpd.HostStateProvisioned || len(transitions) != 3 {
+		t.Errorf("transitions = %+v, want provisioned once", transitions)
+	}
+}
+
+func TestInventory(t *testing.T) {
+	ctx := context.Background()
+	ds := newDatastore(t, "")
+	g := newGoHTTPd(t, ds)
+	_, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := tokenOf(ipxe(g, 1, "10.0.0.1").Body.String())
+
+	for _, memory := range []int{1024, 2048} {
+		body := fmt.Sprintf(`{"serial": "SN1", "memory_bytes": %d, "nics": [{"name": "eno1", "mac_address": "52:54:00:00:00:01", "driver": "igb"}]}`, memory)
+		r := httptest.NewRequest(http.MethodPost, "/init/"+token+"/inventory", strings.NewReader(body))
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		g.handler().ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("inventory status = %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+	if w := request(g, http.MethodPost, "/init/"+token+"/inventory", "10.0.0.1", strings.NewReader("{")); w.Code != http.StatusBadRequest {
+		t.Fatalf("status of the broken inventory = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	h, err := ds.GetHostByUUID(ctx, hostUUID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	his, err := ds.ListHostInventory(ctx, h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(his) != 2 || his[0].Version != 2 || his[0].Inventory.Memory != 2048 || his[1].Version != 1 || his[1].Inventory.Memory != 1024 {
+		t.Fatalf("inventories = %+v, want 2 versions, newest first", his)
+	}
+	if nics := his[0].Inventory.NICs; len(nics) != 1 || nics[0].Driver != "igb" {
+		t.Errorf("NICs = %+v, want eno1", nics)
+	}
+	var versions []string
+	for _, e := range g.bus.Since(0) {
+		if e.Type == event.TypeInventoryReceived {
+			versions = append(versions, e.Data["version"])
+		}
+	}
+	if strings.Join(versions, ",") != "1,2" {
+		t.Errorf("inventory events = %v, want versions 1 and 2", versions)
+	}
+}
@@ -0,0 +1,194 @@
+package gohttpd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+const ignitionVersion = "3.3.0"
+
+// ignitionConfig is Ignition config spec v3.
+type ignitionConfig struct {
+	Ignition ignition        `json:"ignition"`
+	Passwd   ignitionPasswd  `json:"passwd"`
+	Storage  ignitionStorage `json:"storage"`
+	Systemd  ignitionSystemd `json:"systemd"`
+}
+
+type ignition struct {
+	Version string `json:"version"`
+}
+
+type ignitionPasswd struct {
+	Users []ignitionUser `json:"users,omitempty"`
+}
+
+type ignitionUser struct {
+	Name              string   `json:"name"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+}
+
+type ignitionStorage struct {
+	Files []ignitionFile `json:"files,omitempty"`
+}
+
+type ignitionFile struct {
+	Path      string           `json:"path"`
+	Mode      int              `json:"mode"`
+	Overwrite bool             `json:"overwrite"`
+	Contents  ignitionContents `json:"contents"`
+}
+
+type ignitionContents struct {
+	Source string `json:"source"`
+}
+
+type ignitionSystemd struct {
+	Units []ignitionUnit `json:"units,omitempty"`
+}
+
+type ignitionUnit struct {
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Contents string `json:"contents"`
+}
+
+func newIgnitionFile(path string, mode int, contents string) ignitionFile {
+	return ignitionFile{
+		Path:      path,
+		Mode:      mode,
+		Overwrite: true,
+		Contents: ignitionContents{
+			Source: "data:;base64," + base64.StdEncoding.EncodeToString([]byte(contents)),
+		},
+	}
+}
+
+// renderIgnition renders the Ignition config of the host from the same
+// data as the user-data.
+func renderIgnition(ctx context.Context, ds datastore.Datastore, h httpd.Host, base, seed string, opts NetworkOptions) ([]byte, error) {
+	params, err := getUserdataParams(ctx, ds, h, base, seed)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := getNetworkConfig(ctx, ds, h, params.Lease, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	config := ignitionConfig{
+		Ignition: ignition{Version: ignitionVersion},
+		Storage: ignitionStorage{
+			Files: []ignitionFile{
+				newIgnitionFile("/etc/hostname", 0644, h.Name+"\n"),
+			},
+		},
+		Systemd: ignitionSystemd{
+			Units: []ignitionUnit{{
+				Name:     "ursa-phone-home.service",
+				Enabled:  true,
+				Contents: phoneHomeUnit(h, seed),
+			}},
+		},
+	}
+	for _, u := range params.Users {
+		config.Passwd.Users = append(config.Passwd.Users, ignitionUser{
+			Name:              u.Name,
+			SSHAuthorizedKeys: u.Keys,
+		})
+		config.Storage.Files = append(config.Storage.Files,
+			newIgnitionFile("/etc/sudoers.d/90-ursa-"+u.Name, 0440, u.Name+" ALL=(ALL) NOPASSWD:ALL\n"))
+	}
+	units := networkdUnits(*nc)
+	var names []string
+	for name := range units {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		config.Storage.Files = append(config.Storage.Files,
+			newIgnitionFile("/etc/systemd/network/"+name, 0644, units[name]))
+	}
+
+	out, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ignition config: %w", err)
+	}
+	return out, nil
+}
+
+// networkdUnits returns the systemd-networkd units of the network config,
+// keyed by the file name.
+func networkdUnits(nc networkConfig) map[string]string {
+	units := map[string]string{
+		fmt.Sprintf("10-%s.netdev", bondName): fmt.Sprintf("[NetDev]\nName=%s\nKind=bond\n\n"+
+			"[Bond]\nMode=802.3ad\nLACPTransmitRate=fast\nMIIMonitorSec=100ms\nTransmitHashPolicy=layer2+3\n", bondName),
+	}
+	for _, name := range nc.members() {
+		m := nc.Ethernets[name].Match
+		var section string
+		switch {
+		case m.MACAddress != "":
+			section = "MACAddress=" + m.MACAddress
+		case m.Driver != "":
+			section = "Driver=" + m.Driver
+		default:
+			section = "Name=" + m.Name
+		}
+		units[fmt.Sprintf("10-%s-%s.network", bondName, name)] = fmt.Sprintf("[Match]\n%s\n\n[Network]\nBond=%s\n", section, bondName)
+	}
+
+	name, a := nc.service()
+	var service strings.Builder
+	fmt.Fprintf(&service, "[Match]\nName=%s\n\n[Network]\n", name)
+	for _, addr := range a.Addresses {
+		fmt.Fprintf(&service, "Address=%s\n", addr)
+	}
+	for _, r := range a.Routes {
+		fmt.Fprintf(&service, "Gateway=%s\n", r.Via)
+	}
+	if a.Nameservers != nil {
+		for _, addr := range a.Nameservers.Addresses {
+			fmt.Fprintf(&service, "DNS=%s\n", addr)
+		}
+	}
+
+	if vlanName, v, ok := nc.serviceVLAN(); ok {
+		units[fmt.Sprintf("10-%s.network", bondName)] = fmt.Sprintf("[Match]\nName=%s\n\n[Network]\nVLAN=%s\nLinkLocalAddressing=no\n", bondName, vlanName)
+		units[fmt.Sprintf("10-%s.netdev", vlanName)] = fmt.Sprintf("[NetDev]\nName=%s\nKind=vlan\n\n[VLAN]\nId=%d\n", vlanName, v.ID)
+	}
+	units[fmt.Sprintf("10-%s.network", name)] = service.String()
+	return units
+}
+
+// phoneHomeUnit returns the unit that reports the first boot to ursa as
+// cloud-init phone_home does.
+func phoneHomeUnit(h httpd.Host, seed string) string {
+	form := url.Values{
+		"instance_id": {h.UUID.String()},
+		"hostname":    {h.Name},
+	}.Encode()
+	// % starts a specifier in unit files.
+	form = strings.ReplaceAll(form, "%", "%%")
+	return fmt.Sprintf(`[Unit]
+Description=Report the boot to ursa
+ConditionFirstBoot=yes
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=/usr/bin/curl -fsS --retry 10 --retry-connrefused -o /dev/null -d "%s" %sphone-home
+
+[Install]
+WantedBy=multi-user.target
+`, form, seed)
+}
@@ -0,0 +1,152 @@
+package gohttpd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// ignitionV33 is the subset of the Ignition config spec v3.3.0 that ursa
+// renders.
+type ignitionV33 struct {
+	Ignition struct {
+		Version string `json:"version"`
+	} `json:"ignition"`
+	Passwd struct {
+		Users []struct {
+			Name              string   `json:"name"`
+			SSHAuthorizedKeys []string `json:"sshAuthorizedKeys"`
+		} `json:"users"`
+	} `json:"passwd"`
+	Storage struct {
+		Files []struct {
+			Path      string `json:"path"`
+			Mode      int    `json:"mode"`
+			Overwrite bool   `json:"overwrite"`
+			Contents  struct {
+				Source string `json:"source"`
+			} `json:"contents"`
+		} `json:"files"`
+	} `json:"storage"`
+	Systemd struct {
+		Units []struct {
+			Name     string `json:"name"`
+			Enabled  bool   `json:"enabled"`
+			Contents string `json:"contents"`
+		} `json:"units"`
+	} `json:"systemd"`
+}
+
+// addUser adds the user and the keys to the datastore.
+func addUser(t *testing.T, ds datastore.Datastore, name string, keys ...string) {
+	t.Helper()
+	ctx := context.Background()
+	dump, err := ds.Export(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := httpd.User{ID: len(dump.Users) + 1, Name: name}
+	dump.Users = append(dump.Users, u)
+	for _, k := range keys {
+		dump.Keys = append(dump.Keys, httpd.Key{ID: len(dump.Keys) + 1, Key: k, UserID: u.ID})
+	}
+	err = ds.Import(ctx, *dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenderIgnition(t *testing.T) {
+	ctx := context.Background()
+	ds := newDatastore(t, "")
+	_, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = registerHostIfNotExists(ctx, ds, nil, mac(1), hostUUID(1), "SN1", "product", "manufacturer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addUser(t, ds, "core", "ssh-ed25519 AAAA core")
+	h, err := ds.GetHostByUUID(ctx, hostUUID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Name = "host%1 \"a\""
+
+	out, err := renderIgnition(ctx, ds, *h, "http://10.0.0.254", testSeed, NetworkOptions{BondDriver: "ixgbe", ServiceVLAN: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config ignitionV33
+	d := json.NewDecoder(bytes.NewReader(out))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&config); err != nil {
+		t.Fatalf("invalid ignition config: %v\n%s", err, out)
+	}
+	if config.Ignition.Version != "3.3.0" {
+		t.Errorf("version = %s, want 3.3.0", config.Ignition.Version)
+	}
+	users := config.Passwd.Users
+	if len(users) != 1 || users[0].Name != "core" || len(users[0].SSHAuthorizedKeys) != 1 || users[0].SSHAuthorizedKeys[0] != "ssh-ed25519 AAAA core" {
+		t.Errorf("users = %+v, want core with the key", users)
+	}
+
+	files := map[string]string{}
+	modes := map[string]int{}
+	for _, f := range config.Storage.Files {
+		const prefix = "data:;base64,"
+		if !strings.HasPrefix(f.Contents.Source, prefix) || !f.Overwrite {
+			t.Fatalf("file = %+v, want the overwritten data URL", f)
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(f.Contents.Source, prefix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Path] = string(b)
+		modes[f.Path] = f.Mode
+	}
+	tests := []struct {
+		path string
+		mode int
+		want string
+	}{
+		{path: "/etc/hostname", mode: 0644, want: h.Name + "\n"},
+		{path: "/etc/sudoers.d/90-ursa-core", mode: 0440, want: "core ALL=(ALL) NOPASSWD:ALL\n"},
+		{path: "/etc/systemd/network/10-bond0.netdev", mode: 0644, want: "Kind=bond"},
+		{path: "/etc/systemd/network/10-bond0-ports.network", mode: 0644, want: "Driver=ixgbe"},
+		{path: "/etc/systemd/network/10-bond0.network", mode: 0644, want: "VLAN=bond0.1000"},
+		{path: "/etc/systemd/network/10-bond0.1000.netdev", mode: 0644, want: "Id=1000"},
+		{path: "/etc/systemd/network/10-bond0.1000.network", mode: 0644, want: "Address=192.168.0.1/24"},
+	}
+	for _, test := range tests {
+		got, ok := files[test.path]
+		if !ok || !strings.Contains(got, test.want) || modes[test.path] != test.mode {
+			t.Errorf("%s (%o) = %q, want %q with mode %o", test.path, modes[test.path], got, test.want, test.mode)
+		}
+	}
+	if len(files) != len(tests) {
+		t.Errorf("files = %v, want %d", files, len(tests))
+	}
+
+	units := config.Systemd.Units
+	if len(units) != 1 || units[0].Name != "ursa-phone-home.service" || !units[0].Enabled {
+		t.Fatalf("units = %+v, want the enabled phone home", units)
+	}
+	unit := units[0].Contents
+	if !strings.Contains(unit, "\nConditionFirstBoot=yes\n") {
+		t.Errorf("phone home = %s, want only on the first boot", unit)
+	}
+	form := url.Values{"instance_id": {h.UUID.String()}, "hostname": {h.Name}}.Encode()
+	want := `-d "` + strings.ReplaceAll(form, "%", "%%") + `" ` + testSeed + "phone-home\n"
+	if !strings.Contains(unit, want) {
+		t.Errorf("phone home = %s, want %s", unit, want)
+	}
+}
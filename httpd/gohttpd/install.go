@@ -0,0 +1,387 @@
+package gohttpd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// installParams is passed to install config templates.
+type installParams struct {
+	userdataParams
+	Disk   string
+	Layout string
+	// PostInstall is the base64 encoded shell script that is run in the
+	// installed system.
+	PostInstall string
+	// PhoneHome is the form posted to the phone-home endpoint.
+	PhoneHome string
+
+	network networkConfig
+}
+
+var installFuncs = template.FuncMap{
+	"trimDev": func(s string) string { return strings.TrimPrefix(s, "/dev/") },
+	"shquote": shellQuote,
+}
+
+// shellQuote quotes s as a single word of sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// installerArgs returns the kernel arguments that start the automated
+// installation, or Ignition, with the config served under metadata.
+func installerArgs(profile httpd.BootProfile, metadata string, h httpd.Host) string {
+	if profile.Kind == httpd.BootProfileKindIgnition {
+		return fmt.Sprintf("ignition.firstboot flatcar.first_boot=1 ignition.platform.id=metal ignition.config.url=%signition.json", metadata)
+	}
+	switch profile.Installer {
+	case httpd.InstallerPreseed:
+		return fmt.Sprintf("auto=true priority=critical interface=auto url=%spreseed.cfg hostname=%s domain=", metadata, h.Name)
+	case httpd.InstallerAutoinstall:
+		return fmt.Sprintf("autoinstall ds=nocloud-net;s=%s", metadata)
+	case httpd.InstallerKickstart:
+		return fmt.Sprintf("inst.ks=%skickstart.cfg", metadata)
+	}
+	return ""
+}
+
+// renderInstallConfig renders the automated installation config of the
+// profile for the host.
+func renderInstallConfig(ctx context.Context, ds datastore.Datastore, h httpd.Host, profile httpd.BootProfile, base, seed string, opts NetworkOptions) ([]byte, error) {
+	up, err := getUserdataParams(ctx, ds, h, base, seed)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := getNetworkConfig(ctx, ds, h, up.Lease, opts)
+	if err != nil {
+		return nil, err
+	}
+	params := installParams{
+		userdataParams: *up,
+		Disk:           profile.Disk,
+		Layout:         profile.Layout,
+		PhoneHome: url.Values{
+			"instance_id": {h.UUID.String()},
+			"hostname":    {h.Name},
+		}.Encode(),
+		network: *nc,
+	}
+	if params.Layout == "" {
+		params.Layout = httpd.InstallLayoutLVM
+	}
+
+	switch profile.Installer {
+	case httpd.InstallerPreseed:
+		params.PostInstall, err = renderPostInstall(params, true)
+		if err != nil {
+			return nil, err
+		}
+		return executeInstallTemplate(preseedTmpl, params)
+	case httpd.InstallerKickstart:
+		params.PostInstall, err = renderPostInstall(params, false)
+		if err != nil {
+			return nil, err
+		}
+		return executeInstallTemplate(kickstartTmpl, params)
+	case httpd.InstallerAutoinstall:
+		return renderAutoinstall(params)
+	}
+	return nil, fmt.Errorf("unknown installer %s", profile.Installer)
+}
+
+func executeInstallTemplate(t *template.Template, params installParams) ([]byte, error) {
+	var buff bytes.Buffer
+	err := t.Execute(&buff, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute install template: %w", err)
+	}
+	return buff.Bytes(), nil
+}
+
+// renderPostInstall renders the script that configures the service network,
+// creates users and phones home. The network is written as netplan if
+// netplan is true, otherwise as NetworkManager keyfiles.
+func renderPostInstall(params installParams, netplan bool) (string, error) {
+	var network string
+	if netplan {
+		out, err := yaml.Marshal(map[string]networkConfig{"network": params.network})
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal network config: %w", err)
+		}
+		network = string(out)
+	}
+
+	vlanName, v, _ := params.network.serviceVLAN()
+	var buff bytes.Buffer
+	err := postInstallTmpl.Execute(&buff, struct {
+		installParams
+		Netplan  bool
+		Network  string
+		BondName string
+		Ports    []keyfilePort
+		VLANName string
+		VLANID   int
+		IPv4     string
+	}{
+		installParams: params,
+		Netplan:       netplan,
+		Network:       network,
+		BondName:      bondName,
+		Ports:         keyfilePorts(params.network),
+		VLANName:      vlanName,
+		VLANID:        v.ID,
+		IPv4:          keyfileIPv4(params.network),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to execute post-install template: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(buff.Bytes()), nil
+}
+
+// keyfilePort is a NetworkManager connection of a bond member.
+type keyfilePort struct {
+	Name string
+	// Match is the keyfile section that selects the NIC.
+	Match string
+}
+
+func keyfilePorts(nc networkConfig) []keyfilePort {
+	var ports []keyfilePort
+	for _, name := range nc.members() {
+		m := nc.Ethernets[name].Match
+		var section string
+		switch {
+		case m.MACAddress != "":
+			section = fmt.Sprintf("[ethernet]\nmac-address=%s\n", m.MACAddress)
+		case m.Driver != "":
+			section = fmt.Sprintf("[match]\ndriver=%s\n", m.Driver)
+		default:
+			section = fmt.Sprintf("[match]\ninterface-name=%s\n", m.Name)
+		}
+		ports = append(ports, keyfilePort{Name: name, Match: section})
+	}
+	return ports
+}
+
+// keyfileIPv4 returns the ipv4 section of the service interface.
+func keyfileIPv4(nc networkConfig) string {
+	_, a := nc.service()
+	var b strings.Builder
+	b.WriteString("[ipv4]\nmethod=manual\n")
+	fmt.Fprintf(&b, "address1=%s", a.Addresses[0])
+	for _, r := range a.Routes {
+		fmt.Fprintf(&b, ",%s", r.Via)
+	}
+	b.WriteString("\n")
+	if a.Nameservers != nil {
+		fmt.Fprintf(&b, "dns=%s;\n", strings.Join(a.Nameservers.Addresses, ";"))
+	}
+	return b.String()
+}
+
+var postInstallTmpl = template.Must(template.New("post-install").Funcs(installFuncs).Parse(`#!/bin/sh
+set -e
+{{ if .Netplan }}mkdir -p /etc/netplan
+cat > /etc/netplan/50-ursa.yaml <<'URSA_EOF'
+{{ .Network }}URSA_EOF
+chmod 600 /etc/netplan/50-ursa.yaml
+{{ else }}mkdir -p /etc/NetworkManager/system-connections
+cat > /etc/NetworkManager/system-connections/{{ .BondName }}.nmconnection <<'URSA_EOF'
+[connection]
+id={{ .BondName }}
+type=bond
+interface-name={{ .BondName }}
+
+[bond]
+mode=802.3ad
+lacp_rate=fast
+miimon=100
+xmit_hash_policy=layer2+3
+
+{{ if .VLANName }}[ipv4]
+method=disabled
+{{ else }}{{ .IPv4 }}{{ end }}
+[ipv6]
+method=ignore
+URSA_EOF
+{{ range .Ports }}cat > /etc/NetworkManager/system-connections/{{ $.BondName }}-{{ .Name }}.nmconnection <<'URSA_EOF'
+[connection]
+id={{ $.BondName }}-{{ .Name }}
+type=ethernet
+master={{ $.BondName }}
+slave-type=bond
+multi-connect=3
+
+{{ .Match }}URSA_EOF
+{{ end }}{{ if .VLANName }}cat > /etc/NetworkManager/system-connections/{{ .VLANName }}.nmconnection <<'URSA_EOF'
+[connection]
+id={{ .VLANName }}
+type=vlan
+interface-name={{ .VLANName }}
+
+[vlan]
+id={{ .VLANID }}
+parent={{ .BondName }}
+
+{{ .IPv4 }}
+[ipv6]
+method=ignore
+URSA_EOF
+{{ end }}chmod 600 /etc/NetworkManager/system-connections/*.nmconnection
+{{ end }}
+{{ range .Users }}id {{ shquote .Name }} >/dev/null 2>&1 || useradd -m -s /bin/bash {{ shquote .Name }}
+mkdir -p /home/{{ shquote .Name }}/.ssh
+printf '%s\n'{{ range .Keys }} {{ shquote . }}{{ end }} > /home/{{ shquote .Name }}/.ssh/authorized_keys
+chmod 700 /home/{{ shquote .Name }}/.ssh
+chmod 600 /home/{{ shquote .Name }}/.ssh/authorized_keys
+chown -R {{ shquote .Name }}: /home/{{ shquote .Name }}/.ssh
+echo {{ shquote (printf "%s ALL=(ALL) NOPASSWD:ALL" .Name) }} > /etc/sudoers.d/90-ursa-{{ shquote .Name }}
+chmod 440 /etc/sudoers.d/90-ursa-{{ shquote .Name }}
+{{ end }}
+# move the host to provisioned so that it boots from the local disk
+if command -v curl >/dev/null 2>&1; then
+  curl -fsS -o /dev/null -d {{ shquote .PhoneHome }} {{ shquote (printf "%sphone-home" .Seed) }}
+else
+  wget -q -O /dev/null --post-data {{ shquote .PhoneHome }} {{ shquote (printf "%sphone-home" .Seed) }}
+fi
+`))
+
+var preseedTmpl = template.Must(template.New("preseed").Funcs(installFuncs).Parse(`d-i debian-installer/locale string en_US.UTF-8
+d-i keyboard-configuration/xkb-keymap select us
+d-i netcfg/choose_interface select auto
+d-i netcfg/get_hostname string {{ .Host.Name }}
+d-i netcfg/get_domain string
+d-i netcfg/hostname string {{ .Host.Name }}
+d-i mirror/country string manual
+d-i mirror/http/hostname string deb.debian.org
+d-i mirror/http/directory string /debian
+d-i mirror/http/proxy string
+d-i clock-setup/utc boolean true
+d-i time/zone string Etc/UTC
+d-i passwd/root-login boolean true
+d-i passwd/root-password-crypted password !
+d-i passwd/make-user boolean false
+{{ if .Disk }}d-i partman-auto/disk string {{ .Disk }}
+{{ end }}d-i partman-auto/method string {{ if eq .Layout "direct" }}regular{{ else }}lvm{{ end }}
+d-i partman-auto-lvm/guided_size string max
+d-i partman-auto/choose_recipe select atomic
+d-i partman-lvm/device_remove_lvm boolean true
+d-i partman-lvm/confirm boolean true
+d-i partman-lvm/confirm_nooverwrite boolean true
+d-i partman-md/device_remove_md boolean true
+d-i partman-partitioning/confirm_write_new_label boolean true
+d-i partman/choose_partition select finish
+d-i partman/confirm boolean true
+d-i partman/confirm_nooverwrite boolean true
+tasksel tasksel/first multiselect standard, ssh-server
+d-i pkgsel/include string netplan.io lldpd sudo wget
+d-i grub-installer/only_debian boolean true
+d-i grub-installer/bootdev string {{ if .Disk }}{{ .Disk }}{{ else }}default{{ end }}
+d-i preseed/late_command string in-target sh -c 'echo {{ .PostInstall }} | base64 -d | sh'
+d-i finish-install/reboot_in_progress note
+`))
+
+var kickstartTmpl = template.Must(template.New("kickstart").Funcs(installFuncs).Parse(`text
+lang en_US.UTF-8
+keyboard us
+timezone Etc/UTC --utc
+network --bootproto=dhcp --hostname={{ .Host.Name }} --activate
+rootpw --lock
+{{ if .Disk }}ignoredisk --only-use={{ trimDev .Disk }}
+{{ end }}zerombr
+clearpart --all --initlabel
+autopart --type={{ if eq .Layout "direct" }}plain{{ else }}lvm{{ end }}
+bootloader
+skipx
+firstboot --disable
+reboot
+
+%packages
+@^minimal-environment
+curl
+%end
+
+%post --log=/root/ursa-post-install.log
+echo {{ .PostInstall }} | base64 -d | sh
+%end
+`))
+
+// autoinstall is Ubuntu autoinstall config version 1.
+type autoinstall struct {
+	Version      int                 `yaml:"version"`
+	Network      networkConfig       `yaml:"network"`
+	Storage      autoinstallStorage  `yaml:"storage"`
+	SSH          autoinstallSSH      `yaml:"ssh"`
+	Packages     []string            `yaml:"packages"`
+	UserData     autoinstallUserdata `yaml:"user-data"`
+	LateCommands []string            `yaml:"late-commands"`
+}
+
+type autoinstallStorage struct {
+	Layout autoinstallLayout `yaml:"layout"`
+}
+
+type autoinstallLayout struct {
+	Name  string            `yaml:"name"`
+	Match map[string]string `yaml:"match,omitempty"`
+}
+
+type autoinstallSSH struct {
+	InstallServer bool `yaml:"install-server"`
+	AllowPW       bool `yaml:"allow-pw"`
+}
+
+type autoinstallUserdata struct {
+	Hostname string `yaml:"hostname"`
+	FQDN     string `yaml:"fqdn"`
+	Users    []user `yaml:"users"`
+}
+
+func renderAutoinstall(params installParams) ([]byte, error) {
+	ai := autoinstall{
+		Version: 1,
+		Network: params.network,
+		Storage: autoinstallStorage{
+			Layout: autoinstallLayout{Name: params.Layout},
+		},
+		SSH: autoinstallSSH{
+			InstallServer: true,
+		},
+		Packages: []string{"lldpd"},
+		UserData: autoinstallUserdata{
+			Hostname: params.Host.Name,
+			FQDN:     params.Host.Name,
+		},
+		LateCommands: []string{
+			fmt.Sprintf("curl -fsS -o /dev/null -d %s %s", shellQuote(params.PhoneHome), shellQuote(params.Seed+"phone-home")),
+		},
+	}
+	if params.Disk != "" {
+		ai.Storage.Layout.Match = map[string]string{"path": params.Disk}
+	}
+	for _, u := range params.Users {
+		ai.UserData.Users = append(ai.UserData.Users, user{
+			Name:              u.Name,
+			Sudo:              "ALL=(ALL) NOPASSWD:ALL",
+			Groups:            "users, admin",
+			SSHAuthorizedKeys: u.Keys,
+		})
+	}
+
+	out, err := yaml.Marshal(map[string]autoinstall{"autoinstall": ai})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal yaml: %w", err)
+	}
+	return append([]byte("#cloud-config\n"), out...), nil
+}
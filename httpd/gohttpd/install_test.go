@@ -0,0 +1,247 @@
+package gohttpd
+
+import (
+	"context"
+	"encoding/base64"
+	"net/url"
+	"os/exec"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+const testSeed = "http://10.0.0.254/init/token/"
+
+// checkShell checks the syntax of the script with sh.
+func checkShell(t *testing.T, script string) {
+	t.Helper()
+	out, err := exec.Command("sh", "-n", "-c", script).CombinedOutput()
+	if err != nil {
+		t.Fatalf("invalid shell: %v: %s\n%s", err, out, script)
+	}
+}
+
+// decodeScript decodes the base64 encoded script of the command
+// "echo <script> | base64 -d | sh".
+func decodeScript(t *testing.T, line string) string {
+	t.Helper()
+	i := strings.Index(line, "echo ")
+	j := strings.Index(line, " | base64 -d")
+	if i < 0 || j < i {
+		t.Fatalf("no post-install script in %q", line)
+	}
+	script, err := base64.StdEncoding.DecodeString(line[i+len("echo ") : j])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(script)
+}
+
+// lineWithPrefix returns the first line of s that starts with prefix.
+func lineWithPrefix(t *testing.T, s, prefix string) string {
+	t.Helper()
+	for _, line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+	t.Fatalf("no line starts with %q in\n%s", prefix, s)
+	return ""
+}
+
+func checkPhoneHome(t *testing.T, script string, h httpd.Host) {
+	t.Helper()
+	line := strings.TrimSpace(lineWithPrefix(t, script, "  curl "))
+	want := "curl -fsS -o /dev/null -d " + shellQuote(url.Values{"instance_id": {h.UUID.String()}, "hostname": {h.Name}}.Encode()) + " " + shellQuote(testSeed+"phone-home")
+	if line != want {
+		t.Errorf("phone home = %q, want %q", line, want)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, s := range []string{"", "root", "o'brien", `it's "quoted" $HOME \n`, "''", "ssh-ed25519 AAAA a'b`id`"} {
+		out, err := exec.Command("sh", "-c", "printf %s "+shellQuote(s)).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != s {
+			t.Errorf("sh read %q, want %q", out, s)
+		}
+	}
+}
+
+func TestInstallerArgs(t *testing.T) {
+	h := httpd.Host{Name: "host1"}
+	metadata := "http://10.0.0.254/init/token/"
+	tests := []struct {
+		profile httpd.BootProfile
+		want    string
+	}{
+		{
+			profile: httpd.BootProfile{Kind: httpd.BootProfileKindInstaller, Installer: httpd.InstallerPreseed},
+			want:    "auto=true priority=critical interface=auto url=http://10.0.0.254/init/token/preseed.cfg hostname=host1 domain=",
+		},
+		{
+			profile: httpd.BootProfile{Kind: httpd.BootProfileKindInstaller, Installer: httpd.InstallerAutoinstall},
+			want:    "autoinstall ds=nocloud-net;s=http://10.0.0.254/init/token/",
+		},
+		{
+			profile: httpd.BootProfile{Kind: httpd.BootProfileKindInstaller, Installer: httpd.InstallerKickstart},
+			want:    "inst.ks=http://10.0.0.254/init/token/kickstart.cfg",
+		},
+		{
+			profile: httpd.BootProfile{Kind: httpd.BootProfileKindIgnition},
+			want:    "ignition.firstboot flatcar.first_boot=1 ignition.platform.id=metal ignition.config.url=http://10.0.0.254/init/token/ignition.json",
+		},
+		{
+			profile: httpd.BootProfile{Kind: httpd.BootProfileKindLive},
+			want:    "",
+		},
+	}
+	for _, test := range tests {
+		if got := installerArgs(test.profile, metadata, h); got != test.want {
+			t.Errorf("installerArgs(%s/%s) = %q, want %q", test.profile.Kind, test.profile.Installer, got, test.want)
+		}
+	}
+}
+
+func TestRenderInstallConfig(t *testing.T) {
+	ctx := context.Background()
+	ds := newDatastore(t, "")
+	_, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = registerHostIfNotExists(ctx, ds, nil, mac(1), hostUUID(1), "SN1", "product", "manufacturer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ds.GetHostByUUID(ctx, hostUUID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := NetworkOptions{BondDriver: "ixgbe", ServiceVLAN: 1000}
+	render := func(t *testing.T, installer, layout string) string {
+		t.Helper()
+		profile := httpd.BootProfile{Kind: httpd.BootProfileKindInstaller, Installer: installer, Disk: "/dev/sda", Layout: layout}
+		out, err := renderInstallConfig(ctx, ds, *h, profile, "http://10.0.0.254", testSeed, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+
+	t.Run("preseed", func(t *testing.T) {
+		out := render(t, httpd.InstallerPreseed, "")
+		for _, want := range []string{
+			"d-i netcfg/hostname string " + h.Name,
+			"d-i partman-auto/disk string /dev/sda",
+			"d-i partman-auto/method string lvm",
+			"d-i grub-installer/bootdev string /dev/sda",
+		} {
+			lineWithPrefix(t, out, want)
+		}
+		script := decodeScript(t, lineWithPrefix(t, out, "d-i preseed/late_command string "))
+		checkShell(t, script)
+		checkPhoneHome(t, script, *h)
+		if !strings.Contains(script, "/etc/netplan/50-ursa.yaml") || !strings.Contains(script, "bond0.1000") {
+			t.Errorf("post-install = %s, want the netplan of the service VLAN", script)
+		}
+	})
+
+	t.Run("kickstart", func(t *testing.T) {
+		out := render(t, httpd.InstallerKickstart, httpd.InstallLayoutDirect)
+		for _, want := range []string{
+			"network --bootproto=dhcp --hostname=" + h.Name + " --activate",
+			"ignoredisk --only-use=sda",
+			"autopart --type=plain",
+			"%post --log=/root/ursa-post-install.log",
+		} {
+			lineWithPrefix(t, out, want)
+		}
+		script := decodeScript(t, lineWithPrefix(t, out, "echo "))
+		checkShell(t, script)
+		checkPhoneHome(t, script, *h)
+		if !strings.Contains(script, "/etc/NetworkManager/system-connections/bond0.1000.nmconnection") {
+			t.Errorf("post-install = %s, want the keyfile of the service VLAN", script)
+		}
+	})
+
+	t.Run("autoinstall", func(t *testing.T) {
+		out := render(t, httpd.InstallerAutoinstall, "")
+		if !strings.HasPrefix(out, "#cloud-config\n") {
+			t.Fatalf("autoinstall = %s, want cloud-config", out)
+		}
+		var config map[string]autoinstall
+		if err := yaml.Unmarshal([]byte(out), &config); err != nil {
+			t.Fatal(err)
+		}
+		ai := config["autoinstall"]
+		if ai.Version != 1 || ai.UserData.Hostname != h.Name || !ai.SSH.InstallServer {
+			t.Errorf("autoinstall = %+v", ai)
+		}
+		if ai.Storage.Layout.Name != httpd.InstallLayoutLVM || ai.Storage.Layout.Match["path"] != "/dev/sda" {
+			t.Errorf("storage = %+v, want lvm on /dev/sda", ai.Storage)
+		}
+		if _, ok := ai.Network.VLANs["bond0.1000"]; !ok {
+			t.Errorf("network = %+v, want the service VLAN", ai.Network)
+		}
+		if len(ai.LateCommands) != 1 {
+			t.Fatalf("late-commands = %v, want the phone home", ai.LateCommands)
+		}
+		checkShell(t, ai.LateCommands[0])
+		checkPhoneHome(t, "  "+ai.LateCommands[0], *h)
+	})
+}
+
+func TestRenderPostInstallQuoting(t *testing.T) {
+	params := installParams{
+		userdataParams: userdataParams{
+			Host: httpd.Host{UUID: hostUUID(1), Name: "host'1&x=y"},
+			Seed: testSeed,
+			Users: []userdataUser{
+				{User: httpd.User{Name: "o'brien"}, Keys: []string{`ssh-ed25519 AAAA "it's" $HOME`, "ssh-rsa BBBB URSA_EOF"}},
+				{User: httpd.User{Name: "nokey"}},
+			},
+		},
+		network: newNetworkConfig(testLease(t), testNICs, NetworkOptions{}),
+	}
+	params.PhoneHome = url.Values{"instance_id": {params.Host.UUID.String()}, "hostname": {params.Host.Name}}.Encode()
+
+	for _, netplan := range []bool{true, false} {
+		out, err := renderPostInstall(params, netplan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := base64.StdEncoding.DecodeString(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		script := string(b)
+		checkShell(t, script)
+		checkPhoneHome(t, script, params.Host)
+
+		// The keys and the sudoers entry are written as they are.
+		line := lineWithPrefix(t, script, "printf '%s\\n' ")
+		cmd := line[:strings.Index(line, " > /home/")]
+		got, err := exec.Command("sh", "-c", cmd).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "ssh-ed25519 AAAA \"it's\" $HOME\nssh-rsa BBBB URSA_EOF\n"; string(got) != want {
+			t.Errorf("authorized_keys = %q, want %q", got, want)
+		}
+		line = lineWithPrefix(t, script, "echo 'o'")
+		cmd = line[:strings.Index(line, " > /etc/sudoers.d/")]
+		got, err = exec.Command("sh", "-c", cmd).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "o'brien ALL=(ALL) NOPASSWD:ALL\n"; string(got) != want {
+			t.Errorf("sudoers = %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package gohttpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+const bondName = "bond0"
+
+// NetworkOptions are the settings of the network config of the hosts.
+type NetworkOptions struct {
+	// BondDriver is the driver of the NICs to bond. If it is empty, every
+	// NIC in the inventory is bonded.
+	BondDriver string
+	// ServiceVLAN is the VLAN id of the service network. If it is 0, the
+	// service address is put on the bond.
+	ServiceVLAN int
+}
+
+// networkConfig is cloud-init network config version 2.
+type networkConfig struct {
+	Version   int                 `yaml:"version"`
+	Ethernets map[string]ethernet `yaml:"ethernets,omitempty"`
+	Bonds     map[string]bond     `yaml:"bonds,omitempty"`
+	VLANs     map[string]vlan     `yaml:"vlans,omitempty"`
+}
+
+type match struct {
+	Name       string `yaml:"name,omitempty"`
+	Driver     string `yaml:"driver,omitempty"`
+	MACAddress string `yaml:"macaddress,omitempty"`
+}
+
+type ethernet struct {
+	Match match `yaml:"match"`
+	DHCP4 bool  `yaml:"dhcp4"`
+}
+
+type bondParameters struct {
+	Mode               string `yaml:"mode"`
+	LACPRate           string `yaml:"lacp-rate"`
+	MIIMonitorInterval int    `yaml:"mii-monitor-interval"`
+	TransmitHashPolicy string `yaml:"transmit-hash-policy"`
+}
+
+// addressing is the static address of the service network.
+type addressing struct {
+	Addresses   []string     `yaml:"addresses,omitempty"`
+	Routes      []route      `yaml:"routes,omitempty"`
+	Nameservers *nameservers `yaml:"nameservers,omitempty"`
+}
+
+type bond struct {
+	Interfaces []string       `yaml:"interfaces"`
+	Parameters bondParameters `yaml:"parameters"`
+	DHCP4      bool           `yaml:"dhcp4"`
+	addressing `yaml:",inline"`
+}
+
+type route struct {
+	To  string `yaml:"to"`
+	Via string `yaml:"via"`
+}
+
+type nameservers struct {
+	Addresses []string `yaml:"addresses"`
+}
+
+type vlan struct {
+	ID         int    `yaml:"id"`
+	Link       string `yaml:"link"`
+	addressing `yaml:",inline"`
+}
+
+// getNetworkConfig returns the network config of the host from its service
+// lease and the NICs in its latest inventory. The network profile assigned
+// to the host overrides opts.
+func getNetworkConfig(ctx context.Context, ds datastore.Datastore, h httpd.Host, l httpd.Lease, opts NetworkOptions) (*networkConfig, error) {
+	profile, err := ds.GetNetworkProfileByHost(ctx, h)
+	if err == nil {
+		opts = NetworkOptions{
+			BondDriver:  profile.BondDriver,
+			ServiceVLAN: profile.ServiceVLAN,
+		}
+	} else if !errors.Is(err, datastore.ErrNotFound) {
+		return nil, fmt.Errorf("failed to get network profile: %w", err)
+	}
+
+	var nics []httpd.NIC
+	inventory, err := ds.GetLatestHostInventory(ctx, h.ID)
+	if err == nil {
+		nics = inventory.Inventory.NICs
+	} else if !errors.Is(err, datastore.ErrNotFound) {
+		return nil, fmt.Errorf("failed to get latest host inventory: %w", err)
+	}
+	nc := newNetworkConfig(l, nics, opts)
+	return &nc, nil
+}
+
+// bondMembers returns the ethernets to bond: the NICs of the driver in the
+// inventory matched by their MAC addresses. If the inventory has none of
+// them, every NIC of the driver, or every en* NIC if driver is empty, is
+// matched instead.
+func bondMembers(nics []httpd.NIC, driver string) map[string]ethernet {
+	members := map[string]ethernet{}
+	for _, nic := range nics {
+		if driver != "" && nic.Driver != driver {
+			continue
+		}
+		members[nic.Name] = ethernet{Match: match{MACAddress: nic.MACAddress}}
+	}
+	if len(members) == 0 {
+		if driver != "" {
+			members["ports"] = ethernet{Match: match{Driver: driver}}
+		} else {
+			members["ports"] = ethernet{Match: match{Name: "en*"}}
+		}
+	}
+	return members
+}
+
+// newNetworkConfig returns the network config that bonds the NICs of the
+// host and puts the service lease address on the VLAN interface of the
+// bond. nics are the NICs in the latest inventory, and may be empty.
+func newNetworkConfig(l httpd.Lease, nics []httpd.NIC, opts NetworkOptions) networkConfig {
+	ones, _ := net.IPMask(l.Network.Mask).Size()
+	a := addressing{
+		Addresses: []string{fmt.Sprintf("%s/%d", l.IPAddress, ones)},
+	}
+	if l.Gateway != nil {
+		a.Routes = []route{{
+			To:  "0.0.0.0/0",
+			Via: l.Gateway.String(),
+		}}
+	}
+	if l.DNSServer != nil {
+		a.Nameservers = &nameservers{
+			Addresses: []string{l.DNSServer.String()},
+		}
+	}
+
+	ethernets := bondMembers(nics, opts.BondDriver)
+	var interfaces []string
+	for name := range ethernets {
+		interfaces = append(interfaces, name)
+	}
+	sort.Strings(interfaces)
+	b := bond{
+		Interfaces: interfaces,
+		Parameters: bondParameters{
+			Mode:               "802.3ad",
+			LACPRate:           "fast",
+			MIIMonitorInterval: 100,
+			TransmitHashPolicy: "layer2+3",
+		},
+	}
+	if opts.ServiceVLAN == 0 {
+		b.addressing = a
+	}
+	config := networkConfig{
+		Version:   2,
+		Ethernets: ethernets,
+		Bonds:     map[string]bond{bondName: b},
+	}
+	if opts.ServiceVLAN == 0 {
+		return config
+	}
+	config.VLANs = map[string]vlan{
+		vlanName(opts.ServiceVLAN): {
+			ID:         opts.ServiceVLAN,
+			Link:       bondName,
+			addressing: a,
+		},
+	}
+	return config
+}
+
+func vlanName(id int) string {
+	return fmt.Sprintf("%s.%d", bondName, id)
+}
+
+// serviceVLAN returns the VLAN interface of the service network, or false
+// if the service address is on the bond.
+func (nc networkConfig) serviceVLAN() (string, vlan, bool) {
+	for name, v := range nc.VLANs {
+		return name, v, true
+	}
+	return "", vlan{}, false
+}
+
+// service returns the name and the address of the interface that has the
+// service address.
+func (nc networkConfig) service() (string, addressing) {
+	if name, v, ok := nc.serviceVLAN(); ok {
+		return name, v.addressing
+	}
+	return bondName, nc.Bonds[bondName].addressing
+}
+
+// members returns the names of the bond members in order.
+func (nc networkConfig) members() []string {
+	return nc.Bonds[bondName].Interfaces
+}
@@ -0,0 +1,176 @@
+package gohttpd
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+func testLease(t *testing.T) httpd.Lease {
+	t.Helper()
+	gw := mustParseIP(t, "192.168.0.254")
+	dns := mustParseIP(t, "8.8.8.8")
+	return httpd.Lease{
+		IPAddress: mustParseIP(t, "192.168.0.10"),
+		Network:   mustParseCIDR(t, "192.168.0.0/24"),
+		Gateway:   &gw,
+		DNSServer: &dns,
+	}
+}
+
+var testNICs = []httpd.NIC{
+	{Name: "eno1", MACAddress: "52:54:00:00:01:01", Driver: "igb"},
+	{Name: "ens1f0", MACAddress: "52:54:00:00:02:01", Driver: "ixgbe"},
+	{Name: "ens1f1", MACAddress: "52:54:00:00:02:02", Driver: "ixgbe"},
+}
+
+func TestNewNetworkConfig(t *testing.T) {
+	l := testLease(t)
+	service := addressing{
+		Addresses:   []string{"192.168.0.10/24"},
+		Routes:      []route{{To: "0.0.0.0/0", Via: "192.168.0.254"}},
+		Nameservers: &nameservers{Addresses: []string{"8.8.8.8"}},
+	}
+	tests := []struct {
+		name      string
+		nics      []httpd.NIC
+		opts      NetworkOptions
+		ethernets map[string]ethernet
+		service   string
+	}{
+		{
+			name: "inventory NICs of the driver",
+			nics: testNICs,
+			opts: NetworkOptions{BondDriver: "ixgbe", ServiceVLAN: 1000},
+			ethernets: map[string]ethernet{
+				"ens1f0": {Match: match{MACAddress: "52:54:00:00:02:01"}},
+				"ens1f1": {Match: match{MACAddress: "52:54:00:00:02:02"}},
+			},
+			service: "bond0.1000",
+		},
+		{
+			name: "every inventory NIC without VLAN",
+			nics: testNICs,
+			opts: NetworkOptions{},
+			ethernets: map[string]ethernet{
+				"eno1":   {Match: match{MACAddress: "52:54:00:00:01:01"}},
+				"ens1f0": {Match: match{MACAddress: "52:54:00:00:02:01"}},
+				"ens1f1": {Match: match{MACAddress: "52:54:00:00:02:02"}},
+			},
+			service: "bond0",
+		},
+		{
+			name: "no NIC of the driver in the inventory",
+			nics: testNICs,
+			opts: NetworkOptions{BondDriver: "e1000e", ServiceVLAN: 1000},
+			ethernets: map[string]ethernet{
+				"ports": {Match: match{Driver: "e1000e"}},
+			},
+			service: "bond0.1000",
+		},
+		{
+			name: "no inventory",
+			opts: NetworkOptions{},
+			ethernets: map[string]ethernet{
+				"ports": {Match: match{Name: "en*"}},
+			},
+			service: "bond0",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nc := newNetworkConfig(l, test.nics, test.opts)
+			if !reflect.DeepEqual(nc.Ethernets, test.ethernets) {
+				t.Errorf("ethernets = %+v, want %+v", nc.Ethernets, test.ethernets)
+			}
+			if len(nc.members()) != len(test.ethernets) {
+				t.Errorf("members = %v, want %d interfaces", nc.members(), len(test.ethernets))
+			}
+			name, a := nc.service()
+			if name != test.service {
+				t.Errorf("service interface = %s, want %s", name, test.service)
+			}
+			if !reflect.DeepEqual(a, service) {
+				t.Errorf("service addressing = %+v, want %+v", a, service)
+			}
+			_, _, ok := nc.serviceVLAN()
+			if ok != (test.opts.ServiceVLAN != 0) {
+				t.Errorf("has VLAN = %t, want %t", ok, test.opts.ServiceVLAN != 0)
+			}
+		})
+	}
+}
+
+func TestGetNetworkConfig(t *testing.T) {
+	ctx := context.Background()
+	ds := newDatastore(t, "")
+	_, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = registerHostIfNotExists(ctx, ds, nil, mac(1), hostUUID(1), "SN1", "product", "manufacturer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ds.GetHostByUUID(ctx, hostUUID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := testLease(t)
+	opts := NetworkOptions{BondDriver: "ixgbe", ServiceVLAN: 1000}
+
+	nc, err := getNetworkConfig(ctx, ds, *h, l, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := nc.Ethernets["ports"].Match; m.Driver != "ixgbe" {
+		t.Errorf("match without inventory = %+v, want the driver", m)
+	}
+
+	_, err = ds.CreateHostInventory(ctx, h.ID, httpd.Inventory{NICs: testNICs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc, err = getNetworkConfig(ctx, ds, *h, l, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := nc.members(), []string{"ens1f0", "ens1f1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("members = %v, want %v", got, want)
+	}
+
+	units := networkdUnits(*nc)
+	if u := units["10-bond0-ens1f1.network"]; !strings.Contains(u, "MACAddress=52:54:00:00:02:02") {
+		t.Errorf("member unit = %q, want matched by the MAC address", u)
+	}
+	if u := units["10-bond0.1000.network"]; !strings.Contains(u, "Address=192.168.0.10/24") {
+		t.Errorf("service unit = %q, want the lease address", u)
+	}
+	ports := keyfilePorts(*nc)
+	if len(ports) != 2 || !strings.Contains(ports[0].Match, "mac-address=52:54:00:00:02:01") {
+		t.Errorf("keyfile ports = %+v, want matched by the MAC addresses", ports)
+	}
+
+	// The network profile assigned to the host overrides the options.
+	p, err := ds.CreateNetworkProfile(ctx, httpd.NetworkProfile{Name: "onboard", BondDriver: "igb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ds.AssignNetworkProfile(ctx, httpd.ScopeHost, h.UUID.String(), p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc, err = getNetworkConfig(ctx, ds, *h, l, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := nc.members(), []string{"eno1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("members with the profile = %v, want %v", got, want)
+	}
+	if name, _ := nc.service(); name != bondName {
+		t.Errorf("service interface with the profile = %s, want %s", name, bondName)
+	}
+}
@@ -1,15 +1,48 @@
 package gohttpd
 
-import "text/template"
+import (
+	"path"
+	"text/template"
+
+	"github.com/lovi-cloud/ursa/httpd"
+)
 
 type ipxeParams struct {
 	Initrd   string
 	Kernel   string
 	RootFS   string
+	Cmdline  string
 	Metadata string
+	// Install is the kernel arguments that make the OS fetch its config
+	// from ursa.
+	Install string
+	Host    httpd.Host
+	// Verify enables iPXE image trust. The detached signature of an
+	// artifact is served at the artifact URL + ".sig".
+	Verify bool
+}
+
+var ipxeFuncs = template.FuncMap{
+	"base": path.Base,
+}
+
+// defaultBootProfile is used when no boot profile is assigned to the host.
+var defaultBootProfile = httpd.BootProfile{
+	Name:    "default",
+	Kind:    httpd.BootProfileKindLive,
+	Kernel:  "kernel",
+	Initrd:  "initrd.img",
+	RootFS:  "filesystem.squashfs",
+	Cmdline: "boot=live components text console=ttyS0,115200 console=tty0 initrd=initrd.img apparmor=0",
+}
+
+// localBootProfile boots the host from the local disk.
+var localBootProfile = httpd.BootProfile{
+	Name: "local",
+	Kind: httpd.BootProfileKindLocal,
 }
 
-var tmpl = template.Must(template.New("iPXE").Parse(`#!ipxe
+var tmpl = template.Must(template.New("iPXE").Funcs(ipxeFuncs).Parse(`#!ipxe
 
 :boot_menu
 menu Select the boot source
@@ -18,9 +51,47 @@ item ipxe_shell Shell
 choose --default default --timeout 3000 target && goto ${target}
 
 :default
-initrd {{ .Initrd }} || goto boot_menu
-boot {{ .Kernel }} fetch={{ .RootFS }} boot=live components text console=ttyS0,115200 console=tty0 initrd=initrd.img apparmor=0 ds=nocloud-net;s={{ .Metadata }} || goto boot_menu
+{{ if .Verify }}imgtrust --permanent || goto boot_menu
+{{ end }}kernel {{ .Kernel }} fetch={{ .RootFS }} {{ .Cmdline }} ds=nocloud-net;s={{ .Metadata }} || goto boot_menu
+{{ if .Verify }}imgverify {{ base .Kernel }} {{ .Kernel }}.sig || goto boot_menu
+{{ end }}initrd {{ .Initrd }} || goto boot_menu
+{{ if .Verify }}imgverify {{ base .Initrd }} {{ .Initrd }}.sig || goto boot_menu
+{{ end }}boot || goto boot_menu
 
 :ipxe_shell
 shell || goto boot_menu
 `))
+
+var kernelTmpl = template.Must(template.New("iPXE").Funcs(ipxeFuncs).Parse(`#!ipxe
+
+:boot_menu
+menu Select the boot source
+item default Default
+item ipxe_shell Shell
+choose --default default --timeout 3000 target && goto ${target}
+
+:default
+{{ if .Verify }}imgtrust --permanent || goto boot_menu
+{{ end }}kernel {{ .Kernel }} {{ .Cmdline }}{{ if .Install }} {{ .Install }}{{ end }} || goto boot_menu
+{{ if .Verify }}imgverify {{ base .Kernel }} {{ .Kernel }}.sig || goto boot_menu
+{{ end }}{{ if .Initrd }}initrd {{ .Initrd }} || goto boot_menu
+{{ if .Verify }}imgverify {{ base .Initrd }} {{ .Initrd }}.sig || goto boot_menu
+{{ end }}{{ end }}boot || goto boot_menu
+
+:ipxe_shell
+shell || goto boot_menu
+`))
+
+var localTmpl = template.Must(template.New("iPXE").Parse(`#!ipxe
+
+sanboot --no-describe --drive 0x80 || exit
+`))
+
+var ipxeTemplates = map[string]*template.Template{
+	httpd.BootProfileKindLive:      tmpl,
+	httpd.BootProfileKindInstaller: kernelTmpl,
+	httpd.BootProfileKindRescue:    kernelTmpl,
+	httpd.BootProfileKindMemtest:   kernelTmpl,
+	httpd.BootProfileKindIgnition:  kernelTmpl,
+	httpd.BootProfileKindLocal:     localTmpl,
+}
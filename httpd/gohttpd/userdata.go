@@ -0,0 +1,227 @@
+package gohttpd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/dhcpd"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+var userdataFuncs = template.FuncMap{
+	"quote": strconv.Quote,
+	"join":  strings.Join,
+}
+
+// userdataParams is passed to user-data templates.
+type userdataParams struct {
+	Host   httpd.Host
+	Lease  httpd.Lease
+	Subnet dhcpd.Subnet
+	// Users are the users that have the access to the host.
+	Users  []userdataUser
+	Labels map[string]string
+	// Groups are the names of the host groups of the host.
+	Groups []string
+	// BaseURL is the scheme and address of ursa httpd that the host is
+	// talking to, e.g. http://192.0.2.1
+	BaseURL string
+	// Seed is the nocloud-net seed URL of the host.
+	Seed string
+}
+
+type userdataUser struct {
+	httpd.User
+	Keys []string
+}
+
+// ParseUserdataTemplate parses the user-data template text.
+func ParseUserdataTemplate(text string) (*template.Template, error) {
+	return template.New("user-data").Funcs(userdataFuncs).Parse(text)
+}
+
+// RenderUserdata renders the user-data of the host. If text is empty, the
+// template assigned to the host is used, and if there is no assignment the
+// built-in cloud-config is rendered. The phone_home of ursa is added to the
+// cloud-config rendered by the template unless it has phone_home.
+func RenderUserdata(ctx context.Context, ds datastore.Datastore, h httpd.Host, base, seed, text string) ([]byte, error) {
+	params, err := getUserdataParams(ctx, ds, h, base, seed)
+	if err != nil {
+		return nil, err
+	}
+
+	if text == "" {
+		t, err := ds.GetUserdataTemplateByHost(ctx, h)
+		if errors.Is(err, datastore.ErrNotFound) {
+			return renderDefaultUserdata(*params)
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get user-data template: %w", err)
+		}
+		text = t.Template
+	}
+
+	t, err := ParseUserdataTemplate(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse user-data template: %w", err)
+	}
+	var buff bytes.Buffer
+	err = t.Execute(&buff, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute user-data template: %w", err)
+	}
+	return ensurePhoneHome(buff.Bytes(), params.Seed)
+}
+
+// ensurePhoneHome adds phone_home to the cloud-config that does not have
+// it, so that the host is moved to provisioned. It is appended to the text
+// rather than re-marshaling the config, which would change the scalars
+// such as 0001. The other formats, e.g. a shell script, must post to the
+// phone-home URL by themselves.
+func ensurePhoneHome(out []byte, seed string) ([]byte, error) {
+	if !bytes.HasPrefix(out, []byte("#cloud-config")) {
+		return out, nil
+	}
+	var items yaml.MapSlice
+	err := yaml.Unmarshal(out, &items)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse cloud-config: %w", err)
+	}
+	for _, item := range items {
+		if item.Key == "phone_home" {
+			return out, nil
+		}
+	}
+	b, err := yaml.Marshal(map[string]*phoneHome{"phone_home": newPhoneHome(seed)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal yaml: %w", err)
+	}
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		out = append(out, '\n')
+	}
+	out = append(out, b...)
+	var check config
+	err = yaml.Unmarshal(out, &check)
+	if err != nil || check.PhoneHome == nil {
+		return nil, errors.New("failed to add phone_home to cloud-config, write the config in block style or add phone_home")
+	}
+	return out, nil
+}
+
+func newPhoneHome(seed string) *phoneHome {
+	return &phoneHome{
+		URL:   seed + "phone-home",
+		Post:  []string{"pub_key_dsa", "pub_key_rsa", "pub_key_ecdsa", "pub_key_ed25519", "instance_id", "hostname", "fqdn"},
+		Tries: 10,
+	}
+}
+
+func getUserdataParams(ctx context.Context, ds datastore.Datastore, h httpd.Host, base, seed string) (*userdataParams, error) {
+	l, err := ds.GetLeaseByID(ctx, h.ServiceLeaseID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lease by id: %w", err)
+	}
+	subnet, err := ds.GetServiceSubnet(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get service subnet: %w", err)
+	}
+	params := &userdataParams{
+		Host:    h,
+		Lease:   *l,
+		Subnet:  *subnet,
+		BaseURL: base,
+		Seed:    seed,
+	}
+
+	params.Labels, err = ds.GetHostLabels(ctx, h.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host labels: %w", err)
+	}
+	groups, err := ds.ListHostGroupByHost(ctx, h.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list host group by host: %w", err)
+	}
+	for _, g := range groups {
+		params.Groups = append(params.Groups, g.Name)
+	}
+
+	us, err := ds.ListUserByHost(ctx, h)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return nil, fmt.Errorf("failed to list user by host: %w", err)
+	}
+	for _, u := range us {
+		ks, err := ds.ListKeyByUserID(ctx, u.ID)
+		if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+			return nil, fmt.Errorf("failed to list key by user_id: %w", err)
+		}
+		var keys []string
+		for _, k := range ks {
+			keys = append(keys, k.Key)
+		}
+		params.Users = append(params.Users, userdataUser{
+			User: u,
+			Keys: keys,
+		})
+	}
+	return params, nil
+}
+
+func renderDefaultUserdata(params userdataParams) ([]byte, error) {
+	config := config{
+		ManageEtcHosts: true,
+		RunCMD: []string{
+			"echo \"dash dash/sh boolean false\" | debconf-set-selections",
+			"DEBIAN_FRONTEND=noninteractive dpkg-reconfigure dash",
+			"echo \"configure system description '$(dmidecode -s system-serial-number)'\" >> /etc/lldpd.conf",
+			"systemctl restart lldpd",
+			fmt.Sprintf("wget %s/static/ursa-inventory -O /tmp/ursa-inventory", params.BaseURL),
+			"chmod +x /tmp/ursa-inventory",
+			fmt.Sprintf("/tmp/ursa-inventory -url %sinventory", params.Seed),
+		},
+		FQDN:      params.Host.Name,
+		Hostname:  params.Host.Name,
+		PhoneHome: newPhoneHome(params.Seed),
+	}
+	for _, u := range params.Users {
+		config.Users = append(config.Users, user{
+			Name:              u.Name,
+			Sudo:              "ALL=(ALL) NOPASSWD:ALL",
+			Groups:            "users, admin",
+			SSHAuthorizedKeys: u.Keys,
+		})
+	}
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal yaml: %w", err)
+	}
+	return append([]byte("#cloud-config\n"), out...), nil
+}
+
+type config struct {
+	ManageEtcHosts bool       `yaml:"manage_etc_hosts"`
+	FQDN           string     `yaml:"fqdn"`
+	Hostname       string     `yaml:"hostname"`
+	Users          []user     `yaml:"users"`
+	RunCMD         []string   `yaml:"runcmd"`
+	PhoneHome      *phoneHome `yaml:"phone_home,omitempty"`
+}
+
+type phoneHome struct {
+	URL   string   `yaml:"url"`
+	Post  []string `yaml:"post"`
+	Tries int      `yaml:"tries"`
+}
+
+type user struct {
+	Name              string   `yaml:"name"`
+	Sudo              string   `yaml:"sudo"`
+	Groups            string   `yaml:"groups"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys"`
+}
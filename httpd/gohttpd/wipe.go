@@ -0,0 +1,101 @@
+package gohttpd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/event"
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/trace"
+)
+
+// wipeBootProfileName is the name of the boot profile that decommissioning
+// hosts boot. If it is not registered, the default live image is used.
+const wipeBootProfileName = "wipe"
+
+const maxWipeReportSize = 1 << 20
+
+func getWipeBootProfile(ctx context.Context, ds datastore.Datastore) (*httpd.BootProfile, error) {
+	profile, err := ds.GetBootProfileByName(ctx, wipeBootProfileName)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return &defaultBootProfile, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get wipe boot profile: %w", err)
+	}
+	return profile, nil
+}
+
+// renderWipeUserdata renders the user-data that erases all disks of the host
+// by ursa-wipe. It does not phone home, the wipe report does instead.
+func renderWipeUserdata(h httpd.Host, base, seed string) ([]byte, error) {
+	config := config{
+		FQDN:     h.Name,
+		Hostname: h.Name,
+		RunCMD: []string{
+			fmt.Sprintf("wget %s/static/ursa-wipe -O /tmp/ursa-wipe", base),
+			"chmod +x /tmp/ursa-wipe",
+			fmt.Sprintf("/tmp/ursa-wipe -url %swipe-report", seed),
+		},
+	}
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal yaml: %w", err)
+	}
+	return append([]byte("#cloud-config\n"), out...), nil
+}
+
+// wipeReportHandler receives the report posted by ursa-wipe. If all disks
+// are erased, the leases of the host are released and the host is wiped.
+func (g *GoHTTPd) wipeReportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		h := hostFromContext(r.Context())
+		if h.State != httpd.HostStateDecommissioning {
+			w.WriteHeader(http.StatusConflict)
+			g.logger.Warn("received wipe report from host that is not decommissioning", zap.String("host", h.Name), zap.String("state", h.State))
+			return
+		}
+		var report httpd.WipeReport
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWipeReportSize)).Decode(&report)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			g.logger.Error("failed to decode wipe report", zap.Error(err))
+			return
+		}
+		_, err = g.ds.CreateWipeReport(r.Context(), h.ID, report)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			g.logger.Error("failed to create wipe report", zap.Error(err))
+			return
+		}
+		g.bus.Publish(event.TypeWipeReportReceived, h.Name, map[string]string{"succeeded": strconv.FormatBool(report.Succeeded())})
+		if !report.Succeeded() {
+			g.logger.Warn("failed to wipe disks", zap.String("host", h.Name))
+			return
+		}
+
+		_, err = g.ds.DecommissionHost(r.Context(), h.ID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			g.logger.Error("failed to decommission host", zap.String("host", h.Name), zap.Error(err))
+			return
+		}
+		g.logger.Info("host wiped", zap.String("host", h.Name))
+		g.tracer.EndBoot(trace.BootKey{UUID: h.UUID.String()}, nil)
+		g.publishHostStateChanged(*h, httpd.HostStateWiped)
+		for _, id := range []int{h.ServiceLeaseID, h.ManagementLeaseID} {
+			g.bus.Publish(event.TypeLeaseReleased, h.Name, map[string]string{"id": strconv.Itoa(id)})
+		}
+	})
+}
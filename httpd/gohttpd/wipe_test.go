@@ -0,0 +1,125 @@
+package gohttpd
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lovi-cloud/ursa/event"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+func TestWipeReport(t *testing.T) {
+	ctx := context.Background()
+	ds := newDatastore(t, "")
+	g := newGoHTTPd(t, ds)
+	for i := 1; i <= 2; i++ {
+		_, err := ds.CreateLeaseFromManagementSubnet(ctx, mac(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The second host is provisioning, not decommissioning.
+	other := tokenOf(ipxe(g, 2, "10.0.0.2").Body.String())
+	ipxe(g, 1, "10.0.0.1")
+	h, err := ds.GetHostByUUID(ctx, hostUUID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.UpdateHostState(ctx, h.ID, httpd.HostStateDecommissioning)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The decommissioning host boots the live image with the wipe user-data.
+	token := tokenOf(ipxe(g, 1, "10.0.0.1").Body.String())
+	if token == "" {
+		t.Fatal("want a token for the decommissioning host")
+	}
+	w := request(g, http.MethodGet, "/init/"+token+"/user-data", "10.0.0.1", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/tmp/ursa-wipe -url http://example.com/init/"+token+"/wipe-report") || strings.Contains(w.Body.String(), "phone_home") {
+		t.Fatalf("user-data = %d %s, want ursa-wipe", w.Code, w.Body.String())
+	}
+
+	post := func(token, body string) int {
+		r := request(g, http.MethodPost, "/init/"+token+"/wipe-report", "10.0.0.1", strings.NewReader(body))
+		return r.Code
+	}
+	failed := `{"disks": [{"name": "sda", "serial": "S1", "method": "blkdiscard", "success": true}, {"name": "sdb", "serial": "S2", "method": "shred", "success": false, "message": "I/O error"}]}`
+	succeeded := `{"disks": [{"name": "sda", "serial": "S1", "method": "blkdiscard", "success": true}]}`
+	tests := []struct {
+		name  string
+		token string
+		body  string
+		code  int
+	}{
+		{name: "bad token", token: "bad", body: succeeded, code: http.StatusForbidden},
+		{name: "token of another host", token: other, body: succeeded, code: http.StatusConflict},
+		{name: "broken report", token: token, body: "{", code: http.StatusBadRequest},
+		{name: "failed report", token: token, body: failed, code: http.StatusOK},
+	}
+	for _, test := range tests {
+		if code := post(test.token, test.body); code != test.code {
+			t.Errorf("%s: status = %d, want %d", test.name, code, test.code)
+		}
+	}
+	h, err = ds.GetHostByUUID(ctx, hostUUID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.State != httpd.HostStateDecommissioning || h.ManagementLeaseID == 0 {
+		t.Fatalf("host = %+v, want decommissioning after the failed report", h)
+	}
+
+	if code := post(token, succeeded); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	h, err = ds.GetHostByUUID(ctx, hostUUID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.State != httpd.HostStateWiped || h.ServiceLeaseID != 0 || h.ManagementLeaseID != 0 {
+		t.Fatalf("host = %+v, want wiped without leases", h)
+	}
+	reports, err := ds.ListWipeReport(ctx, h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 {
+		t.Errorf("wipe reports = %+v, want 2", reports)
+	}
+	if _, err := ds.GetLeaseFromManagementSubnet(ctx, mac(1)); err == nil {
+		t.Error("want the management lease released")
+	}
+	// The token is revoked with the leases.
+	if code := post(token, succeeded); code != http.StatusForbidden {
+		t.Errorf("status after wiped = %d, want %d", code, http.StatusForbidden)
+	}
+
+	var got []string
+	for _, e := range g.bus.Since(0) {
+		switch e.Type {
+		case event.TypeWipeReportReceived:
+			got = append(got, e.Type+"="+e.Data["succeeded"])
+		case event.TypeHostStateChanged:
+			got = append(got, e.Type+"="+e.Data["to"])
+		case event.TypeLeaseReleased:
+			if e.Host == h.Name {
+				got = append(got, e.Type)
+			}
+		}
+	}
+	want := []string{
+		event.TypeHostStateChanged + "=" + httpd.HostStateProvisioning,
+		event.TypeHostStateChanged + "=" + httpd.HostStateProvisioning,
+		event.TypeWipeReportReceived + "=false",
+		event.TypeWipeReportReceived + "=true",
+		event.TypeHostStateChanged + "=" + httpd.HostStateWiped,
+		event.TypeLeaseReleased,
+		event.TypeLeaseReleased,
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
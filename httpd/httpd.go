@@ -1,8 +1,12 @@
 package httpd
 
-import "context"
+import (
+	"context"
+	"crypto/tls"
+)
 
 // HTTPd is the interface for usra to provide the HTTP daemon.
 type HTTPd interface {
 	Serve(ctx context.Context, addr string) error
+	ServeTLS(ctx context.Context, addr string, cert tls.Certificate) error
 }
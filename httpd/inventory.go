@@ -0,0 +1,97 @@
+package httpd
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Inventory is the hardware inventory reported by the host.
+type Inventory struct {
+	Serial string `json:"serial"`
+	CPU    CPU    `json:"cpu"`
+	Memory uint64 `json:"memory_bytes"`
+	Disks  []Disk `json:"disks"`
+	NICs   []NIC  `json:"nics"`
+	BIOS   BIOS   `json:"bios"`
+	BMC    *BMC   `json:"bmc,omitempty"`
+}
+
+// CPU is
+type CPU struct {
+	Model   string `json:"model"`
+	Sockets int    `json:"sockets"`
+	Cores   int    `json:"cores"`
+	Threads int    `json:"threads"`
+}
+
+// Disk is
+type Disk struct {
+	Name       string `json:"name"`
+	Model      string `json:"model"`
+	Serial     string `json:"serial"`
+	Size       uint64 `json:"size_bytes"`
+	Rotational bool   `json:"rotational"`
+}
+
+// NIC is
+type NIC struct {
+	Name         string        `json:"name"`
+	MACAddress   string        `json:"mac_address"`
+	Driver       string        `json:"driver"`
+	Speed        int           `json:"speed_mbps"`
+	LLDPNeighbor *LLDPNeighbor `json:"lldp_neighbor,omitempty"`
+}
+
+// LLDPNeighbor is the switch port that the NIC is connected to.
+type LLDPNeighbor struct {
+	ChassisID       string `json:"chassis_id"`
+	SystemName      string `json:"system_name"`
+	PortID          string `json:"port_id"`
+	PortDescription string `json:"port_description"`
+}
+
+// BIOS is
+type BIOS struct {
+	Vendor  string `json:"vendor"`
+	Version string `json:"version"`
+	Date    string `json:"date"`
+}
+
+// BMC is
+type BMC struct {
+	Version    string `json:"version"`
+	IPAddress  string `json:"ip_address"`
+	MACAddress string `json:"mac_address"`
+}
+
+// Value implements the database/sql/driver Valuer interface.
+func (i Inventory) Value() (driver.Value, error) {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return nil, err
+	}
+	return driver.Value(string(b)), nil
+}
+
+// Scan implements the database/sql Scanner interface.
+func (i *Inventory) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(src), i)
+	case []uint8:
+		return json.Unmarshal(src, i)
+	default:
+		return fmt.Errorf("incompatible type for Inventory: %T", src)
+	}
+}
+
+// HostInventory is a version of the inventory of the host.
+type HostInventory struct {
+	ID        int       `db:"id" json:"id"`
+	HostID    int       `db:"host_id" json:"host_id"`
+	Version   int       `db:"version" json:"version"`
+	Inventory Inventory `db:"inventory" json:"inventory"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
@@ -1,6 +1,8 @@
 package httpd
 
 import (
+	"time"
+
 	uuid "github.com/satori/go.uuid"
 
 	"github.com/lovi-cloud/ursa/types"
@@ -8,11 +10,26 @@ import (
 
 // Host is
 type Host struct {
-	ID                int       `db:"id"`
-	UUID              uuid.UUID `db:"uuid"`
-	Name              string    `db:"name"`
-	ServiceLeaseID    int       `db:"service_lease_id"`
-	ManagementLeaseID int       `db:"management_lease_id"`
+	ID                int        `db:"id" json:"id"`
+	UUID              uuid.UUID  `db:"uuid" json:"uuid"`
+	Name              string     `db:"name" json:"name"`
+	Serial            string     `db:"serial" json:"serial"`
+	Product           string     `db:"product" json:"product"`
+	Manufacturer      string     `db:"manufacturer" json:"manufacturer"`
+	ServiceLeaseID    int        `db:"service_lease_id" json:"service_lease_id"`
+	ManagementLeaseID int        `db:"management_lease_id" json:"management_lease_id"`
+	State             string     `db:"state" json:"state"`
+	StateUpdatedAt    time.Time  `db:"state_updated_at" json:"state_updated_at"`
+	InstanceID        string     `db:"instance_id" json:"instance_id"`
+	PhonedHomeAt      *time.Time `db:"phoned_home_at" json:"phoned_home_at"`
+}
+
+// HostKey is a SSH host key reported by cloud-init.
+type HostKey struct {
+	ID     int    `db:"id" json:"id"`
+	HostID int    `db:"host_id" json:"host_id"`
+	Type   string `db:"type" json:"type"`
+	Key    string `db:"key" json:"key"`
 }
 
 // Lease is
@@ -26,13 +43,117 @@ type Lease struct {
 
 // User is
 type User struct {
-	ID   int    `db:"id"`
-	Name string `db:"name"`
+	ID   int    `db:"id" json:"id"`
+	Name string `db:"name" json:"name"`
 }
 
 // Key is
 type Key struct {
-	ID     int    `db:"id"`
-	Key    string `db:"key"`
-	UserID int    `db:"user_id"`
+	ID     int    `db:"id" json:"id"`
+	Key    string `db:"key" json:"key"`
+	UserID int    `db:"user_id" json:"user_id"`
+}
+
+// BootProfile kinds
+const (
+	BootProfileKindLive      = "live"
+	BootProfileKindInstaller = "installer"
+	BootProfileKindRescue    = "rescue"
+	BootProfileKindLocal     = "local"
+	BootProfileKindMemtest   = "memtest"
+	BootProfileKindCustom    = "custom"
+	// BootProfileKindIgnition boots Flatcar or Fedora CoreOS configured by
+	// the Ignition config of the host.
+	BootProfileKindIgnition = "ignition"
+)
+
+// BootProfile is a set of boot artifacts and an iPXE script kind.
+type BootProfile struct {
+	ID      int    `db:"id" json:"id"`
+	Name    string `db:"name" json:"name"`
+	Kind    string `db:"kind" json:"kind"`
+	Kernel  string `db:"kernel" json:"kernel"`
+	Initrd  string `db:"initrd" json:"initrd"`
+	RootFS  string `db:"rootfs" json:"rootfs"`
+	Cmdline string `db:"cmdline" json:"cmdline"`
+	Script  string `db:"script" json:"script"`
+	// Installer is the format of the automated installation config served
+	// to an installer kind profile.
+	Installer string `db:"installer" json:"installer"`
+	// Disk is the install target, e.g. /dev/sda. The installer chooses if
+	// empty.
+	Disk string `db:"install_disk" json:"disk"`
+	// Layout is the partitioning layout, InstallLayoutLVM if empty.
+	Layout string `db:"install_layout" json:"layout"`
+	// Diskless keeps booting the profile after the host is provisioned.
+	// Otherwise a provisioned host boots from the local disk.
+	Diskless bool `db:"diskless" json:"diskless"`
+}
+
+// Installers
+const (
+	InstallerPreseed     = "preseed"
+	InstallerAutoinstall = "autoinstall"
+	InstallerKickstart   = "kickstart"
+)
+
+// Install layouts
+const (
+	InstallLayoutLVM    = "lvm"
+	InstallLayoutDirect = "direct"
+)
+
+// Assignment scopes of boot profiles, user-data templates and user access,
+// in order of precedence.
+const (
+	ScopeHost = "host"
+	// ScopeGroup is the hosts in the host group of the name.
+	ScopeGroup = "group"
+	// ScopeSelector is the hosts whose labels match the label selector.
+	ScopeSelector     = "selector"
+	ScopeProduct      = "product"
+	ScopeManufacturer = "manufacturer"
+	ScopeDefault      = "default"
+)
+
+// HostGroup is a named set of hosts.
+type HostGroup struct {
+	ID   int    `db:"id" json:"id"`
+	Name string `db:"name" json:"name"`
+}
+
+// UserdataTemplate is a Go template of cloud-init user-data.
+type UserdataTemplate struct {
+	ID       int    `db:"id" json:"id"`
+	Name     string `db:"name" json:"name"`
+	Template string `db:"template" json:"template"`
+}
+
+// NetworkProfile is the network of the hosts it is assigned to. It
+// overrides the network options of ursa httpd.
+type NetworkProfile struct {
+	ID   int    `db:"id" json:"id"`
+	Name string `db:"name" json:"name"`
+	// BondDriver is the driver of the NICs to bond, every NIC if empty.
+	BondDriver string `db:"bond_driver" json:"bond_driver"`
+	// ServiceVLAN is the VLAN id of the service network, untagged if 0.
+	ServiceVLAN int `db:"service_vlan" json:"service_vlan"`
+}
+
+// BMC drivers
+const (
+	BMCDriverIPMI    = "ipmi"
+	BMCDriverRedfish = "redfish"
+)
+
+// BMCCredential is a credential to control the host through its BMC.
+type BMCCredential struct {
+	ID       int    `db:"id" json:"id"`
+	HostID   int    `db:"host_id" json:"host_id"`
+	Driver   string `db:"driver" json:"driver"`
+	Address  string `db:"address" json:"address"`
+	Username string `db:"username" json:"username"`
+	Password string `db:"password" json:"-"`
+	// Insecure skips the verification of the BMC certificate.
+	Insecure bool `db:"insecure" json:"insecure"`
 }
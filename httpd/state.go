@@ -0,0 +1,47 @@
+package httpd
+
+import (
+	"errors"
+	"time"
+)
+
+// Host provisioning states
+const (
+	HostStateDiscovered      = "discovered"
+	HostStateProvisioning    = "provisioning"
+	HostStateProvisioned     = "provisioned"
+	HostStateInService       = "in-service"
+	HostStateDecommissioning = "decommissioning"
+	HostStateWiped           = "wiped"
+)
+
+// ErrInvalidHostStateTransition is returned when the transition is not allowed.
+var ErrInvalidHostStateTransition = errors.New("invalid host state transition")
+
+var hostStateTransitions = map[string][]string{
+	HostStateDiscovered:      {HostStateProvisioning, HostStateDecommissioning},
+	HostStateProvisioning:    {HostStateDiscovered, HostStateProvisioned, HostStateDecommissioning},
+	HostStateProvisioned:     {HostStateProvisioning, HostStateInService, HostStateDecommissioning},
+	HostStateInService:       {HostStateProvisioning, HostStateDecommissioning},
+	HostStateDecommissioning: {HostStateWiped},
+	HostStateWiped:           {HostStateDiscovered},
+}
+
+// CanTransitHostState reports whether the host can move from one state to another.
+func CanTransitHostState(from, to string) bool {
+	for _, s := range hostStateTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// HostStateTransition is a record of the host state change.
+type HostStateTransition struct {
+	ID        int       `db:"id" json:"id"`
+	HostID    int       `db:"host_id" json:"host_id"`
+	From      string    `db:"from_state" json:"from_state"`
+	To        string    `db:"to_state" json:"to_state"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
@@ -0,0 +1,97 @@
+package httpd
+
+import "time"
+
+// Boot event protocols
+const (
+	BootEventProtocolDHCP = "dhcp"
+	BootEventProtocolTFTP = "tftp"
+	BootEventProtocolHTTP = "http"
+	// BootEventProtocolState is a host state transition merged into the
+	// timeline.
+	BootEventProtocolState = "state"
+)
+
+// Boot event outcomes
+const (
+	BootEventOutcomeOK    = "ok"
+	BootEventOutcomeError = "error"
+)
+
+// BootEvent is a request that a host made while booting. DHCP events are
+// recorded by the MAC address and the others by the source address.
+type BootEvent struct {
+	ID         int       `db:"id" json:"id"`
+	MACAddress string    `db:"mac_address" json:"mac_address,omitempty"`
+	IPAddress  string    `db:"ip_address" json:"ip_address,omitempty"`
+	Protocol   string    `db:"protocol" json:"protocol"`
+	Name       string    `db:"name" json:"name"`
+	Outcome    string    `db:"outcome" json:"outcome"`
+	Detail     string    `db:"detail" json:"detail,omitempty"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+}
+
+// BootSession is a series of boot events that are close in time.
+type BootSession struct {
+	StartedAt time.Time   `json:"started_at"`
+	EndedAt   time.Time   `json:"ended_at"`
+	Events    []BootEvent `json:"events"`
+}
+
+// MergeStateTransitions merges the state transitions into the boot events,
+// both in chronological order. A transition is an event named by the new
+// state, after the boot events of the same time, as the request comes
+// before the transition it causes.
+func MergeStateTransitions(events []BootEvent, transitions []HostStateTransition) []BootEvent {
+	merged := make([]BootEvent, 0, len(events)+len(transitions))
+	i := 0
+	for _, tr := range transitions {
+		for i < len(events) && !events[i].CreatedAt.After(tr.CreatedAt) {
+			merged = append(merged, events[i])
+			i++
+		}
+		e := BootEvent{
+			Protocol:  BootEventProtocolState,
+			Name:      tr.To,
+			Outcome:   BootEventOutcomeOK,
+			CreatedAt: tr.CreatedAt,
+		}
+		if tr.From != "" {
+			e.Detail = "from " + tr.From
+		}
+		merged = append(merged, e)
+	}
+	return append(merged, events[i:]...)
+}
+
+// SplitBootSessions splits the events in chronological order into sessions.
+// A session ends when the host is idle for gap or the firmware starts over
+// from DHCP DISCOVER.
+func SplitBootSessions(events []BootEvent, gap time.Duration) []BootSession {
+	var sessions []BootSession
+	for _, e := range events {
+		n := len(sessions)
+		if n == 0 || e.CreatedAt.Sub(sessions[n-1].EndedAt) > gap || startsBoot(e, sessions[n-1]) {
+			sessions = append(sessions, BootSession{StartedAt: e.CreatedAt})
+			n++
+		}
+		sessions[n-1].EndedAt = e.CreatedAt
+		sessions[n-1].Events = append(sessions[n-1].Events, e)
+	}
+	return sessions
+}
+
+// startsBoot reports whether e is the DHCP DISCOVER of a new boot, that is,
+// the session already went beyond DHCP. The DISCOVER of the chainloaded
+// iPXE has the user class in the detail and continues the session.
+func startsBoot(e BootEvent, s BootSession) bool {
+	if e.Protocol != BootEventProtocolDHCP || e.Name != "discover" || e.Detail == "iPXE" {
+		return false
+	}
+	for _, prev := range s.Events {
+		if prev.Protocol != BootEventProtocolDHCP {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package httpd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTimeline(t *testing.T) {
+	start := time.Date(2020, 11, 2, 1, 15, 4, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	events := []BootEvent{
+		{Protocol: BootEventProtocolDHCP, Name: "discover", CreatedAt: at(0)},
+		{Protocol: BootEventProtocolDHCP, Name: "request", CreatedAt: at(time.Second)},
+		{Protocol: BootEventProtocolTFTP, Name: "ipxe.efi", CreatedAt: at(2 * time.Second)},
+		{Protocol: BootEventProtocolDHCP, Name: "discover", Detail: "iPXE", CreatedAt: at(4 * time.Second)},
+		{Protocol: BootEventProtocolHTTP, Name: "GET /ipxe", CreatedAt: at(5 * time.Second)},
+		{Protocol: BootEventProtocolHTTP, Name: "POST /init/-/phone-home", CreatedAt: at(time.Minute)},
+		// The host reboots into the local disk.
+		{Protocol: BootEventProtocolDHCP, Name: "discover", CreatedAt: at(2 * time.Minute)},
+		// The host boots again after it was idle.
+		{Protocol: BootEventProtocolDHCP, Name: "discover", CreatedAt: at(time.Hour)},
+	}
+	transitions := []HostStateTransition{
+		{To: HostStateDiscovered, CreatedAt: at(5 * time.Second)},
+		{From: HostStateDiscovered, To: HostStateProvisioning, CreatedAt: at(5 * time.Second)},
+		{From: HostStateProvisioning, To: HostStateProvisioned, CreatedAt: at(time.Minute)},
+		{From: HostStateProvisioned, To: HostStateInService, CreatedAt: at(3 * time.Minute)},
+	}
+
+	merged := MergeStateTransitions(events, transitions)
+	var got []string
+	for _, e := range merged {
+		got = append(got, e.Protocol+" "+e.Name)
+	}
+	want := []string{
+		"dhcp discover",
+		"dhcp request",
+		"tftp ipxe.efi",
+		"dhcp discover",
+		"http GET /ipxe",
+		"state discovered",
+		"state provisioning",
+		"http POST /init/-/phone-home",
+		"state provisioned",
+		"dhcp discover",
+		"state in-service",
+		"dhcp discover",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("merged = %v, want %v", got, want)
+	}
+	if e := merged[6]; e.Detail != "from discovered" || e.Outcome != BootEventOutcomeOK {
+		t.Errorf("transition = %+v, want from discovered", e)
+	}
+	if e := merged[5]; e.Detail != "" {
+		t.Errorf("first transition = %+v, want no detail", e)
+	}
+
+	sessions := SplitBootSessions(merged, 10*time.Minute)
+	var lens []int
+	for _, s := range sessions {
+		lens = append(lens, len(s.Events))
+	}
+	if !reflect.DeepEqual(lens, []int{9, 2, 1}) {
+		t.Fatalf("sessions = %v, want 9, 2 and 1 events", lens)
+	}
+	if s := sessions[0]; !s.StartedAt.Equal(at(0)) || !s.EndedAt.Equal(at(time.Minute)) {
+		t.Errorf("first session = %s - %s", s.StartedAt, s.EndedAt)
+	}
+	if got := MergeStateTransitions(events, nil); !reflect.DeepEqual(got, events) {
+		t.Errorf("merged without transitions = %+v", got)
+	}
+	if got := MergeStateTransitions(nil, transitions[:1]); len(got) != 1 || got[0].Protocol != BootEventProtocolState {
+		t.Errorf("merged without events = %+v", got)
+	}
+}
@@ -0,0 +1,73 @@
+package httpd
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Disk wipe methods
+const (
+	WipeMethodNVMeFormat     = "nvme-format"
+	WipeMethodATASecureErase = "ata-secure-erase"
+	WipeMethodBlkdiscard     = "blkdiscard"
+	WipeMethodZeroFill       = "zero-fill"
+)
+
+// WipeReport is the result of the disk wipe reported by the host.
+type WipeReport struct {
+	Disks []DiskWipeResult `json:"disks"`
+}
+
+// DiskWipeResult is
+type DiskWipeResult struct {
+	Name    string `json:"name"`
+	Serial  string `json:"serial"`
+	Method  string `json:"method"`
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+}
+
+// Succeeded reports whether all disks are wiped. A report without disks is
+// not succeeded.
+func (r WipeReport) Succeeded() bool {
+	if len(r.Disks) == 0 {
+		return false
+	}
+	for _, d := range r.Disks {
+		if !d.Success {
+			return false
+		}
+	}
+	return true
+}
+
+// Value implements the database/sql/driver Valuer interface.
+func (r WipeReport) Value() (driver.Value, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return driver.Value(string(b)), nil
+}
+
+// Scan implements the database/sql Scanner interface.
+func (r *WipeReport) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(src), r)
+	case []uint8:
+		return json.Unmarshal(src, r)
+	default:
+		return fmt.Errorf("incompatible type for WipeReport: %T", src)
+	}
+}
+
+// HostWipeReport is a wipe report of the host.
+type HostWipeReport struct {
+	ID        int        `db:"id" json:"id"`
+	HostID    int        `db:"host_id" json:"host_id"`
+	Report    WipeReport `db:"report" json:"report"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+}
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/dhcpd"
+	"github.com/lovi-cloud/ursa/httpd"
+)
+
+// Metrics is the set of metrics shared by the daemons of ursa.
+type Metrics struct {
+	Registry *Registry
+
+	DHCPPackets       *CounterVec
+	TFTPTransfers     *CounterVec
+	TFTPBytes         *CounterVec
+	HTTPRequests      *CounterVec
+	HTTPDuration      *HistogramVec
+	ArtifactBytes     *CounterVec
+	DatastoreDuration *HistogramVec
+}
+
+// New is
+func New() *Metrics {
+	m := &Metrics{
+		Registry:          NewRegistry(),
+		DHCPPackets:       NewCounterVec("ursa_dhcp_packets_total", "DHCP packets received by message type and outcome.", "type", "outcome"),
+		TFTPTransfers:     NewCounterVec("ursa_tftp_transfers_total", "TFTP transfers by outcome.", "outcome"),
+		TFTPBytes:         NewCounterVec("ursa_tftp_bytes_total", "Bytes sent by TFTP per file.", "file"),
+		HTTPRequests:      NewCounterVec("ursa_http_requests_total", "HTTP requests by server, handler and status code.", "server", "handler", "code"),
+		HTTPDuration:      NewHistogramVec("ursa_http_request_duration_seconds", "HTTP request latency by server and handler.", DefaultBuckets, "server", "handler"),
+		ArtifactBytes:     NewCounterVec("ursa_http_artifact_bytes_total", "Bytes served per boot artifact.", "artifact"),
+		DatastoreDuration: NewHistogramVec("ursa_datastore_query_duration_seconds", "Datastore operation latency by method.", DefaultBuckets, "method"),
+	}
+	for _, c := range []Collector{m.DHCPPackets, m.TFTPTransfers, m.TFTPBytes, m.HTTPRequests, m.HTTPDuration, m.ArtifactBytes, m.DatastoreDuration} {
+		m.Registry.Register(c)
+	}
+	return m
+}
+
+// DatastoreHook returns the hook that observes the latency of datastore
+// methods.
+func (m *Metrics) DatastoreHook() datastore.Hook {
+	return func(ctx context.Context, method string) (context.Context, func(err error)) {
+		start := time.Now()
+		return ctx, func(err error) {
+			m.DatastoreDuration.Observe(time.Since(start).Seconds(), method)
+		}
+	}
+}
+
+// RegisterDatastore registers the metrics that are read from the datastore
+// on every scrape: the pool utilization per subnet and the hosts per
+// provisioning state.
+func (m *Metrics) RegisterDatastore(ds datastore.Datastore) {
+	m.Registry.Register(NewGaugeFunc("ursa_pool_addresses", "Addresses in the pool per subnet.", func(ctx context.Context) ([]Sample, error) {
+		subnets, err := getSubnets(ctx, ds)
+		if err != nil {
+			return nil, err
+		}
+		var samples []Sample
+		for _, name := range sortedNames(subnets) {
+			samples = append(samples, Sample{LabelValues: []string{name}, Value: float64(poolSize(subnets[name]))})
+		}
+		return samples, nil
+	}, "subnet"))
+	m.Registry.Register(NewGaugeFunc("ursa_pool_leases", "Leased addresses per subnet.", func(ctx context.Context) ([]Sample, error) {
+		subnets, err := getSubnets(ctx, ds)
+		if err != nil {
+			return nil, err
+		}
+		counts, err := ds.CountLeaseBySubnet(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var samples []Sample
+		for _, name := range sortedNames(subnets) {
+			samples = append(samples, Sample{LabelValues: []string{name}, Value: float64(counts[subnets[name].ID])})
+		}
+		return samples, nil
+	}, "subnet"))
+	m.Registry.Register(NewGaugeFunc("ursa_hosts", "Hosts per provisioning state.", func(ctx context.Context) ([]Sample, error) {
+		counts, err := ds.CountHostByState(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var samples []Sample
+		for _, state := range []string{
+			httpd.HostStateDiscovered,
+			httpd.HostStateProvisioning,
+			httpd.HostStateProvisioned,
+			httpd.HostStateInService,
+			httpd.HostStateDecommissioning,
+			httpd.HostStateWiped,
+		} {
+			samples = append(samples, Sample{LabelValues: []string{state}, Value: float64(counts[state])})
+		}
+		return samples, nil
+	}, "state"))
+}
+
+// getSubnets returns the configured subnets keyed by the name. The BMC
+// subnet is optional.
+func getSubnets(ctx context.Context, ds datastore.Datastore) (map[string]dhcpd.Subnet, error) {
+	subnets := map[string]dhcpd.Subnet{}
+	for name, get := range map[string]func(context.Context) (*dhcpd.Subnet, error){
+		"management": ds.GetManagementSubnet,
+		"service":    ds.GetServiceSubnet,
+		"bmc":        ds.GetBMCSubnet,
+	} {
+		subnet, err := get(ctx)
+		if errors.Is(err, datastore.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get %s subnet: %w", name, err)
+		}
+		subnets[name] = *subnet
+	}
+	return subnets, nil
+}
+
+func sortedNames(subnets map[string]dhcpd.Subnet) []string {
+	var names []string
+	for name := range subnets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// poolSize returns the number of addresses from Start to End.
+func poolSize(subnet dhcpd.Subnet) uint32 {
+	start := net.IP(subnet.Start).To4()
+	end := net.IP(subnet.End).To4()
+	if start == nil || end == nil {
+		return 0
+	}
+	s, e := binary.BigEndian.Uint32(start), binary.BigEndian.Uint32(end)
+	if e < s {
+		return 0
+	}
+	return e - s + 1
+}
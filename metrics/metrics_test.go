@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/datastore/memory"
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/types"
+)
+
+func mustParseIP(t *testing.T, s string) types.IP {
+	t.Helper()
+	ip, err := types.ParseIP(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *ip
+}
+
+func mustParseCIDR(t *testing.T, s string) types.IPNet {
+	t.Helper()
+	n, err := types.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *n
+}
+
+// newDatastore returns a datastore with the subnets and a provisioning host.
+func newDatastore(t *testing.T) datastore.Datastore {
+	t.Helper()
+	ctx := context.Background()
+	naming, err := datastore.NewNaming("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := memory.New(naming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.CreateManagementSubnet(ctx, mustParseCIDR(t, "10.0.0.0/24"), mustParseIP(t, "10.0.0.1"), mustParseIP(t, "10.0.0.99"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.CreateServiceSubnet(ctx, mustParseCIDR(t, "192.168.0.0/24"), mustParseIP(t, "192.168.0.1"), mustParseIP(t, "192.168.0.10"), mustParseIP(t, "192.168.0.254"), mustParseIP(t, "8.8.8.8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := types.HardwareAddr(net.HardwareAddr{0x52, 0x54, 0x00, 0x00, 0x00, 0x01})
+	ml, err := ds.CreateLeaseFromManagementSubnet(ctx, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := ds.CreateLeaseFromServiceSubnet(ctx, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ds.RegisterHost(ctx, uuid.NewV5(uuid.NamespaceOID, "host-1"), "SN1", "product", "manufacturer", sl.ID, ml.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.UpdateHostState(ctx, h.ID, httpd.HostStateProvisioning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.Registry.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("content type = %s, want the text exposition format", ct)
+	}
+	return w.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	m.RegisterDatastore(newDatastore(t))
+	m.HTTPRequests.Inc("httpd", "/ipxe", "200")
+	m.HTTPRequests.Inc("httpd", "/ipxe", "200")
+	m.HTTPRequests.Inc("apid", "/api/v1/hosts/", "404")
+	m.HTTPDuration.Observe(0.003, "httpd", "/ipxe")
+	m.HTTPDuration.Observe(0.2, "httpd", "/ipxe")
+	m.ArtifactBytes.Add(1024, "dir/\"quoted\"\\\nname")
+
+	out := scrape(t, m)
+	for _, want := range []string{
+		"# HELP ursa_http_requests_total HTTP requests by server, handler and status code.\n# TYPE ursa_http_requests_total counter\n" +
+			"ursa_http_requests_total{server=\"apid\",handler=\"/api/v1/hosts/\",code=\"404\"} 1\n" +
+			"ursa_http_requests_total{server=\"httpd\",handler=\"/ipxe\",code=\"200\"} 2\n",
+		"# TYPE ursa_http_request_duration_seconds histogram\n",
+		"ursa_http_request_duration_seconds_bucket{server=\"httpd\",handler=\"/ipxe\",le=\"0.001\"} 0\n" +
+			"ursa_http_request_duration_seconds_bucket{server=\"httpd\",handler=\"/ipxe\",le=\"0.005\"} 1\n",
+		"ursa_http_request_duration_seconds_bucket{server=\"httpd\",handler=\"/ipxe\",le=\"0.25\"} 2\n",
+		"ursa_http_request_duration_seconds_bucket{server=\"httpd\",handler=\"/ipxe\",le=\"+Inf\"} 2\n" +
+			"ursa_http_request_duration_seconds_sum{server=\"httpd\",handler=\"/ipxe\"} 0.203\n" +
+			"ursa_http_request_duration_seconds_count{server=\"httpd\",handler=\"/ipxe\"} 2\n",
+		"ursa_http_artifact_bytes_total{artifact=\"dir/\\\"quoted\\\"\\\\\\nname\"} 1024\n",
+		"# TYPE ursa_pool_addresses gauge\nursa_pool_addresses{subnet=\"management\"} 99\nursa_pool_addresses{subnet=\"service\"} 10\n",
+		"ursa_pool_leases{subnet=\"management\"} 1\nursa_pool_leases{subnet=\"service\"} 1\n",
+		"# TYPE ursa_hosts gauge\nursa_hosts{state=\"discovered\"} 0\nursa_hosts{state=\"provisioning\"} 1\nursa_hosts{state=\"provisioned\"} 0\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("want %q in the metrics, but got:\n%s", want, out)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	if got, want := escapeLabel("a\"b\\c\nd"), `a\"b\\c\nd`; got != want {
+		t.Errorf("escapeLabel = %s, want %s", got, want)
+	}
+	if got, want := escapeHelp("a\"b\\c\nd"), `a"b\\c\nd`; got != want {
+		t.Errorf("escapeHelp = %s, want %s", got, want)
+	}
+}
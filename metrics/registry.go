@@ -0,0 +1,274 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Collector writes metrics in the Prometheus text exposition format.
+type Collector interface {
+	Write(ctx context.Context, w io.Writer) error
+}
+
+// Registry is a set of collectors served at /metrics.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// NewRegistry is
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds the collector. Collectors are written in registered order.
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// ServeHTTP serves the metrics of all collectors.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	collectors := append([]Collector{}, r.collectors...)
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		err := c.Write(req.Context(), bw)
+		if err != nil {
+			// the other metrics are still useful, so report the error as a comment
+			fmt.Fprintf(bw, "# failed to collect: %s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+		}
+	}
+	bw.Flush()
+}
+
+type series struct {
+	labels []string
+	value  float64
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*series
+}
+
+// NewCounterVec is
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: map[string]*series{},
+	}
+}
+
+// Inc increments the counter of the label values by 1.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter of the label values.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.values[key]
+	if !ok {
+		s = &series{labels: labelValues}
+		c.values[key] = s
+	}
+	s.value += v
+}
+
+// Write is
+func (c *CounterVec) Write(ctx context.Context, w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	var keys []string
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := c.values[key]
+		writeSample(w, c.name, c.labels, s.labels, s.value)
+	}
+	return nil
+}
+
+// DefaultBuckets are the upper bounds of histogram buckets in seconds.
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+// NewHistogramVec is
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  map[string]*histogram{},
+	}
+}
+
+// Observe adds the observation v to the histogram of the label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogram{labels: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// Write is
+func (h *HistogramVec) Write(ctx context.Context, w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	labels := append(append([]string{}, h.labels...), "le")
+	var keys []string
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.values[key]
+		for i, upper := range h.buckets {
+			writeSample(w, h.name+"_bucket", labels, append(append([]string{}, s.labels...), formatFloat(upper)), float64(s.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", labels, append(append([]string{}, s.labels...), "+Inf"), float64(s.count))
+		writeSample(w, h.name+"_sum", h.labels, s.labels, s.sum)
+		writeSample(w, h.name+"_count", h.labels, s.labels, float64(s.count))
+	}
+	return nil
+}
+
+// Sample is a value of GaugeFunc.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// GaugeFunc is a gauge that is computed by fn on every scrape.
+type GaugeFunc struct {
+	name   string
+	help   string
+	labels []string
+	fn     func(ctx context.Context) ([]Sample, error)
+}
+
+// NewGaugeFunc is
+func NewGaugeFunc(name, help string, fn func(ctx context.Context) ([]Sample, error), labels ...string) *GaugeFunc {
+	return &GaugeFunc{
+		name:   name,
+		help:   help,
+		labels: labels,
+		fn:     fn,
+	}
+}
+
+// Write is
+func (g *GaugeFunc) Write(ctx context.Context, w io.Writer) error {
+	samples, err := g.fn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to collect %s: %w", g.name, err)
+	}
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, s := range samples {
+		writeSample(w, g.name, g.labels, s.LabelValues, s.Value)
+	}
+	return nil
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, typ)
+}
+
+func writeSample(w io.Writer, name string, labels, values []string, v float64) {
+	io.WriteString(w, name)
+	if len(labels) != 0 {
+		io.WriteString(w, "{")
+		for i, l := range labels {
+			if i != 0 {
+				io.WriteString(w, ",")
+			}
+			var value string
+			if i < len(values) {
+				value = values[i]
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l, escapeLabel(value))
+		}
+		io.WriteString(w, "}")
+	}
+	fmt.Fprintf(w, " %s\n", formatFloat(v))
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
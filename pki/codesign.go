@@ -0,0 +1,163 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+)
+
+// SignatureSuffix is appended to the artifact path to make the path of the
+// detached signature.
+const SignatureSuffix = ".sig"
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+)
+
+// CodeSigner signs boot artifacts for iPXE imgverify.
+type CodeSigner struct {
+	cert *x509.Certificate
+	ca   *x509.Certificate
+	key  *rsa.PrivateKey
+}
+
+// LoadOrCreateCodeSigner loads the code signing certificate from dir. If
+// dir has no certificate, it is issued by the CA in dir.
+func LoadOrCreateCodeSigner(dir string) (*CodeSigner, error) {
+	pair, err := loadOrCreateLeaf(dir, CodeSignCertFile, CodeSignKeyFile, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "ursa code signing"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse code signing certificate: %w", err)
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported code signing key type %T", pair.PrivateKey)
+	}
+	ca, _, err := loadOrCreateCA(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &CodeSigner{
+		cert: cert,
+		ca:   ca,
+		key:  key,
+	}, nil
+}
+
+// SignFile writes the detached signature of path to path + SignatureSuffix.
+// The signature is not rewritten if it is newer than the file.
+func (c *CodeSigner) SignFile(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	si, err := os.Stat(path + SignatureSuffix)
+	if err == nil && si.ModTime().After(fi.ModTime()) {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	sig, err := c.Sign(f)
+	if err != nil {
+		return fmt.Errorf("failed to sign %s: %w", path, err)
+	}
+	err = ioutil.WriteFile(path+SignatureSuffix, sig, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write signature of %s: %w", path, err)
+	}
+	return nil
+}
+
+// Sign returns the DER encoded CMS detached signature of r. It is the
+// same format as `openssl cms -sign -binary -noattr -outform DER`.
+func (c *CodeSigner) Sign(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	sha256Algorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	certs := append(append([]byte{}, c.cert.Raw...), c.ca.Raw...)
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content: signedData{
+			Version:          1,
+			DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+			EncapContentInfo: encapContentInfo{EContentType: oidData},
+			Certificates: asn1.RawValue{
+				Class:      asn1.ClassContextSpecific,
+				Tag:        0,
+				IsCompound: true,
+				Bytes:      certs,
+			},
+			SignerInfos: []signerInfo{{
+				Version: 1,
+				SID: issuerAndSerialNumber{
+					Issuer:       asn1.RawValue{FullBytes: c.cert.RawIssuer},
+					SerialNumber: c.cert.SerialNumber,
+				},
+				DigestAlgorithm:    sha256Algorithm,
+				SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+				Signature:          signature,
+			}},
+		},
+	})
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     signedData `asn1:"explicit,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      []signerInfo `asn1:"set"`
+}
+
+type encapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerialNumber
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
@@ -0,0 +1,105 @@
+package pki
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// verify verifies the detached signature of data as iPXE imgverify does,
+// trusting only the CA in dir.
+func verify(t *testing.T, dir string, data, sig []byte) error {
+	t.Helper()
+	var ci contentInfo
+	rest, err := asn1.Unmarshal(sig, &ci)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 0 || !ci.ContentType.Equal(oidSignedData) || len(ci.Content.SignerInfos) != 1 {
+		t.Fatalf("unexpected signature: %+v", ci)
+	}
+	certs, err := x509.ParseCertificates(ci.Content.Certificates.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _, err := loadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	leaf := certs[0]
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}})
+	if err != nil {
+		return err
+	}
+	si := ci.Content.SignerInfos[0]
+	if si.SID.SerialNumber.Cmp(leaf.SerialNumber) != 0 || !bytes.Equal(si.SID.Issuer.FullBytes, leaf.RawIssuer) {
+		t.Fatalf("signer %+v is not the certificate %s", si.SID, leaf.Subject)
+	}
+	digest := sha256.Sum256(data)
+	return rsa.VerifyPKCS1v15(leaf.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], si.Signature)
+}
+
+func TestCodeSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ursa-pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	signer, err := LoadOrCreateCodeSigner(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("kernel")
+	path := filepath.Join(dir, "kernel")
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = signer.SignFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := ioutil.ReadFile(path + SignatureSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verify(t, dir, data, sig)
+	if err != nil {
+		t.Fatalf("failed to verify signature: %v", err)
+	}
+	if err := verify(t, dir, []byte("tampered"), sig); err == nil {
+		t.Fatal("want an error for the tampered data")
+	}
+
+	// The signer is loaded from dir, and signs by the same key.
+	loaded, err := LoadOrCreateCodeSigner(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.cert.Equal(signer.cert) {
+		t.Fatal("want the code signing certificate loaded")
+	}
+
+	// A signature trusted by another CA is rejected.
+	other, err := ioutil.TempDir("", "ursa-pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(other)
+	if _, _, err := loadOrCreateCA(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(t, other, data, sig); err == nil {
+		t.Fatal("want an error for another CA")
+	}
+}
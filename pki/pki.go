@@ -0,0 +1,178 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File names in the certificate directory.
+const (
+	CACertFile       = "ca.crt"
+	CAKeyFile        = "ca.key"
+	ServerCertFile   = "server.crt"
+	ServerKeyFile    = "server.key"
+	CodeSignCertFile = "codesign.crt"
+	CodeSignKeyFile  = "codesign.key"
+)
+
+const validity = 10 * 365 * 24 * time.Hour
+
+// RSA keys are used because iPXE verifies only RSA signatures.
+const keyBits = 2048
+
+// LoadOrCreate loads the server certificate from dir. If dir has no
+// certificate, a self-signed CA and a server certificate for ips are
+// generated and saved in dir. ca.crt can be embedded into a custom iPXE
+// build (make TRUST=ca.crt) to verify ursa.
+func LoadOrCreate(dir string, ips []net.IP) (tls.Certificate, error) {
+	return loadOrCreateLeaf(dir, ServerCertFile, ServerKeyFile, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "ursa"},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses: ips,
+	})
+}
+
+func loadOrCreateLeaf(dir, certFile, keyFile string, tmpl *x509.Certificate) (tls.Certificate, error) {
+	certPath := filepath.Join(dir, certFile)
+	keyPath := filepath.Join(dir, keyFile)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil {
+		return cert, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return tls.Certificate{}, fmt.Errorf("failed to load %s: %w", certFile, err)
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	ca, caKey, err := loadOrCreateCA(dir)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+	tmpl.SerialNumber, err = newSerialNumber()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl.NotBefore = now.Add(-time.Hour)
+	tmpl.NotAfter = now.Add(validity)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	err = writeCertificate(certPath, der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	err = writeKey(keyPath, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
+
+func loadOrCreateCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	certPath := filepath.Join(dir, CACertFile)
+	keyPath := filepath.Join(dir, CAKeyFile)
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil {
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+		}
+		key, ok := pair.PrivateKey.(crypto.Signer)
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported CA key type %T", pair.PrivateKey)
+		}
+		return ca, key, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("failed to load CA certificate: %w", err)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate CA key: %w", err)
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "ursa CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	err = writeCertificate(certPath, der)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = writeKey(keyPath, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+	return ca, key, nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial, nil
+}
+
+func writeCertificate(path string, der []byte) error {
+	out := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	err := ioutil.WriteFile(path, out, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+func writeKey(path string, key crypto.PrivateKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %w", err)
+	}
+	out := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	err = ioutil.WriteFile(path, out, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
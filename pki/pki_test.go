@@ -0,0 +1,97 @@
+package pki
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ip := net.ParseIP("127.0.0.1")
+
+	cert, err := LoadOrCreate(filepath.Join(dir, "certs"), []net.IP{ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{CAKeyFile, ServerKeyFile} {
+		fi, err := os.Stat(filepath.Join(dir, "certs", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("mode of %s = %o, want 0600", name, fi.Mode().Perm())
+		}
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// The client trusts only the CA in dir.
+	pem, err := ioutil.ReadFile(filepath.Join(dir, "certs", CACertFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		t.Fatal("failed to parse ca.crt")
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("body = %q, want ok", body)
+	}
+
+	// A client trusting another CA rejects the server.
+	other, err := ioutil.TempDir("", "pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(other)
+	ca, _, err := loadOrCreateCA(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots = x509.NewCertPool()
+	roots.AddCert(ca)
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if _, err := client.Get(srv.URL); err == nil {
+		t.Error("want an error trusting another CA")
+	}
+
+	// The certificates are loaded again rather than regenerated.
+	reloaded, err := LoadOrCreate(filepath.Join(dir, "certs"), []net.IP{ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reloaded.Certificate[0], cert.Certificate[0]) {
+		t.Error("want the same certificate after reload")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.IsCA || len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(ip) {
+		t.Errorf("leaf = %+v, want a server certificate for %s", leaf, ip)
+	}
+}
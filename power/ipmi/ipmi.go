@@ -0,0 +1,83 @@
+package ipmi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/lovi-cloud/ursa/power"
+)
+
+// IPMI controls the BMC by ipmitool over IPMI v2.0 (lanplus).
+type IPMI struct {
+	address  string
+	username string
+	password string
+}
+
+// New is
+func New(address, username, password string) (power.Driver, error) {
+	if _, err := exec.LookPath("ipmitool"); err != nil {
+		return nil, fmt.Errorf("failed to find ipmitool: %w", err)
+	}
+	return &IPMI{
+		address:  address,
+		username: username,
+		password: password,
+	}, nil
+}
+
+// PowerOn is
+func (i *IPMI) PowerOn(ctx context.Context) error {
+	_, err := i.run(ctx, "chassis", "power", "on")
+	return err
+}
+
+// PowerOff is
+func (i *IPMI) PowerOff(ctx context.Context) error {
+	_, err := i.run(ctx, "chassis", "power", "off")
+	return err
+}
+
+// PowerCycle is
+func (i *IPMI) PowerCycle(ctx context.Context) error {
+	_, err := i.run(ctx, "chassis", "power", "cycle")
+	return err
+}
+
+// PowerState is
+func (i *IPMI) PowerState(ctx context.Context) (string, error) {
+	out, err := i.run(ctx, "chassis", "power", "status")
+	if err != nil {
+		return power.StateUnknown, err
+	}
+	switch {
+	case strings.HasSuffix(strings.TrimSpace(out), "is on"):
+		return power.StateOn, nil
+	case strings.HasSuffix(strings.TrimSpace(out), "is off"):
+		return power.StateOff, nil
+	}
+	return power.StateUnknown, nil
+}
+
+// SetNextBootPXE is
+func (i *IPMI) SetNextBootPXE(ctx context.Context) error {
+	_, err := i.run(ctx, "chassis", "bootdev", "pxe")
+	return err
+}
+
+func (i *IPMI) run(ctx context.Context, args ...string) (string, error) {
+	// -E reads the password from IPMI_PASSWORD not to show it in the process list.
+	args = append([]string{"-I", "lanplus", "-H", i.address, "-U", i.username, "-E"}, args...)
+	cmd := exec.CommandContext(ctx, "ipmitool", args...)
+	cmd.Env = append(os.Environ(), "IPMI_PASSWORD="+i.password)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to exec [ipmitool %s] msg=%s: %w", strings.Join(args, " "), string(out), err)
+	}
+	return string(out), nil
+}
+
+var _ power.Driver = &IPMI{}
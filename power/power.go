@@ -0,0 +1,21 @@
+package power
+
+import "context"
+
+// Power states
+const (
+	StateOn      = "on"
+	StateOff     = "off"
+	StateUnknown = "unknown"
+)
+
+// Driver is the interface for usra to control the power of a host through
+// its BMC.
+type Driver interface {
+	PowerOn(ctx context.Context) error
+	PowerOff(ctx context.Context) error
+	PowerCycle(ctx context.Context) error
+	PowerState(ctx context.Context) (string, error)
+	// SetNextBootPXE makes the host boot from the network once.
+	SetNextBootPXE(ctx context.Context) error
+}
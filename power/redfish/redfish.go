@@ -0,0 +1,174 @@
+package redfish
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lovi-cloud/ursa/power"
+)
+
+// Redfish controls the BMC by the Redfish API.
+type Redfish struct {
+	endpoint string
+	username string
+	password string
+	client   *http.Client
+}
+
+// New is. address is a host name or a URL of the BMC. If insecure is true,
+// the certificate of the BMC is not verified.
+func New(address, username, password string, insecure bool) (power.Driver, error) {
+	endpoint := address
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	return &Redfish{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		username: username,
+		password: password,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+			},
+		},
+	}, nil
+}
+
+type odataID struct {
+	ID string `json:"@odata.id"`
+}
+
+type collection struct {
+	Members []odataID `json:"Members"`
+}
+
+type computerSystem struct {
+	PowerState string `json:"PowerState"`
+}
+
+// PowerOn is
+func (r *Redfish) PowerOn(ctx context.Context) error {
+	return r.reset(ctx, "On")
+}
+
+// PowerOff is
+func (r *Redfish) PowerOff(ctx context.Context) error {
+	return r.reset(ctx, "ForceOff")
+}
+
+// PowerCycle restarts the host, or powers it on if it is off.
+func (r *Redfish) PowerCycle(ctx context.Context) error {
+	state, err := r.PowerState(ctx)
+	if err != nil {
+		return err
+	}
+	if state == power.StateOff {
+		return r.reset(ctx, "On")
+	}
+	return r.reset(ctx, "ForceRestart")
+}
+
+// PowerState is
+func (r *Redfish) PowerState(ctx context.Context) (string, error) {
+	system, err := r.system(ctx)
+	if err != nil {
+		return power.StateUnknown, err
+	}
+	var cs computerSystem
+	err = r.do(ctx, http.MethodGet, system, nil, &cs)
+	if err != nil {
+		return power.StateUnknown, err
+	}
+	// A host that is powering on or off is still reported as on, so that
+	// it is not powered on again.
+	switch cs.PowerState {
+	case "On", "PoweringOn", "PoweringOff":
+		return power.StateOn, nil
+	case "Off":
+		return power.StateOff, nil
+	}
+	return power.StateUnknown, nil
+}
+
+// SetNextBootPXE is
+func (r *Redfish) SetNextBootPXE(ctx context.Context) error {
+	system, err := r.system(ctx)
+	if err != nil {
+		return err
+	}
+	body := map[string]interface{}{
+		"Boot": map[string]string{
+			"BootSourceOverrideTarget":  "Pxe",
+			"BootSourceOverrideEnabled": "Once",
+		},
+	}
+	return r.do(ctx, http.MethodPatch, system, body, nil)
+}
+
+func (r *Redfish) reset(ctx context.Context, resetType string) error {
+	system, err := r.system(ctx)
+	if err != nil {
+		return err
+	}
+	body := map[string]string{"ResetType": resetType}
+	return r.do(ctx, http.MethodPost, system+"/Actions/ComputerSystem.Reset", body, nil)
+}
+
+// system returns the path of the first computer system.
+func (r *Redfish) system(ctx context.Context) (string, error) {
+	var systems collection
+	err := r.do(ctx, http.MethodGet, "/redfish/v1/Systems", nil, &systems)
+	if err != nil {
+		return "", err
+	}
+	if len(systems.Members) == 0 {
+		return "", fmt.Errorf("failed to find computer system")
+	}
+	return systems.Members[0].ID, nil
+}
+
+func (r *Redfish) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.endpoint+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.SetBasicAuth(r.username, r.password)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("failed to request %s %s: status=%d msg=%s", method, path, resp.StatusCode, string(msg))
+	}
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	return nil
+}
+
+var _ power.Driver = &Redfish{}
@@ -0,0 +1,143 @@
+package redfish
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/lovi-cloud/ursa/power"
+)
+
+// mockBMC is a Redfish service of a computer system.
+type mockBMC struct {
+	mu         sync.Mutex
+	powerState string
+	resets     []string
+	boot       map[string]string
+}
+
+func (m *mockBMC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, p, ok := r.BasicAuth(); !ok || u != "admin" || p != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/redfish/v1/Systems":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Members": []map[string]string{{"@odata.id": "/redfish/v1/Systems/1"}},
+		})
+	case r.Method == http.MethodGet && r.URL.Path == "/redfish/v1/Systems/1":
+		json.NewEncoder(w).Encode(map[string]string{"PowerState": m.powerState})
+	case r.Method == http.MethodPatch && r.URL.Path == "/redfish/v1/Systems/1":
+		var body struct {
+			Boot map[string]string `json:"Boot"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m.boot = body.Boot
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && r.URL.Path == "/redfish/v1/Systems/1/Actions/ComputerSystem.Reset":
+		var body struct {
+			ResetType string `json:"ResetType"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m.resets = append(m.resets, body.ResetType)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newDriver(t *testing.T, bmc *mockBMC, password string) power.Driver {
+	t.Helper()
+	srv := httptest.NewServer(bmc)
+	t.Cleanup(srv.Close)
+	d, err := New(srv.URL, "admin", password, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestPower(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name       string
+		powerState string
+		do         func(d power.Driver) error
+		want       []string
+	}{
+		{"on", "Off", func(d power.Driver) error { return d.PowerOn(ctx) }, []string{"On"}},
+		{"off", "On", func(d power.Driver) error { return d.PowerOff(ctx) }, []string{"ForceOff"}},
+		{"cycle", "On", func(d power.Driver) error { return d.PowerCycle(ctx) }, []string{"ForceRestart"}},
+		{"cycle off", "Off", func(d power.Driver) error { return d.PowerCycle(ctx) }, []string{"On"}},
+		{"cycle powering on", "PoweringOn", func(d power.Driver) error { return d.PowerCycle(ctx) }, []string{"ForceRestart"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bmc := &mockBMC{powerState: tc.powerState}
+			err := tc.do(newDriver(t, bmc, "secret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(bmc.resets, tc.want) {
+				t.Fatalf("want %v, but got %v", tc.want, bmc.resets)
+			}
+		})
+	}
+}
+
+func TestPowerState(t *testing.T) {
+	for powerState, want := range map[string]string{
+		"On":          power.StateOn,
+		"Off":         power.StateOff,
+		"PoweringOn":  power.StateOn,
+		"PoweringOff": power.StateOn,
+		"":            power.StateUnknown,
+	} {
+		state, err := newDriver(t, &mockBMC{powerState: powerState}, "secret").PowerState(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != want {
+			t.Errorf("want %s for %q, but got %s", want, powerState, state)
+		}
+	}
+}
+
+func TestSetNextBootPXE(t *testing.T) {
+	bmc := &mockBMC{powerState: "On"}
+	err := newDriver(t, bmc, "secret").SetNextBootPXE(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"BootSourceOverrideTarget": "Pxe", "BootSourceOverrideEnabled": "Once"}
+	if !reflect.DeepEqual(bmc.boot, want) {
+		t.Fatalf("want %v, but got %v", want, bmc.boot)
+	}
+	if len(bmc.resets) != 0 {
+		t.Fatalf("want no reset, but got %v", bmc.resets)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	bmc := &mockBMC{powerState: "Off"}
+	err := newDriver(t, bmc, "wrong").PowerOn(context.Background())
+	if err == nil {
+		t.Fatal("want an error for the wrong password")
+	}
+	if len(bmc.resets) != 0 {
+		t.Fatalf("want no reset, but got %v", bmc.resets)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"path/filepath"
+	"strconv"
 
 	"go.uber.org/zap"
 	"go.universe.tf/netboot/tftp"
@@ -14,20 +15,30 @@ import (
 	// import ipxe.efi
 	_ "github.com/lovi-cloud/ursa/tftpd/statik"
 
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/httpd"
+	"github.com/lovi-cloud/ursa/metrics"
 	"github.com/lovi-cloud/ursa/tftpd"
+	"github.com/lovi-cloud/ursa/trace"
 )
 
 // Netboot is
 type Netboot struct {
-	fs     http.FileSystem
-	logger *zap.Logger
+	fs      http.FileSystem
+	ds      datastore.Datastore
+	logger  *zap.Logger
+	metrics *metrics.Metrics
+	tracer  *trace.Tracer
 }
 
 // New is
-func New(fs http.FileSystem, logger *zap.Logger) (tftpd.TFTPd, error) {
+func New(fs http.FileSystem, ds datastore.Datastore, logger *zap.Logger, m *metrics.Metrics, tracer *trace.Tracer) (tftpd.TFTPd, error) {
 	return &Netboot{
-		fs:     fs,
-		logger: logger,
+		fs:      fs,
+		ds:      ds,
+		logger:  logger,
+		metrics: m,
+		tracer:  tracer,
 	}, nil
 }
 
@@ -47,23 +58,81 @@ func (n *Netboot) Serve(ctx context.Context, addr string) error {
 		TransferLog: func(clientAddr net.Addr, path string, err error) {
 			if err != nil {
 				n.logger.Error("transfer", zap.String("path", path), zap.String("client", clientAddr.String()), zap.Error(err))
+				n.metrics.TFTPTransfers.Inc("error")
 			} else {
 				n.logger.Info("transfer", zap.String("path", path), zap.String("client", clientAddr.String()))
+				n.metrics.TFTPTransfers.Inc("success")
 			}
+			n.recordBootEvent(clientAddr, path, err)
 		},
 	}
 
 	return server.Serve(l)
 }
 
+// recordBootEvent records the transfer in the boot timeline of the client.
+func (n *Netboot) recordBootEvent(clientAddr net.Addr, path string, err error) {
+	e := httpd.BootEvent{
+		Protocol: httpd.BootEventProtocolTFTP,
+		Name:     path,
+		Outcome:  httpd.BootEventOutcomeOK,
+	}
+	if addr, ok := clientAddr.(*net.UDPAddr); ok {
+		e.IPAddress = addr.IP.String()
+	}
+	if err != nil {
+		e.Outcome = httpd.BootEventOutcomeError
+		e.Detail = err.Error()
+	}
+	if err := n.ds.RecordBootEvent(context.Background(), e); err != nil {
+		n.logger.Warn("failed to record boot event", zap.Error(err))
+	}
+}
+
 func (n *Netboot) handler(path string, clientAddr net.Addr) (io.ReadCloser, int64, error) {
+	var key trace.BootKey
+	if addr, ok := clientAddr.(*net.UDPAddr); ok {
+		key.IP = addr.IP
+	}
+	_, span := n.tracer.StartBoot(context.Background(), key, "tftp "+path)
+
 	f, err := n.fs.Open(filepath.Join("/", path))
 	if err != nil {
-		return nil, -1, fmt.Errorf("failed to open path %s: %w", path, err)
+		err = fmt.Errorf("failed to open path %s: %w", path, err)
+		span.SetError(err)
+		span.End()
+		return nil, -1, err
 	}
 	s, err := f.Stat()
 	if err != nil {
-		return nil, -1, fmt.Errorf("faield to get %s stat: %w", path, err)
+		err = fmt.Errorf("faield to get %s stat: %w", path, err)
+		span.SetError(err)
+		span.End()
+		return nil, -1, err
 	}
-	return f, s.Size(), nil
+	return &countingReader{ReadCloser: f, file: path, bytes: n.metrics.TFTPBytes, span: span}, s.Size(), nil
+}
+
+// countingReader counts the bytes read from the file. Only files that
+// exist are counted, so the file label is bounded. The span of the transfer
+// ends when the file is closed.
+type countingReader struct {
+	io.ReadCloser
+	file  string
+	bytes *metrics.CounterVec
+	span  *trace.Span
+	read  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes.Add(float64(n), r.file)
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *countingReader) Close() error {
+	r.span.SetAttribute("tftp.bytes", strconv.FormatInt(r.read, 10))
+	r.span.End()
+	return r.ReadCloser.Close()
 }
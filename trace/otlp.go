@@ -0,0 +1,144 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	serviceName = "ursa"
+
+	spanKindInternal = 1
+	spanKindServer   = 2
+	statusCodeOK     = 1
+	statusCodeError  = 2
+)
+
+// exporter exports spans by OTLP/HTTP with the JSON encoding.
+type exporter struct {
+	url    string
+	client *http.Client
+}
+
+func newExporter(endpoint string) (*exporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %s", endpoint)
+	}
+	return &exporter{
+		url:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func newOTLPSpan(s *Span) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	span := otlpSpan{
+		TraceID:           hexID(s.traceID[:]),
+		SpanID:            hexID(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: statusCodeOK},
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hexID(s.parentID[:])
+	}
+	for k, v := range s.attributes {
+		span.Attributes = append(span.Attributes, otlpAttribute{Key: k, Value: otlpValue{StringValue: v}})
+	}
+	if s.err != nil {
+		span.Status = otlpStatus{Code: statusCodeError, Message: s.err.Error()}
+	}
+	return span
+}
+
+func (e *exporter) export(ctx context.Context, spans []*Span) error {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: serviceName}}
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, newOTLPSpan(s))
+	}
+	body, err := json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: serviceName}}},
+			},
+			ScopeSpans: []otlpScopeSpans{scope},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal spans: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post spans: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to post spans: status=%d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lovi-cloud/ursa/datastore"
+)
+
+const (
+	// bootTimeout ends the boot trace that has no activity.
+	bootTimeout = 10 * time.Minute
+	// flushInterval is the interval to export the ended spans.
+	flushInterval = 5 * time.Second
+)
+
+// Span is an operation in a trace. The methods of a nil Span do nothing, so
+// callers do not need to check whether the operation is traced.
+type Span struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        error
+	tracer     *Tracer
+
+	mu sync.Mutex
+}
+
+// SetAttribute is
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// End ends the span and queues it to be exported.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.queue(s)
+}
+
+type spanContextKey struct{}
+
+// FromContext returns the span in ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanContextKey{}).(*Span)
+	return s
+}
+
+// BootKey identifies the boot of a host. A boot is started by the MAC
+// address, and the IP address and the host UUID are bound to it as they
+// become known.
+type BootKey struct {
+	MAC  net.HardwareAddr
+	IP   net.IP
+	UUID string
+}
+
+type boot struct {
+	root     *Span
+	keys     []string
+	activeAt time.Time
+}
+
+// Tracer traces the boot of hosts. A boot is a trace whose root span lasts
+// from the first request of the host until the host phones home or stops
+// talking to ursa. The methods of a nil Tracer do nothing.
+type Tracer struct {
+	exporter *exporter
+	logger   *zap.Logger
+
+	mu    sync.Mutex
+	boots map[string]*boot
+	ended []*Span
+}
+
+// New returns the tracer that exports spans by OTLP/HTTP to endpoint
+// (e.g. http://127.0.0.1:4318).
+func New(endpoint string, logger *zap.Logger) (*Tracer, error) {
+	exporter, err := newExporter(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracer{
+		exporter: exporter,
+		logger:   logger,
+		boots:    map[string]*boot{},
+	}, nil
+}
+
+func bootIndexes(key BootKey) []string {
+	var keys []string
+	if len(key.MAC) != 0 {
+		keys = append(keys, "mac/"+key.MAC.String())
+	}
+	if key.UUID != "" {
+		keys = append(keys, "uuid/"+key.UUID)
+	}
+	if len(key.IP) != 0 && !key.IP.IsUnspecified() {
+		keys = append(keys, "ip/"+key.IP.String())
+	}
+	return keys
+}
+
+// StartBoot starts the span of the boot identified by key. A new boot is
+// started only if key has the MAC address, otherwise the span is nil if no
+// boot is found.
+func (t *Tracer) StartBoot(ctx context.Context, key BootKey, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.getBoot(key, true)
+	if b == nil {
+		return ctx, nil
+	}
+	span := t.newSpan(b.root, name)
+	span.kind = spanKindServer
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// BindBoot binds the keys to the boot found by key, so that later requests
+// are traced by any of them.
+func (t *Tracer) BindBoot(key BootKey) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.getBoot(key, false)
+}
+
+// getBoot returns the boot of key and binds the keys to it. It must be
+// called with t.mu held.
+func (t *Tracer) getBoot(key BootKey, create bool) *boot {
+	indexes := bootIndexes(key)
+	var b *boot
+	for _, index := range indexes {
+		if b = t.boots[index]; b != nil {
+			break
+		}
+	}
+	if b == nil {
+		if !create || len(key.MAC) == 0 {
+			return nil
+		}
+		b = &boot{root: t.newSpan(nil, "boot")}
+		b.root.attributes["host.mac"] = key.MAC.String()
+	}
+	for _, index := range indexes {
+		if other, ok := t.boots[index]; ok && other != b {
+			// the key was bound to a stale boot, e.g. the address is reused
+			t.removeIndex(other, index)
+		}
+		if _, ok := t.boots[index]; !ok {
+			t.boots[index] = b
+			b.keys = append(b.keys, index)
+		}
+	}
+	if len(key.IP) != 0 {
+		b.root.SetAttribute("host.ip", key.IP.String())
+	}
+	if key.UUID != "" {
+		b.root.SetAttribute("host.uuid", key.UUID)
+	}
+	b.activeAt = time.Now()
+	return b
+}
+
+// removeIndex must be called with t.mu held.
+func (t *Tracer) removeIndex(b *boot, index string) {
+	delete(t.boots, index)
+	for i, k := range b.keys {
+		if k == index {
+			b.keys = append(b.keys[:i], b.keys[i+1:]...)
+			break
+		}
+	}
+	if len(b.keys) == 0 {
+		// nothing can reach the boot anymore, so end it here
+		b.root.mu.Lock()
+		b.root.end = time.Now()
+		b.root.mu.Unlock()
+		t.ended = append(t.ended, b.root)
+	}
+}
+
+// EndBoot ends the boot identified by key. err is recorded to the root span
+// if the boot failed.
+func (t *Tracer) EndBoot(key BootKey, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	var b *boot
+	for _, index := range bootIndexes(key) {
+		if b = t.boots[index]; b != nil {
+			break
+		}
+	}
+	if b != nil {
+		t.removeBoot(b)
+	}
+	t.mu.Unlock()
+
+	if b != nil {
+		b.root.SetError(err)
+		b.root.End()
+	}
+}
+
+// removeBoot must be called with t.mu held.
+func (t *Tracer) removeBoot(b *boot) {
+	for _, index := range b.keys {
+		delete(t.boots, index)
+	}
+}
+
+// Start starts the child span of the span in ctx. If ctx has no span, the
+// span is nil.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := t.newSpan(parent, name)
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+func (t *Tracer) newSpan(parent *Span, name string) *Span {
+	s := &Span{
+		name:       name,
+		kind:       spanKindInternal,
+		start:      time.Now(),
+		attributes: map[string]string{},
+		tracer:     t,
+	}
+	rand.Read(s.spanID[:])
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	return s
+}
+
+// DatastoreHook returns the hook that traces datastore methods as children
+// of the span in the context.
+func (t *Tracer) DatastoreHook() datastore.Hook {
+	return func(ctx context.Context, method string) (context.Context, func(err error)) {
+		ctx, span := t.Start(ctx, "datastore "+method)
+		return ctx, func(err error) {
+			span.SetError(err)
+			span.End()
+		}
+	}
+}
+
+func (t *Tracer) queue(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ended = append(t.ended, s)
+}
+
+// Run exports the ended spans and ends the idle boots until ctx is done.
+func (t *Tracer) Run(ctx context.Context) error {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.expire(time.Now().Add(-bootTimeout))
+			t.flush(ctx)
+		case <-ctx.Done():
+			t.flush(context.Background())
+			return nil
+		}
+	}
+}
+
+func (t *Tracer) expire(before time.Time) {
+	t.mu.Lock()
+	var idle []*boot
+	seen := map[*boot]bool{}
+	for _, b := range t.boots {
+		if !seen[b] && b.activeAt.Before(before) {
+			idle = append(idle, b)
+		}
+		seen[b] = true
+	}
+	for _, b := range idle {
+		t.removeBoot(b)
+	}
+	t.mu.Unlock()
+
+	for _, b := range idle {
+		b.root.SetAttribute("boot.timeout", "true")
+		b.root.End()
+	}
+}
+
+func (t *Tracer) flush(ctx context.Context) {
+	t.mu.Lock()
+	spans := t.ended
+	t.ended = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	err := t.exporter.export(ctx, spans)
+	if err != nil {
+		t.logger.Warn("failed to export spans", zap.Int("spans", len(spans)), zap.Error(err))
+	}
+}
+
+func hexID(id []byte) string {
+	return hex.EncodeToString(id)
+}
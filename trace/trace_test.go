@@ -0,0 +1,208 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// collector is an OTLP/HTTP collector that keeps the exported spans.
+type collector struct {
+	requests chan otlpRequest
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var req otlpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.requests <- req
+}
+
+func newTracer(t *testing.T) (*Tracer, *collector, func()) {
+	t.Helper()
+	c := &collector{requests: make(chan otlpRequest, 1)}
+	srv := httptest.NewServer(c)
+	tracer, err := New(srv.URL+"/", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tracer, c, srv.Close
+}
+
+// exported flushes the ended spans and returns them by name.
+func exported(t *testing.T, tracer *Tracer, c *collector) map[string]otlpSpan {
+	t.Helper()
+	tracer.flush(context.Background())
+	var req otlpRequest
+	select {
+	case req = <-c.requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the export")
+	}
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+	rs := req.ResourceSpans[0]
+	if attrs := rs.Resource.Attributes; len(attrs) != 1 || attrs[0].Key != "service.name" || attrs[0].Value.StringValue != serviceName {
+		t.Fatalf("unexpected resource: %+v", rs.Resource)
+	}
+	spans := map[string]otlpSpan{}
+	for _, s := range rs.ScopeSpans[0].Spans {
+		spans[s.Name] = s
+	}
+	return spans
+}
+
+func attribute(s otlpSpan, key string) string {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value.StringValue
+		}
+	}
+	return ""
+}
+
+func TestBoot(t *testing.T) {
+	tracer, c, done := newTracer(t)
+	defer done()
+	ctx := context.Background()
+	mac, _ := net.ParseMAC("52:54:00:00:00:01")
+	ip := net.ParseIP("10.0.0.10")
+	uuid := "4c4c4544-0000-0000-0000-000000000001"
+
+	// A request of an unknown address does not start a boot.
+	if _, span := tracer.StartBoot(ctx, BootKey{IP: ip}, "tftp undionly.kpxe"); span != nil {
+		t.Fatal("want no span without the MAC address")
+	}
+
+	// DHCP starts the boot by the MAC address and binds the offered address.
+	_, dhcp := tracer.StartBoot(ctx, BootKey{MAC: mac}, "dhcp discover")
+	dhcp.End()
+	tracer.BindBoot(BootKey{MAC: mac, IP: ip})
+	// TFTP is joined by the address.
+	_, tftp := tracer.StartBoot(ctx, BootKey{IP: ip}, "tftp undionly.kpxe")
+	tftp.SetAttribute("tftp.file", "undionly.kpxe")
+	tftp.End()
+	// HTTP binds the UUID, and the datastore is traced as its child.
+	httpCtx, ipxe := tracer.StartBoot(ctx, BootKey{MAC: mac, IP: ip, UUID: uuid}, "http /ipxe")
+	_, ds := tracer.Start(httpCtx, "datastore GetHostByUUID")
+	ds.SetError(errors.New("not found"))
+	ds.End()
+	ipxe.End()
+	// The phone home is joined by the UUID and ends the boot.
+	_, phoneHome := tracer.StartBoot(ctx, BootKey{UUID: uuid}, "http /init/")
+	phoneHome.End()
+	tracer.EndBoot(BootKey{UUID: uuid}, nil)
+	if _, span := tracer.StartBoot(ctx, BootKey{IP: ip}, "tftp undionly.kpxe"); span != nil {
+		t.Fatal("want no span after the boot ended")
+	}
+
+	spans := exported(t, tracer, c)
+	root, ok := spans["boot"]
+	if !ok || len(spans) != 6 {
+		t.Fatalf("want the boot and 5 spans, but got %+v", spans)
+	}
+	if root.ParentSpanID != "" || attribute(root, "host.mac") != mac.String() || attribute(root, "host.ip") != ip.String() || attribute(root, "host.uuid") != uuid {
+		t.Errorf("root span = %+v, want correlated by mac, ip and uuid", root)
+	}
+	for name, s := range spans {
+		if s.TraceID != root.TraceID || len(s.TraceID) != 32 || len(s.SpanID) != 16 {
+			t.Errorf("span %s = %+v, want in the trace %s", name, s, root.TraceID)
+		}
+		if s.StartTimeUnixNano == "" || s.EndTimeUnixNano < s.StartTimeUnixNano {
+			t.Errorf("span %s has invalid time %s - %s", name, s.StartTimeUnixNano, s.EndTimeUnixNano)
+		}
+	}
+	for _, name := range []string{"dhcp discover", "tftp undionly.kpxe", "http /ipxe", "http /init/"} {
+		if s := spans[name]; s.ParentSpanID != root.SpanID || s.Kind != spanKindServer {
+			t.Errorf("span %s = %+v, want a server span of the boot", name, s)
+		}
+	}
+	if got := attribute(spans["tftp undionly.kpxe"], "tftp.file"); got != "undionly.kpxe" {
+		t.Errorf("tftp.file = %s, want undionly.kpxe", got)
+	}
+	child := spans["datastore GetHostByUUID"]
+	if child.ParentSpanID != spans["http /ipxe"].SpanID || child.Kind != spanKindInternal || child.Status.Code != statusCodeError || child.Status.Message != "not found" {
+		t.Errorf("datastore span = %+v, want a failed child of http /ipxe", child)
+	}
+	if root.Status.Code != statusCodeOK {
+		t.Errorf("root status = %+v, want ok", root.Status)
+	}
+}
+
+func TestBootTimeout(t *testing.T) {
+	tracer, c, done := newTracer(t)
+	defer done()
+	ctx := context.Background()
+	mac, _ := net.ParseMAC("52:54:00:00:00:02")
+	ip := net.ParseIP("10.0.0.11")
+
+	_, dhcp := tracer.StartBoot(ctx, BootKey{MAC: mac, IP: ip}, "dhcp request")
+	dhcp.End()
+	// The boot active within the timeout is kept.
+	tracer.expire(time.Now().Add(-bootTimeout))
+	if _, span := tracer.StartBoot(ctx, BootKey{IP: ip}, "tftp ipxe.efi"); span == nil {
+		t.Fatal("want the boot kept within the timeout")
+	} else {
+		span.End()
+	}
+
+	// The boot idle for the timeout is ended.
+	tracer.expire(time.Now().Add(time.Second))
+	if _, span := tracer.StartBoot(ctx, BootKey{IP: ip}, "tftp ipxe.efi"); span != nil {
+		t.Fatal("want no span after the boot timed out")
+	}
+	spans := exported(t, tracer, c)
+	if root := spans["boot"]; attribute(root, "boot.timeout") != "true" || attribute(root, "host.mac") != mac.String() {
+		t.Fatalf("root span = %+v, want timed out", root)
+	}
+	if bootTimeout != 10*time.Minute {
+		t.Errorf("boot timeout = %s, want 10m", bootTimeout)
+	}
+}
+
+func TestExportError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	e, err := newExporter(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := &Tracer{}
+	span := tracer.newSpan(nil, "boot")
+	span.end = span.start
+	if err := e.export(context.Background(), []*Span{span}); err == nil {
+		t.Fatal("want an error for 503")
+	}
+	if _, err := newExporter("127.0.0.1:4318"); err == nil {
+		t.Fatal("want an error for the endpoint without scheme")
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.StartBoot(context.Background(), BootKey{}, "boot")
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("error"))
+	span.End()
+	tracer.BindBoot(BootKey{})
+	tracer.EndBoot(BootKey{}, nil)
+	if FromContext(ctx) != nil {
+		t.Fatal("want no span in the context")
+	}
+}
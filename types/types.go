@@ -2,6 +2,7 @@ package types
 
 import (
 	"database/sql/driver"
+	"encoding/json"
 	"fmt"
 	"net"
 )
@@ -38,6 +39,25 @@ func (i *IPNet) String() string {
 	return ipNet.String()
 }
 
+// MarshalJSON is
+func (i IPNet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(i.String())
+}
+
+// UnmarshalJSON is
+func (i *IPNet) UnmarshalJSON(b []byte) error {
+	var buff string
+	if err := json.Unmarshal(b, &buff); err != nil {
+		return err
+	}
+	tmp, err := ParseCIDR(buff)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal IPNet: input=\"%s\"", buff)
+	}
+	*i = *tmp
+	return nil
+}
+
 // IPMask is net.IPMask with the implementation of the Valuer and Scanner interface.
 type IPMask net.IPMask
 
@@ -128,6 +148,25 @@ func (i IP) MarshalYAML() (interface{}, error) {
 	return net.IP(i).String(), nil
 }
 
+// MarshalJSON is
+func (i IP) MarshalJSON() ([]byte, error) {
+	return json.Marshal(i.String())
+}
+
+// UnmarshalJSON is
+func (i *IP) UnmarshalJSON(b []byte) error {
+	var buff string
+	if err := json.Unmarshal(b, &buff); err != nil {
+		return err
+	}
+	tmp, err := ParseIP(buff)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal IP: input=\"%s\"", buff)
+	}
+	*i = *tmp
+	return nil
+}
+
 // UnmarshalYAML is
 func (i *IP) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var buff string
@@ -173,6 +212,25 @@ func (h HardwareAddr) String() string {
 	return net.HardwareAddr(h).String()
 }
 
+// MarshalJSON is
+func (h HardwareAddr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.String())
+}
+
+// UnmarshalJSON is
+func (h *HardwareAddr) UnmarshalJSON(b []byte) error {
+	var buff string
+	if err := json.Unmarshal(b, &buff); err != nil {
+		return err
+	}
+	tmp, err := ParseMAC(buff)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal HardwareAddr: input=\"%s\"", buff)
+	}
+	*h = *tmp
+	return nil
+}
+
 // ParseCIDR is
 func ParseCIDR(s string) (*IPNet, error) {
 	_, n, err := net.ParseCIDR(s)
@@ -1,29 +1,42 @@
 package ursa
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"os"
 	"strings"
-
-	sqlite3 "github.com/mattn/go-sqlite3"
+	"time"
 
 	"github.com/rakyll/statik/fs"
 
-
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/lovi-cloud/ursa/apid/goapid"
+	"github.com/lovi-cloud/ursa/datastore"
+	"github.com/lovi-cloud/ursa/datastore/memory"
+	"github.com/lovi-cloud/ursa/datastore/postgres"
 	"github.com/lovi-cloud/ursa/datastore/sqlite"
-	"github.com/lovi-cloud/ursa/types"
+	"github.com/lovi-cloud/ursa/dhcpd"
 	"github.com/lovi-cloud/ursa/dhcpd/godhcpd"
+	"github.com/lovi-cloud/ursa/event"
+	"github.com/lovi-cloud/ursa/event/webhook"
 	"github.com/lovi-cloud/ursa/httpd/gohttpd"
+	"github.com/lovi-cloud/ursa/metrics"
+	"github.com/lovi-cloud/ursa/pki"
 	"github.com/lovi-cloud/ursa/tftpd/gotftpd"
+	"github.com/lovi-cloud/ursa/trace"
+	"github.com/lovi-cloud/ursa/types"
 )
 
+// eventBufferSize is the number of recent events kept for the event API.
+const eventBufferSize = 1024
+
 // Run the ursa
 func Run(ctx context.Context) error {
 	logger, err := zap.NewProduction()
@@ -32,19 +45,50 @@ func Run(ctx context.Context) error {
 	}
 
 	var (
-		dsn       string
+		datastoreKind string
+		dsn           string
+
 		iface     string
 		dhcpRange string
 		staticDir string
 
-		serviceNetwork string
-		serviceRange   string
-		serviceGateway string
-		serviceDNS     string
-		hostnamePrefix string
+		serviceNetwork   string
+		serviceRange     string
+		serviceGateway   string
+		serviceDNS       string
+		bondDriver       string
+		serviceVLAN      int
+		vendorData       string
+		hostnamePrefix   string
+		hostnameTemplate string
+		apiAddr          string
+		apiTokens        string
+
+		enableTLS bool
+		tlsDir    string
+		tlsCert   string
+		tlsKey    string
+
+		imageTrust bool
+
+		bmcRange       string
+		bmcVendorClass string
+		bmcOUI         string
+
+		webhookURL    string
+		webhookSecret string
+
+		otlpEndpoint string
+
+		bootEventRetention time.Duration
+
+		backupDir      string
+		backupInterval time.Duration
+		backupKeep     int
 	)
 	flags := flag.NewFlagSet(fmt.Sprintf("ursa (v%s rev:%s)", version, revision), flag.ContinueOnError)
-	flags.StringVar(&dsn, "dsn", "file:ursa.db?cache=shared", "sqlite3 dsn")
+	flags.StringVar(&datastoreKind, "datastore", "sqlite", "datastore backend (sqlite, postgres, memory)")
+	flags.StringVar(&dsn, "dsn", "file:ursa.db", "datastore dsn (e.g. postgres://ursa@127.0.0.1/ursa?sslmode=disable for postgres)")
 	flags.StringVar(&iface, "iface", "eth0", "ursa listening interface")
 	flags.StringVar(&dhcpRange, "dhcp-range", "192.0.2.100:192.0.2.200", "START:END")
 	flags.StringVar(&staticDir, "static-dir", "./static", "static assets directory path")
@@ -52,7 +96,28 @@ func Run(ctx context.Context) error {
 	flags.StringVar(&serviceRange, "service-range", "198.51.100.100:198.51.100.200", "START:END")
 	flags.StringVar(&serviceGateway, "service-gw", "198.51.100.1", "service network gateway")
 	flags.StringVar(&serviceDNS, "service-dns", "8.8.8.8", "service network dns server")
+	flags.StringVar(&bondDriver, "bond-driver", "e1000e", "driver of the NICs to bond (every NIC in the inventory if empty)")
+	flags.IntVar(&serviceVLAN, "service-vlan", 1000, "VLAN id of the service network (untagged on the bond if 0)")
+	flags.StringVar(&vendorData, "vendor-data", "./vendor-data", "cloud-init vendor-data path")
 	flags.StringVar(&hostnamePrefix, "hostname-prefix", "cn", "hostname prefix (prefixNNNN)")
+	flags.StringVar(&hostnameTemplate, "hostname-template", "", "Go template of the hostnames (default {{.Prefix}}{{printf \"%04d\" .ID}})")
+	flags.StringVar(&apiAddr, "api-addr", "127.0.0.1:8080", "management API listening address")
+	flags.StringVar(&apiTokens, "api-tokens", "./api-tokens", "file of the management API tokens (generated with a token named admin if not exists)")
+	flags.BoolVar(&enableTLS, "tls", false, "serve HTTPS on 443/tcp in addition to HTTP")
+	flags.StringVar(&tlsDir, "tls-dir", "./tls", "directory of the auto-generated CA and server certificate")
+	flags.StringVar(&tlsCert, "tls-cert", "", "server certificate path (auto-generated in -tls-dir if empty)")
+	flags.StringVar(&tlsKey, "tls-key", "", "server key path")
+	flags.BoolVar(&imageTrust, "image-trust", false, "sign boot artifacts with the code signing key in -tls-dir and verify them in iPXE")
+	flags.StringVar(&bmcRange, "bmc-range", "", "START:END of the BMC pool in the management network (disabled if empty)")
+	flags.StringVar(&bmcVendorClass, "bmc-vendor-class", "iDRAC,CPQRIB", "comma separated DHCP vendor class prefixes of BMCs")
+	flags.StringVar(&bmcOUI, "bmc-oui", "", "comma separated OUIs of BMCs (e.g. 00:25:90)")
+	flags.StringVar(&webhookURL, "webhook-url", "", "comma separated URLs to deliver events to")
+	flags.StringVar(&webhookSecret, "webhook-secret", "", "HMAC-SHA256 key to sign webhook deliveries")
+	flags.StringVar(&otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP endpoint to export boot traces to (e.g. http://127.0.0.1:4318, disabled if empty)")
+	flags.DurationVar(&bootEventRetention, "boot-event-retention", 30*24*time.Hour, "retention of the boot timeline")
+	flags.StringVar(&backupDir, "backup-dir", "", "directory to write online SQLite backups to (disabled if empty)")
+	flags.DurationVar(&backupInterval, "backup-interval", 24*time.Hour, "interval of the backups")
+	flags.IntVar(&backupKeep, "backup-keep", 7, "number of the backups to keep (all if 0)")
 	flags.Parse(os.Args[1:])
 
 	ip, inet, err := getInterfaceAddress(iface)
@@ -82,35 +147,121 @@ func Run(ctx context.Context) error {
 	if dns == nil {
 		return fmt.Errorf("failed to parse service-dns %s", serviceDNS)
 	}
+	if serviceVLAN < 0 || serviceVLAN > 4094 {
+		return fmt.Errorf("invalid service-vlan %d", serviceVLAN)
+	}
+	var bmcStart, bmcEnd net.IP
+	var bmcFilter *dhcpd.BMCFilter
+	if bmcRange != "" {
+		bmcStart, bmcEnd, err = parseRange(bmcRange, inet)
+		if err != nil {
+			return err
+		}
+		if overlapRange(dhspStart, dhcpEnd, bmcStart, bmcEnd) {
+			return fmt.Errorf("bmc-range %s overlaps dhcp-range %s", bmcRange, dhcpRange)
+		}
+		bmcFilter, err = parseBMCFilter(bmcVendorClass, bmcOUI)
+		if err != nil {
+			return err
+		}
+	}
 
-	ds, err := sqlite.New(ctx, dsn, hostnamePrefix)
+	m := metrics.New()
+	var tracer *trace.Tracer
+	if otlpEndpoint != "" {
+		tracer, err = trace.New(otlpEndpoint, logger)
+		if err != nil {
+			return err
+		}
+	}
+	naming, err := datastore.NewNaming(hostnamePrefix, hostnameTemplate)
 	if err != nil {
 		return err
 	}
-	defer ds.Close()
-	_, err = ds.CreateManagementSubnet(ctx, types.IPNet(*inet), types.IP(dhspStart), types.IP(dhcpEnd))
-	var sqliteErr sqlite3.Error
-	if errors.As(err, &sqliteErr) {
-		if sqliteErr.ExtendedCode != sqlite3.ErrConstraintPrimaryKey {
-			return err
+	db, err := newDatastore(ctx, datastoreKind, dsn, naming)
+	if err != nil {
+		return err
+	}
+	var backuper datastore.Backuper
+	if backupDir != "" {
+		var ok bool
+		backuper, ok = db.(datastore.Backuper)
+		if !ok {
+			return fmt.Errorf("datastore %s does not support backup", datastoreKind)
 		}
+	}
+	defer db.Close()
+	ds := datastore.Instrument(db, m.DatastoreHook(), tracer.DatastoreHook())
+	m.RegisterDatastore(ds)
+	// withActor returns the datastore whose changes are audited as made by
+	// the daemon, unless the context of the change has an actor.
+	withActor := func(daemon string) datastore.Datastore {
+		return datastore.Instrument(ds, datastore.ActorHook("daemon:"+daemon))
+	}
+	initCtx := datastore.WithActor(ctx, "daemon:ursa")
+	_, err = ds.CreateManagementSubnet(initCtx, types.IPNet(*inet), types.IP(dhspStart), types.IP(dhcpEnd))
+	if errors.Is(err, datastore.ErrConflict) {
 		logger.Warn("management subnet already exists")
 	} else if err != nil {
 		return err
 	}
-	_, err = ds.CreateServiceSubnet(ctx, types.IPNet(*serviceNet), types.IP(serviceStart), types.IP(serviceEnd), types.IP(serviceGW), types.IP(dns))
-	if errors.As(err, &sqliteErr) {
-		if sqliteErr.ExtendedCode != sqlite3.ErrConstraintPrimaryKey {
-			return err
-		}
+	_, err = ds.CreateServiceSubnet(initCtx, types.IPNet(*serviceNet), types.IP(serviceStart), types.IP(serviceEnd), types.IP(serviceGW), types.IP(dns))
+	if errors.Is(err, datastore.ErrConflict) {
 		logger.Warn("service subnet already exists")
 	} else if err != nil {
 		return err
 	}
+	if bmcFilter != nil {
+		_, err = ds.CreateBMCSubnet(initCtx, types.IPNet(*inet), types.IP(bmcStart), types.IP(bmcEnd))
+		if errors.Is(err, datastore.ErrConflict) {
+			logger.Warn("BMC subnet already exists")
+		} else if err != nil {
+			return err
+		}
+	}
+
+	var signer *pki.CodeSigner
+	if imageTrust {
+		signer, err = pki.LoadOrCreateCodeSigner(tlsDir)
+		if err != nil {
+			return fmt.Errorf("failed to load code signing key: %w", err)
+		}
+		err = gohttpd.SignBootProfiles(ctx, ds, signer)
+		if err != nil {
+			return err
+		}
+	}
 
 	eg, ctx := errgroup.WithContext(ctx)
+	bus := event.NewBus(eventBufferSize)
+	if tracer != nil {
+		eg.Go(func() error {
+			logger.Info("starting tracer", zap.String("endpoint", otlpEndpoint))
+			return tracer.Run(ctx)
+		})
+	}
+	if webhookURL != "" {
+		dispatcher, err := webhook.New(bus, logger, strings.Split(webhookURL, ","), webhookSecret)
+		if err != nil {
+			return err
+		}
+		eg.Go(func() error {
+			logger.Info("starting webhook dispatcher", zap.String("url", webhookURL))
+			return dispatcher.Run(ctx)
+		})
+	}
 
-	dhcpd, err := godhcpd.New(ds, logger)
+	eg.Go(func() error {
+		return pruneBootEvents(ctx, ds, logger, bootEventRetention)
+	})
+	if backuper != nil {
+		eg.Go(func() error {
+			logger.Info("starting backup", zap.String("dir", backupDir), zap.Duration("interval", backupInterval))
+			return backupDatastore(ctx, backuper, logger, backupDir, backupInterval, backupKeep)
+		})
+	}
+
+	dhcpd, err := godhcpd.New(withActor("dhcpd"), logger, bmcFilter, bus, m, tracer)
 	if err != nil {
 		return err
 	}
@@ -123,7 +274,7 @@ func Run(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	tftpd, err := gotftpd.New(statikFS, logger)
+	tftpd, err := gotftpd.New(statikFS, withActor("tftpd"), logger, m, tracer)
 	if err != nil {
 		return err
 	}
@@ -133,7 +284,11 @@ func Run(ctx context.Context) error {
 		return tftpd.Serve(ctx, addr)
 	})
 
-	httpd, err := gohttpd.New(ds, logger)
+	network := gohttpd.NetworkOptions{
+		BondDriver:  bondDriver,
+		ServiceVLAN: serviceVLAN,
+	}
+	httpd, err := gohttpd.New(withActor("httpd"), logger, imageTrust, bus, m, tracer, network, vendorData)
 	if err != nil {
 		return err
 	}
@@ -143,9 +298,99 @@ func Run(ctx context.Context) error {
 		return httpd.Serve(ctx, addr)
 	})
 
+	if enableTLS {
+		var cert tls.Certificate
+		if tlsCert != "" {
+			cert, err = tls.LoadX509KeyPair(tlsCert, tlsKey)
+		} else {
+			cert, err = pki.LoadOrCreate(tlsDir, []net.IP{ip})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load certificate: %w", err)
+		}
+		eg.Go(func() error {
+			addr := fmt.Sprintf("%s:443", ip)
+			logger.Info("starting httpd (TLS)", zap.String("addr", addr))
+			return httpd.ServeTLS(ctx, addr, cert)
+		})
+	}
+
+	tokens, err := goapid.LoadOrCreateTokens(apiTokens)
+	if err != nil {
+		return fmt.Errorf("failed to load API tokens: %w", err)
+	}
+	apid, err := goapid.New(withActor("apid"), logger, signer, bus, m, tokens)
+	if err != nil {
+		return err
+	}
+	eg.Go(func() error {
+		logger.Info("starting apid", zap.String("addr", apiAddr))
+		return apid.Serve(ctx, apiAddr)
+	})
+
 	return eg.Wait()
 }
 
+// pruneBootEvents deletes the boot events older than retention every hour.
+func pruneBootEvents(ctx context.Context, ds datastore.Datastore, logger *zap.Logger, retention time.Duration) error {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		err := ds.PruneBootEvent(ctx, time.Now().UTC().Add(-retention))
+		if err != nil {
+			logger.Warn("failed to prune boot events", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Migrate migrates the schema of the datastore to the latest version.
+func Migrate(ctx context.Context, args []string) error {
+	var datastoreKind, dsn string
+	flags := flag.NewFlagSet(fmt.Sprintf("ursa migrate (v%s rev:%s)", version, revision), flag.ContinueOnError)
+	flags.StringVar(&datastoreKind, "datastore", "sqlite", "datastore backend (sqlite, postgres)")
+	flags.StringVar(&dsn, "dsn", "file:ursa.db", "datastore dsn")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var from, to int
+	switch datastoreKind {
+	case "sqlite":
+		from, to, err = sqlite.Migrate(ctx, dsn)
+	case "postgres":
+		from, to, err = postgres.Migrate(ctx, dsn)
+	default:
+		return fmt.Errorf("invalid datastore %s", datastoreKind)
+	}
+	if err != nil {
+		return err
+	}
+	if from == to {
+		fmt.Printf("schema is up to date (version %d)\n", to)
+	} else {
+		fmt.Printf("migrated schema from version %d to %d\n", from, to)
+	}
+	return nil
+}
+
+func newDatastore(ctx context.Context, kind, dsn string, naming *datastore.Naming) (datastore.Datastore, error) {
+	switch kind {
+	case "sqlite":
+		return sqlite.New(ctx, dsn, naming)
+	case "postgres":
+		return postgres.New(ctx, dsn, naming)
+	case "memory":
+		return memory.New(naming)
+	}
+	return nil, fmt.Errorf("invalid datastore %s", kind)
+}
+
 func getInterfaceAddress(name string) (net.IP, *net.IPNet, error) {
 	iface, err := net.InterfaceByName(name)
 	if err != nil {
@@ -189,3 +434,27 @@ func parseRange(input string, inet *net.IPNet) (net.IP, net.IP, error) {
 	}
 	return start, end, nil
 }
+
+func overlapRange(aStart, aEnd, bStart, bEnd net.IP) bool {
+	return bytes.Compare(aStart.To16(), bEnd.To16()) <= 0 && bytes.Compare(bStart.To16(), aEnd.To16()) <= 0
+}
+
+func parseBMCFilter(vendorClasses, ouis string) (*dhcpd.BMCFilter, error) {
+	filter := &dhcpd.BMCFilter{}
+	for _, vc := range strings.Split(vendorClasses, ",") {
+		if vc = strings.TrimSpace(vc); vc != "" {
+			filter.VendorClasses = append(filter.VendorClasses, vc)
+		}
+	}
+	for _, oui := range strings.Split(ouis, ",") {
+		if oui = strings.TrimSpace(oui); oui == "" {
+			continue
+		}
+		mac, err := net.ParseMAC(oui + ":00:00:00")
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bmc-oui %s: %w", oui, err)
+		}
+		filter.OUIs = append(filter.OUIs, mac)
+	}
+	return filter, nil
+}